@@ -30,6 +30,10 @@ var (
 	GenesisBlock *btc.Uint256
 	Magic        [4]byte
 	Testnet      bool
+	Regtest      bool // if true, Testnet is also set
+	Signet       bool // if true, Testnet is also set
+
+	SignetChallenge []byte
 
 	Last TheLastBlock
 
@@ -204,7 +208,10 @@ func RecalcAverageBlockSize() {
 
 func GetRawTx(BlockHeight uint32, txid *btc.Uint256) (data []byte, er error) {
 	data, er = BlockChain.GetRawTx(BlockHeight, txid)
-	if er != nil {
+	if er != nil && BlockChain.TxIdx != nil {
+		data, _, er = BlockChain.FindTx(txid)
+	}
+	if er != nil && !Regtest && !Signet {
 		if Testnet {
 			data = utils.GetTestnetTxFromWeb(txid)
 		} else {
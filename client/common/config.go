@@ -5,8 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/piotrnar/gocoin"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/lib/utxo"
+	"github.com/piotrnar/gocoin/lib/script"
 	"io/ioutil"
 	"os"
 	"runtime/debug"
@@ -29,15 +33,24 @@ var (
 		NoWallet      bool
 		Log           bool
 		SaveConfig    bool
+		LoadSnapshot  string
 	}
 
 	CFG struct { // Options that can come from either command line or common file
 		Testnet        bool
+		Regtest        bool
+		Signet         bool
+		SignetChallenge string // hex encoded - leave empty for the default (public) signet
 		ConnectOnly    string
 		Datadir        string
 		TextUI_Enabled bool
 		UserAgent      string
 		LastTrustedBlock string
+		TxIndex        bool // keep txid -> block index, to find any confirmed transaction
+		AddrIndex      bool // keep history of all the scripts (addresses) - built in the background from the stored blocks
+		BlockFilters   bool // keep BIP158 block filters and serve them to peers (BIP157) - built in the background from the stored blocks
+		AssumeUTXO     string // hash of the UTXO snapshot that is allowed to be loaded with -loadsnap
+		VerifyThreads  int // number of threads verifying scripts of new blocks (0 for one per CPU core)
 
 		WebUI          struct {
 			Interface   string
@@ -45,7 +58,6 @@ var (
 			ShowBlocks  uint32
 			AddrListLen uint32 // size of address list in MakeTx tab popups
 			Title       string
-			PayCmdName  string
 			ServerMode  bool
 		}
 		RPC struct {
@@ -54,6 +66,21 @@ var (
 			Password string
 			TCPPort  uint32
 		}
+		Electrum struct {
+			Enabled      bool
+			Interface    string // plain TCP listener (leave empty to disable it)
+			TLSInterface string // TLS listener (needs TLSCert and TLSKey)
+			TLSCert      string // PEM file with the server's certificate
+			TLSKey       string // PEM file with the certificate's private key
+			Banner       string
+			MaxClients   uint
+		}
+		Notify struct {
+			Enabled    bool
+			Interface  string // ZMQ-compatible publisher (leave empty to disable it)
+			WebSocket  bool   // serve the events at /events of WebUI
+			MaxClients uint
+		}
 		Net struct {
 			ListenTCP      bool
 			TCPPort        uint16
@@ -64,6 +91,13 @@ var (
 			MaxBlockAtOnce uint32
 			MinSegwitCons  uint32
 			ExternalIP     string
+			V2Transport    bool // BIP324 encrypted connections
+			IPv6           bool // make outgoing connections to IPv6 peers
+			CJDNS          bool // make outgoing connections to CJDNS peers (needs cjdns running on this host)
+			Proxy          string // SOCKS5 proxy (e.g. Tor) for outgoing connections, as host:port
+			ProxyRandomize bool // use different proxy credentials for each connection (Tor stream isolation)
+			TorControl     string // Tor control port, as host:port - to create onion service for incoming connections
+			TorPassword    string // password for the Tor control port (empty for cookie authentication)
 		}
 		TXPool struct {
 			Enabled        bool // Global on/off swicth
@@ -89,6 +123,8 @@ var (
 			CacheOnDisk   bool
 			MaxDataFileMB uint // 0 for unlimited size
 			DataFilesKeep uint32 // 0 for all
+			SigCacheSize  int // number of verified signatures to remember (0 to disable the cache)
+			ScriptCacheSize int // number of transactions with verified scripts to remember (0 to disable the cache)
 		}
 		AllBalances struct {
 			MinValue   uint64 // Do not keep balance records for values lower than this
@@ -110,6 +146,9 @@ var (
 			SecondsToTake uint  // zero for as fast as possible, 600 for do it in 10 minutes
 			BlocksToHold  uint32 // zero for immediatelly, one for every other block...
 		}
+		Prune struct {
+			TargetMB uint // remove the oldest block data files when they take more than this (0 to keep all)
+		}
 	}
 
 	mutex_cfg sync.Mutex
@@ -130,6 +169,8 @@ func InitConfig() {
 	CFG.Net.MaxInCons = 10
 	CFG.Net.MaxBlockAtOnce = 3
 	CFG.Net.MinSegwitCons = 4
+	CFG.Net.V2Transport = true
+	CFG.Net.ProxyRandomize = true
 
 	CFG.TextUI_Enabled = true
 
@@ -138,11 +179,18 @@ func InitConfig() {
 	CFG.WebUI.ShowBlocks = 144
 	CFG.WebUI.AddrListLen = 15
 	CFG.WebUI.Title = "Gocoin"
-	CFG.WebUI.PayCmdName = "pay_cmd.txt"
 
 	CFG.RPC.Username = "gocoinrpc"
 	CFG.RPC.Password = "gocoinpwd"
 
+	CFG.Electrum.Interface = "127.0.0.1:50001"
+	CFG.Electrum.Banner = "Welcome to Gocoin's Electrum server"
+	CFG.Electrum.MaxClients = 100
+
+	CFG.Notify.Interface = "127.0.0.1:28332"
+	CFG.Notify.WebSocket = true
+	CFG.Notify.MaxClients = 100
+
 	CFG.TXPool.Enabled = true
 	CFG.TXPool.AllowMemInputs = true
 	CFG.TXPool.FeePerByte = 1.0
@@ -161,6 +209,8 @@ func InitConfig() {
 	CFG.Memory.MaxCachedBlks = 200
 	CFG.Memory.CacheOnDisk = true
 	CFG.Memory.MaxDataFileMB = 1000 // max 1GB per single data file
+	CFG.Memory.SigCacheSize = script.SigCacheMax
+	CFG.Memory.ScriptCacheSize = script.ScriptCacheMax
 
 	CFG.Stat.HashrateHrs = 12
 	CFG.Stat.MiningHrs = 24
@@ -192,6 +242,8 @@ func InitConfig() {
 	flag.BoolVar(&FLAG.Rescan, "r", false, "Rebuild UTXO database (fixes 'Unknown input TxID' errors)")
 	flag.BoolVar(&FLAG.VolatileUTXO, "v", false, "Use UTXO database in volatile mode (speeds up rebuilding)")
 	flag.BoolVar(&CFG.Testnet, "t", CFG.Testnet, "Use Testnet3")
+	flag.BoolVar(&CFG.Regtest, "regtest", CFG.Regtest, "Use Regtest (local test network)")
+	flag.BoolVar(&CFG.Signet, "signet", CFG.Signet, "Use Signet (see SignetChallenge config value for a custom one)")
 	flag.StringVar(&CFG.ConnectOnly, "c", CFG.ConnectOnly, "Connect only to this host and nowhere else")
 	flag.BoolVar(&CFG.Net.ListenTCP, "l", CFG.Net.ListenTCP, "Listen for incoming TCP connections (on default port)")
 	flag.StringVar(&CFG.Datadir, "d", CFG.Datadir, "Specify Gocoin's database root folder")
@@ -205,8 +257,16 @@ func InitConfig() {
 	flag.BoolVar(&FLAG.TrustAll, "trust", FLAG.TrustAll, "Trust all scripts inside new blocks (for fast syncig)")
 	flag.BoolVar(&FLAG.UnbanAllPeers, "unban", FLAG.UnbanAllPeers, "Un-ban all peers in databse, before starting")
 	flag.BoolVar(&FLAG.NoWallet, "nowallet", FLAG.NoWallet, "Do not automatically enable the wallet functionality (lower memory usage and faster block processing)")
+	flag.BoolVar(&CFG.TxIndex, "txindex", CFG.TxIndex, "Maintain the transaction index (built in the background - needs more memory and disk space)")
+	flag.BoolVar(&CFG.AddrIndex, "addrindex", CFG.AddrIndex, "Maintain the address history index (built in the background - needs lots of disk space)")
+	flag.BoolVar(&CFG.BlockFilters, "blockfilters", CFG.BlockFilters, "Maintain BIP158 block filters and serve them to peers (built in the background)")
+	flag.BoolVar(&CFG.Electrum.Enabled, "electrum", CFG.Electrum.Enabled, "Run Electrum protocol server (see Electrum section of the config file)")
+	flag.BoolVar(&CFG.Notify.Enabled, "notify", CFG.Notify.Enabled, "Publish block and transaction events over ZMQ and WebSocket (see Notify section of the config file)")
 	flag.BoolVar(&FLAG.Log, "log", FLAG.Log, "Store some runtime information in the log files")
 	flag.BoolVar(&FLAG.SaveConfig, "sc", FLAG.SaveConfig, "Save gocoin.conf file and exit (use to create default config file)")
+	flag.IntVar(&CFG.VerifyThreads, "vt", CFG.VerifyThreads, "Number of script verification threads (0 for one per CPU core)")
+	flag.UintVar(&CFG.Prune.TargetMB, "prune", CFG.Prune.TargetMB, "Prune old blocks to keep their data files below this many MB (0 to keep all)")
+	flag.StringVar(&FLAG.LoadSnapshot, "loadsnap", FLAG.LoadSnapshot, "Start a fresh datadir from this UTXO snapshot file (its hash must match AssumeUTXO config value)")
 
 	if CFG.Datadir == "" {
 		CFG.Datadir = sys.BitcoinHome() + "gocoin"
@@ -219,7 +279,11 @@ func InitConfig() {
 	flag.Parse()
 
 	// swap LastTrustedBlock if it's now from the other chain
-	if CFG.Testnet {
+	if CFG.Regtest || CFG.Signet {
+		if CFG.LastTrustedBlock == LastTrustedBTCBlock || CFG.LastTrustedBlock == LastTrustedTN3Block {
+			CFG.LastTrustedBlock = ""
+		}
+	} else if CFG.Testnet {
 		if new_config_file || CFG.LastTrustedBlock == LastTrustedBTCBlock {
 			CFG.LastTrustedBlock = LastTrustedTN3Block
 		}
@@ -249,6 +313,12 @@ func InitConfig() {
 }
 
 func DataSubdir() string {
+	if CFG.Regtest {
+		return "regtest"
+	}
+	if CFG.Signet {
+		return "signet"
+	}
 	if CFG.Testnet {
 		return "tstnet"
 	} else {
@@ -298,9 +368,15 @@ func Reset() {
 		println("WARNING: No IP is currently allowed at WebUI")
 	}
 	ListenTCP = CFG.Net.ListenTCP
+	peersdb.NetReachable[btc.NET_IPV6] = CFG.Net.IPv6
+	peersdb.NetReachable[btc.NET_TORV3] = CFG.Net.Proxy != ""
+	peersdb.NetReachable[btc.NET_CJDNS] = CFG.Net.CJDNS
 
 	utxo.UTXO_WRITING_TIME_TARGET = time.Second * time.Duration(CFG.UTXOSave.SecondsToTake)
 	utxo.UTXO_SKIP_SAVE_BLOCKS = CFG.UTXOSave.BlocksToHold
+	chain.SetScriptVerifyThreads(CFG.VerifyThreads)
+	script.SigCacheMax = CFG.Memory.SigCacheSize
+	script.ScriptCacheMax = CFG.Memory.ScriptCacheSize
 
 	if CFG.UserAgent != "" {
 		UserAgent = CFG.UserAgent
@@ -334,7 +410,11 @@ func RPCPort() (res uint32) {
 		res = CFG.RPC.TCPPort
 		return
 	}
-	if CFG.Testnet {
+	if CFG.Regtest {
+		res = 18443
+	} else if CFG.Signet {
+		res = 38332
+	} else if CFG.Testnet {
 		res = 18332
 	} else {
 		res = 8332
@@ -350,7 +430,11 @@ func DefaultTcpPort() (res uint16) {
 		res = CFG.Net.TCPPort
 		return
 	}
-	if CFG.Testnet {
+	if CFG.Regtest {
+		res = 18444
+	} else if CFG.Signet {
+		res = 38333
+	} else if CFG.Testnet {
 		res = 18333
 	} else {
 		res = 8333
@@ -437,6 +521,13 @@ func SetBool(addr *bool, val bool) {
 	mutex_cfg.Unlock()
 }
 
+func GetString(addr *string) (res string) {
+	mutex_cfg.Lock()
+	res = *addr
+	mutex_cfg.Unlock()
+	return
+}
+
 func AllBalMinVal() uint64 {
 	return atomic.LoadUint64(&allBalMinVal)
 }
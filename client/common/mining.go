@@ -120,7 +120,7 @@ func GetAverageFee() (float64) {
 		for o := range cbasetx.TxOut {
 			fees_from_this_block += int64(cbasetx.TxOut[o].Value)
 		}
-		fees_from_this_block -= int64(btc.GetBlockReward(end.Height))
+		fees_from_this_block -= int64(BlockChain.GetBlockReward(end.Height))
 
 		if fees_from_this_block > 0 {
 			AverageFeeTotal += uint64(fees_from_this_block)
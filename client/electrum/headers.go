@@ -0,0 +1,164 @@
+package electrum
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+const MAX_HEADERS_CHUNK = 2016
+
+var (
+	hdr_mutex sync.Mutex
+	hdr_nodes []*chain.BlockTreeNode // main chain's nodes, indexed by height
+)
+
+// Makes hdr_nodes follow the current chain's tip, which it returns
+func update_headers() (tip *chain.BlockTreeNode) {
+	tip = common.BlockChain.LastBlock()
+	hdr_mutex.Lock()
+	if len(hdr_nodes) != int(tip.Height)+1 || hdr_nodes[tip.Height] != tip {
+		if len(hdr_nodes) > int(tip.Height)+1 {
+			hdr_nodes = hdr_nodes[:tip.Height+1]
+		}
+		for len(hdr_nodes) < int(tip.Height)+1 {
+			hdr_nodes = append(hdr_nodes, nil)
+		}
+		common.BlockChain.BlockIndexAccess.Lock()
+		for n := tip; n != nil && hdr_nodes[n.Height] != n; n = n.Parent {
+			hdr_nodes[n.Height] = n
+		}
+		common.BlockChain.BlockIndexAccess.Unlock()
+	}
+	hdr_mutex.Unlock()
+	return
+}
+
+// Returns the main chain's block at the given height (nil if above the tip)
+func node_at(height uint32) (n *chain.BlockTreeNode) {
+	hdr_mutex.Lock()
+	if int(height) < len(hdr_nodes) {
+		n = hdr_nodes[height]
+	}
+	hdr_mutex.Unlock()
+	return
+}
+
+func hash_hex(h []byte) string {
+	return btc.NewUint256(h).String()
+}
+
+// Returns the merkle branch of the element at the given index and the merkle root of all the hashes
+func branch_and_root(hashes [][32]byte, index int) (branch [][32]byte, root [32]byte) {
+	level := append([][32]byte{}, hashes...)
+	var tmp [64]byte
+	for len(level) > 1 {
+		if len(level)&1 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		branch = append(branch, level[index^1])
+		index >>= 1
+		for i := 0; i < len(level); i += 2 {
+			copy(tmp[:32], level[i][:])
+			copy(tmp[32:], level[i+1][:])
+			btc.ShaHash(tmp[:], level[i/2][:])
+		}
+		level = level[:len(level)/2]
+	}
+	root = level[0]
+	return
+}
+
+// Adds the header's merkle proof against the checkpoint at cp_height to the result
+func header_proof(res map[string]interface{}, height, cp_height uint32) *rpc_error {
+	if cp_height < height || node_at(cp_height) == nil {
+		return &rpc_error{Code: BAD_REQUEST, Message: "header height greater than checkpoint height"}
+	}
+	hashes := make([][32]byte, cp_height+1)
+	for i := range hashes {
+		hashes[i] = node_at(uint32(i)).BlockHash.Hash
+	}
+	branch, root := branch_and_root(hashes, int(height))
+	res["root"] = hash_hex(root[:])
+	br := make([]string, len(branch))
+	for i := range branch {
+		br[i] = hash_hex(branch[i][:])
+	}
+	res["branch"] = br
+	return nil
+}
+
+func headers_subscribe(s *session, par []interface{}) (interface{}, *rpc_error) {
+	s.Lock()
+	s.headers = true
+	s.Unlock()
+	tip := update_headers()
+	return header_notification(tip), nil
+}
+
+func header_notification(tip *chain.BlockTreeNode) map[string]interface{} {
+	return map[string]interface{}{"hex": hex.EncodeToString(tip.BlockHeader[:]), "height": tip.Height}
+}
+
+func block_header(s *session, par []interface{}) (interface{}, *rpc_error) {
+	height, ok := param_uint(par, 0, -1)
+	if !ok {
+		return nil, bad_param("height")
+	}
+	cp_height, ok := param_uint(par, 1, 0)
+	if !ok {
+		return nil, bad_param("cp_height")
+	}
+	update_headers()
+	n := node_at(height)
+	if n == nil {
+		return nil, &rpc_error{Code: BAD_REQUEST, Message: "height out of range"}
+	}
+	hdr := hex.EncodeToString(n.BlockHeader[:])
+	if cp_height == 0 {
+		return hdr, nil
+	}
+	res := map[string]interface{}{"header": hdr}
+	if e := header_proof(res, height, cp_height); e != nil {
+		return nil, e
+	}
+	return res, nil
+}
+
+func block_headers(s *session, par []interface{}) (interface{}, *rpc_error) {
+	start, ok := param_uint(par, 0, -1)
+	if !ok {
+		return nil, bad_param("start_height")
+	}
+	count, ok := param_uint(par, 1, -1)
+	if !ok {
+		return nil, bad_param("count")
+	}
+	cp_height, ok := param_uint(par, 2, 0)
+	if !ok {
+		return nil, bad_param("cp_height")
+	}
+	if count > MAX_HEADERS_CHUNK {
+		count = MAX_HEADERS_CHUNK
+	}
+	update_headers()
+	var buf []byte
+	var cnt uint32
+	for ; cnt < count; cnt++ {
+		n := node_at(start + cnt)
+		if n == nil {
+			break
+		}
+		buf = append(buf, n.BlockHeader[:]...)
+	}
+	res := map[string]interface{}{"hex": hex.EncodeToString(buf), "count": cnt, "max": MAX_HEADERS_CHUNK}
+	if cnt > 0 && cp_height != 0 {
+		if e := header_proof(res, start+cnt-1, cp_height); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
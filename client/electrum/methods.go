@@ -0,0 +1,415 @@
+package electrum
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/piotrnar/gocoin"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/client/rpcapi"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+type handler func(s *session, par []interface{}) (interface{}, *rpc_error)
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"server.version":          server_version,
+		"server.banner":           server_banner,
+		"server.donation_address": server_donation_address,
+		"server.features":         server_features,
+		"server.peers.subscribe":  server_peers,
+		"server.ping":             server_ping,
+
+		"blockchain.headers.subscribe": headers_subscribe,
+		"blockchain.block.header":      block_header,
+		"blockchain.block.headers":     block_headers,
+
+		"blockchain.estimatefee":    estimate_fee,
+		"blockchain.relayfee":       relay_fee,
+		"mempool.get_fee_histogram": fee_histogram,
+
+		"blockchain.scripthash.get_balance": scripthash_balance,
+		"blockchain.scripthash.get_history": scripthash_history,
+		"blockchain.scripthash.get_mempool": scripthash_mempool,
+		"blockchain.scripthash.listunspent": scripthash_unspent,
+		"blockchain.scripthash.subscribe":   scripthash_subscribe,
+		"blockchain.scripthash.unsubscribe": scripthash_unsubscribe,
+
+		"blockchain.transaction.get":        transaction_get,
+		"blockchain.transaction.broadcast":  transaction_broadcast,
+		"blockchain.transaction.get_merkle": transaction_merkle,
+	}
+}
+
+func bad_param(name string) *rpc_error {
+	return &rpc_error{Code: BAD_REQUEST, Message: "invalid " + name}
+}
+
+// Returns the parameter at the given index as uint32.
+// If the parameter is missing, returns def (or false if def is negative).
+func param_uint(par []interface{}, idx int, def int64) (res uint32, ok bool) {
+	if idx >= len(par) || par[idx] == nil {
+		return uint32(def), def >= 0
+	}
+	if n, is := par[idx].(json.Number); is {
+		if v, er := n.Int64(); er == nil && v >= 0 && v <= 0xffffffff {
+			return uint32(v), true
+		}
+	}
+	return
+}
+
+func param_string(par []interface{}, idx int) (res string, ok bool) {
+	if idx < len(par) {
+		res, ok = par[idx].(string)
+	}
+	return
+}
+
+func param_bool(par []interface{}, idx int) (res bool) {
+	if idx < len(par) {
+		res, _ = par[idx].(bool)
+	}
+	return
+}
+
+func server_version(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return []string{"Gocoin " + gocoin.Version, PROTOCOL_VERSION}, nil
+}
+
+func server_banner(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return common.CFG.Electrum.Banner, nil
+}
+
+func server_donation_address(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return "", nil
+}
+
+func server_features(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return map[string]interface{}{
+		"genesis_hash":   common.GenesisBlock.String(),
+		"hosts":          map[string]interface{}{},
+		"protocol_max":   PROTOCOL_VERSION,
+		"protocol_min":   PROTOCOL_VERSION,
+		"pruning":        nil,
+		"server_version": "Gocoin " + gocoin.Version,
+		"hash_function":  "sha256",
+	}, nil
+}
+
+func server_peers(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return []interface{}{}, nil
+}
+
+func server_ping(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return nil, nil
+}
+
+// Returns BTC per kilobyte
+func estimate_fee(s *session, par []interface{}) (interface{}, *rpc_error) {
+	blocks, ok := param_uint(par, 0, -1)
+	if !ok || blocks < 1 || blocks > 1008 {
+		return nil, bad_param("number")
+	}
+	spkb, _ := rpcapi.FeeForBlocks(uint32(blocks), true)
+	return float64(spkb) / 1e8, nil
+}
+
+func relay_fee(s *session, par []interface{}) (interface{}, *rpc_error) {
+	return float64(common.MinFeePerKB()) / 1e8, nil
+}
+
+// Returns [fee_rate, vsize] pairs, in the same way as ElectrumX does it
+func fee_histogram(s *session, par []interface{}) (interface{}, *rpc_error) {
+	network.TxMutex.Lock()
+	fees := network.GetMempoolFees(0xffffffffffffffff)
+	network.TxMutex.Unlock()
+
+	res := make([][2]uint64, 0)
+	var bin_size, cum_size, prv_rate uint64 = 100000, 0, 0
+	for _, f := range fees {
+		if f[0] == 0 {
+			break
+		}
+		rate := 4 * f[1] / f[0]
+		if cum_size > bin_size && rate != prv_rate {
+			res = append(res, [2]uint64{prv_rate, cum_size})
+			cum_size = 0
+			bin_size = bin_size * 11 / 10
+		}
+		cum_size += (f[0] + 3) / 4
+		prv_rate = rate
+	}
+	if cum_size > 0 {
+		res = append(res, [2]uint64{prv_rate, cum_size})
+	}
+	return res, nil
+}
+
+var (
+	tx_heights_mutex sync.Mutex
+	tx_heights       = make(map[[32]byte]uint32) // block heights of the txs we returned in histories
+)
+
+func remember_height(txid *btc.Uint256, height uint32) {
+	tx_heights_mutex.Lock()
+	if len(tx_heights) >= 1e6 {
+		tx_heights = make(map[[32]byte]uint32)
+	}
+	tx_heights[txid.Hash] = height
+	tx_heights_mutex.Unlock()
+}
+
+// Returns the error message set by an rpcapi function
+func rpcapi_error(resp *rpcapi.RpcResponse) *rpc_error {
+	if e, ok := resp.Error.(rpcapi.RpcError); ok {
+		return &rpc_error{Code: BAD_REQUEST, Message: e.Message}
+	}
+	return nil
+}
+
+func transaction_get(s *session, par []interface{}) (interface{}, *rpc_error) {
+	txid_str, _ := param_string(par, 0)
+	txid := btc.NewUint256FromString(txid_str)
+	if txid == nil || len(txid_str) != 64 {
+		return nil, bad_param("tx_hash")
+	}
+	params := []interface{}{txid_str, param_bool(par, 1)}
+	tx_heights_mutex.Lock()
+	height, ok := tx_heights[txid.Hash]
+	tx_heights_mutex.Unlock()
+	if ok {
+		if n := node_at(height); n != nil {
+			params = append(params, n.BlockHash.String())
+		}
+	}
+	var resp rpcapi.RpcResponse
+	rpcapi.GetRawTransaction(&rpcapi.RpcCommand{Method: "getrawtransaction", Params: params}, &resp)
+	if resp.Error != nil && len(params) == 3 { // maybe it has been reorged
+		resp.Error = nil
+		rpcapi.GetRawTransaction(&rpcapi.RpcCommand{Method: "getrawtransaction", Params: params[:2]}, &resp)
+	}
+	if e := rpcapi_error(&resp); e != nil {
+		return nil, e
+	}
+	return resp.Result, nil
+}
+
+func transaction_broadcast(s *session, par []interface{}) (interface{}, *rpc_error) {
+	raw, ok := param_string(par, 0)
+	if !ok {
+		return nil, bad_param("raw_tx")
+	}
+	var resp rpcapi.RpcResponse
+	rpcapi.SendRawTransaction(&rpcapi.RpcCommand{Method: "sendrawtransaction", Params: []interface{}{raw}}, &resp)
+	if e := rpcapi_error(&resp); e != nil {
+		e.Message = "the transaction was rejected by network rules.\n\n" + e.Message + "\n[" + raw + "]"
+		return nil, e
+	}
+	return resp.Result, nil
+}
+
+func transaction_merkle(s *session, par []interface{}) (interface{}, *rpc_error) {
+	txid_str, _ := param_string(par, 0)
+	txid := btc.NewUint256FromString(txid_str)
+	if txid == nil || len(txid_str) != 64 {
+		return nil, bad_param("tx_hash")
+	}
+	height, ok := param_uint(par, 1, -1)
+	if !ok {
+		return nil, bad_param("height")
+	}
+	update_headers()
+	n := node_at(height)
+	if n == nil {
+		return nil, &rpc_error{Code: BAD_REQUEST, Message: "block not found"}
+	}
+	raw, _, er := common.BlockChain.Blocks.BlockGet(n.BlockHash)
+	if er != nil {
+		return nil, &rpc_error{Code: DAEMON_ERROR, Message: er.Error()}
+	}
+	bl, er := btc.NewBlock(raw)
+	if er == nil {
+		er = bl.BuildTxList()
+	}
+	if er != nil {
+		return nil, &rpc_error{Code: DAEMON_ERROR, Message: er.Error()}
+	}
+	pos := -1
+	hashes := make([][32]byte, len(bl.Txs))
+	for i, tx := range bl.Txs {
+		hashes[i] = tx.Hash.Hash
+		if tx.Hash.Equal(txid) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return nil, &rpc_error{Code: BAD_REQUEST, Message: "tx " + txid_str + " not in block at height " + bl.Hash.String()}
+	}
+	branch, _ := branch_and_root(hashes, pos)
+	merkle := make([]string, len(branch))
+	for i := range branch {
+		merkle[i] = hash_hex(branch[i][:])
+	}
+	return map[string]interface{}{"block_height": height, "merkle": merkle, "pos": pos}, nil
+}
+
+// Returns the script hash given in Electrum's format (reversed hex of sha256)
+func param_sh(par []interface{}) (sh [32]byte, er *rpc_error) {
+	s, _ := param_string(par, 0)
+	b, e := hex.DecodeString(s)
+	if e != nil || len(b) != 32 {
+		er = bad_param("scripthash")
+		return
+	}
+	for i := range b {
+		sh[i] = b[31-i]
+	}
+	return
+}
+
+func sh_to_hex(sh [32]byte) string {
+	return hash_hex(sh[:])
+}
+
+func scripthash_balance(s *session, par []interface{}) (interface{}, *rpc_error) {
+	sh, er := param_sh(par)
+	if er != nil {
+		return nil, er
+	}
+	unsp, er := confirmed_unspent(sh)
+	if er != nil {
+		return nil, er
+	}
+	var confirmed uint64
+	for _, u := range unsp {
+		confirmed += u.value
+	}
+	var unconfirmed int64
+	for _, e := range mempool_index()[sh] {
+		if e.spending {
+			unconfirmed -= int64(e.value)
+		} else {
+			unconfirmed += int64(e.value)
+		}
+	}
+	return map[string]interface{}{"confirmed": confirmed, "unconfirmed": unconfirmed}, nil
+}
+
+type history_resp struct {
+	TxHash string  `json:"tx_hash"`
+	Height int     `json:"height"`
+	Fee    *uint64 `json:"fee,omitempty"`
+}
+
+func history_json(hist []*hist_item) (res []*history_resp) {
+	res = make([]*history_resp, len(hist))
+	for i, h := range hist {
+		res[i] = &history_resp{TxHash: h.txid.String(), Height: h.height}
+		if h.height <= 0 {
+			fee := h.fee
+			res[i].Fee = &fee
+		}
+	}
+	return
+}
+
+func scripthash_history(s *session, par []interface{}) (interface{}, *rpc_error) {
+	sh, er := param_sh(par)
+	if er != nil {
+		return nil, er
+	}
+	hist, er := history(sh)
+	if er != nil {
+		return nil, er
+	}
+	return history_json(hist), nil
+}
+
+func scripthash_mempool(s *session, par []interface{}) (interface{}, *rpc_error) {
+	sh, er := param_sh(par)
+	if er != nil {
+		return nil, er
+	}
+	return history_json(mempool_history(sh)), nil
+}
+
+type unspent_resp struct {
+	TxHash string `json:"tx_hash"`
+	TxPos  uint32 `json:"tx_pos"`
+	Height uint32 `json:"height"`
+	Value  uint64 `json:"value"`
+}
+
+func scripthash_unspent(s *session, par []interface{}) (interface{}, *rpc_error) {
+	sh, er := param_sh(par)
+	if er != nil {
+		return nil, er
+	}
+	unsp, er := confirmed_unspent(sh)
+	if er != nil {
+		return nil, er
+	}
+	mp := mempool_index()[sh]
+	for _, e := range mp {
+		if !e.spending {
+			unsp = append(unsp, &unspent_item{po: e.po, value: e.value})
+		}
+	}
+	res := make([]*unspent_resp, 0, len(unsp))
+	network.TxMutex.Lock()
+	for _, u := range unsp {
+		if _, spent := network.SpentOutputs[u.po.UIdx()]; !spent {
+			res = append(res, &unspent_resp{TxHash: btc.NewUint256(u.po.Hash[:]).String(), TxPos: u.po.Vout,
+				Height: u.height, Value: u.value})
+		}
+	}
+	network.TxMutex.Unlock()
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Height < res[j].Height })
+	return res, nil
+}
+
+func scripthash_subscribe(s *session, par []interface{}) (interface{}, *rpc_error) {
+	sh, er := param_sh(par)
+	if er != nil {
+		return nil, er
+	}
+	s.Lock()
+	cnt := len(s.subs)
+	s.Unlock()
+	if cnt >= MAX_SUBSCRIPTIONS {
+		return nil, &rpc_error{Code: BAD_REQUEST, Message: "too many subscriptions"}
+	}
+	st, er := status(sh)
+	if er != nil {
+		return nil, er
+	}
+	s.Lock()
+	if _, ok := s.subs[sh]; !ok {
+		subscribed_add(sh)
+	}
+	s.subs[sh] = st
+	s.Unlock()
+	return status_json(st), nil
+}
+
+func scripthash_unsubscribe(s *session, par []interface{}) (interface{}, *rpc_error) {
+	sh, er := param_sh(par)
+	if er != nil {
+		return nil, er
+	}
+	s.Lock()
+	_, ok := s.subs[sh]
+	if ok {
+		delete(s.subs, sh)
+		subscribed_del(sh)
+	}
+	s.Unlock()
+	return ok, nil
+}
@@ -0,0 +1,235 @@
+package electrum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/client/wallet"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+type hist_item struct {
+	txid   *btc.Uint256
+	height int    // 0 for mempool txs, -1 for mempool txs with unconfirmed inputs
+	fee    uint64 // only for mempool txs
+}
+
+type unspent_item struct {
+	po     btc.TxPrevOut
+	height uint32 // zero for mempool txs
+	value  uint64
+}
+
+// Memory pool tx's output paying to a script, or its input spending from it
+type mempool_entry struct {
+	tx       *hist_item
+	sh       [32]byte
+	spending bool
+	po       btc.TxPrevOut // the output being created or spent
+	value    uint64
+}
+
+var (
+	mp_mutex sync.Mutex
+	mp_stamp [2]uint64
+	mp_time  time.Time
+	mp_tip   *chain.BlockTreeNode
+	mp_txs   = make(map[network.BIDX][]*mempool_entry) // cached entries of each mempool tx
+	mp_index map[[32]byte][]*mempool_entry
+)
+
+// Changes when the content of the memory pool changes
+func mempool_stamp() (res [2]uint64) {
+	network.TxMutex.Lock()
+	res[0] = uint64(len(network.TransactionsToSend))
+	res[1] = network.TransactionsToSendSize
+	network.TxMutex.Unlock()
+	return
+}
+
+func mempool_tx_entries(t2s *network.OneTxToSend) (res []*mempool_entry) {
+	h := &hist_item{txid: &t2s.Hash, fee: t2s.Fee}
+	if t2s.MemInputCnt > 0 {
+		h.height = -1
+	}
+	spent := t2s.Spent_outputs
+	if spent == nil {
+		spent = network.GetSpentOutputs(t2s.Tx) // the tx is shared, so do not set it there
+	}
+	if spent != nil {
+		for i, out := range spent {
+			res = append(res, &mempool_entry{tx: h, sh: chain.ScriptHash(out.Pk_script), spending: true,
+				po: t2s.TxIn[i].Input, value: out.Value})
+		}
+	}
+	for i, out := range t2s.TxOut {
+		res = append(res, &mempool_entry{tx: h, sh: chain.ScriptHash(out.Pk_script),
+			po: btc.TxPrevOut{Hash: t2s.Hash.Hash, Vout: uint32(i)}, value: out.Value})
+	}
+	return
+}
+
+// Returns script hash -> memory pool entries map, rebuilding it if the memory pool has changed.
+// Script hashes of the txs that have been added or removed get marked as touched.
+func mempool_index() map[[32]byte][]*mempool_entry {
+	mp_mutex.Lock()
+	defer mp_mutex.Unlock()
+
+	stamp := mempool_stamp()
+	tip := common.BlockChain.LastBlock()
+	if mp_index != nil && stamp == mp_stamp && tip == mp_tip && time.Since(mp_time) < 10*time.Second {
+		return mp_index
+	}
+	renew := tip != mp_tip // unconfirmed inputs might have been mined
+
+	var changed [][]*mempool_entry
+	network.TxMutex.Lock()
+	idx := make(map[[32]byte][]*mempool_entry)
+	txs := make(map[network.BIDX][]*mempool_entry, len(network.TransactionsToSend))
+	for bidx, t2s := range network.TransactionsToSend {
+		ents, ok := mp_txs[bidx]
+		if !ok || renew {
+			ents = mempool_tx_entries(t2s)
+			changed = append(changed, ents)
+		}
+		txs[bidx] = ents
+		for _, e := range ents {
+			idx[e.sh] = append(idx[e.sh], e)
+		}
+	}
+	network.TxMutex.Unlock()
+	for bidx, ents := range mp_txs {
+		if _, ok := txs[bidx]; !ok {
+			changed = append(changed, ents) // removed from the memory pool
+		}
+	}
+	touch_entries(changed)
+
+	mp_txs, mp_index, mp_stamp, mp_time, mp_tip = txs, idx, stamp, time.Now(), tip
+	return mp_index
+}
+
+// Returns the memory pool transactions touching the script
+func mempool_history(sh [32]byte) (res []*hist_item) {
+	done := make(map[*hist_item]bool)
+	for _, e := range mempool_index()[sh] {
+		if !done[e.tx] {
+			done[e.tx] = true
+			res = append(res, e.tx)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].height != res[j].height {
+			return res[i].height > res[j].height
+		}
+		return res[i].txid.String() < res[j].txid.String()
+	})
+	return
+}
+
+func wallet_ready() bool {
+	return wallet.ScriptHashesReady()
+}
+
+// Returns the confirmed transactions touching the script, ordered by block height.
+func confirmed_history(sh [32]byte) (res []*hist_item, er *rpc_error) {
+	index := common.BlockChain.AddrIndexReady()
+	if !index && !wallet_ready() {
+		er = &rpc_error{Code: DAEMON_ERROR, Message: "wallet balances not loaded and address index not ready"}
+		return
+	}
+	done := make(map[[32]byte]bool)
+	if index {
+		recs, e := common.BlockChain.GetAddrHistory(sh[:])
+		if e != nil {
+			er = &rpc_error{Code: DAEMON_ERROR, Message: e.Error()}
+			return
+		}
+		for _, r := range recs {
+			if !done[r.TxID.Hash] {
+				done[r.TxID.Hash] = true
+				res = append(res, &hist_item{txid: btc.NewUint256(r.TxID.Hash[:]), height: int(r.Height)})
+			}
+		}
+	} else {
+		// without the index we only know unspent outputs
+		for _, u := range wallet.GetScriptHashUnspent(sh) {
+			if !done[u.TxPrevOut.Hash] {
+				done[u.TxPrevOut.Hash] = true
+				res = append(res, &hist_item{txid: btc.NewUint256(u.TxPrevOut.Hash[:]), height: int(u.MinedAt)})
+			}
+		}
+		sort.SliceStable(res, func(i, j int) bool { return res[i].height < res[j].height })
+	}
+	for _, h := range res {
+		remember_height(h.txid, uint32(h.height))
+	}
+	return
+}
+
+// Returns the confirmed unspent outputs of the script.
+func confirmed_unspent(sh [32]byte) (res []*unspent_item, er *rpc_error) {
+	if !common.BlockChain.AddrIndexReady() {
+		if !wallet_ready() {
+			er = &rpc_error{Code: DAEMON_ERROR, Message: "wallet balances not loaded and address index not ready"}
+			return
+		}
+		for _, u := range wallet.GetScriptHashUnspent(sh) {
+			res = append(res, &unspent_item{po: u.TxPrevOut, height: u.MinedAt, value: u.Value})
+		}
+		return
+	}
+	recs, e := common.BlockChain.GetAddrHistory(sh[:])
+	if e != nil {
+		er = &rpc_error{Code: DAEMON_ERROR, Message: e.Error()}
+		return
+	}
+	spent := make(map[btc.TxPrevOut]bool)
+	for _, r := range recs {
+		if r.Spent != nil {
+			spent[*r.Spent] = true
+		}
+	}
+	for _, r := range recs {
+		po := btc.TxPrevOut{Hash: r.TxID.Hash, Vout: r.Index}
+		if r.Spent == nil && !spent[po] {
+			res = append(res, &unspent_item{po: po, height: r.Height, value: r.Value})
+		}
+	}
+	return
+}
+
+// Returns the full history of the script.
+func history(sh [32]byte) (res []*hist_item, er *rpc_error) {
+	if res, er = confirmed_history(sh); er == nil {
+		res = append(res, mempool_history(sh)...)
+	}
+	return
+}
+
+// Returns the script's status as defined by the Electrum protocol ("" for no history)
+func status(sh [32]byte) (string, *rpc_error) {
+	hist, er := history(sh)
+	if er != nil || len(hist) == 0 {
+		return "", er
+	}
+	sha := sha256.New()
+	for _, h := range hist {
+		fmt.Fprint(sha, h.txid.String(), ":", h.height, ":")
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
+
+func status_json(st string) interface{} {
+	if st == "" {
+		return nil
+	}
+	return st
+}
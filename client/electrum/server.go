@@ -0,0 +1,375 @@
+// Package electrum implements Electrum protocol server (JSON-RPC over TCP or TLS),
+// so Electrum wallets can use the node directly, instead of a separate ElectrumX.
+// Script hashes are looked up in the wallet's balance records and (if enabled) in the address index.
+package electrum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+const (
+	PROTOCOL_VERSION  = "1.4"
+	MAX_REQUEST_SIZE  = 1e6
+	MAX_SUBSCRIPTIONS = 1000 // per session
+)
+
+// Error codes used by ElectrumX
+const (
+	BAD_REQUEST  = 1
+	DAEMON_ERROR = 2
+
+	JSONRPC_PARSE_ERROR      = -32700
+	JSONRPC_INVALID_REQUEST  = -32600
+	JSONRPC_METHOD_NOT_FOUND = -32601
+)
+
+type rpc_error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type request struct {
+	Id     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type response_ok struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Id      interface{} `json:"id"`
+	Result  interface{} `json:"result"`
+}
+
+type response_err struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Id      interface{} `json:"id"`
+	Error   *rpc_error  `json:"error"`
+}
+
+type notification struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type session struct {
+	sync.Mutex // protects the fields below and writing to conn
+	conn       net.Conn
+	headers    bool                // subscribed to new headers
+	subs       map[[32]byte]string // subscribed script hashes -> last status sent ("" for null)
+}
+
+var (
+	sessions_mutex sync.Mutex
+	sessions       = make(map[*session]bool)
+
+	touched_mutex sync.Mutex
+	subscribed    = make(map[[32]byte]int)  // script hash -> number of sessions subscribed to it
+	touched       = make(map[[32]byte]bool) // subscribed script hashes whose status might have changed
+	touched_all   bool                      // the status of each subscribed script hash must be checked
+)
+
+// Starts the listeners configured in common.CFG.Electrum
+func StartServer() {
+	if iface := common.CFG.Electrum.Interface; iface != "" {
+		ln, er := net.Listen("tcp", iface)
+		if er != nil {
+			println("Electrum:", er.Error())
+		} else {
+			fmt.Println("Starting Electrum server at", iface)
+			go accept_loop(ln)
+		}
+	}
+	if iface := common.CFG.Electrum.TLSInterface; iface != "" {
+		cert, er := tls.LoadX509KeyPair(common.CFG.Electrum.TLSCert, common.CFG.Electrum.TLSKey)
+		if er != nil {
+			println("Electrum TLS:", er.Error())
+		} else if ln, er := tls.Listen("tcp", iface, &tls.Config{Certificates: []tls.Certificate{cert}}); er != nil {
+			println("Electrum TLS:", er.Error())
+		} else {
+			fmt.Println("Starting Electrum TLS server at", iface)
+			go accept_loop(ln)
+		}
+	}
+	go notify_loop()
+}
+
+func accept_loop(ln net.Listener) {
+	for {
+		conn, er := ln.Accept()
+		if er != nil {
+			println("Electrum:", er.Error())
+			return
+		}
+		s := &session{conn: conn, subs: make(map[[32]byte]string)}
+		sessions_mutex.Lock()
+		if uint(len(sessions)) >= common.CFG.Electrum.MaxClients {
+			sessions_mutex.Unlock()
+			common.CountSafe("ElectrumTooMany")
+			conn.Close()
+			continue
+		}
+		sessions[s] = true
+		sessions_mutex.Unlock()
+		common.CountSafe("ElectrumConnect")
+		go s.serve()
+	}
+}
+
+// Reads requests from the connection (one per line) until it gets closed
+func (s *session) serve() {
+	defer func() {
+		sessions_mutex.Lock()
+		delete(sessions, s)
+		sessions_mutex.Unlock()
+		s.Lock()
+		for sh := range s.subs {
+			subscribed_del(sh)
+		}
+		s.Unlock()
+		s.conn.Close()
+	}()
+	rd := bufio.NewReaderSize(s.conn, 64*1024)
+	for {
+		var line []byte
+		for {
+			part, pref, er := rd.ReadLine()
+			if er != nil {
+				return
+			}
+			if line = append(line, part...); len(line) > MAX_REQUEST_SIZE {
+				common.CountSafe("ElectrumTooBig")
+				return
+			}
+			if !pref {
+				break
+			}
+		}
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		if !s.send(s.process(line)) {
+			return
+		}
+	}
+}
+
+// Executes a single request or a batch of them
+func (s *session) process(line []byte) interface{} {
+	jd := json.NewDecoder(bytes.NewReader(line))
+	jd.UseNumber()
+	if line[0] == '[' {
+		var reqs []request
+		if jd.Decode(&reqs) != nil || len(reqs) == 0 {
+			return &response_err{Jsonrpc: "2.0", Error: &rpc_error{Code: JSONRPC_PARSE_ERROR, Message: "invalid batch"}}
+		}
+		res := make([]interface{}, len(reqs))
+		for i := range reqs {
+			res[i] = s.execute(&reqs[i])
+		}
+		return res
+	}
+	var req request
+	if jd.Decode(&req) != nil {
+		return &response_err{Jsonrpc: "2.0", Error: &rpc_error{Code: JSONRPC_PARSE_ERROR, Message: "invalid JSON"}}
+	}
+	return s.execute(&req)
+}
+
+func (s *session) execute(req *request) interface{} {
+	var par []interface{}
+	switch pp := req.Params.(type) {
+	case nil:
+	case []interface{}:
+		par = pp
+	default:
+		return &response_err{Jsonrpc: "2.0", Id: req.Id,
+			Error: &rpc_error{Code: JSONRPC_INVALID_REQUEST, Message: "params must be an array"}}
+	}
+	h, ok := handlers[req.Method]
+	if !ok {
+		return &response_err{Jsonrpc: "2.0", Id: req.Id,
+			Error: &rpc_error{Code: JSONRPC_METHOD_NOT_FOUND, Message: "unknown method " + req.Method}}
+	}
+	common.CountSafe("Electrum-" + req.Method)
+	res, er := h(s, par)
+	if er != nil {
+		return &response_err{Jsonrpc: "2.0", Id: req.Id, Error: er}
+	}
+	return &response_ok{Jsonrpc: "2.0", Id: req.Id, Result: res}
+}
+
+// Writes the message (followed by a new line), returning false on error
+func (s *session) send(msg interface{}) bool {
+	b, er := json.Marshal(msg)
+	if er != nil {
+		println("Electrum:", er.Error())
+		return false
+	}
+	s.Lock()
+	s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, er = s.conn.Write(append(b, '\n'))
+	s.Unlock()
+	return er == nil
+}
+
+func subscribed_add(sh [32]byte) {
+	touched_mutex.Lock()
+	subscribed[sh]++
+	touched_mutex.Unlock()
+}
+
+func subscribed_del(sh [32]byte) {
+	touched_mutex.Lock()
+	if subscribed[sh]--; subscribed[sh] <= 0 {
+		delete(subscribed, sh)
+		delete(touched, sh)
+	}
+	touched_mutex.Unlock()
+}
+
+// Call it with touched_mutex locked
+func touch(script []byte) {
+	if sh := chain.ScriptHash(script); subscribed[sh] > 0 {
+		touched[sh] = true
+	}
+}
+
+func touch_entries(list [][]*mempool_entry) {
+	touched_mutex.Lock()
+	for _, ents := range list {
+		for _, e := range ents {
+			if subscribed[e.sh] > 0 {
+				touched[e.sh] = true
+			}
+		}
+	}
+	touched_mutex.Unlock()
+}
+
+// BlockConnected marks the subscribed script hashes used by the block.
+// It is called from the main thread, after the block has been applied.
+func BlockConnected(bl *btc.Block) {
+	touched_mutex.Lock()
+	if len(subscribed) > 0 {
+		for _, tx := range bl.Txs {
+			for _, out := range tx.TxOut {
+				touch(out.Pk_script)
+			}
+			for _, out := range tx.Spent_outputs {
+				if out != nil {
+					touch(out.Pk_script)
+				}
+			}
+		}
+	}
+	touched_mutex.Unlock()
+}
+
+// BlockDisconnected is called from the main thread, after the block has been undone.
+// We do not know the outputs it has spent, so all the statuses need to be checked.
+func BlockDisconnected(bl *btc.Block) {
+	touched_mutex.Lock()
+	touched_all = true
+	touched_mutex.Unlock()
+}
+
+// Returns the touched script hashes (nil if all of them) and clears the list
+func take_touched() (res map[[32]byte]bool, any bool) {
+	touched_mutex.Lock()
+	if touched_all {
+		any = true
+	} else if len(touched) > 0 {
+		res, any = touched, true
+	}
+	touched = make(map[[32]byte]bool)
+	touched_all = false
+	touched_mutex.Unlock()
+	return
+}
+
+// Sends notifications about a new tip and changed statuses of the subscribed script hashes.
+// Only the statuses of the touched script hashes are checked (all of them if touched is nil).
+func (s *session) notify(tip *chain.BlockTreeNode, new_tip bool, touched map[[32]byte]bool, check bool) {
+	s.Lock()
+	hdrs := s.headers
+	var shs [][32]byte
+	if check {
+		for sh := range s.subs {
+			if touched == nil || touched[sh] {
+				shs = append(shs, sh)
+			}
+		}
+	}
+	s.Unlock()
+
+	if new_tip && hdrs {
+		s.send(&notification{Jsonrpc: "2.0", Method: "blockchain.headers.subscribe",
+			Params: []interface{}{header_notification(tip)}})
+	}
+	if len(shs) == 0 {
+		return
+	}
+
+	stats := make([]string, len(shs))
+	failed := make([]bool, len(shs))
+	for i := range shs {
+		var er *rpc_error
+		stats[i], er = status(shs[i])
+		failed[i] = er != nil
+	}
+
+	for i, sh := range shs {
+		if failed[i] {
+			continue
+		}
+		s.Lock()
+		prv, ok := s.subs[sh]
+		if ok && prv != stats[i] {
+			s.subs[sh] = stats[i]
+		}
+		s.Unlock()
+		if ok && prv != stats[i] {
+			s.send(&notification{Jsonrpc: "2.0", Method: "blockchain.scripthash.subscribe",
+				Params: []interface{}{sh_to_hex(sh), status_json(stats[i])}})
+		}
+	}
+}
+
+// Checks every second for a new block or a changed memory pool
+func notify_loop() {
+	var last_tip *chain.BlockTreeNode
+	for {
+		time.Sleep(time.Second)
+		tip := update_headers()
+		mempool_index() // marks the script hashes of the txs added or removed
+		touched, check := take_touched()
+		new_tip := tip != last_tip
+		if !new_tip && !check {
+			continue
+		}
+		last_tip = tip
+
+		sessions_mutex.Lock()
+		list := make([]*session, 0, len(sessions))
+		for s := range sessions {
+			list = append(list, s)
+		}
+		sessions_mutex.Unlock()
+
+		for _, s := range list {
+			s.notify(tip, new_tip, touched, check)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 	"io/ioutil"
+	"encoding/hex"
 	"crypto/rand"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/utxo"
@@ -17,8 +18,31 @@ import (
 func host_init() {
 	common.GocoinHomeDir = common.CFG.Datadir+string(os.PathSeparator)
 
-	common.Testnet = common.CFG.Testnet // So chaging this value would will only affect the behaviour after restart
-	if common.CFG.Testnet { // testnet3
+	common.Testnet = common.CFG.Testnet || common.CFG.Regtest || common.CFG.Signet // So chaging this value would will only affect the behaviour after restart
+	common.Regtest = common.CFG.Regtest
+	common.Signet = common.CFG.Signet && !common.CFG.Regtest
+	if common.CFG.Regtest {
+		common.GenesisBlock = btc.NewUint256FromString("0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206")
+		common.Magic = [4]byte{0xFA,0xBF,0xB5,0xDA}
+		common.GocoinHomeDir += common.DataSubdir() + string(os.PathSeparator)
+		common.MaxPeersNeeded = 100
+		btc.TestnetHRP = btc.RegtestHRP
+	} else if common.CFG.Signet {
+		common.GenesisBlock = btc.NewUint256FromString("00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6")
+		if common.CFG.SignetChallenge != "" {
+			var er error
+			if common.SignetChallenge, er = hex.DecodeString(common.CFG.SignetChallenge); er != nil || len(common.SignetChallenge) == 0 {
+				println("Incorrect SignetChallenge value in the config file")
+				os.Exit(1)
+			}
+		} else {
+			common.SignetChallenge = chain.SignetChallenge()
+		}
+		common.Magic = chain.SignetMagic(common.SignetChallenge)
+		common.GocoinHomeDir += common.DataSubdir() + string(os.PathSeparator)
+		common.MaxPeersNeeded = 1000
+		btc.TestnetHRP = btc.SignetHRP
+	} else if common.CFG.Testnet { // testnet3
 		common.GenesisBlock = btc.NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
 		common.Magic = [4]byte{0x0B,0x11,0x09,0x07}
 		common.GocoinHomeDir += common.DataSubdir() + string(os.PathSeparator)
@@ -72,17 +96,29 @@ func host_init() {
 		fmt.Println("Using native secp256k1 lib for EC_Verify (consider installing a speedup)")
 	}
 
+	if common.CFG.Prune.TargetMB != 0 && (common.CFG.TxIndex || common.CFG.AddrIndex || common.FLAG.Rescan) {
+		fmt.Println("Pruning (Prune.TargetMB) cannot be used along with TxIndex, AddrIndex or -r switch")
+		sys.UnlockDatabaseDir()
+		os.Exit(1)
+	}
+
 	ext := &chain.NewChanOpts{
 		UTXOVolatileMode : common.FLAG.VolatileUTXO,
 		UndoBlocks : common.FLAG.UndoBlocks,
-		BlockMinedCB : blockMined}
+		BlockMinedCB : blockMined,
+		BlockUndoneCB : blockUndone,
+		SignetChallenge : common.SignetChallenge,
+		TxIndex : common.CFG.TxIndex,
+		AddrIndex : common.CFG.AddrIndex,
+		BlockFilters : common.CFG.BlockFilters}
 
 	sta := time.Now()
 	common.BlockChain = chain.NewChainExt(common.GocoinHomeDir, common.GenesisBlock, common.FLAG.Rescan, ext,
 		&chain.BlockDBOpts{
 			MaxCachedBlocks : int(common.CFG.Memory.MaxCachedBlks),
 			MaxDataFileSize : uint64(common.CFG.Memory.MaxDataFileMB) << 20,
-			DataFilesKeep : common.CFG.Memory.DataFilesKeep})
+			DataFilesKeep : common.CFG.Memory.DataFilesKeep,
+			PruneTargetSize : uint64(common.CFG.Prune.TargetMB) << 20})
 	if chain.AbortNow {
 		fmt.Printf("Blockchain opening aborted after %s seconds\n", time.Now().Sub(sta).String())
 		common.BlockChain.Close()
@@ -90,6 +126,24 @@ func host_init() {
 		os.Exit(1)
 	}
 
+	if common.FLAG.LoadSnapshot != "" {
+		fmt.Println("Loading UTXO snapshot from", common.FLAG.LoadSnapshot, "...")
+		hash := btc.NewUint256FromString(common.CFG.AssumeUTXO)
+		if hash == nil {
+			fmt.Println("Set AssumeUTXO in the config file to the hash of the snapshot you trust")
+		} else if er := common.BlockChain.LoadSnapshot(common.FLAG.LoadSnapshot, hash); er != nil {
+			fmt.Println(er.Error())
+			hash = nil
+		}
+		if hash == nil {
+			common.BlockChain.Close()
+			sys.UnlockDatabaseDir()
+			os.Exit(1)
+		}
+		fmt.Println("Started from UTXO snapshot at block", common.BlockChain.LastBlock().Height,
+			"- blocks below it will be verified in the background")
+	}
+
 	common.Last.Block = common.BlockChain.LastBlock()
 	common.Last.Time = time.Unix(int64(common.Last.Block.Timestamp()), 0)
 	if common.Last.Time.After(time.Now()) {
@@ -111,6 +165,16 @@ func host_init() {
 	fmt.Printf("Blockchain open in %s.  %d + %d MB of RAM used (%d)\n",
 		sto.Sub(sta).String(), al>>20, utxo.ExtraMemoryConsumed()>>20, sy>>20)
 
+	if common.BlockChain.TxIdx != nil && common.FLAG.UndoBlocks == 0 {
+		go common.BlockChain.RebuildTxIndex() // index the blocks we do not have in it yet
+	}
+	if common.BlockChain.AddrIdx != nil && common.FLAG.UndoBlocks == 0 {
+		go common.BlockChain.RebuildAddrIndex()
+	}
+	if common.BlockChain.FilterIdx != nil && common.FLAG.UndoBlocks == 0 {
+		go common.BlockChain.RebuildBlockFilters()
+	}
+
 	common.StartTime = time.Now()
 	__exit <- true
 	_ = <- __done
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/piotrnar/gocoin"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/client/pubsub"
 	"github.com/piotrnar/gocoin/client/rpcapi"
+	"github.com/piotrnar/gocoin/client/electrum"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/client/usif/textui"
 	"github.com/piotrnar/gocoin/client/usif/webui"
@@ -46,10 +49,18 @@ func reset_save_timer() {
 }
 
 func blockMined(bl *btc.Block) {
+	pubsub.BlockConnected(bl)
+	electrum.BlockConnected(bl)
 	network.BlockMined(bl)
 	if int(bl.LastKnownHeight)-int(bl.Height) < 144 { // do not run it when syncing chain
 		usif.ProcessBlockFees(bl.Height, bl)
 	}
+	usif.UTXOSnapshotCheck(bl.Height)
+}
+
+func blockUndone(bl *btc.Block) {
+	pubsub.BlockDisconnected(bl)
+	electrum.BlockDisconnected(bl)
 }
 
 func LocalAcceptBlock(newbl *network.BlockRcvd) (e error) {
@@ -259,6 +270,12 @@ func HandleRpcBlock(msg *rpcapi.BlockSubmited) {
 	common.Last.Block = common.BlockChain.LastBlock()
 	common.Last.Mutex.Unlock()
 
+	network.MutexRcv.Lock()
+	if common.Last.Block.Height > network.LastCommitedHeader.Height {
+		network.LastCommitedHeader = common.Last.Block
+	}
+	network.MutexRcv.Unlock()
+
 	msg.Done.Done()
 }
 
@@ -327,6 +344,9 @@ func main() {
 		reset_save_timer() // we wil do one save try after loading, in case if ther was a rescan
 
 		peersdb.Testnet = common.Testnet
+		peersdb.Regtest = common.Regtest
+		peersdb.Signet = common.Signet
+		peersdb.CustomSignet = common.Signet && !bytes.Equal(common.SignetChallenge, chain.SignetChallenge())
 		peersdb.ConnectOnly = common.CFG.ConnectOnly
 		peersdb.Services = common.Services
 		peersdb.InitPeers(common.GocoinHomeDir)
@@ -363,6 +383,10 @@ func main() {
 			go textui.MainThread()
 		}
 
+		if common.CFG.Notify.Enabled {
+			pubsub.Start()
+		}
+
 		if common.CFG.WebUI.Interface != "" {
 			fmt.Println("Starting WebUI at", common.CFG.WebUI.Interface)
 			go webui.ServerThread(common.CFG.WebUI.Interface)
@@ -372,7 +396,12 @@ func main() {
 			go rpcapi.StartServer(common.RPCPort())
 		}
 
+		if common.CFG.Electrum.Enabled {
+			electrum.StartServer()
+		}
+
 		usif.LoadBlockFees()
+		usif.LoadFeeEstimator()
 
 		wallet.FetchingBalanceTick = func() bool {
 			select {
@@ -399,6 +428,10 @@ func main() {
 			return usif.Exit_now.Get()
 		}
 
+		if common.Regtest {
+			common.SetBool(&common.BlockChainSynchronized, true) // there is nothing to catch up with
+		}
+
 		startup_ticks := 5 // give 5 seconds for finding out missing blocks
 		if !common.FLAG.NoWallet {
 			// snooze the timer to 10 seconds after startup_ticks goes down
@@ -451,6 +484,11 @@ func main() {
 				common.Busy()
 				HandleRpcBlock(rpcbl)
 
+			case br := <-network.BackfillBlocks:
+				common.Busy()
+				common.CountSafe("MainBackfillBlock")
+				network.HandleBackfillBlock(br)
+
 			case rec := <-usif.LocksChan:
 				common.Busy()
 				common.CountSafe("MainLocks")
@@ -529,6 +567,7 @@ func main() {
 	fmt.Println("Blockchain closed in", time.Now().Sub(sta).String())
 	peersdb.ClosePeerDB()
 	usif.SaveBlockFees()
+	usif.SaveFeeEstimator()
 	sys.UnlockDatabaseDir()
 	os.RemoveAll(common.TempBlocksDir())
 }
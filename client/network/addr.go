@@ -8,7 +8,7 @@ import (
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 	"github.com/piotrnar/gocoin/lib/others/qdb"
-	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/others/utils"
 	"sort"
 	"sync"
 	"time"
@@ -101,34 +101,90 @@ func BestExternalAddr() []byte {
 	return res
 }
 
-func (c *OneConnection) SendAddr() {
-	pers := peersdb.GetBestPeers(MaxAddrsPerMessage, nil)
+// Sends the given peers in "addrv2" message, if the peer supports it, or in "addr" otherwise
+func (c *OneConnection) send_addrs(pers []*peersdb.PeerAddr) {
 	maxtime := uint32(time.Now().Unix() + 3600)
-	if len(pers) > 0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint64(len(pers)))
-		for i := range pers {
-			if pers[i].Time > maxtime {
-				println("addr", i, "time in future", pers[i].Time, maxtime, "should not happen")
-				pers[i].Time = maxtime - 7200
-			}
+	buf := new(bytes.Buffer)
+	btc.WriteVlen(buf, uint64(len(pers)))
+	v2 := c.MutexGetBool(&c.X.AddrV2)
+	for i := range pers {
+		if pers[i].Time > maxtime {
+			println("addr", i, "time in future", pers[i].Time, maxtime, "should not happen")
+			pers[i].Time = maxtime - 7200
+		}
+		if v2 {
+			buf.Write(pers[i].AddrV2().Bytes())
+		} else {
 			binary.Write(buf, binary.LittleEndian, pers[i].Time)
 			buf.Write(pers[i].NetAddr.Bytes())
 		}
+	}
+	if v2 {
+		c.SendRawMsg("addrv2", buf.Bytes())
+	} else {
 		c.SendRawMsg("addr", buf.Bytes())
 	}
 }
 
+func (c *OneConnection) SendAddr() {
+	pers := peersdb.GetPeersToSend(MaxAddrsPerMessage, c.MutexGetBool(&c.X.AddrV2))
+	if len(pers) > 0 {
+		c.send_addrs(pers)
+	}
+}
+
 func (c *OneConnection) SendOwnAddr() {
-	if ExternalAddrLen() > 0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint64(1))
-		binary.Write(buf, binary.LittleEndian, uint32(time.Now().Unix()))
-		buf.Write(BestExternalAddr())
-		c.SendRawMsg("addr", buf.Bytes())
+	var pers []*peersdb.PeerAddr
+	if common.IsListenTCP() && ExternalAddrLen() > 0 {
+		pers = append(pers, peersdb.NewPeer(append(make([]byte, 4), BestExternalAddr()...)))
+	}
+	// our onion address goes only to connections via Tor, not to link it with our IP
+	if onion := GetOnionAddress(); onion != "" && c.MutexGetBool(&c.X.AddrV2) && c.MutexGetBool(&c.X.Proxied) {
+		if ad, _ := peersdb.NewAddrFromString(onion, false); ad != nil {
+			ad.Services = common.Services
+			pers = append(pers, ad)
+		}
+	}
+	if len(pers) > 0 {
+		for _, ad := range pers {
+			ad.Time = uint32(time.Now().Unix())
+		}
+		c.send_addrs(pers)
 	}
 }
 
+// Stores the address received from the peer in our DB
+func (c *OneConnection) addr_received(a *peersdb.PeerAddr) bool {
+	if !a.Valid() {
+		common.CountSafe("AddrInvalid")
+		/*if c.Misbehave("AddrLocal", 1) {
+			break
+		}*/
+		//print(c.PeerAddr.Ip(), " ", c.Node.Agent, " ", c.Node.Version, " addr local ", a.String(), "\n> ")
+	} else if time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Hour)) {
+		if time.Now().Before(time.Unix(int64(a.Time), 0).Add(peersdb.ExpirePeerAfter)) {
+			k := qdb.KeyType(a.UniqID())
+			v := peersdb.PeerDB.Get(k)
+			if v != nil {
+				a.Banned = peersdb.NewPeer(v[:]).Banned
+			}
+			a.Time = uint32(time.Now().Add(-5 * time.Minute).Unix()) // add new peers as not just alive
+			if a.Time > uint32(time.Now().Unix()) {
+				println("wtf", a.Time, time.Now().Unix())
+			}
+			peersdb.PeerDB.Put(k, a.Bytes())
+			common.CountSafe("AddrNet-" + btc.NetName(a.Network()))
+		} else {
+			common.CountSafe("AddrStale")
+		}
+	} else {
+		if c.Misbehave("AddrFuture", 50) {
+			return false
+		}
+	}
+	return true
+}
+
 // Parese network's "addr" message
 func (c *OneConnection) ParseAddr(pl []byte) {
 	b := bytes.NewBuffer(pl)
@@ -142,32 +198,38 @@ func (c *OneConnection) ParseAddr(pl []byte) {
 			//println("ParseAddr:", n, e)
 			break
 		}
-		a := peersdb.NewPeer(buf[:])
-		if !sys.ValidIp4(a.Ip4[:]) {
-			common.CountSafe("AddrInvalid")
-			/*if c.Misbehave("AddrLocal", 1) {
-				break
-			}*/
-			//print(c.PeerAddr.Ip(), " ", c.Node.Agent, " ", c.Node.Version, " addr local ", a.String(), "\n> ")
-		} else if time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Hour)) {
-			if time.Now().Before(time.Unix(int64(a.Time), 0).Add(peersdb.ExpirePeerAfter)) {
-				k := qdb.KeyType(a.UniqID())
-				v := peersdb.PeerDB.Get(k)
-				if v != nil {
-					a.Banned = peersdb.NewPeer(v[:]).Banned
-				}
-				a.Time = uint32(time.Now().Add(-5 * time.Minute).Unix()) // add new peers as not just alive
-				if a.Time > uint32(time.Now().Unix()) {
-					println("wtf", a.Time, time.Now().Unix())
-				}
-				peersdb.PeerDB.Put(k, a.Bytes())
-			} else {
-				common.CountSafe("AddrStale")
-			}
-		} else {
-			if c.Misbehave("AddrFuture", 50) {
+		if !c.addr_received(peersdb.NewPeer(buf[:])) {
+			break
+		}
+	}
+}
+
+// Parese network's "addrv2" message (BIP155)
+func (c *OneConnection) ParseAddrV2(pl []byte) {
+	b := bytes.NewReader(pl)
+	cnt, _ := btc.ReadVLen(b)
+	if cnt > btc.MAX_ADDRV2_PER_MESSAGE {
+		c.DoS("AddrV2TooMany")
+		return
+	}
+	for i := 0; i < int(cnt); i++ {
+		a, e := btc.ReadAddrV2(b)
+		if e != nil {
+			common.CountSafe("AddrV2Error")
+			c.DoS("AddrV2Error")
+			break
+		}
+		p := utils.NewPeerFromAddrV2(a)
+		if p == nil {
+			if a.NetID >= btc.NET_IPV4 && a.NetID <= btc.NET_CJDNS && !btc.NetAddrLenOK(a.NetID, len(a.Addr)) {
+				c.DoS("AddrV2BadLen")
 				break
 			}
+			common.CountSafe("AddrV2Ignored") // unknown network, TorV2 or IPv4 mapped into IPv6
+			continue
+		}
+		if !c.addr_received(&peersdb.PeerAddr{OnePeer:p}) {
+			break
 		}
 	}
 }
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"time"
+)
+
+// Downloading of the blocks below the UTXO snapshot (see chain.Backfill)
+
+const (
+	BACKFILL_WINDOW          = 500 // how many blocks above the verified one we can ask for
+	BACKFILL_PER_PEER        = 16  // max number of blocks in progress from one peer
+	BACKFILL_RETRY_AFTER     = time.Minute
+	BACKFILL_STORED_PER_TICK = 100
+)
+
+var (
+	// blocks we asked for (protected by MutexRcv)
+	backfillAsked map[BIDX]time.Time = make(map[BIDX]time.Time)
+
+	BackfillBlocks chan *BlockRcvd = make(chan *BlockRcvd, BACKFILL_WINDOW)
+)
+
+// Called from GetBlockData (with MutexRcv locked) when there are no new blocks to fetch
+func (c *OneConnection) getBackfillData() bool {
+	bf := common.BlockChain.Backfill
+	if bf == nil || len(BackfillBlocks) > cap(BackfillBlocks)/2 ||
+		(c.Node.Services&(SERVICE_NETWORK|SERVICE_SEGWIT)) != SERVICE_NETWORK|SERVICE_SEGWIT {
+		return false
+	}
+
+	c.Mutex.Lock()
+	cbip := len(c.GetBlockInProgress)
+	c.Mutex.Unlock()
+	now := time.Now()
+	if cbip >= BACKFILL_PER_PEER {
+		c.nextGetData = now.Add(time.Second) // wait for some blocks to complete
+		return true
+	}
+
+	invs := new(bytes.Buffer)
+	var cnt int
+	for _, n := range bf.Wanted(BACKFILL_WINDOW) {
+		idx := n.BlockHash.BIdx()
+		if t, ok := backfillAsked[idx]; ok && now.Sub(t) < BACKFILL_RETRY_AFTER {
+			continue
+		}
+		backfillAsked[idx] = now
+		binary.Write(invs, binary.LittleEndian, uint32(MSG_WITNESS_BLOCK))
+		invs.Write(n.BlockHash.Hash[:])
+		c.Mutex.Lock()
+		c.GetBlockInProgress[idx] = &oneBlockDl{hash: n.BlockHash, start: now, SentAtPingCnt: c.X.PingSentCnt}
+		c.Mutex.Unlock()
+		cnt++
+		if cbip+cnt >= BACKFILL_PER_PEER {
+			break
+		}
+	}
+	if cnt == 0 {
+		return false
+	}
+
+	bu := new(bytes.Buffer)
+	btc.WriteVlen(bu, uint64(cnt))
+	c.SendRawMsg("getdata", append(bu.Bytes(), invs.Bytes()...))
+	c.IncCnt("FetchBackfill", uint64(cnt))
+	c.nextGetData = now.Add(time.Second)
+	return true
+}
+
+// Called from netBlockReceived (with MutexRcv locked).
+// Returns yes=true if it is a block we asked for (res is nil if the block was corrupt).
+func backfillBlockReceived(conn *OneConnection, hash *btc.Uint256, b []byte) (res *BlockRcvd, yes bool) {
+	idx := hash.BIdx()
+	if _, yes = backfillAsked[idx]; !yes {
+		return
+	}
+	delete(backfillAsked, idx)
+
+	conn.Mutex.Lock()
+	delete(conn.GetBlockInProgress, idx)
+	conn.counters["BackfillBlock"]++
+	conn.Mutex.Unlock()
+
+	bl, er := btc.NewBlock(b)
+	if er != nil {
+		conn.DoS("BadBackfillBlock")
+		return
+	}
+	common.CountSafe("BackfillBlockRcvd")
+	res = &BlockRcvd{Conn: conn, Block: bl}
+	return
+}
+
+// HandleBackfillBlock is called from the main thread
+func HandleBackfillBlock(br *BlockRcvd) {
+	if e := common.BlockChain.Backfill.AddBlock(br.Block); e != nil {
+		println("Backfill block", br.Block.Hash.String(), "from", br.Conn.PeerAddr.Ip(), "-", e.Error())
+		br.Conn.DoS("BadBackfillBlock")
+	}
+}
+
+// Called from NetworkTick (in the main thread)
+func backfillTick() {
+	bf := common.BlockChain.Backfill
+	if bf == nil || bf.Done() {
+		return
+	}
+	bf.ProcessStored(BACKFILL_STORED_PER_TICK)
+
+	now := time.Now()
+	MutexRcv.Lock()
+	for k, t := range backfillAsked {
+		if now.Sub(t) >= BACKFILL_RETRY_AFTER {
+			delete(backfillAsked, k)
+		}
+	}
+	MutexRcv.Unlock()
+}
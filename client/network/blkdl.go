@@ -0,0 +1,273 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"time"
+)
+
+/*
+	Headers-first block download scheduler.
+	Blocks are only requested within a window of DL_WINDOW_SIZE heights, starting from
+	the lowest block that we still miss, so whatever we download can be committed soon.
+	Download speed of each peer is measured and it decides how much data we ask it for.
+	If the lowest block of a full window does not arrive in time, it is requested again
+	from the fastest of the other peers and if the stalling peer still does not deliver it,
+	it gets disconnected. Each such disconnect doubles the stall timeout (for slow networks),
+	while each move of the window brings it back towards the minimum.
+*/
+
+const (
+	DL_WINDOW_SIZE       = 1024 // how many blocks above the lowest missing one we can ask for
+	DL_STALL_TIMEOUT_MIN = 4 * time.Second
+	DL_STALL_TIMEOUT_MAX = 64 * time.Second
+	DL_PEER_BUFFER_TIME  = 10 * time.Second // do not ask a peer for more than it can send within this time
+)
+
+// Per-peer download statistics (protected by OneConnection.Mutex)
+type blockDlStats struct {
+	speed  float64   // average download speed in bytes/second (zero if not measured yet)
+	last   time.Time // when the last requested block was received
+	bytes  uint64    // total length of the requested blocks received
+	stalls uint      // how many times the peer stalled the download window
+}
+
+// BlockDlInfo describes the state of the scheduler (see GetBlockDlInfo)
+type BlockDlInfo struct {
+	WindowStart, WindowEnd uint32
+	WindowFull             bool
+	LowestSince            time.Time
+	StallTimeout           time.Duration
+	LowestHash             *btc.Uint256
+	LowestFrom             []uint32 // IDs of the connections the lowest block is in progress with
+}
+
+var (
+	// all protected by MutexRcv
+	dlLowest       uint32
+	dlLowestSince  time.Time
+	dlWindowFull   bool          // some peer had nothing to fetch because of the window's limit
+	dlStallTimeout time.Duration = DL_STALL_TIMEOUT_MIN
+)
+
+// dlBlockReceived updates the download speed of the peer.
+// Call it with c.Mutex locked.
+func (c *OneConnection) dlBlockReceived(bip *oneBlockDl, size int) {
+	now := time.Now()
+	from := bip.start
+	if c.dl.last.After(from) {
+		from = c.dl.last // blocks requested together arrive one after another
+	}
+	c.dl.last = now
+	c.dl.bytes += uint64(size)
+	if tim := now.Sub(from); tim > 0 {
+		spd := float64(size) / tim.Seconds()
+		if c.dl.speed == 0 {
+			c.dl.speed = spd
+		} else {
+			c.dl.speed = 0.9*c.dl.speed + 0.1*spd
+		}
+	}
+}
+
+// dlMaxBytesInProgress returns how much block data we can have requested from the peer.
+// Call it with c.Mutex locked.
+func (c *OneConnection) dlMaxBytesInProgress(avg_block_size int) (res int) {
+	if c.dl.speed == 0 {
+		return MAX_GETDATA_FORWARD
+	}
+	res = int(c.dl.speed * DL_PEER_BUFFER_TIME.Seconds())
+	if res < 2*avg_block_size {
+		res = 2 * avg_block_size
+	}
+	if res > MAX_GETDATA_FORWARD {
+		res = MAX_GETDATA_FORWARD
+	}
+	return
+}
+
+// dlWindowEnd returns the highest block that can be requested now.
+// Call it with MutexRcv locked.
+func dlWindowEnd() uint32 {
+	return LowestIndexToBlocksToGet + DL_WINDOW_SIZE - 1
+}
+
+// Called from NetworkTick (in the main thread)
+func blockDlTick(now time.Time) {
+	var cons []*OneConnection
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		cons = append(cons, v)
+	}
+	Mutex_net.Unlock()
+
+	MutexRcv.Lock()
+	if LowestIndexToBlocksToGet != dlLowest {
+		if dlLowest != 0 && LowestIndexToBlocksToGet > dlLowest {
+			if dlStallTimeout = dlStallTimeout * 85 / 100; dlStallTimeout < DL_STALL_TIMEOUT_MIN {
+				dlStallTimeout = DL_STALL_TIMEOUT_MIN
+			}
+		}
+		dlLowest = LowestIndexToBlocksToGet
+		dlLowestSince = now
+		dlWindowFull = false
+	}
+	if dlLowest == 0 || !dlWindowFull || now.Sub(dlLowestSince) < dlStallTimeout {
+		MutexRcv.Unlock()
+		return
+	}
+
+	var disconnect []*OneConnection
+	for _, idx := range IndexToBlocksToGet[dlLowest] {
+		b2g := BlocksToGet[idx]
+		if b2g == nil || b2g.InProgress == 0 {
+			continue
+		}
+
+		// find the peer(s) we are getting this block from
+		var holders []*OneConnection
+		var bips []*oneBlockDl
+		var newest *oneBlockDl
+		for _, c := range cons {
+			c.Mutex.Lock()
+			if bip := c.GetBlockInProgress[idx]; bip != nil && !c.broken {
+				holders = append(holders, c)
+				bips = append(bips, bip)
+				if newest == nil || bip.start.After(newest.start) {
+					newest = bip
+				}
+			}
+			c.Mutex.Unlock()
+		}
+		if newest == nil {
+			continue
+		}
+
+		var reassigned bool
+		if now.Sub(newest.start) >= dlStallTimeout {
+			// the window is stalled - ask the fastest other peer for the block
+			for i, c := range holders {
+				c.Mutex.Lock()
+				if !bips[i].stalled {
+					bips[i].stalled = true
+					c.dl.stalls++
+					common.CountSafe("BlockDlStalled")
+				}
+				c.Mutex.Unlock()
+			}
+			if c := dlFastestPeer(cons, holders, b2g); c != nil {
+				c.dlRequestBlock(b2g, now)
+				common.CountSafe("BlockDlReassigned")
+				reassigned = true
+			}
+		}
+
+		// drop the peers that have been stalling it for too long (if someone else has been asked for it)
+		for i, c := range holders {
+			if (reassigned || bips[i] != newest) && now.Sub(bips[i].start) >= 2*dlStallTimeout {
+				disconnect = append(disconnect, c)
+			}
+		}
+	}
+	if len(disconnect) > 0 {
+		if dlStallTimeout *= 2; dlStallTimeout > DL_STALL_TIMEOUT_MAX {
+			dlStallTimeout = DL_STALL_TIMEOUT_MAX
+		}
+		dlLowestSince = now
+	}
+	MutexRcv.Unlock()
+
+	for _, c := range disconnect {
+		common.CountSafe("BlockDlStallDrop")
+		c.Disconnect("BlockDlStall")
+	}
+}
+
+// dlFastestPeer returns the fastest peer, other than the given ones, that can deliver the block.
+// Call it with MutexRcv locked.
+func dlFastestPeer(cons, not []*OneConnection, b2g *OneBlockToGet) (res *OneConnection) {
+	need_segwit := common.BlockChain.Consensus.Enforce_SEGWIT != 0 &&
+		b2g.BlockTreeNode.Height >= common.BlockChain.Consensus.Enforce_SEGWIT
+	var best float64
+next_peer:
+	for _, c := range cons {
+		for _, n := range not {
+			if c == n {
+				continue next_peer
+			}
+		}
+		c.Mutex.Lock()
+		ok := !c.broken && c.X.VersionReceived && c.X.BlocksExpired == 0 &&
+			c.Node.Height >= b2g.BlockTreeNode.Height &&
+			(c.Node.Services&SERVICE_NETWORK) != 0 &&
+			(!need_segwit || (c.Node.Services&SERVICE_SEGWIT) != 0) &&
+			len(c.GetBlockInProgress) < MAX_PEERS_BLOCKS_IN_PROGRESS
+		if ok && (res == nil || c.dl.speed > best) {
+			res = c
+			best = c.dl.speed
+		}
+		c.Mutex.Unlock()
+	}
+	return
+}
+
+// dlRequestBlock sends getdata for a single block.
+// Call it with MutexRcv locked.
+func (c *OneConnection) dlRequestBlock(b2g *OneBlockToGet, now time.Time) {
+	block_type := uint32(MSG_BLOCK)
+	if (c.Node.Services & SERVICE_SEGWIT) != 0 {
+		block_type = MSG_WITNESS_BLOCK
+	}
+	pl := new(bytes.Buffer)
+	btc.WriteVlen(pl, 1)
+	binary.Write(pl, binary.LittleEndian, block_type)
+	pl.Write(b2g.BlockHash.Hash[:])
+
+	b2g.InProgress++
+	c.Mutex.Lock()
+	c.GetBlockInProgress[b2g.BlockHash.BIdx()] =
+		&oneBlockDl{hash: b2g.BlockHash, start: now, SentAtPingCnt: c.X.PingSentCnt}
+	c.Mutex.Unlock()
+	c.SendRawMsg("getdata", pl.Bytes())
+	c.IncCnt("FetchStalled", 1)
+}
+
+// GetBlockDlInfo returns the current state of the block download scheduler.
+func GetBlockDlInfo() (res BlockDlInfo) {
+	var cons []*OneConnection
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		cons = append(cons, v)
+	}
+	Mutex_net.Unlock()
+
+	MutexRcv.Lock()
+	res.StallTimeout = dlStallTimeout
+	if LowestIndexToBlocksToGet != 0 {
+		res.WindowStart = LowestIndexToBlocksToGet
+		res.WindowEnd = dlWindowEnd()
+		if LastCommitedHeader != nil && res.WindowEnd > LastCommitedHeader.Height {
+			res.WindowEnd = LastCommitedHeader.Height
+		}
+		res.WindowFull = dlWindowFull
+		if dlLowest == LowestIndexToBlocksToGet {
+			res.LowestSince = dlLowestSince
+		}
+		if idxs := IndexToBlocksToGet[LowestIndexToBlocksToGet]; len(idxs) > 0 {
+			if b2g := BlocksToGet[idxs[0]]; b2g != nil {
+				res.LowestHash = b2g.BlockHash
+				for _, c := range cons {
+					c.Mutex.Lock()
+					if _, ok := c.GetBlockInProgress[idxs[0]]; ok {
+						res.LowestFrom = append(res.LowestFrom, c.ConnID)
+					}
+					c.Mutex.Unlock()
+				}
+			}
+		}
+	}
+	MutexRcv.Unlock()
+	return
+}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/lib/blockfilter"
+)
+
+// BIP157 - serving compact block filters
+
+const (
+	MAX_GETCFILTERS_SIZE = 1000
+	MAX_GETCFHEADERS_SIZE = 2000
+	CFCHECKPT_INTERVAL = 1000
+)
+
+// Returns the blocks from start_height up to the one with stop_hash (which does not need to be in the main chain)
+func cfilters_range(pl []byte, max uint32) (typ byte, stop *btc.Uint256, nodes []*chain.BlockTreeNode, ok bool) {
+	if len(pl) != 37 {
+		return
+	}
+	typ = pl[0]
+	start := binary.LittleEndian.Uint32(pl[1:5])
+	stop = btc.NewUint256(pl[5:37])
+	common.BlockChain.BlockIndexAccess.Lock()
+	n := common.BlockChain.BlockIndex[stop.BIdx()]
+	if n != nil && start <= n.Height && n.Height-start < max {
+		nodes = make([]*chain.BlockTreeNode, n.Height-start+1)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			nodes[i] = n
+			n = n.Parent
+		}
+		ok = true
+	}
+	common.BlockChain.BlockIndexAccess.Unlock()
+	return
+}
+
+// Make sure we can serve the filters before processing the request
+func (c *OneConnection) cfilters_allowed(typ byte) bool {
+	if typ != blockfilter.BASIC_FILTER || !common.BlockChain.BlockFiltersReady() {
+		c.DoS("CFilterUnsupported")
+		return false
+	}
+	return true
+}
+
+func (c *OneConnection) ProcessGetCFilters(pl []byte) {
+	typ, _, nodes, ok := cfilters_range(pl, MAX_GETCFILTERS_SIZE)
+	if !ok {
+		c.DoS("BadGetCFilters")
+		return
+	}
+	if !c.cfilters_allowed(typ) {
+		return
+	}
+	for i, n := range nodes {
+		if c.SendingPaused() {
+			// continue it later, from the block we have not sent yet
+			c.unfinished_getcfilters = make([]byte, 37)
+			copy(c.unfinished_getcfilters, pl)
+			binary.LittleEndian.PutUint32(c.unfinished_getcfilters[1:5], nodes[i].Height)
+			common.CountSafe("GetCFiltersPaused")
+			return
+		}
+		rec := common.BlockChain.GetBlockFilter(n.BlockHash)
+		if rec == nil {
+			common.CountSafe("GetCFiltersMissing")
+			return
+		}
+		b := new(bytes.Buffer)
+		b.WriteByte(typ)
+		b.Write(n.BlockHash.Hash[:])
+		btc.WriteVlen(b, uint64(len(rec.Filter)))
+		b.Write(rec.Filter)
+		c.SendRawMsg("cfilter", b.Bytes())
+	}
+	c.unfinished_getcfilters = nil
+}
+
+func (c *OneConnection) ProcessGetCFHeaders(pl []byte) {
+	typ, stop, nodes, ok := cfilters_range(pl, MAX_GETCFHEADERS_SIZE)
+	if !ok {
+		c.DoS("BadGetCFHeaders")
+		return
+	}
+	if !c.cfilters_allowed(typ) {
+		return
+	}
+	var prev_header [32]byte
+	if nodes[0].Parent != nil {
+		rec := common.BlockChain.GetBlockFilter(nodes[0].Parent.BlockHash)
+		if rec == nil {
+			common.CountSafe("GetCFHeadersMissing")
+			return
+		}
+		prev_header = rec.Header
+	}
+	b := new(bytes.Buffer)
+	b.WriteByte(typ)
+	b.Write(stop.Hash[:])
+	b.Write(prev_header[:])
+	btc.WriteVlen(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		rec := common.BlockChain.GetBlockFilter(n.BlockHash)
+		if rec == nil {
+			common.CountSafe("GetCFHeadersMissing")
+			return
+		}
+		b.Write(rec.FilterHash[:])
+	}
+	c.SendRawMsg("cfheaders", b.Bytes())
+}
+
+func (c *OneConnection) ProcessGetCFCheckpt(pl []byte) {
+	if len(pl) != 33 {
+		c.DoS("BadGetCFCheckpt")
+		return
+	}
+	if !c.cfilters_allowed(pl[0]) {
+		return
+	}
+	stop := btc.NewUint256(pl[1:33])
+	var nodes []*chain.BlockTreeNode
+	common.BlockChain.BlockIndexAccess.Lock()
+	n, found := common.BlockChain.BlockIndex[stop.BIdx()]
+	if found {
+		cnt := n.Height / CFCHECKPT_INTERVAL
+		nodes = make([]*chain.BlockTreeNode, cnt)
+		for ; cnt > 0; n = n.Parent {
+			if n.Height == cnt*CFCHECKPT_INTERVAL {
+				cnt--
+				nodes[cnt] = n
+			}
+		}
+	}
+	common.BlockChain.BlockIndexAccess.Unlock()
+	if !found {
+		c.DoS("BadGetCFCheckpt")
+		return
+	}
+	b := new(bytes.Buffer)
+	b.WriteByte(pl[0])
+	b.Write(stop.Hash[:])
+	btc.WriteVlen(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		rec := common.BlockChain.GetBlockFilter(n.BlockHash)
+		if rec == nil {
+			common.CountSafe("GetCFCheckptMissing")
+			return
+		}
+		b.Write(rec.Header[:])
+	}
+	c.SendRawMsg("cfcheckpt", b.Bytes())
+}
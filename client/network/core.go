@@ -13,6 +13,7 @@ import (
 	"encoding/hex"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/bip324"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
@@ -43,7 +44,11 @@ const (
 
 	MAX_INV_HISTORY = 500
 
+	SERVICE_NETWORK = 0x1
 	SERVICE_SEGWIT = 0x8
+	SERVICE_COMPACT_FILTERS = 0x40
+	SERVICE_NETWORK_LIMITED = 0x400
+	SERVICE_P2P_V2 = 0x800
 
 	TxsCounterPeriod = 6*time.Second // how long for one tick
 	TxsCounterBufLen = 60 // how many ticks
@@ -88,6 +93,7 @@ type ConnectionStatus struct {
 	Incomming bool
 	ConnectedAt time.Time
 	VersionReceived bool
+	VerackReceived bool
 	LastBtsRcvd, LastBtsSent uint32
 	LastCmdRcvd, LastCmdSent string
 	LastDataGot time.Time // if we have no data for some time, we abort this conenction
@@ -129,6 +135,12 @@ type ConnectionStatus struct {
 
 	PingSentCnt uint64
 	BlocksExpired uint64
+
+	V2Transport bool // BIP324 encrypted transport
+	SessionID string // BIP324 session ID (hex)
+	Proxied bool // connected via SOCKS5 proxy or our onion service
+	AddrV2 bool // peer wants "addrv2" messages (BIP155)
+	WTxIDRelay bool // peer announces txs by wtxid (BIP339)
 }
 
 type ConnInfo struct {
@@ -146,6 +158,10 @@ type ConnInfo struct {
 	BlocksReceived int
 	GetMPInProgress bool
 
+	DlSpeed float64 // block download speed in bytes/second
+	DlBytes uint64
+	DlStalls uint
+
 	LocalAddr, RemoteAddr string
 
 	// This one is only set inside webui's hnadler (for sorted connections)
@@ -164,6 +180,7 @@ type OneConnection struct {
 	misbehave int // When it reaches 1000, ban it
 
 	net.Conn
+	v2 *bip324.Cipher // not nil if the connection uses BIP324 transport
 
 	// TCP connection data:
 	X ConnectionStatus
@@ -181,6 +198,7 @@ type OneConnection struct {
 	}
 	LastMsgTime time.Time
 	unfinished_getdata []byte
+	unfinished_getcfilters []byte
 
 	InvDone struct {
 		Map map[uint64]uint32
@@ -196,6 +214,7 @@ type OneConnection struct {
 	PendingInvs []*[36]byte // List of pending INV to send and the mutex protecting access to it
 
 	GetBlockInProgress map[BIDX] *oneBlockDl
+	dl blockDlStats
 
 	// Ping stats
 	LastPingSent time.Time
@@ -225,6 +244,7 @@ type oneBlockDl struct {
 	start time.Time
 	col *CmpctBlockCollector
 	SentAtPingCnt uint64
+	stalled bool // it has been stalling the download window
 }
 
 
@@ -310,6 +330,9 @@ func (v *OneConnection) GetStats(res *ConnInfo) {
 	res.InvsDone = len(v.InvDone.History)
 	res.BlocksReceived = len(v.blocksreceived)
 	res.GetMPInProgress = len(v.GetMP) != 0
+	res.DlSpeed = v.dl.speed
+	res.DlBytes = v.dl.bytes
+	res.DlStalls = v.dl.stalls
 
 	v.Mutex.Unlock()
 }
@@ -323,11 +346,25 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 	}*/
 
 	if !c.broken {
+		var sbuf [24]byte
+		hdr, body := sbuf[:], pl
+		if c.v2 != nil {
+			hdr, body = nil, c.v2.EncryptMsg(cmd, pl)
+		} else {
+			binary.LittleEndian.PutUint32(sbuf[0:4], common.Version)
+			copy(sbuf[0:4], common.Magic[:])
+			copy(sbuf[4:16], cmd)
+			binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
+
+			sh := btc.Sha2Sum(pl[:])
+			copy(sbuf[20:24], sh[:4])
+		}
+
 		// we never allow the buffer to be totally full because then producer would be equal consumer
-		if bytes_left := SendBufSize - c.BytesToSent(); bytes_left <= len(pl) + 24 {
+		if bytes_left := SendBufSize - c.BytesToSent(); bytes_left <= len(hdr) + len(body) {
 			c.Mutex.Unlock()
 			println(c.PeerAddr.Ip(), c.Node.Version, c.Node.Agent, "Peer Send Buffer Overflow @",
-				cmd, bytes_left, len(pl)+24, c.SendBufProd, c.SendBufCons, c.BytesToSent())
+				cmd, bytes_left, len(hdr)+len(body), c.SendBufProd, c.SendBufCons, c.BytesToSent())
 			c.Disconnect("SendBufferOverflow")
 			common.CountSafe("PeerSendOverflow")
 			return errors.New("Send buffer overflow")
@@ -338,21 +375,12 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 
 		common.CountSafe("sent_"+cmd)
 		common.CountSafeAdd("sbts_"+cmd, uint64(len(pl)))
-		var sbuf [24]byte
 
 		c.X.LastCmdSent = cmd
 		c.X.LastBtsSent = uint32(len(pl))
 
-		binary.LittleEndian.PutUint32(sbuf[0:4], common.Version)
-		copy(sbuf[0:4], common.Magic[:])
-		copy(sbuf[4:16], cmd)
-		binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
-
-		sh := btc.Sha2Sum(pl[:])
-		copy(sbuf[20:24], sh[:4])
-
-		c.append_to_send_buffer(sbuf[:])
-		c.append_to_send_buffer(pl)
+		c.append_to_send_buffer(hdr)
+		c.append_to_send_buffer(body)
 
 		if x:=c.BytesToSent(); x>c.X.MaxSentBufSize {
 			c.X.MaxSentBufSize = x
@@ -450,6 +478,10 @@ func (c *OneConnection) FetchMessage() (ret *BCmsg, timeout_or_data bool) {
 	var e error
 	var n int
 
+	if c.v2 != nil {
+		return c.fetch_v2_message()
+	}
+
 	for c.recv.hdr_len < 24 {
 		n, e = common.SockRead(c.Conn, c.recv.hdr[c.recv.hdr_len:24])
 		if n < 0 {
@@ -556,12 +588,20 @@ func (c *OneConnection) FetchMessage() (ret *BCmsg, timeout_or_data bool) {
 	c.recv.hdr_len = 0
 	c.recv.cmd = ""
 	c.recv.dat = nil
+	c.Mutex.Unlock()
+
+	c.msg_received(ret)
+	return
+}
 
+
+// Updates the statistics after receiving a message
+func (c *OneConnection) msg_received(ret *BCmsg) {
+	c.Mutex.Lock()
 	c.counters["rcvd_"+ret.cmd]++
 	c.counters["rbts_"+ret.cmd] += uint64(len(ret.pl))
 	c.X.LastCmdRcvd = ret.cmd
 	c.X.LastBtsRcvd = uint32(len(ret.pl))
-
 	c.Mutex.Unlock()
 
 	c.LastMsgTime = time.Now()
@@ -571,8 +611,6 @@ func (c *OneConnection) FetchMessage() (ret *BCmsg, timeout_or_data bool) {
 	/*if c.X.Debug {
 		fmt.Println(c.ConnID, "rcvd", cmd.cmd, len(cmd.pl))
 	}*/
-
-	return
 }
 
 
@@ -643,6 +681,7 @@ func maxmsgsize(cmd string) uint32 {
 		case "inv": return 9+50000*36 // the spec says "max 50000 entries"
 		case "tx": return 500e3 // max segwit tx size 500KB
 		case "addr": return 9+1000*30 // max 1000 addrs
+		case "addrv2": return 9+1000*(4+9+1+3+512+2) // max 1000 addrs, up to 512 bytes each
 		case "block": return 4e6 // max segwit block size 4MB
 		case "getblocks": return 4+9+101*32+32 // MAX_LOCATOR_SZ = 101
 		case "getdata": return 9+50000*36 // core: MAX_INV_SZ = 50000
@@ -12,7 +12,7 @@ import (
 
 
 func (c *OneConnection) ProcessGetData(pl []byte) {
-	//var notfound []byte
+	var notfound []byte
 
 	//println(c.PeerAddr.Ip(), "getdata")
 	b := bytes.NewReader(pl)
@@ -53,6 +53,11 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 		common.CountSafe(fmt.Sprintf("GetdataType-%x",typ))
 		if typ == MSG_BLOCK || typ == MSG_WITNESS_BLOCK {
 			hash := btc.NewUint256(h[4:])
+			if common.BlockChain.Blocks.BlockPruned(hash) {
+				common.CountSafe("GetDataPruned")
+				notfound = append(notfound, h[:]...)
+				continue
+			}
 			crec, _, er := common.BlockChain.Blocks.BlockGetExt(hash)
 
 			if er == nil {
@@ -73,14 +78,18 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 				//fmt.Println("BlockGetExt-2 failed for", hash.String(), er.Error())
 				//notfound = append(notfound, h[:]...)
 			}
-		} else if typ == MSG_TX || typ == MSG_WITNESS_TX {
+		} else if typ == MSG_TX || typ == MSG_WITNESS_TX || typ == MSG_WTX {
 			// transaction
 			TxMutex.Lock()
-			if tx, ok := TransactionsToSend[btc.NewUint256(h[4:]).BIdx()]; ok && tx.Blocked==0 {
+			tx, ok := TransactionsToSend[btc.NewUint256(h[4:]).BIdx()]
+			if !ok && typ == MSG_WTX {
+				tx, ok = TransactionsToSendWTx[btc.NewUint256(h[4:]).BIdx()]
+			}
+			if ok && tx.Blocked==0 {
 				tx.SentCnt++
 				tx.Lastsent = time.Now()
 				TxMutex.Unlock()
-				if tx.SegWit==nil || typ==MSG_WITNESS_TX {
+				if tx.SegWit==nil || typ!=MSG_TX {
 					c.SendRawMsg("tx", tx.Raw)
 				} else {
 					c.SendRawMsg("tx", tx.Serialize())
@@ -103,14 +112,12 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 		}
 	}
 
-	/*
 	if len(notfound)>0 {
 		buf := new(bytes.Buffer)
 		btc.WriteVlen(buf, uint64(len(notfound)/36))
 		buf.Write(notfound)
 		c.SendRawMsg("notfound", buf.Bytes())
 	}
-	*/
 }
 
 
@@ -127,6 +134,14 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 
 	MutexRcv.Lock()
 
+	if br, yes := backfillBlockReceived(conn, hash, b); yes {
+		MutexRcv.Unlock()
+		if br != nil {
+			BackfillBlocks <- br
+		}
+		return
+	}
+
 	// the blocks seems to be fine
 	if rb, got := ReceivedBlocks[idx]; got {
 		rb.Cnt++
@@ -202,6 +217,7 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 		conn.counters["NewBlock!"]++
 		orb.TxMissing = -2
 	} else {
+		conn.dlBlockReceived(bip, len(b))
 		delete(conn.GetBlockInProgress, idx)
 		conn.counters["NewBlock"]++
 		orb.TxMissing = -1
@@ -287,6 +303,9 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 	defer MutexRcv.Unlock()
 
 	if LowestIndexToBlocksToGet==0 || len(BlocksToGet)==0 {
+		if c.getBackfillData() {
+			return true
+		}
 		c.IncCnt("FetchNoBlocksToGet", 1)
 		// wake up in one minute, just in case
 		c.nextGetData = time.Now().Add(60*time.Second)
@@ -300,6 +319,8 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 		return
 	}
 	cbip := len(c.GetBlockInProgress)
+	avg_block_size := common.AverageBlockSize.Get()
+	max_bytes_in_progress := c.dlMaxBytesInProgress(avg_block_size)
 	c.Mutex.Unlock()
 
 	if cbip >= MAX_PEERS_BLOCKS_IN_PROGRESS {
@@ -309,10 +330,9 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 		return
 	}
 
-	avg_block_size := common.AverageBlockSize.Get()
 	block_data_in_progress := cbip * avg_block_size
 
-	if block_data_in_progress > 0 && (block_data_in_progress + avg_block_size) > MAX_GETDATA_FORWARD {
+	if block_data_in_progress > 0 && (block_data_in_progress + avg_block_size) > max_bytes_in_progress {
 		c.IncCnt("FetchMaxBytesInProgress", 1)
 		// wake up in a few seconds, maybe some blocks will complete by then
 		c.nextGetData = time.Now().Add(1*time.Second) // wait for some blocks to complete
@@ -344,6 +364,11 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 	if max_height > LastCommitedHeader.Height {
 		max_height = LastCommitedHeader.Height
 	}
+	var window_limit bool
+	if max_height > dlWindowEnd() {
+		max_height = dlWindowEnd()
+		window_limit = true
+	}
 
 	if common.BlockChain.Consensus.Enforce_SEGWIT!=0 && (c.Node.Services&SERVICE_SEGWIT)==0 { // no segwit node
 		if max_height >= common.BlockChain.Consensus.Enforce_SEGWIT-1 {
@@ -402,13 +427,20 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 			break  // no more than 2000 blocks in progress / peer
 		}
 		block_data_in_progress += avg_block_size
-		if block_data_in_progress > MAX_GETDATA_FORWARD {
+		if block_data_in_progress > max_bytes_in_progress {
 			break
 		}
 	}
 
 	if cnt == 0 {
 		//println(c.ConnID, "fetch nothing", cbip, block_data_in_progress, max_height-common.Last.Block.Height, cnt_in_progress)
+		if window_limit {
+			// the window is full - wake up as soon as it moves
+			dlWindowFull = true
+			c.IncCnt("FetchWindowFull", 1)
+			c.nextGetData = time.Now().Add(time.Second)
+			return
+		}
 		c.IncCnt("FetchNothing", 1)
 		// wake up in a few seconds, maybe it will be different next time
 		c.nextGetData = time.Now().Add(5*time.Second)
@@ -17,6 +17,7 @@ const (
 	MSG_TX = 1
 	MSG_BLOCK = 2
 	MSG_CMPCT_BLOCK = 4
+	MSG_WTX = 5 // BIP339
 	MSG_WITNESS_TX = MSG_TX | MSG_WITNESS_FLAG
 	MSG_WITNESS_BLOCK = MSG_BLOCK | MSG_WITNESS_FLAG
 )
@@ -73,6 +74,7 @@ func (c *OneConnection) ProcessInv(pl []byte) {
 		c.Mutex.Lock()
 		c.InvStore(typ, pl[of+4:of+36])
 		ahr := c.X.AllHeadersReceived
+		wtxr := c.X.WTxIDRelay
 		c.Mutex.Unlock()
 		common.CountSafe(fmt.Sprint("InvGot-",typ))
 		if typ==MSG_BLOCK {
@@ -99,9 +101,12 @@ func (c *OneConnection) ProcessInv(pl []byte) {
 					common.CountSafe("InvBlockOld")
 				}
 			}
-		} else if typ==MSG_TX {
-			if common.AcceptTx() {
-				c.TxInvNotify(pl[of+4:of+36])
+		} else if typ==MSG_TX || typ==MSG_WTX {
+			if (typ==MSG_WTX) != wtxr {
+				// BIP339: after "wtxidrelay" txs are announced only by wtxid
+				common.CountSafe("InvTxWrongType")
+			} else if common.AcceptTx() {
+				c.TxInvNotify(typ, pl[of+4:of+36])
 			} else {
 				common.CountSafe("InvTxIgnored")
 			}
@@ -137,6 +142,19 @@ func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spk
 	binary.LittleEndian.PutUint32(inv[0:4], typ)
 	copy(inv[4:36], h.Bytes())
 
+	// Peers that sent us "wtxidrelay" want SegWit txs announced by wtxid
+	winv := inv
+	if typ == MSG_TX {
+		winv = new([36]byte)
+		binary.LittleEndian.PutUint32(winv[0:4], MSG_WTX)
+		copy(winv[4:36], h.Bytes()) // for non-SegWit txs wtxid is the same as txid
+		TxMutex.Lock()
+		if tx, ok := TransactionsToSend[h.BIdx()]; ok {
+			copy(winv[4:36], tx.WTxID().Hash[:])
+		}
+		TxMutex.Unlock()
+	}
+
 	// Append it to PendingInvs in each open connection
 	Mutex_net.Lock()
 	for _, v := range OpenCons {
@@ -160,11 +178,15 @@ func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spk
 				*/
 			}
 			if send_inv {
+				vinv := inv
+				if v.X.WTxIDRelay {
+					vinv = winv
+				}
 				if len(v.PendingInvs) < 500 {
-					if typ, ok := v.InvDone.Map[hash2invid(inv[4:36])]; ok {
+					if typ, ok := v.InvDone.Map[hash2invid(vinv[4:36])]; ok {
 						common.CountSafe(fmt.Sprint("SendInvSame-", typ))
 					} else {
-						v.PendingInvs = append(v.PendingInvs, inv)
+						v.PendingInvs = append(v.PendingInvs, vinv)
 						cnt++
 					}
 				} else {
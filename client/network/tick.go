@@ -208,11 +208,11 @@ func DoNetwork(ad *peersdb.PeerAddr) {
 		var e error
 		con_done := make(chan bool, 1)
 
-		go func(addr string) {
+		go func() {
 			// we do net.Dial() in paralell routine, so we can abort quickly upon request
-			con, e = net.DialTimeout("tcp4", addr, TCPDialTimeout)
+			con, e = dial_peer(ad)
 			con_done <- true
-		}(fmt.Sprintf("%d.%d.%d.%d:%d", ad.Ip4[0], ad.Ip4[1], ad.Ip4[2], ad.Ip4[3], ad.Port))
+		}()
 
 		for {
 			select {
@@ -221,6 +221,7 @@ func DoNetwork(ad *peersdb.PeerAddr) {
 					Mutex_net.Lock()
 					conn.Conn = con
 					conn.X.ConnectedAt = time.Now()
+					conn.X.Proxied = common.GetString(&common.CFG.Net.Proxy) != ""
 					Mutex_net.Unlock()
 					conn.Run()
 				}
@@ -401,6 +402,15 @@ func NetworkTick() {
 		}
 	}
 
+	if common.GetString(&common.CFG.Net.TorControl) != "" && !common.NetworkClosed.Get() {
+		Mutex_net.Lock()
+		if !OnionServerStarted {
+			OnionServerStarted = true
+			go onion_server()
+		}
+		Mutex_net.Unlock()
+	}
+
 	now := time.Now()
 
 	// Push GetHeaders if not in progress
@@ -518,6 +528,9 @@ func NetworkTick() {
 	} else if now.After(lastTxsExpire.Add(time.Minute)) {
 		expireTxsNow = true
 	}
+
+	blockDlTick(now)
+	backfillTick()
 }
 
 func (c *OneConnection) SendFeeFilter() {
@@ -596,6 +609,11 @@ func (c *OneConnection) Run() {
 
 	c.writing_thread_push = make(chan bool, 1)
 
+	if !c.start_transport() {
+		c.Conn.Close()
+		return
+	}
+
 	c.SendVersion()
 
 	c.Mutex.Lock()
@@ -640,6 +658,12 @@ func (c *OneConnection) Run() {
 				goto recovered_getdata
 			}
 
+			if c.unfinished_getcfilters != nil && !c.SendingPaused() {
+				cmd = &BCmsg{cmd:"getcfilters", pl:c.unfinished_getcfilters}
+				common.CountSafe("GetCFiltersRestored")
+				goto recovered_getdata
+			}
+
 			if !read_tried {
 				// it will end up here if we did not even try to read anything because of BW limit
 				time.Sleep(10 * time.Millisecond)
@@ -701,7 +725,7 @@ func (c *OneConnection) Run() {
 			c.PeerAddr.Services = c.Node.Services
 			c.PeerAddr.Save()
 
-			if common.IsListenTCP() {
+			if common.IsListenTCP() || GetOnionAddress() != "" {
 				c.SendOwnAddr()
 			}
 			continue
@@ -720,6 +744,30 @@ func (c *OneConnection) Run() {
 		case "addr":
 			c.ParseAddr(cmd.pl)
 
+		case "addrv2":
+			c.ParseAddrV2(cmd.pl)
+
+		case "sendaddrv2":
+			if c.X.VerackReceived {
+				common.CountSafe("SendAddrV2Late") // BIP155: it must come before verack
+				break
+			}
+			c.Mutex.Lock()
+			c.X.AddrV2 = true
+			c.Mutex.Unlock()
+
+		case "verack":
+			c.X.VerackReceived = true
+
+		case "wtxidrelay":
+			if c.X.VerackReceived {
+				common.CountSafe("WTxIDRelayLate") // BIP339: it must come before verack
+				break
+			}
+			c.Mutex.Lock()
+			c.X.WTxIDRelay = true
+			c.Mutex.Unlock()
+
 		case "block": //block received
 			netBlockReceived(c, cmd.pl)
 			c.X.GetBlocksDataNow = true // try to ask for more blocks
@@ -822,6 +870,16 @@ func (c *OneConnection) Run() {
 		case "getmpdone":
 			c.GetMPDone(cmd.pl)
 
+		case "getcfilters":
+			c.unfinished_getcfilters = nil
+			c.ProcessGetCFilters(cmd.pl)
+
+		case "getcfheaders":
+			c.ProcessGetCFHeaders(cmd.pl)
+
+		case "getcfcheckpt":
+			c.ProcessGetCFCheckpt(cmd.pl)
+
 		case "filterload", "filteradd", "filterclear", "merkleblock":
 			c.DoS("SPV")
 
@@ -854,7 +912,7 @@ func (c *OneConnection) Run() {
 		if ban {
 			c.PeerAddr.Ban()
 			common.CountSafe("PeersBanned")
-		} else if c.X.Incomming && !c.MutexGetBool(&c.X.IsSpecial) {
+		} else if c.X.Incomming && !c.PeerAddr.OnionIn && !c.MutexGetBool(&c.X.IsSpecial) {
 			HammeringMutex.Lock()
 			RecentlyDisconencted[c.PeerAddr.NetAddr.Ip4] = time.Now()
 			HammeringMutex.Unlock()
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+	"strings"
+	"io/ioutil"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/tor"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// SOCKS5 proxy and Tor onion service
+
+const (
+	OnionKeyFile = "onion_v3_key"
+	OnionRetryAfter = time.Minute
+)
+
+var (
+	OnionServerStarted bool
+	OnionAddress string // of our onion service, as host:port (empty if not running)
+)
+
+
+// Opens the TCP connection to the peer - via the proxy, if one is configured
+func dial_peer(ad *peersdb.PeerAddr) (net.Conn, error) {
+	common.LockCfg()
+	proxy := common.CFG.Net.Proxy
+	randomize := common.CFG.Net.ProxyRandomize
+	common.UnlockCfg()
+
+	switch ad.Network() {
+		case btc.NET_IPV4:
+			if proxy == "" {
+				return net.DialTimeout("tcp4", ad.Ip(), TCPDialTimeout)
+			}
+		case btc.NET_IPV6:
+			if proxy == "" {
+				return net.DialTimeout("tcp6", ad.Ip(), TCPDialTimeout)
+			}
+		case btc.NET_CJDNS:
+			return net.DialTimeout("tcp6", ad.Ip(), TCPDialTimeout) // never via proxy
+		case btc.NET_TORV3:
+			if proxy == "" {
+				return nil, fmt.Errorf("Proxy needed to connect %s", ad.Ip())
+			}
+		default:
+			return nil, fmt.Errorf("Cannot connect to %s network", btc.NetName(ad.Network()))
+	}
+
+	var user, pass string
+	if randomize {
+		var rnd [16]byte
+		rand.Read(rnd[:])
+		user, pass = hex.EncodeToString(rnd[:8]), hex.EncodeToString(rnd[8:])
+	}
+	return tor.DialSOCKS5(proxy, ad.Ip(), user, pass, TCPDialTimeout)
+}
+
+
+// Creates the onion service via Tor control port and accepts the incoming connections from it
+func onion_server() {
+	defer func() {
+		Mutex_net.Lock()
+		OnionServerStarted = false
+		OnionAddress = ""
+		Mutex_net.Unlock()
+	}()
+
+	common.LockCfg()
+	control := common.CFG.Net.TorControl
+	password := common.CFG.Net.TorPassword
+	common.UnlockCfg()
+
+	// Tor forwards the connections to a local port of our choice
+	lis, e := net.ListenTCP("tcp4", &net.TCPAddr{IP:net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		println("Onion ListenTCP", e.Error())
+		time.Sleep(OnionRetryAfter)
+		return
+	}
+	defer lis.Close()
+
+	ctrl, e := tor.NewControl(control, password, TCPDialTimeout)
+	if e != nil {
+		println("Tor control port:", e.Error())
+		time.Sleep(OnionRetryAfter)
+		return
+	}
+	defer ctrl.Close() // this also removes the onion service
+
+	key_file := common.GocoinHomeDir + OnionKeyFile
+	key := "NEW:ED25519-V3"
+	if d, _ := ioutil.ReadFile(key_file); len(d) > 0 {
+		key = strings.TrimSpace(string(d))
+	}
+	service_id, new_key, e := ctrl.AddOnion(key, common.DefaultTcpPort(), lis.Addr().String())
+	if e != nil {
+		println("ADD_ONION:", e.Error())
+		time.Sleep(OnionRetryAfter)
+		return
+	}
+	if new_key != "" {
+		if e = ioutil.WriteFile(key_file, []byte(new_key), 0600); e != nil {
+			println("Onion key not saved:", e.Error())
+		}
+	}
+
+	Mutex_net.Lock()
+	OnionAddress = fmt.Sprint(service_id, ".onion:", common.DefaultTcpPort())
+	Mutex_net.Unlock()
+	fmt.Println("Onion service started at", OnionAddress)
+
+	next_check := time.Now().Add(OnionRetryAfter)
+	for common.GetString(&common.CFG.Net.TorControl) == control && !common.NetworkClosed.Get() {
+		if time.Now().After(next_check) {
+			// if Tor has been restarted, our service is gone - start it again
+			if _, e = ctrl.Command("GETINFO version"); e != nil {
+				println("Tor control port:", e.Error())
+				break
+			}
+			next_check = time.Now().Add(OnionRetryAfter)
+		}
+		Mutex_net.Lock()
+		ica := InConsActive
+		Mutex_net.Unlock()
+		if ica >= common.GetUint32(&common.CFG.Net.MaxInCons) {
+			time.Sleep(1e8)
+			continue
+		}
+		lis.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		tc, e := lis.AcceptTCP()
+		if e != nil {
+			continue
+		}
+		common.CountSafe("OnionConnIn")
+
+		// we know nothing about the peer, so its local address serves as the ID of the connection
+		ad, _ := peersdb.NewAddrFromString(tc.RemoteAddr().String(), false)
+		ad.OnionIn = true
+		conn := NewConnection(ad)
+		conn.X.ConnectedAt = time.Now()
+		conn.X.Incomming = true
+		conn.X.Proxied = true
+		conn.Conn = tc
+		Mutex_net.Lock()
+		OpenCons[ad.UniqID()] = conn
+		InConsActive++
+		Mutex_net.Unlock()
+		go func() {
+			conn.Run()
+			Mutex_net.Lock()
+			delete(OpenCons, ad.UniqID())
+			InConsActive--
+			Mutex_net.Unlock()
+		}()
+	}
+
+	Mutex_net.Lock()
+	for _, c := range OpenCons {
+		if c.PeerAddr.OnionIn {
+			c.Disconnect("CloseOnionIn")
+		}
+	}
+	Mutex_net.Unlock()
+}
+
+
+
+// Returns address of our onion service (empty if not running)
+func GetOnionAddress() (res string) {
+	Mutex_net.Lock()
+	res = OnionAddress
+	Mutex_net.Unlock()
+	return
+}
@@ -0,0 +1,277 @@
+package network
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"errors"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/bip324"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// BIP324 - encrypted (v2) transport
+
+const (
+	V2HandshakeTimeout = 20*time.Second
+)
+
+
+// Size of the biggest packet that we accept (the one with a block inside)
+func v2_max_packet() int {
+	return int(maxmsgsize("block")) + 13 + bip324.HEADER_LEN + bip324.EXPANSION
+}
+
+// Reads exactly len(buf) bytes during the handshake
+func (c *OneConnection) v2_read(buf []byte) (e error) {
+	var n int
+	n, e = io.ReadFull(c.Conn, buf)
+	c.Mutex.Lock()
+	c.X.BytesReceived += uint64(n)
+	c.Mutex.Unlock()
+	return
+}
+
+// Writes the data during the handshake
+func (c *OneConnection) v2_write(buf []byte) (e error) {
+	var n int
+	n, e = c.Conn.Write(buf)
+	c.Mutex.Lock()
+	c.X.BytesSent += uint64(n)
+	c.Mutex.Unlock()
+	return
+}
+
+// Performs the BIP324 handshake. prefix is what we have already received from the peer.
+// got_data is set if we have received anything from the peer.
+func (c *OneConnection) v2_handshake(prefix []byte) (got_data bool, e error) {
+	var rnd [2]byte
+	ci := bip324.NewCipher()
+	rand.Read(rnd[:])
+	garbage := make([]byte, int(binary.LittleEndian.Uint16(rnd[:])) % (bip324.MAX_GARBAGE_LEN+1))
+	rand.Read(garbage)
+
+	c.Conn.SetDeadline(time.Now().Add(V2HandshakeTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	if e = c.v2_write(append(ci.OurPubkey, garbage...)); e != nil {
+		return
+	}
+
+	theirs := make([]byte, bip324.ELLSWIFT_LEN)
+	copy(theirs, prefix)
+	if e = c.v2_read(theirs[len(prefix):]); e != nil {
+		return
+	}
+	got_data = true
+	if e = ci.Initialize(theirs, !c.X.Incomming, common.Magic[:]); e != nil {
+		return
+	}
+
+	// garbage terminator, followed by the version packet
+	if e = c.v2_write(append(ci.SendTerminator, ci.Encrypt(nil, garbage, false)...)); e != nil {
+		return
+	}
+
+	// skip the peer's garbage, up to its terminator
+	rcvd := make([]byte, bip324.GARBAGE_TERMINATOR_LEN, bip324.GARBAGE_TERMINATOR_LEN + bip324.MAX_GARBAGE_LEN)
+	if e = c.v2_read(rcvd); e != nil {
+		return
+	}
+	for !bytes.Equal(rcvd[len(rcvd)-bip324.GARBAGE_TERMINATOR_LEN:], ci.RecvTerminator) {
+		if len(rcvd) == cap(rcvd) {
+			e = errors.New("garbage terminator not found")
+			return
+		}
+		rcvd = rcvd[:len(rcvd)+1]
+		if e = c.v2_read(rcvd[len(rcvd)-1:]); e != nil {
+			return
+		}
+	}
+
+	// the version packet (possibly preceded by decoys) authenticates the garbage
+	aad := rcvd[:len(rcvd)-bip324.GARBAGE_TERMINATOR_LEN]
+	for {
+		var enc [bip324.LENGTH_LEN]byte
+		if e = c.v2_read(enc[:]); e != nil {
+			return
+		}
+		pkt := make([]byte, ci.DecryptLength(enc[:]))
+		if len(pkt) > v2_max_packet() {
+			e = errors.New("packet too long")
+			return
+		}
+		if e = c.v2_read(pkt); e != nil {
+			return
+		}
+		var ignore bool
+		if _, ignore, e = ci.Decrypt(pkt, aad); e != nil {
+			return
+		}
+		if !ignore {
+			break
+		}
+		aad = nil
+	}
+
+	c.Mutex.Lock()
+	c.v2 = ci
+	c.X.V2Transport = true
+	c.X.SessionID = hex.EncodeToString(ci.SessionID)
+	c.Mutex.Unlock()
+	return
+}
+
+
+// Decides which transport to use with the peer and does the BIP324 handshake, if needed.
+// Returns false if the connection shall be dropped.
+func (c *OneConnection) start_transport() bool {
+	if !common.GetBool(&common.CFG.Net.V2Transport) {
+		return true
+	}
+
+	if c.X.Incomming {
+		// v1 peers start with the version message
+		prefix := make([]byte, 16)
+		c.Conn.SetReadDeadline(time.Now().Add(V2HandshakeTimeout))
+		e := c.v2_read(prefix)
+		c.Conn.SetReadDeadline(time.Time{})
+		if e != nil {
+			common.CountSafe("V2HandshakeFail")
+			return false
+		}
+		if bytes.Equal(prefix, bip324.V1Prefix(common.Magic[:])) {
+			copy(c.recv.hdr[:], prefix)
+			c.recv.hdr_len = len(prefix)
+			common.CountSafe("V1TransportIn")
+			return true
+		}
+		if _, e = c.v2_handshake(prefix); e != nil {
+			common.CountSafe("V2HandshakeFail")
+			return false
+		}
+		common.CountSafe("V2TransportIn")
+		return true
+	}
+
+	if (c.PeerAddr.Services & SERVICE_P2P_V2) == 0 {
+		return true
+	}
+	got_data, e := c.v2_handshake(nil)
+	if e == nil {
+		common.CountSafe("V2TransportOut")
+		return true
+	}
+	if got_data {
+		common.CountSafe("V2HandshakeFail")
+		return false
+	}
+
+	// the peer has dropped us without saying anything - reconnect and try v1
+	common.CountSafe("V2Downgrade")
+	c.Conn.Close()
+	con, e := dial_peer(c.PeerAddr)
+	if e != nil {
+		return false
+	}
+	c.Mutex.Lock()
+	c.Conn = con
+	c.X.BytesReceived, c.X.BytesSent = 0, 0
+	c.Mutex.Unlock()
+	return true
+}
+
+
+// FetchMessage() for the encrypted transport
+func (c *OneConnection) fetch_v2_message() (ret *BCmsg, timeout_or_data bool) {
+	var e error
+	var n int
+
+	if c.recv.hdr_len < bip324.LENGTH_LEN {
+		n, e = common.SockRead(c.Conn, c.recv.hdr[c.recv.hdr_len:bip324.LENGTH_LEN])
+		if n < 0 {
+			n = 0
+		} else {
+			timeout_or_data = true
+		}
+		if n > 0 {
+			c.Mutex.Lock()
+			c.X.BytesReceived += uint64(n)
+			c.X.LastDataGot = time.Now()
+			c.recv.hdr_len += n
+			c.Mutex.Unlock()
+		}
+		if e != nil {
+			c.HandleError(e)
+			return
+		}
+		if c.MutexGetBool(&c.broken) || c.recv.hdr_len < bip324.LENGTH_LEN {
+			return
+		}
+		le := c.v2.DecryptLength(c.recv.hdr[:bip324.LENGTH_LEN])
+		if le > v2_max_packet() {
+			c.DoS("V2BigPacket")
+			return
+		}
+		c.Mutex.Lock()
+		c.recv.pl_len = uint32(le)
+		c.recv.dat = make([]byte, le)
+		c.recv.datlen = 0
+		c.Mutex.Unlock()
+	}
+
+	if c.recv.datlen < c.recv.pl_len {
+		n, e = common.SockRead(c.Conn, c.recv.dat[c.recv.datlen:])
+		if n < 0 {
+			n = 0
+		} else {
+			timeout_or_data = true
+		}
+		if n > 0 {
+			c.Mutex.Lock()
+			c.X.BytesReceived += uint64(n)
+			c.recv.datlen += uint32(n)
+			c.Mutex.Unlock()
+		}
+		if e != nil {
+			c.HandleError(e)
+			return
+		}
+		if c.MutexGetBool(&c.broken) || c.recv.datlen < c.recv.pl_len {
+			return
+		}
+	}
+
+	contents, ignore, e := c.v2.Decrypt(c.recv.dat, nil)
+	c.Mutex.Lock()
+	c.recv.hdr_len = 0
+	c.recv.dat = nil
+	c.Mutex.Unlock()
+	if e != nil {
+		common.CountSafe("V2BadPacket")
+		c.Disconnect("V2BadPacket")
+		return
+	}
+	if ignore {
+		common.CountSafe("V2DecoyRcvd")
+		return
+	}
+
+	ret = new(BCmsg)
+	if ret.cmd, ret.pl, e = bip324.DecodeMsg(contents); e != nil {
+		c.DoS("V2BadMsg")
+		return nil, timeout_or_data
+	}
+	if ret.cmd == "" {
+		common.CountSafe("V2UnknownMsgID")
+		return nil, timeout_or_data
+	}
+	if uint32(len(ret.pl)) > maxmsgsize(ret.cmd) {
+		c.DoS("Big-"+ret.cmd)
+		return nil, timeout_or_data
+	}
+	c.msg_received(ret)
+	return
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/pubsub"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/script"
@@ -42,6 +43,9 @@ var (
 	TransactionsToSendSize   uint64
 	TransactionsToSendWeight uint64
 
+	// SegWit txs from TransactionsToSend, indexed by wtxid (BIP339):
+	TransactionsToSendWTx map[BIDX]*OneTxToSend = make(map[BIDX]*OneTxToSend)
+
 	// All the outputs that are currently spent in TransactionsToSend:
 	SpentOutputs map[uint64]BIDX = make(map[uint64]BIDX)
 
@@ -49,7 +53,11 @@ var (
 	TransactionsRejected     map[BIDX]*OneTxRejected = make(map[BIDX]*OneTxRejected)
 	TransactionsRejectedSize uint64                  // only include those that have *Tx pointer set
 
+	// SegWit txs from TransactionsRejected, indexed by wtxid:
+	TransactionsRejectedWTx map[BIDX]*OneTxRejected = make(map[BIDX]*OneTxRejected)
+
 	// Transactions that are received from network (via "tx"), but not yet processed:
+	// (SegWit ones are also there by wtxid)
 	TransactionsPending map[BIDX]bool = make(map[BIDX]bool)
 
 	// Transactions that are waiting for inputs:
@@ -74,6 +82,7 @@ type OneTxToSend struct {
 
 type OneTxRejected struct {
 	Id *btc.Uint256
+	Wtxid *btc.Uint256 // only set for SegWit txs
 	time.Time
 	Size     uint32
 	Reason   byte
@@ -125,16 +134,48 @@ func ReasonToString(reason byte) string {
 	return fmt.Sprint("UNKNOWN_", reason)
 }
 
+// Returns true if the rejection might have been caused by the tx's witness data,
+// so another version of the same tx (with a different witness) may still be fine.
+func (tr *OneTxRejected) WitnessRelated() bool {
+	if tr.Wtxid == nil {
+		return false
+	}
+	switch tr.Reason {
+	case TX_REJECTED_TOO_BIG, TX_REJECTED_LOW_FEE, TX_REJECTED_RBF_LOWFEE:
+		return true
+	}
+	return false
+}
+
+// Make sure to call it with locked TxMutex.
+// Returns true if we have rejected this tx. wid is its wtxid, or nil if we only know the txid.
+func isRejected(id, wid *btc.Uint256) bool {
+	tr, ok := TransactionsRejected[id.BIdx()]
+	if !ok {
+		return false
+	}
+	if !tr.WitnessRelated() || wid != nil && wid.Equal(tr.Wtxid) {
+		return true
+	}
+	// do not let a malleated witness block the valid tx
+	common.CountSafe("TxRejectedWitnessRetry")
+	return false
+}
+
 func NeedThisTx(id *btc.Uint256, cb func()) (res bool) {
 	return NeedThisTxExt(id, cb) == 0
 }
 
 // Return false if we do not want to receive a data for this tx
 func NeedThisTxExt(id *btc.Uint256, cb func()) (why_not int) {
+	return needThisTx(id, nil, cb)
+}
+
+func needThisTx(id, wid *btc.Uint256, cb func()) (why_not int) {
 	TxMutex.Lock()
 	if _, present := TransactionsToSend[id.BIdx()]; present {
 		why_not = 1
-	} else if _, present := TransactionsRejected[id.BIdx()]; present {
+	} else if isRejected(id, wid) {
 		why_not = 2
 	} else if _, present := TransactionsPending[id.BIdx()]; present {
 		why_not = 3
@@ -152,12 +193,31 @@ func NeedThisTxExt(id *btc.Uint256, cb func()) (why_not int) {
 	return
 }
 
-// Handle tx-inv notifications
-func (c *OneConnection) TxInvNotify(hash []byte) {
-	if NeedThisTx(btc.NewUint256(hash), nil) {
+// Same as NeedThisTx, but for txs announced by wtxid (we cannot check the UTXO set then)
+func NeedThisWTx(wid *btc.Uint256) (res bool) {
+	bidx := wid.BIdx()
+	TxMutex.Lock()
+	// for non-SegWit txs, wtxid is the same as txid
+	res = TransactionsToSendWTx[bidx] == nil && TransactionsToSend[bidx] == nil &&
+		TransactionsRejectedWTx[bidx] == nil && TransactionsRejected[bidx] == nil && !TransactionsPending[bidx]
+	TxMutex.Unlock()
+	return
+}
+
+// Handle tx-inv notifications (typ is MSG_TX or MSG_WTX)
+func (c *OneConnection) TxInvNotify(typ uint32, hash []byte) {
+	var need bool
+	if typ == MSG_WTX {
+		need = NeedThisWTx(btc.NewUint256(hash))
+	} else {
+		need = NeedThisTx(btc.NewUint256(hash), nil)
+	}
+	if need {
 		var b [1 + 4 + 32]byte
 		b[0] = 1 // One inv
-		if (c.Node.Services & SERVICE_SEGWIT) != 0 {
+		if typ == MSG_WTX {
+			b[1] = MSG_WTX // BIP339
+		} else if (c.Node.Services & SERVICE_SEGWIT) != 0 {
 			binary.LittleEndian.PutUint32(b[1:5], MSG_WITNESS_TX) // SegWit Tx
 			//println(c.ConnID, "getdata", btc.NewUint256(hash).String())
 		} else {
@@ -177,6 +237,11 @@ func RejectTx(tx *btc.Tx, why byte) *OneTxRejected {
 	rec.Size = uint32(len(tx.Raw))
 	rec.Reason = why
 
+	bidx := tx.Hash.BIdx()
+	if _, ok := TransactionsRejected[bidx]; ok {
+		deleteRejected(bidx) // another version of the tx
+	}
+
 	// TODO: only store tx for selected reasons
 	if why >= 200 {
 		rec.Tx = tx
@@ -187,7 +252,11 @@ func RejectTx(tx *btc.Tx, why byte) *OneTxRejected {
 		rec.Id.Hash = tx.Hash.Hash
 	}
 
-	bidx := tx.Hash.BIdx()
+	if tx.SegWit != nil {
+		rec.Wtxid = new(btc.Uint256)
+		rec.Wtxid.Hash = tx.WTxID().Hash
+		TransactionsRejectedWTx[rec.Wtxid.BIdx()] = rec
+	}
 	TransactionsRejected[bidx] = rec
 
 	LimitRejectedSize()
@@ -222,12 +291,15 @@ func (c *OneConnection) ParseTxNet(pl []byte) {
 		return
 	}
 
-	NeedThisTx(&tx.Hash, func() {
+	needThisTx(&tx.Hash, tx.WTxID(), func() {
 		// This body is called with a locked TxMutex
 		tx.Raw = pl
 		select {
 		case NetTxs <- &TxRcvd{conn: c, Tx: tx, trusted: c.X.Authorized}:
 			TransactionsPending[tx.Hash.BIdx()] = true
+			if tx.SegWit != nil {
+				TransactionsPending[tx.WTxID().BIdx()] = true
+			}
 		default:
 			common.CountSafe("TxRejectedFullQ")
 			//println("NetTxsFULL")
@@ -249,6 +321,9 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 
 	TxMutex.Lock()
 
+	if tx.SegWit != nil {
+		delete(TransactionsPending, tx.WTxID().BIdx())
+	}
 	if !retry {
 		if _, present := TransactionsPending[tx.Hash.BIdx()]; !present {
 			// It had to be mined in the meantime, so just drop it now
@@ -355,6 +430,19 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 				}
 
 				if rej, ok := TransactionsRejected[btc.BIdx(tx.TxIn[i].Input.Hash[:])]; ok {
+					if rej.Reason == TX_REJECTED_LOW_FEE && rej.Tx != nil && !ntx.pkg {
+						// try it as a package - the child may pay for its parent
+						TxMutex.Unlock()
+						common.CountSafe("TxTryAsPackage")
+						if _, e := HandlePackage([]*btc.Tx{rej.Tx, tx}, ntx.conn, ntx.trusted, ntx.local); e == nil {
+							return true
+						}
+						TxMutex.Lock()
+						RejectTx(ntx.Tx, TX_REJECTED_NO_TXOU)
+						TxMutex.Unlock()
+						common.CountSafe("TxRejectedParentRej")
+						return
+					}
 					if rej.Reason != TX_REJECTED_NO_TXOU || rej.Waiting4 == nil {
 						RejectTx(ntx.Tx, TX_REJECTED_NO_TXOU)
 						TxMutex.Unlock()
@@ -424,10 +512,14 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 
 	// Check for a proper fee
 	fee := totinp - totout
-	if !ntx.local && fee < (uint64(tx.VSize())*common.MinFeePerKB()/1000)  { // do not check minimum fee for locally loaded txs
+	if !ntx.local && !ntx.pkg && fee < (uint64(tx.VSize())*common.MinFeePerKB()/1000)  { // do not check minimum fee for locally loaded txs
 		RejectTx(ntx.Tx, TX_REJECTED_LOW_FEE)
+		wtg := WaitingForInputs[tx.Hash.BIdx()]
 		TxMutex.Unlock()
 		common.CountSafe("TxRejectedLowFee")
+		if wtg != nil {
+			RetryWaitingForInput(wtg) // its children may pay for it
+		}
 		return
 	}
 
@@ -440,7 +532,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 			totfees += ctx.Fee
 		}
 
-		if !ntx.local && totfees*uint64(tx.Weight()) >= fee*uint64(totweight) {
+		if !ntx.local && !ntx.pkg && totfees*uint64(tx.Weight()) >= fee*uint64(totweight) {
 			RejectTx(ntx.Tx, TX_REJECTED_RBF_LOWFEE)
 			TxMutex.Unlock()
 			common.CountSafe("TxRejectedRBFLowFee")
@@ -454,12 +546,18 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		var wg sync.WaitGroup
 		var ver_err_cnt uint32
 
+		// The standard flags are stricter than the consensus ones, so the scripts valid with them
+		// are also valid in the next block and would not need to be verified again when it comes.
+		blk_flags := common.BlockChain.NextBlockFlags()
+		flags := script.STANDARD_VERIFY_FLAGS | blk_flags | script.VER_CACHE_STORE
+
 		prev_dbg_err := script.DBG_ERR
 		script.DBG_ERR = false // keep quiet for incorrect txs
+		tx.Spent_outputs = pos // needed by taproot inputs
 		for i := range tx.TxIn {
 			wg.Add(1)
 			go func(prv []byte, amount uint64, i int, tx *btc.Tx) {
-				if !script.VerifyTxScript(prv, amount, i, tx, script.STANDARD_VERIFY_FLAGS) {
+				if !script.VerifyTxScript(prv, amount, i, tx, flags) {
 					atomic.AddUint32(&ver_err_cnt, 1)
 				}
 				wg.Done()
@@ -469,6 +567,10 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		wg.Wait()
 		script.DBG_ERR = prev_dbg_err
 
+		if ver_err_cnt == 0 {
+			script.ScriptCacheAdd(tx, blk_flags)
+		}
+
 		if ver_err_cnt > 0 {
 			// not moving it to rejected, but baning the peer
 			TxMutex.Unlock()
@@ -503,6 +605,9 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		SigopsCost: uint64(sigops), Final: final, VerifyTime: time.Now().Sub(start_time)}
 
 	TransactionsToSend[tx.Hash.BIdx()] = rec
+	if tx.SegWit != nil {
+		TransactionsToSendWTx[tx.WTxID().BIdx()] = rec
+	}
 
 	if maxpoolsize := common.MaxMempoolSize(); maxpoolsize != 0 {
 		newsize := TransactionsToSendSize + uint64(len(rec.Raw))
@@ -526,12 +631,18 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 
 	TxMutex.Unlock()
 	common.CountSafe("TxAccepted")
+	pubsub.TxAdded(tx)
+
+	if frommem == nil && !ntx.local && !ntx.pkg {
+		// txs spending unconfirmed outputs (or paid for by a child) would mislead the fee estimator
+		feeEstimatorAdd(tx, fee)
+	}
 
 	if frommem != nil && !common.GetBool(&common.CFG.TXRoute.MemInputs) {
 		// By default Gocoin does not route txs that spend unconfirmed inputs
 		rec.Blocked = TX_REJECTED_NOT_MINED
 		common.CountSafe("TxRouteNotMined")
-	} else if !ntx.trusted && rec.isRoutable() {
+	} else if !ntx.trusted && !ntx.pkg && rec.isRoutable() {
 		// do not automatically route loacally loaded txs
 		rec.Invsentcnt += NetRouteInvExt(1, &tx.Hash, ntx.conn, 1000*fee/uint64(len(ntx.Raw)))
 		common.CountSafe("TxRouteOK")
@@ -549,6 +660,11 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 }
 
 func (rec *OneTxToSend) isRoutable() bool {
+	return rec.isRoutableFee(rec.Fee, rec.VSize())
+}
+
+// Same as isRoutable, but with the fee and vsize given (of the package that the tx is part of)
+func (rec *OneTxToSend) isRoutableFee(fee uint64, vsize int) bool {
 	if !common.CFG.TXRoute.Enabled {
 		common.CountSafe("TxRouteDisabled")
 		rec.Blocked = TX_REJECTED_DISABLED
@@ -559,7 +675,7 @@ func (rec *OneTxToSend) isRoutable() bool {
 		rec.Blocked = TX_REJECTED_TOO_BIG
 		return false
 	}
-	if rec.Fee < (uint64(rec.VSize()) * common.RouteMinFeePerKB() / 1000) {
+	if fee < (uint64(vsize) * common.RouteMinFeePerKB() / 1000) {
 		common.CountSafe("TxRouteLowFee")
 		rec.Blocked = TX_REJECTED_LOW_FEE
 		return false
@@ -583,6 +699,12 @@ func RetryWaitingForInput(wtg *OneWaitingList) {
 // Delete all the children as well if with_children is true
 // If reason is not zero, add the deleted txs to the rejected list
 func (tx *OneTxToSend) Delete(with_children bool, reason byte) {
+	tx.remove(with_children, reason)
+	pubsub.TxRemoved(&tx.Hash)
+}
+
+// Same as Delete, but without the notification (used for the txs that got mined)
+func (tx *OneTxToSend) remove(with_children bool, reason byte) {
 	if with_children {
 		// remove all the children that are spending from tx
 		var po btc.TxPrevOut
@@ -603,6 +725,10 @@ func (tx *OneTxToSend) Delete(with_children bool, reason byte) {
 	TransactionsToSendSize -= uint64(len(tx.Raw))
 	TransactionsToSendWeight -= uint64(tx.Weight())
 	delete(TransactionsToSend, tx.Hash.BIdx())
+	if tx.SegWit != nil {
+		delete(TransactionsToSendWTx, tx.WTxID().BIdx())
+	}
+	FeeEstimator.TxRemoved(tx.Hash.Hash)
 	if reason != 0 {
 		RejectTx(tx.Tx, reason)
 	}
@@ -645,6 +771,9 @@ func deleteRejected(bidx BIDX) {
 		if tr.Tx != nil {
 			TransactionsRejectedSize -= uint64(TransactionsRejected[bidx].Size)
 		}
+		if tr.Wtxid != nil {
+			delete(TransactionsRejectedWTx, tr.Wtxid.BIdx())
+		}
 		delete(TransactionsRejected, bidx)
 	}
 }
@@ -655,6 +784,34 @@ func RemoveFromRejected(hash *btc.Uint256) {
 	TxMutex.Unlock()
 }
 
+// Sets tx.Spent_outputs, looking for the inputs in the mempool and in the UTXO set.
+// It is left nil, if any of the inputs cannot be found.
+func SetSpentOutputs(tx *btc.Tx) {
+	if outs := GetSpentOutputs(tx); outs != nil {
+		tx.Spent_outputs = outs
+	}
+}
+
+// Returns the outputs spent by the tx (nil if any of them cannot be found), without modifying it.
+// Call it with TxMutex locked.
+func GetSpentOutputs(tx *btc.Tx) (outs []*btc.TxOut) {
+	outs = make([]*btc.TxOut, len(tx.TxIn))
+	for i := range tx.TxIn {
+		inp := &tx.TxIn[i].Input
+		if txinmem, ok := TransactionsToSend[btc.BIdx(inp.Hash[:])]; ok {
+			if int(inp.Vout) < len(txinmem.TxOut) {
+				outs[i] = txinmem.TxOut[inp.Vout]
+			}
+		} else {
+			outs[i] = common.BlockChain.Unspent.UnspentGet(inp)
+		}
+		if outs[i] == nil {
+			return nil
+		}
+	}
+	return
+}
+
 func SubmitLocalTx(tx *btc.Tx, rawtx []byte) bool {
 	return HandleNetTx(&TxRcvd{Tx: tx, trusted: true, local: true}, true)
 }
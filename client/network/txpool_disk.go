@@ -110,6 +110,7 @@ func MempoolLoad2() bool {
 	}
 
 	TransactionsToSend = make(map[BIDX]*OneTxToSend, int(totcnt))
+	TransactionsToSendWTx = make(map[BIDX]*OneTxToSend)
 	for ; totcnt > 0; totcnt-- {
 		le, er = btc.ReadVLen(rd)
 		if er != nil {
@@ -187,6 +188,9 @@ func MempoolLoad2() bool {
 		t2s.Tx.Fee = t2s.Fee
 
 		TransactionsToSend[t2s.Hash.BIdx()] = t2s
+		if t2s.SegWit != nil {
+			TransactionsToSendWTx[t2s.WTxID().BIdx()] = t2s
+		}
 		TransactionsToSendSize += uint64(len(t2s.Raw))
 		TransactionsToSendWeight += uint64(t2s.Weight())
 	}
@@ -242,6 +246,7 @@ func MempoolLoad2() bool {
 fatal_error:
 	fmt.Println("Error loading", MEMPOOL_FILE_NAME2, ":", er.Error())
 	TransactionsToSend = make(map[BIDX]*OneTxToSend)
+	TransactionsToSendWTx = make(map[BIDX]*OneTxToSend)
 	TransactionsToSendSize = 0
 	TransactionsToSendWeight = 0
 	SpentOutputs = make(map[uint64]BIDX)
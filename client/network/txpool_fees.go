@@ -0,0 +1,45 @@
+package network
+
+import (
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/feeest"
+)
+
+var (
+	// Learns from the mempool txs that get mined (see lib/feeest)
+	FeeEstimator *feeest.Estimator = feeest.NewEstimator()
+)
+
+// Starts tracking a tx that has just been accepted to the mempool
+func feeEstimatorAdd(tx *btc.Tx, fee uint64) {
+	if !common.GetBool(&common.BlockChainSynchronized) {
+		return // we would not know when the tx really entered the mempool
+	}
+	FeeEstimator.TxAdded(tx.Hash.Hash, common.Last.BlockHeight(), 1000*fee/uint64(tx.VSize()))
+}
+
+// Feeds the estimator with txs of a new block
+func feeEstimatorBlock(bl *btc.Block) {
+	txids := make([][32]byte, len(bl.Txs)-1)
+	for i := 1; i < len(bl.Txs); i++ {
+		txids[i-1] = bl.Txs[i].Hash.Hash
+	}
+	FeeEstimator.BlockConnected(bl.Height, txids)
+}
+
+// Returns fee (in satoshis per 1000 vbytes) that should get a tx confirmed within the given number
+// of blocks, based on the txs that we saw getting mined. It is never lower than the current minimum fee.
+// Returns ok=false if the estimator does not have enough data yet.
+func EstimateFee(blocks uint32, conservative bool) (spkb uint64, ok bool) {
+	certainty := feeest.CERTAINTY_ECONOMICAL
+	if conservative {
+		certainty = feeest.CERTAINTY_CONSERVATIVE
+	}
+	if spkb, ok = FeeEstimator.Estimate(blocks, certainty); ok {
+		if min := common.MinFeePerKB(); spkb < min {
+			spkb = min
+		}
+	}
+	return
+}
@@ -58,7 +58,7 @@ func tx_mined(tx *btc.Tx) (wtg *OneWaitingList) {
 	if rec, ok := TransactionsToSend[h.BIdx()]; ok {
 		common.CountSafe("TxMinedToSend")
 		rec.UnMarkChildrenForMem()
-		rec.Delete(false, 0)
+		rec.remove(false, 0)
 	}
 	if mr, ok := TransactionsRejected[h.BIdx()]; ok {
 		if mr.Tx != nil {
@@ -100,6 +100,7 @@ func tx_mined(tx *btc.Tx) (wtg *OneWaitingList) {
 
 // Removes all the block's tx from the mempool
 func BlockMined(bl *btc.Block) {
+	feeEstimatorBlock(bl) // must go before the txs get removed from mempool
 	wtgs := make([]*OneWaitingList, len(bl.Txs)-1)
 	var wtg_cnt int
 	TxMutex.Lock()
@@ -0,0 +1,238 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Package acceptance: a child with its unconfirmed parents, evaluated by the aggregate feerate,
+// so a high fee child can pay for its below-minfee parents (CPFP).
+
+const (
+	MAX_PACKAGE_COUNT  = 25
+	MAX_PACKAGE_WEIGHT = 404000
+)
+
+type PackageResult struct {
+	Txs      []*OneTxToSend // records of the package txs in the mempool (also those that were there before)
+	Fee      uint64         // of the txs that were not in the mempool yet
+	VSize    int            // of the txs that were not in the mempool yet
+	Replaced []*btc.Uint256 // txids of the mempool txs that got replaced
+}
+
+// Checks if txs is a child (the last one) with its parents, sorted topologically
+func checkPackage(txs []*btc.Tx) error {
+	if len(txs) == 0 || len(txs) > MAX_PACKAGE_COUNT {
+		return errors.New("Package: bad number of transactions")
+	}
+	var weight int
+	ids := make(map[BIDX]int, len(txs))
+	for i, tx := range txs {
+		weight += tx.Weight()
+		ids[tx.Hash.BIdx()] = i
+	}
+	if weight > MAX_PACKAGE_WEIGHT {
+		return errors.New("Package: too big")
+	}
+	if len(ids) != len(txs) {
+		return errors.New("Package: duplicate transactions")
+	}
+
+	child := txs[len(txs)-1]
+	parents := make(map[BIDX]bool, len(child.TxIn))
+	for i := range child.TxIn {
+		parents[btc.BIdx(child.TxIn[i].Input.Hash[:])] = true
+	}
+	spent := make(map[uint64]bool)
+	for i, tx := range txs {
+		if i < len(txs)-1 && !parents[tx.Hash.BIdx()] {
+			return errors.New("Package: not a child with its parents")
+		}
+		for j := range tx.TxIn {
+			if idx, ok := ids[btc.BIdx(tx.TxIn[j].Input.Hash[:])]; ok && idx >= i {
+				return errors.New("Package: not sorted")
+			}
+			uidx := tx.TxIn[j].Input.UIdx()
+			if spent[uidx] {
+				return errors.New("Package: conflicting transactions")
+			}
+			spent[uidx] = true
+		}
+	}
+	return nil
+}
+
+// Make sure to call it with locked TxMutex.
+// Checks the package's aggregate fee and the package RBF rules.
+// Returns the txs that are not in the mempool yet.
+func checkPackageFee(txs []*btc.Tx, trusted bool, res *PackageResult) (todo []*btc.Tx, e error) {
+	ids := make(map[BIDX]*btc.Tx, len(txs))
+	for _, tx := range txs {
+		ids[tx.Hash.BIdx()] = tx
+	}
+
+	var conflicts, parents map[*OneTxToSend]bool
+	for _, tx := range txs {
+		if _, ok := TransactionsToSend[tx.Hash.BIdx()]; ok {
+			continue
+		}
+		var totinp, totout uint64
+		for i := range tx.TxIn {
+			inp := &tx.TxIn[i].Input
+			var out *btc.TxOut
+			if ptx, ok := ids[btc.BIdx(inp.Hash[:])]; ok {
+				if int(inp.Vout) < len(ptx.TxOut) {
+					out = ptx.TxOut[inp.Vout]
+				}
+			} else if t2s, ok := TransactionsToSend[btc.BIdx(inp.Hash[:])]; ok {
+				if int(inp.Vout) < len(t2s.TxOut) {
+					out = t2s.TxOut[inp.Vout]
+				}
+				if parents == nil {
+					parents = make(map[*OneTxToSend]bool)
+				}
+				parents[t2s] = true
+			} else {
+				out = common.BlockChain.Unspent.UnspentGet(inp)
+			}
+			if out == nil {
+				e = fmt.Errorf("Package: %s has a missing input", tx.Hash.String())
+				return
+			}
+			totinp += out.Value
+
+			if so, ok := SpentOutputs[inp.UIdx()]; ok {
+				ctx := TransactionsToSend[so]
+				if conflicts == nil {
+					conflicts = make(map[*OneTxToSend]bool)
+				}
+				conflicts[ctx] = true
+				for _, ch := range ctx.GetAllChildren() {
+					conflicts[ch] = true
+				}
+			}
+		}
+		for i := range tx.TxOut {
+			totout += tx.TxOut[i].Value
+		}
+		if totout > totinp {
+			e = fmt.Errorf("Package: %s spends more than it has", tx.Hash.String())
+			return
+		}
+		res.Fee += totinp - totout
+		res.VSize += tx.VSize()
+		todo = append(todo, tx)
+	}
+
+	if len(todo) == 0 {
+		return
+	}
+
+	if res.Fee < uint64(res.VSize)*common.MinFeePerKB()/1000 {
+		e = errors.New("Package: fee too low")
+		return
+	}
+
+	if conflicts != nil {
+		// Package RBF: the package must pay more and at a higher feerate than all the txs it replaces
+		var totvsize int
+		var totfees uint64
+		for ctx := range conflicts {
+			if parents[ctx] {
+				e = errors.New("Package: spends from a tx it replaces")
+				return
+			}
+			if !trusted && ctx.Final {
+				e = errors.New("Package: " + ReasonToString(TX_REJECTED_RBF_FINAL))
+				return
+			}
+			totvsize += ctx.VSize()
+			totfees += ctx.Fee
+		}
+		if !trusted && len(conflicts) > 100 {
+			e = errors.New("Package: " + ReasonToString(TX_REJECTED_RBF_100))
+			return
+		}
+		if totfees >= res.Fee || totfees*uint64(res.VSize) >= res.Fee*uint64(totvsize) {
+			e = errors.New("Package: " + ReasonToString(TX_REJECTED_RBF_LOWFEE))
+			return
+		}
+		for ctx := range conflicts {
+			res.Replaced = append(res.Replaced, &ctx.Hash)
+		}
+	}
+	return
+}
+
+// Must be called from the chain's thread.
+// Accepts the package into mempool, or none of its txs that would not pay enough fee on their own.
+func HandlePackage(txs []*btc.Tx, conn *OneConnection, trusted, local bool) (res *PackageResult, e error) {
+	if e = checkPackage(txs); e != nil {
+		return
+	}
+
+	res = new(PackageResult)
+	TxMutex.Lock()
+	todo, e := checkPackageFee(txs, trusted, res)
+	TxMutex.Unlock()
+	if e != nil {
+		common.CountSafe("TxPkgRejected")
+		return
+	}
+
+	var done []*btc.Tx
+	for _, tx := range todo {
+		if !HandleNetTx(&TxRcvd{conn: conn, Tx: tx, trusted: trusted, local: local, pkg: true}, true) {
+			e = fmt.Errorf("Package: %s not accepted", tx.Hash.String())
+			break
+		}
+		done = append(done, tx)
+	}
+
+	TxMutex.Lock()
+	if e != nil {
+		// remove those that do not pay enough on their own (with their children)
+		for _, tx := range done {
+			if rec, ok := TransactionsToSend[tx.Hash.BIdx()]; ok {
+				if rec.Fee < uint64(rec.VSize())*common.MinFeePerKB()/1000 {
+					rec.Delete(true, TX_REJECTED_LOW_FEE)
+				}
+			}
+		}
+		TxMutex.Unlock()
+		common.CountSafe("TxPkgFailed")
+		return
+	}
+	var recs []*OneTxToSend
+	for _, tx := range txs {
+		if rec, ok := TransactionsToSend[tx.Hash.BIdx()]; ok {
+			res.Txs = append(res.Txs, rec)
+		}
+	}
+	for _, tx := range done {
+		if rec, ok := TransactionsToSend[tx.Hash.BIdx()]; ok && rec.Blocked == 0 {
+			recs = append(recs, rec)
+		}
+	}
+	TxMutex.Unlock()
+	common.CountSafe("TxPkgAccepted")
+
+	if !trusted {
+		// route the new txs by the package feerate
+		fee_spkb := 1000 * res.Fee / uint64(res.VSize)
+		for _, rec := range recs {
+			if rec.isRoutableFee(res.Fee, res.VSize) {
+				rec.Invsentcnt += NetRouteInvExt(MSG_TX, &rec.Hash, conn, fee_spkb)
+				common.CountSafe("TxRouteOK")
+			}
+		}
+	}
+	return
+}
+
+// Same as SubmitLocalTx, but for a child with its parents
+func SubmitLocalPackage(txs []*btc.Tx) (*PackageResult, error) {
+	return HandlePackage(txs, nil, true, true)
+}
@@ -33,6 +33,7 @@ type TxRcvd struct {
 	conn *OneConnection
 	*btc.Tx
 	trusted, local bool
+	pkg bool // part of a package - its fee has been checked for the whole package
 }
 
 type OneBlockToGet struct {
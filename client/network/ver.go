@@ -19,7 +19,18 @@ func (c *OneConnection) SendVersion() {
 	b := bytes.NewBuffer([]byte{})
 
 	binary.Write(b, binary.LittleEndian, uint32(common.Version))
-	binary.Write(b, binary.LittleEndian, uint64(common.Services))
+	services := common.Services
+	if common.BlockChain.BlockFiltersReady() {
+		services |= SERVICE_COMPACT_FILTERS
+	}
+	if common.GetBool(&common.CFG.Net.V2Transport) {
+		services |= SERVICE_P2P_V2
+	}
+	if common.BlockChain.SnapshotPending() || common.BlockChain.Blocks.PruneEnabled() {
+		// we cannot serve the blocks below the UTXO snapshot yet, or the pruned ones
+		services = (services &^ SERVICE_NETWORK) | SERVICE_NETWORK_LIMITED
+	}
+	binary.Write(b, binary.LittleEndian, uint64(services))
 	binary.Write(b, binary.LittleEndian, uint64(time.Now().Unix()))
 
 	b.Write(c.PeerAddr.NetAddr.Bytes())
@@ -87,7 +98,8 @@ func (c *OneConnection) HandleVersion(pl []byte) error {
 		c.Node.Timestamp = binary.LittleEndian.Uint64(pl[12:20])
 		c.Node.ReportedIp4 = binary.BigEndian.Uint32(pl[40:44])
 
-		use_this_ip := sys.ValidIp4(pl[40:44])
+		// via proxy the peer sees the proxy's address, not ours
+		use_this_ip := !c.X.Proxied && sys.ValidIp4(pl[40:44])
 
 		if len(pl) >= 82 {
 			le, of := btc.VLen(pl[80:])
@@ -178,6 +190,10 @@ func (c *OneConnection) HandleVersion(pl []byte) error {
 	} else {
 		return errors.New("version message too short")
 	}
+	if c.Node.Version >= 70016 {
+		c.SendRawMsg("wtxidrelay", nil) // BIP339: it must come before verack
+		c.SendRawMsg("sendaddrv2", nil) // BIP155: it must come before verack
+	}
 	c.SendRawMsg("verack", []byte{})
 	return nil
 }
@@ -0,0 +1,228 @@
+// Package pubsub publishes real-time notifications about new blocks and memory pool transactions,
+// using the same topics and message format as Bitcoin Core's ZMQ interface.
+// The messages can be received over a ZMQ-compatible (ZMTP 3.0) TCP socket or a WebSocket.
+package pubsub
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+const (
+	TOPIC_HASHBLOCK = "hashblock"
+	TOPIC_RAWBLOCK  = "rawblock"
+	TOPIC_HASHTX    = "hashtx"
+	TOPIC_RAWTX     = "rawtx"
+	TOPIC_SEQUENCE  = "sequence"
+
+	// Labels of the "sequence" topic's messages
+	SEQ_BLOCK_CONNECTED    = 'C'
+	SEQ_BLOCK_DISCONNECTED = 'D'
+	SEQ_TX_ADDED           = 'A'
+	SEQ_TX_REMOVED         = 'R'
+
+	EVENTS_QUEUE_LEN     = 10000
+	SUBSCRIBER_QUEUE_LEN = 1000
+)
+
+// A single message, as published over ZMQ
+type message struct {
+	topic string
+	body  []byte
+	seq   uint32 // per topic
+}
+
+type subscriber struct {
+	sync.Mutex
+	prefixes map[string]int // subscribed topic prefixes (with reference counters)
+	queue    chan *message
+}
+
+var (
+	events    = make(chan *message, EVENTS_QUEUE_LEN)
+	subs_cnt  int32 // so we can quickly skip building the messages if there is nobody to get them
+	subs_lock sync.Mutex
+	subs      = make(map[*subscriber]bool)
+	seqs      = make(map[string]uint32)
+
+	mempool_seq uint64 // incremented each time a tx is added to or removed from the memory pool
+)
+
+// Starts the ZMQ publisher and the events dispatcher, as configured in common.CFG.Notify
+func Start() {
+	go dispatcher()
+	if iface := common.CFG.Notify.Interface; iface != "" {
+		start_zmq(iface)
+	}
+}
+
+func new_subscriber() (s *subscriber) {
+	s = &subscriber{prefixes: make(map[string]int), queue: make(chan *message, SUBSCRIBER_QUEUE_LEN)}
+	subs_lock.Lock()
+	subs[s] = true
+	subs_lock.Unlock()
+	atomic.AddInt32(&subs_cnt, 1)
+	return
+}
+
+func (s *subscriber) close() {
+	subs_lock.Lock()
+	delete(subs, s)
+	subs_lock.Unlock()
+	atomic.AddInt32(&subs_cnt, -1)
+}
+
+func (s *subscriber) subscribe(prefix string) {
+	s.Lock()
+	s.prefixes[prefix]++
+	s.Unlock()
+}
+
+func (s *subscriber) unsubscribe(prefix string) {
+	s.Lock()
+	if s.prefixes[prefix] > 1 {
+		s.prefixes[prefix]--
+	} else {
+		delete(s.prefixes, prefix)
+	}
+	s.Unlock()
+}
+
+func (s *subscriber) wants(topic string) bool {
+	s.Lock()
+	defer s.Unlock()
+	for pref := range s.prefixes {
+		if strings.HasPrefix(topic, pref) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any of the subscribers is interested in the topic
+func wanted(topic string) bool {
+	if atomic.LoadInt32(&subs_cnt) == 0 {
+		return false
+	}
+	subs_lock.Lock()
+	defer subs_lock.Unlock()
+	for s := range subs {
+		if s.wants(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues the message for the dispatcher. It never blocks the caller.
+func publish(topic string, body []byte) {
+	select {
+	case events <- &message{topic: topic, body: body}:
+	default:
+		common.CountSafe("PubSubQueueFull")
+	}
+}
+
+// Numbers the messages and passes them to the subscribers.
+// A subscriber that does not read its messages fast enough, misses them.
+func dispatcher() {
+	for msg := range events {
+		msg.seq = seqs[msg.topic]
+		seqs[msg.topic]++
+		subs_lock.Lock()
+		for s := range subs {
+			if s.wants(msg.topic) {
+				select {
+				case s.queue <- msg:
+				default:
+					common.CountSafe("PubSubDropped")
+				}
+			}
+		}
+		subs_lock.Unlock()
+	}
+}
+
+// Hashes are published in the reversed byte order (as they are displayed)
+func hash_body(h *btc.Uint256) []byte {
+	b := make([]byte, 32)
+	for i := range b {
+		b[i] = h.Hash[31-i]
+	}
+	return b
+}
+
+func sequence_body(h *btc.Uint256, label byte, mpseq uint64) []byte {
+	b := append(hash_body(h), label)
+	if label == SEQ_TX_ADDED || label == SEQ_TX_REMOVED {
+		var tmp [8]byte
+		binary.LittleEndian.PutUint64(tmp[:], mpseq)
+		b = append(b, tmp[:]...)
+	}
+	return b
+}
+
+func block_event(bl *btc.Block, label byte) {
+	if label == SEQ_BLOCK_CONNECTED {
+		if wanted(TOPIC_HASHBLOCK) {
+			publish(TOPIC_HASHBLOCK, hash_body(bl.Hash))
+		}
+		if wanted(TOPIC_RAWBLOCK) {
+			publish(TOPIC_RAWBLOCK, bl.Raw)
+		}
+		hashtx, rawtx := wanted(TOPIC_HASHTX), wanted(TOPIC_RAWTX)
+		for _, tx := range bl.Txs {
+			if hashtx {
+				publish(TOPIC_HASHTX, hash_body(&tx.Hash))
+			}
+			if rawtx {
+				publish(TOPIC_RAWTX, tx.Raw)
+			}
+		}
+	}
+	if wanted(TOPIC_SEQUENCE) {
+		publish(TOPIC_SEQUENCE, sequence_body(bl.Hash, label, 0))
+	}
+}
+
+// Call it when a block has been connected to the main chain (with its txs list built)
+func BlockConnected(bl *btc.Block) {
+	block_event(bl, SEQ_BLOCK_CONNECTED)
+}
+
+// Call it when a block has been disconnected from the main chain (during a reorg)
+func BlockDisconnected(bl *btc.Block) {
+	block_event(bl, SEQ_BLOCK_DISCONNECTED)
+}
+
+// Call it when a transaction has been accepted to the memory pool
+func TxAdded(tx *btc.Tx) {
+	mpseq := atomic.AddUint64(&mempool_seq, 1)
+	if wanted(TOPIC_HASHTX) {
+		publish(TOPIC_HASHTX, hash_body(&tx.Hash))
+	}
+	if wanted(TOPIC_RAWTX) {
+		publish(TOPIC_RAWTX, tx.Raw)
+	}
+	if wanted(TOPIC_SEQUENCE) {
+		publish(TOPIC_SEQUENCE, sequence_body(&tx.Hash, SEQ_TX_ADDED, mpseq))
+	}
+}
+
+// Call it when a transaction has been removed from the memory pool for any reason other than being mined
+func TxRemoved(txid *btc.Uint256) {
+	mpseq := atomic.AddUint64(&mempool_seq, 1)
+	if wanted(TOPIC_SEQUENCE) {
+		publish(TOPIC_SEQUENCE, sequence_body(txid, SEQ_TX_REMOVED, mpseq))
+	}
+}
+
+// Returns the number of the currently connected subscribers
+func Subscribers() int {
+	return int(atomic.LoadInt32(&subs_cnt))
+}
@@ -0,0 +1,214 @@
+package pubsub
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// A minimal WebSocket (RFC 6455) server side, only sending text messages.
+// Each message is a JSON object with the topic, its sequence number and the body.
+
+const (
+	ws_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	ws_op_text  = 0x1
+	ws_op_close = 0x8
+	ws_op_ping  = 0x9
+	ws_op_pong  = 0xa
+
+	ws_max_frame = 1e4 // we do not expect anything bigger from a client
+)
+
+const WS_DEFAULT_TOPICS = TOPIC_HASHBLOCK + "," + TOPIC_HASHTX + "," + TOPIC_SEQUENCE
+
+type ws_message struct {
+	Topic      string  `json:"topic"`
+	Seq        uint32  `json:"seq"`
+	Hash       string  `json:"hash,omitempty"`
+	Hex        string  `json:"hex,omitempty"`
+	Label      string  `json:"label,omitempty"`
+	MempoolSeq *uint64 `json:"mempool_seq,omitempty"`
+}
+
+func ws_json(msg *message) []byte {
+	m := &ws_message{Topic: msg.topic, Seq: msg.seq}
+	switch msg.topic {
+	case TOPIC_HASHBLOCK, TOPIC_HASHTX:
+		m.Hash = hex.EncodeToString(msg.body)
+	case TOPIC_SEQUENCE:
+		m.Hash = hex.EncodeToString(msg.body[:32])
+		m.Label = string(msg.body[32:33])
+		if len(msg.body) == 41 {
+			mpseq := binary.LittleEndian.Uint64(msg.body[33:41])
+			m.MempoolSeq = &mpseq
+		}
+	default:
+		m.Hex = hex.EncodeToString(msg.body)
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+func ws_write_frame(wr io.Writer, opcode byte, data []byte) (er error) {
+	var hdr [10]byte
+	hdr[0] = 0x80 | opcode // FIN
+	n := 2
+	switch {
+	case len(data) < 126:
+		hdr[1] = byte(len(data))
+	case len(data) <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(len(data)))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:10], uint64(len(data)))
+		n = 10
+	}
+	if _, er = wr.Write(hdr[:n]); er == nil {
+		_, er = wr.Write(data)
+	}
+	return
+}
+
+// Reads a single frame from the client (client frames are always masked)
+func ws_read_frame(rd io.Reader) (opcode byte, data []byte, er error) {
+	var hdr [8]byte
+	if _, er = io.ReadFull(rd, hdr[:2]); er != nil {
+		return
+	}
+	opcode = hdr[0] & 0x0f
+	masked := (hdr[1] & 0x80) != 0
+	size := uint64(hdr[1] & 0x7f)
+	if size == 126 {
+		if _, er = io.ReadFull(rd, hdr[:2]); er != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	} else if size == 127 {
+		if _, er = io.ReadFull(rd, hdr[:8]); er != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(hdr[:8])
+	}
+	if size > ws_max_frame {
+		er = io.ErrShortBuffer
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, er = io.ReadFull(rd, mask[:]); er != nil {
+			return
+		}
+	}
+	data = make([]byte, size)
+	if _, er = io.ReadFull(rd, data); er != nil {
+		return
+	}
+	if masked {
+		for i := range data {
+			data[i] ^= mask[i&3]
+		}
+	}
+	return
+}
+
+// Upgrades the HTTP connection to a WebSocket and sends the events to it, until it gets closed.
+// The topics are taken from a comma separated "topics" URL parameter (WS_DEFAULT_TOPICS if not given).
+func ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "WebSocket connection expected", http.StatusBadRequest)
+		return
+	}
+	if uint(Subscribers()) >= common.CFG.Notify.MaxClients {
+		common.CountSafe("PubSubTooMany")
+		http.Error(w, "Too many subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, er := hj.Hijack()
+	if er != nil {
+		return
+	}
+	defer conn.Close()
+
+	sha := sha1.Sum([]byte(key + ws_guid))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sha[:]) + "\r\n\r\n")
+	if brw.Flush() != nil {
+		return
+	}
+	common.CountSafe("PubSubWsConnect")
+
+	topics := r.URL.Query().Get("topics")
+	if topics == "" {
+		topics = WS_DEFAULT_TOPICS
+	}
+	s := new_subscriber()
+	defer s.close()
+	for _, t := range strings.Split(topics, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			s.subscribe(t)
+		}
+	}
+
+	// the reader only answers pings and detects closing of the connection
+	pongs := make(chan []byte, 1)
+	closed := make(chan bool)
+	go ws_reader(brw.Reader, pongs, closed)
+
+	wr := bufio.NewWriter(conn)
+	for {
+		var er error
+		select {
+		case msg := <-s.queue:
+			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			if er = ws_write_frame(wr, ws_op_text, ws_json(msg)); er == nil && len(s.queue) == 0 {
+				er = wr.Flush()
+			}
+		case data := <-pongs:
+			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			if er = ws_write_frame(wr, ws_op_pong, data); er == nil {
+				er = wr.Flush()
+			}
+		case <-closed:
+			ws_write_frame(wr, ws_op_close, nil)
+			wr.Flush()
+			return
+		}
+		if er != nil {
+			return
+		}
+	}
+}
+
+func ws_reader(rd *bufio.Reader, pongs chan []byte, closed chan bool) {
+	defer close(closed)
+	for {
+		op, data, er := ws_read_frame(rd)
+		if er != nil || op == ws_op_close {
+			return
+		}
+		if op == ws_op_ping {
+			select {
+			case pongs <- data:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// ZMTP 3.0 (the ZMQ wire protocol) with NULL security mechanism, for a PUB socket.
+// See https://rfc.zeromq.org/spec/23/
+
+const (
+	zmtp_more    = 0x01
+	zmtp_long    = 0x02
+	zmtp_command = 0x04
+
+	zmtp_max_frame = 1e4 // we do not expect anything bigger from a subscriber
+)
+
+func start_zmq(iface string) {
+	ln, er := net.Listen("tcp", iface)
+	if er != nil {
+		println("Notify:", er.Error())
+		return
+	}
+	fmt.Println("Starting ZMQ publisher at", iface)
+	go func() {
+		for {
+			conn, er := ln.Accept()
+			if er != nil {
+				println("Notify:", er.Error())
+				return
+			}
+			if uint(Subscribers()) >= common.CFG.Notify.MaxClients {
+				common.CountSafe("PubSubTooMany")
+				conn.Close()
+				continue
+			}
+			go zmq_serve(conn)
+		}
+	}()
+}
+
+func zmtp_greeting() []byte {
+	g := make([]byte, 64)
+	g[0] = 0xff
+	g[9] = 0x7f
+	g[10] = 3 // version 3.0
+	copy(g[12:32], "NULL")
+	return g
+}
+
+func zmtp_write_frame(wr io.Writer, flags byte, body []byte) (er error) {
+	var hdr [9]byte
+	hdr[0] = flags
+	if len(body) > 255 {
+		hdr[0] |= zmtp_long
+		binary.BigEndian.PutUint64(hdr[1:9], uint64(len(body)))
+		_, er = wr.Write(hdr[:9])
+	} else {
+		hdr[1] = byte(len(body))
+		_, er = wr.Write(hdr[:2])
+	}
+	if er == nil {
+		_, er = wr.Write(body)
+	}
+	return
+}
+
+func zmtp_read_frame(rd io.Reader) (flags byte, body []byte, er error) {
+	var hdr [8]byte
+	if _, er = io.ReadFull(rd, hdr[:1]); er != nil {
+		return
+	}
+	flags = hdr[0]
+	var size uint64
+	if (flags & zmtp_long) != 0 {
+		if _, er = io.ReadFull(rd, hdr[:8]); er != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(hdr[:8])
+	} else {
+		if _, er = io.ReadFull(rd, hdr[:1]); er != nil {
+			return
+		}
+		size = uint64(hdr[0])
+	}
+	if size > zmtp_max_frame {
+		er = errors.New("frame too big")
+		return
+	}
+	body = make([]byte, size)
+	_, er = io.ReadFull(rd, body)
+	return
+}
+
+// Returns the command's name and data (or empty name if the body is not a valid command)
+func zmtp_command_name(body []byte) (name string, data []byte) {
+	if len(body) > 0 && int(body[0]) < len(body) {
+		name = string(body[1 : 1+body[0]])
+		data = body[1+body[0]:]
+	}
+	return
+}
+
+func zmtp_ready_command() []byte {
+	b := new(bytes.Buffer)
+	b.WriteByte(5)
+	b.WriteString("READY")
+	b.WriteByte(11)
+	b.WriteString("Socket-Type")
+	binary.Write(b, binary.BigEndian, uint32(3))
+	b.WriteString("PUB")
+	return b.Bytes()
+}
+
+// Returns the value of the given property from READY command's metadata
+func zmtp_property(data []byte, name string) (val string, ok bool) {
+	for len(data) > 0 {
+		nl := int(data[0])
+		if len(data) < 1+nl+4 {
+			return
+		}
+		n := string(data[1 : 1+nl])
+		vl := int(binary.BigEndian.Uint32(data[1+nl : 5+nl]))
+		data = data[5+nl:]
+		if vl > len(data) {
+			return
+		}
+		if n == name {
+			return string(data[:vl]), true
+		}
+		data = data[vl:]
+	}
+	return
+}
+
+func zmq_handshake(conn net.Conn, rd io.Reader) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, er := conn.Write(zmtp_greeting()); er != nil {
+		return er
+	}
+	peer := make([]byte, 64)
+	if _, er := io.ReadFull(rd, peer); er != nil {
+		return er
+	}
+	if peer[0] != 0xff || (peer[9]&1) == 0 || peer[10] < 3 || string(bytes.TrimRight(peer[12:32], "\x00")) != "NULL" {
+		return errors.New("unsupported greeting")
+	}
+	if er := zmtp_write_frame(conn, zmtp_command, zmtp_ready_command()); er != nil {
+		return er
+	}
+	flags, body, er := zmtp_read_frame(rd)
+	if er != nil {
+		return er
+	}
+	name, data := zmtp_command_name(body)
+	if (flags&zmtp_command) == 0 || name != "READY" {
+		return errors.New("READY command expected")
+	}
+	if st, _ := zmtp_property(data, "Socket-Type"); st != "SUB" && st != "XSUB" {
+		return errors.New("unsupported socket type " + st)
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+func zmq_serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	if er := zmq_handshake(conn, rd); er != nil {
+		common.CountSafe("PubSubZmqHandshakeErr")
+		return
+	}
+	common.CountSafe("PubSubZmqConnect")
+
+	s := new_subscriber()
+	defer s.close()
+
+	done := make(chan bool)
+	go func() {
+		wr := bufio.NewWriter(conn)
+		var seq [4]byte
+		for {
+			select {
+			case msg := <-s.queue:
+				binary.LittleEndian.PutUint32(seq[:], msg.seq)
+				conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+				if zmtp_write_frame(wr, zmtp_more, []byte(msg.topic)) != nil ||
+					zmtp_write_frame(wr, zmtp_more, msg.body) != nil ||
+					zmtp_write_frame(wr, 0, seq[:]) != nil {
+					conn.Close()
+					return
+				}
+				if len(s.queue) == 0 && wr.Flush() != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	// ZMTP 3.0 subscribers send subscriptions as messages, while 3.1 ones may use commands
+	var cont bool // the frame is a continuation of a multi-part message
+	for {
+		flags, body, er := zmtp_read_frame(rd)
+		if er != nil {
+			return
+		}
+		if (flags & zmtp_command) != 0 {
+			switch name, data := zmtp_command_name(body); name {
+			case "SUBSCRIBE":
+				s.subscribe(string(data))
+			case "CANCEL":
+				s.unsubscribe(string(data))
+			}
+			continue
+		}
+		if !cont && (flags&zmtp_more) == 0 && len(body) > 0 {
+			switch body[0] {
+			case 1:
+				s.subscribe(string(body[1:]))
+			case 0:
+				s.unsubscribe(string(body[1:]))
+			}
+		}
+		cont = (flags & zmtp_more) != 0
+	}
+}
@@ -1,9 +1,11 @@
 package rpcapi
 
 import (
+	"sort"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/lib/btc"
-	//"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/client/common"
 )
 
 /*
@@ -45,3 +47,164 @@ func ValidateAddress(addr string) (interface{}) {
 	//res.IsWatchOnly = false
 	//res.IsScript = false
 }
+
+
+type AddressDeltaResp struct {
+	Satoshis int64  `json:"satoshis"`
+	Txid     string `json:"txid"`
+	Index    uint32 `json:"index"`
+	Height   uint32 `json:"height"`
+	Address  string `json:"address"`
+}
+
+type AddressBalanceResp struct {
+	Balance  uint64 `json:"balance"`
+	Received uint64 `json:"received"`
+}
+
+type AddressUtxoResp struct {
+	Address     string `json:"address"`
+	Txid        string `json:"txid"`
+	OutputIndex uint32 `json:"outputIndex"`
+	Script      string `json:"script"`
+	Satoshis    uint64 `json:"satoshis"`
+	Height      uint32 `json:"height"`
+}
+
+type address_hist struct {
+	addr  string
+	pkscr []byte
+	recs  []*chain.AddrHistRec
+}
+
+// Reads the "addresses" parameter (a string, an array of strings or {"addresses":[...]})
+// and fetches the history of each address from the address index.
+func address_params(cmd *RpcCommand, resp *RpcResponse) (res []address_hist, ok bool) {
+	if common.BlockChain.AddrIdx == nil {
+		resp.Error = RpcError{Code: RPC_MISC_ERROR, Message: "Address index not enabled (use -addrindex)"}
+		return
+	}
+	par, ok := cmd.GetParams(resp, 1, "addresses")
+	if !ok {
+		return
+	}
+	ok = false
+	v := par[0]
+	if m, is_map := v.(map[string]interface{}); is_map {
+		v = m["addresses"]
+	}
+	var list []interface{}
+	switch vv := v.(type) {
+	case string:
+		list = []interface{}{vv}
+	case []interface{}:
+		list = vv
+	}
+	if len(list) == 0 {
+		resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "No addresses"}
+		return
+	}
+	for _, a := range list {
+		s, _ := ParamString(a)
+		ad, e := btc.NewAddrFromString(s)
+		if e != nil {
+			resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "Invalid address " + s}
+			return
+		}
+		h := address_hist{addr: s, pkscr: ad.OutScript()}
+		sh := chain.ScriptHash(h.pkscr)
+		if h.recs, e = common.BlockChain.GetAddrHistory(sh[:]); e != nil {
+			resp.Error = RpcError{Code: RPC_INTERNAL_ERROR, Message: e.Error()}
+			return
+		}
+		res = append(res, h)
+	}
+	ok = true
+	return
+}
+
+// Returns txids of all the transactions that touched the given addresses, in the blockchain order
+func GetAddressTxids(cmd *RpcCommand, resp *RpcResponse) {
+	hists, ok := address_params(cmd, resp)
+	if !ok {
+		return
+	}
+	var all []*chain.AddrHistRec
+	for _, h := range hists {
+		all = append(all, h.recs...)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Height < all[j].Height })
+	res := make([]string, 0, len(all))
+	done := make(map[[32]byte]bool, len(all))
+	for _, r := range all {
+		if !done[r.TxID.Hash] {
+			done[r.TxID.Hash] = true
+			res = append(res, r.TxID.String())
+		}
+	}
+	resp.Result = res
+}
+
+// Returns all the changes of the given addresses' balances (negative for spending)
+func GetAddressDeltas(cmd *RpcCommand, resp *RpcResponse) {
+	hists, ok := address_params(cmd, resp)
+	if !ok {
+		return
+	}
+	res := make([]*AddressDeltaResp, 0)
+	for _, h := range hists {
+		for _, r := range h.recs {
+			d := &AddressDeltaResp{Satoshis: int64(r.Value), Txid: r.TxID.String(), Index: r.Index,
+				Height: r.Height, Address: h.addr}
+			if r.Spent != nil {
+				d.Satoshis = -d.Satoshis
+			}
+			res = append(res, d)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Height < res[j].Height })
+	resp.Result = res
+}
+
+func GetAddressBalance(cmd *RpcCommand, resp *RpcResponse) {
+	hists, ok := address_params(cmd, resp)
+	if !ok {
+		return
+	}
+	res := new(AddressBalanceResp)
+	for _, h := range hists {
+		for _, r := range h.recs {
+			if r.Spent == nil {
+				res.Received += r.Value
+				res.Balance += r.Value
+			} else {
+				res.Balance -= r.Value
+			}
+		}
+	}
+	resp.Result = res
+}
+
+// Returns the outputs that have not been spent (according to the address index)
+func GetAddressUtxos(cmd *RpcCommand, resp *RpcResponse) {
+	hists, ok := address_params(cmd, resp)
+	if !ok {
+		return
+	}
+	res := make([]*AddressUtxoResp, 0)
+	for _, h := range hists {
+		spent := make(map[btc.TxPrevOut]bool)
+		for _, r := range h.recs {
+			if r.Spent != nil {
+				spent[*r.Spent] = true
+			}
+		}
+		for _, r := range h.recs {
+			if r.Spent == nil && !spent[btc.TxPrevOut{Hash: r.TxID.Hash, Vout: r.Index}] {
+				res = append(res, &AddressUtxoResp{Address: h.addr, Txid: r.TxID.String(), OutputIndex: r.Index,
+					Script: hex.EncodeToString(h.pkscr), Satoshis: r.Value, Height: r.Height})
+			}
+		}
+	}
+	resp.Result = res
+}
@@ -0,0 +1,289 @@
+package rpcapi
+
+import (
+	"fmt"
+	"sync"
+	"math/big"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+type BlockHeaderResp struct {
+	Hash string `json:"hash"`
+	Confirmations int `json:"confirmations"`
+	Height uint32 `json:"height"`
+	Version uint32 `json:"version"`
+	VersionHex string `json:"versionHex"`
+	Merkleroot string `json:"merkleroot"`
+	Time uint32 `json:"time"`
+	Mediantime uint32 `json:"mediantime"`
+	Nonce uint32 `json:"nonce"`
+	Bits string `json:"bits"`
+	Difficulty float64 `json:"difficulty"`
+	Chainwork string `json:"chainwork"`
+	NTx uint32 `json:"nTx"`
+	Previousblockhash string `json:"previousblockhash,omitempty"`
+	Nextblockhash string `json:"nextblockhash,omitempty"`
+}
+
+type BlockResp struct {
+	BlockHeaderResp
+	Strippedsize int `json:"strippedsize"`
+	Size int `json:"size"`
+	Weight uint `json:"weight"`
+	Tx []interface{} `json:"tx"`
+}
+
+type BlockchainInfoResp struct {
+	Chain string `json:"chain"`
+	Blocks uint32 `json:"blocks"`
+	Headers uint32 `json:"headers"`
+	Bestblockhash string `json:"bestblockhash"`
+	Difficulty float64 `json:"difficulty"`
+	Mediantime uint32 `json:"mediantime"`
+	Verificationprogress float64 `json:"verificationprogress"`
+	Initialblockdownload bool `json:"initialblockdownload"`
+	Chainwork string `json:"chainwork"`
+	Pruned bool `json:"pruned"`
+	Pruneheight uint32 `json:"pruneheight,omitempty"`
+	Warnings string `json:"warnings"`
+}
+
+
+var chainwork_cache struct {
+	sync.Mutex
+	node *chain.BlockTreeNode
+	work *big.Int
+}
+
+// Returns the total amount of work in the chain ending at the given node.
+// The result for the highest node asked so far is cached, so for the chain's tip it is cheap.
+func ChainWork(n *chain.BlockTreeNode) (res *big.Int) {
+	var base *big.Int
+	var nodes []*chain.BlockTreeNode
+
+	chainwork_cache.Lock()
+	defer chainwork_cache.Unlock()
+
+	for cur := n; cur != nil; cur = cur.Parent {
+		if cur == chainwork_cache.node {
+			base = chainwork_cache.work
+			break
+		}
+		nodes = append(nodes, cur)
+	}
+
+	res = new(big.Int)
+	if base != nil {
+		res.Set(base)
+	}
+	max := new(big.Int).Lsh(big.NewInt(1), 256)
+	one := big.NewInt(1)
+	for _, cur := range nodes {
+		target := btc.SetCompact(cur.Bits())
+		if target.Sign() <= 0 {
+			continue
+		}
+		res.Add(res, new(big.Int).Div(max, target.Add(target, one)))
+	}
+
+	if chainwork_cache.node == nil || n.Height >= chainwork_cache.node.Height {
+		chainwork_cache.node = n
+		chainwork_cache.work = new(big.Int).Set(res)
+	}
+	return
+}
+
+// Looks up the block tree node for the given hash
+func FindBlockNode(hash *btc.Uint256) (n *chain.BlockTreeNode) {
+	common.BlockChain.BlockIndexAccess.Lock()
+	n = common.BlockChain.BlockIndex[hash.BIdx()]
+	common.BlockChain.BlockIndexAccess.Unlock()
+	return
+}
+
+// Returns the number of confirmations for a block (-1 if it is not on the main chain)
+func confirmations(n *chain.BlockTreeNode) int {
+	if !common.BlockChain.OnActiveBranch(n) {
+		return -1
+	}
+	return int(common.BlockChain.LastBlock().Height - n.Height) + 1
+}
+
+func fill_block_header(n *chain.BlockTreeNode, r *BlockHeaderResp) {
+	r.Hash = n.BlockHash.String()
+	r.Confirmations = confirmations(n)
+	r.Height = n.Height
+	r.Version = n.BlockVersion()
+	r.VersionHex = fmt.Sprintf("%08x", r.Version)
+	r.Merkleroot = btc.NewUint256(n.BlockHeader[36:68]).String()
+	r.Time = n.Timestamp()
+	r.Mediantime = n.GetMedianTimePast()
+	r.Nonce = binary.LittleEndian.Uint32(n.BlockHeader[76:80])
+	r.Bits = fmt.Sprintf("%08x", n.Bits())
+	r.Difficulty = btc.GetDifficulty(n.Bits())
+	r.Chainwork = fmt.Sprintf("%064x", ChainWork(n))
+	r.NTx = n.TxCount
+	if n.Parent != nil {
+		r.Previousblockhash = n.Parent.BlockHash.String()
+	}
+	if r.Confirmations > 1 {
+		common.BlockChain.BlockIndexAccess.Lock()
+		// check it again, as the chain might have changed since the confirmations were counted
+		if common.BlockChain.OnActiveBranch(n) {
+			if nxt := common.BlockChain.BlockAtHeight(n.Height + 1); nxt != nil && nxt.Parent == n {
+				r.Nextblockhash = nxt.BlockHash.String()
+			}
+		}
+		common.BlockChain.BlockIndexAccess.Unlock()
+	}
+}
+
+
+func GetBlockchainInfo(cmd *RpcCommand, resp *RpcResponse) {
+	var r BlockchainInfoResp
+
+	last := common.BlockChain.LastBlock()
+	switch {
+		case common.Regtest:
+			r.Chain = "regtest"
+		case common.Signet:
+			r.Chain = "signet"
+		case common.Testnet:
+			r.Chain = "test"
+		default:
+			r.Chain = "main"
+	}
+	r.Blocks = last.Height
+	r.Headers = network.LastCommitedHeader.Height
+	if r.Headers < r.Blocks {
+		r.Headers = r.Blocks
+	}
+	r.Bestblockhash = last.BlockHash.String()
+	r.Difficulty = btc.GetDifficulty(last.Bits())
+	r.Mediantime = last.GetMedianTimePast()
+	if r.Verificationprogress = 1; r.Headers > 0 {
+		r.Verificationprogress = float64(r.Blocks) / float64(r.Headers)
+	}
+	r.Initialblockdownload = !common.GetBool(&common.BlockChainSynchronized)
+	r.Chainwork = fmt.Sprintf("%064x", ChainWork(last))
+	if r.Pruned = common.BlockChain.Blocks.PruneEnabled(); r.Pruned {
+		r.Pruneheight = common.BlockChain.Blocks.PruneHeight() + 1 // the lowest block that has not been pruned
+	}
+	resp.Result = &r
+}
+
+
+func GetBlockHash(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "height")
+	if !ok {
+		return
+	}
+	height, ok := ParamInt(par[0])
+	if !ok {
+		resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "height must be a number"}
+		return
+	}
+	var n *chain.BlockTreeNode
+	if height >= 0 && height <= 0xffffffff {
+		n = common.BlockChain.BlockAtHeight(uint32(height))
+	}
+	if n == nil {
+		resp.Error = RpcError{Code: RPC_INVALID_PARAMETER, Message: "Block height out of range"}
+		return
+	}
+	resp.Result = n.BlockHash.String()
+}
+
+
+func GetBlockHeader(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "blockhash", "verbose")
+	if !ok {
+		return
+	}
+	hash, ok := ParamHash(resp, par[0], "blockhash")
+	if !ok {
+		return
+	}
+	verbose := true
+	if par[1] != nil {
+		if verbose, ok = ParamBool(par[1]); !ok {
+			resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "verbose must be a boolean"}
+			return
+		}
+	}
+	n := FindBlockNode(hash)
+	if n == nil {
+		resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "Block not found"}
+		return
+	}
+	if !verbose {
+		resp.Result = hex.EncodeToString(n.BlockHeader[:])
+		return
+	}
+	var r BlockHeaderResp
+	fill_block_header(n, &r)
+	resp.Result = &r
+}
+
+
+func GetBlock(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "blockhash", "verbosity")
+	if !ok {
+		return
+	}
+	hash, ok := ParamHash(resp, par[0], "blockhash")
+	if !ok {
+		return
+	}
+	verbosity := int64(1)
+	if par[1] != nil {
+		if verbosity, ok = ParamInt(par[1]); !ok {
+			resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "verbosity must be a number"}
+			return
+		}
+	}
+	n := FindBlockNode(hash)
+	if n == nil {
+		resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "Block not found"}
+		return
+	}
+	raw, _, er := common.BlockChain.Blocks.BlockGet(hash)
+	if er != nil {
+		resp.Error = RpcError{Code: RPC_MISC_ERROR, Message: "Block not available"}
+		return
+	}
+	if verbosity <= 0 {
+		resp.Result = hex.EncodeToString(raw)
+		return
+	}
+
+	bl, er := btc.NewBlock(raw)
+	if er == nil {
+		er = bl.BuildTxList()
+	}
+	if er != nil {
+		resp.Error = RpcError{Code: RPC_DESERIALIZATION_ERROR, Message: er.Error()}
+		return
+	}
+
+	r := new(BlockResp)
+	fill_block_header(n, &r.BlockHeaderResp)
+	r.NTx = uint32(len(bl.Txs))
+	r.Size = len(raw)
+	r.Strippedsize = bl.NoWitnessSize
+	r.Weight = bl.BlockWeight
+	r.Tx = make([]interface{}, len(bl.Txs))
+	for i, tx := range bl.Txs {
+		if verbosity == 1 {
+			r.Tx[i] = tx.Hash.String()
+		} else {
+			r.Tx[i] = TxToResp(tx)
+		}
+	}
+	resp.Result = r
+}
@@ -0,0 +1,179 @@
+package rpcapi
+
+import (
+	"time"
+	"bytes"
+	"errors"
+	"strconv"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+// Returns P2WSH(OP_TRUE) output script - used by regtest when no address is given
+func AnyoneCanSpendScript() []byte {
+	sh := sha256.Sum256([]byte{0x51})
+	return append([]byte{0x00, 0x20}, sh[:]...)
+}
+
+
+// Builds a coinbase transaction paying to the given output script, including witness commitment
+func build_coinbase(height uint32, value uint64, pk_script []byte, txs []*btc.Tx, extra uint32) (cb *btc.Tx) {
+	var sig []byte
+	if height <= 16 {
+		sig = append(sig, byte(0x50 + height))
+	} else {
+		var hb [5]byte
+		var l int
+		binary.LittleEndian.PutUint32(hb[:4], height)
+		for l=4; l>1 && hb[l-1]==0 && hb[l-2]<0x80; l-- {
+		}
+		if hb[l-1] >= 0x80 {
+			l++ // keep the number positive
+		}
+		sig = append(sig, byte(l))
+		sig = append(sig, hb[:l]...)
+	}
+	var eb [4]byte
+	binary.LittleEndian.PutUint32(eb[:], extra)
+	sig = append(sig, 4)
+	sig = append(sig, eb[:]...)
+	sig = append(sig, []byte("\x06gocoin")...)
+
+	cb = new(btc.Tx)
+	cb.Version = 1
+	cb.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Vout:0xffffffff}, ScriptSig:sig, Sequence:0xffffffff}}
+	cb.TxOut = []*btc.TxOut{&btc.TxOut{Value:value, Pk_script:pk_script}}
+
+	// Witness commitment (the coinbase's wtxid is taken as zero, so we can calculate it now)
+	var nonce [32]byte
+	merkle, _ := btc.GetWitnessMerkle(append([]*btc.Tx{cb}, txs...))
+	commit := btc.Sha2Sum(append(merkle, nonce[:]...))
+	cb.TxOut = append(cb.TxOut, &btc.TxOut{Pk_script:append([]byte{0x6a,0x24,0xaa,0x21,0xa9,0xed}, commit[:]...)})
+	cb.SegWit = [][][]byte{[][]byte{nonce[:]}}
+
+	cb.SetHash(cb.SerializeNew())
+	return
+}
+
+
+// Mines a new block on top of the current chain, using our memory pool content
+func MineBlock(pk_script []byte, extra uint32) (bl *btc.Block, e error) {
+	var tmpl GetBlockTemplateResp
+	GetNextBlockTemplate(&tmpl)
+
+	txs := make([]*btc.Tx, len(tmpl.Transactions))
+	for i := range tmpl.Transactions {
+		raw, _ := hex.DecodeString(tmpl.Transactions[i].Data)
+		tx, n := btc.NewTx(raw)
+		if tx == nil || n != len(raw) {
+			e = errors.New("Cannot decode mempool transaction " + tmpl.Transactions[i].Hash)
+			return
+		}
+		tx.SetHash(raw)
+		txs[i] = tx
+	}
+
+	bits, er := strconv.ParseUint(tmpl.Bits, 16, 32)
+	if er != nil {
+		e = er
+		return
+	}
+	prev := btc.NewUint256FromString(tmpl.PreviousBlockHash)
+
+	cb := build_coinbase(uint32(tmpl.Height), tmpl.Coinbasevalue, pk_script, txs, extra)
+	txs = append([]*btc.Tx{cb}, txs...)
+
+	mtr := make([][32]byte, len(txs), 3*len(txs))
+	for i, tx := range txs {
+		mtr[i] = tx.Hash.Hash
+	}
+	merkle, _ := btc.CalcMerkle(mtr)
+
+	hdr := make([]byte, 80)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0x20000000)
+	copy(hdr[4:36], prev.Hash[:])
+	copy(hdr[36:68], merkle)
+	binary.LittleEndian.PutUint32(hdr[68:72], uint32(tmpl.Curtime))
+	binary.LittleEndian.PutUint32(hdr[72:76], uint32(bits))
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(hdr[76:80], nonce)
+		if btc.CheckProofOfWork(btc.NewSha2Hash(hdr), uint32(bits)) {
+			break
+		}
+		if nonce == 0xffffffff {
+			e = errors.New("Nonce space exhausted")
+			return
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(hdr)
+	btc.WriteVlen(buf, uint64(len(txs)))
+	buf.Write(cb.Raw)
+	for _, tx := range txs[1:] {
+		buf.Write(tx.Raw)
+	}
+	bl, e = btc.NewBlock(buf.Bytes())
+	return
+}
+
+
+// Mines the given number of regtest blocks, passing each of them to the main thread
+func GenerateBlocks(cnt int, pk_script []byte) (hashes []string, e error) {
+	if !common.Regtest {
+		e = errors.New("Generating blocks is only possible in regtest mode")
+		return
+	}
+	for i := 0; i < cnt; i++ {
+		bs := new(BlockSubmited)
+		if bs.Block, e = MineBlock(pk_script, uint32(time.Now().UnixNano()) + uint32(i)); e != nil {
+			return
+		}
+
+		network.MutexRcv.Lock()
+		network.ReceivedBlocks[bs.Block.Hash.BIdx()] = &network.OneReceivedBlock{TmStart: time.Now()}
+		network.MutexRcv.Unlock()
+
+		bs.Done.Add(1)
+		RpcBlocks <- bs
+		bs.Done.Wait()
+		if bs.Error != "" {
+			e = errors.New(bs.Error)
+			return
+		}
+		hashes = append(hashes, bs.Block.Hash.String())
+	}
+	return
+}
+
+
+func GenerateToAddress(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 2, "nblocks", "address", "maxtries")
+	if !ok {
+		return
+	}
+	cnt, ok := ParamInt(par[0])
+	if !ok || cnt < 0 {
+		resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "nblocks must be a positive number"}
+		return
+	}
+	s, _ := ParamString(par[1])
+	addr, er := btc.NewAddrFromString(s)
+	if er != nil || addr == nil {
+		resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "Error: Invalid address"}
+		return
+	}
+	hashes, er := GenerateBlocks(int(cnt), addr.OutScript())
+	if er != nil {
+		resp.Error = RpcError{Code: RPC_MISC_ERROR, Message: er.Error()}
+		return
+	}
+	if hashes == nil {
+		hashes = []string{}
+	}
+	resp.Result = hashes
+}
@@ -0,0 +1,291 @@
+package rpcapi
+
+import (
+	"encoding/json"
+	"strings"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+type MempoolInfoResp struct {
+	Loaded bool `json:"loaded"`
+	Size int `json:"size"`
+	Bytes uint64 `json:"bytes"`
+	Usage uint64 `json:"usage"`
+	TotalFee json.Number `json:"total_fee"`
+	Maxmempool uint64 `json:"maxmempool"`
+	Mempoolminfee json.Number `json:"mempoolminfee"`
+	Minrelaytxfee json.Number `json:"minrelaytxfee"`
+}
+
+type MempoolEntryFees struct {
+	Base json.Number `json:"base"`
+	Modified json.Number `json:"modified"`
+	Ancestor json.Number `json:"ancestor"`
+	Descendant json.Number `json:"descendant"`
+}
+
+type MempoolEntryResp struct {
+	Vsize int `json:"vsize"`
+	Weight int `json:"weight"`
+	Time int64 `json:"time"`
+	Descendantcount int `json:"descendantcount"`
+	Descendantsize int `json:"descendantsize"`
+	Ancestorcount int `json:"ancestorcount"`
+	Ancestorsize int `json:"ancestorsize"`
+	Wtxid string `json:"wtxid"`
+	Fees MempoolEntryFees `json:"fees"`
+	Depends []string `json:"depends"`
+	Spentby []string `json:"spentby"`
+	Bip125Replaceable bool `json:"bip125-replaceable"`
+}
+
+type EstimateFeeResp struct {
+	Feerate *json.Number `json:"feerate,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+	Blocks int64 `json:"blocks"`
+}
+
+
+func GetMempoolInfo(cmd *RpcCommand, resp *RpcResponse) {
+	var totfee uint64
+	r := new(MempoolInfoResp)
+	r.Loaded = true
+	network.TxMutex.Lock()
+	r.Size = len(network.TransactionsToSend)
+	for _, t2s := range network.TransactionsToSend {
+		r.Bytes += uint64(t2s.VSize())
+		totfee += t2s.Fee
+	}
+	r.Usage = network.TransactionsToSendSize
+	network.TxMutex.Unlock()
+	r.TotalFee = BtcAmount(totfee)
+	r.Maxmempool = common.MaxMempoolSize()
+	r.Mempoolminfee = BtcAmount(common.MinFeePerKB())
+	r.Minrelaytxfee = BtcAmount(common.RouteMinFeePerKB())
+	resp.Result = r
+}
+
+
+// Returns all the in-mempool ancestors (parents) or descendants (children) of the given transaction.
+// Make sure to call it with network.TxMutex locked.
+func mempool_relatives(t2s *network.OneTxToSend, descendants bool) (res map[*network.OneTxToSend]bool) {
+	res = make(map[*network.OneTxToSend]bool)
+	todo := []*network.OneTxToSend{t2s}
+	for len(todo) > 0 {
+		cur := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		var rels []*network.OneTxToSend
+		if descendants {
+			rels = mempool_children(cur)
+		} else {
+			rels = mempool_parents(cur)
+		}
+		for _, r := range rels {
+			if !res[r] {
+				res[r] = true
+				todo = append(todo, r)
+			}
+		}
+	}
+	return
+}
+
+// Make sure to call it with network.TxMutex locked.
+func mempool_parents(t2s *network.OneTxToSend) (res []*network.OneTxToSend) {
+	if t2s.MemInputs == nil {
+		return
+	}
+	for i, mi := range t2s.MemInputs {
+		if mi {
+			if p, ok := network.TransactionsToSend[btc.BIdx(t2s.TxIn[i].Input.Hash[:])]; ok {
+				res = append(res, p)
+			}
+		}
+	}
+	return
+}
+
+// Make sure to call it with network.TxMutex locked.
+func mempool_children(t2s *network.OneTxToSend) (res []*network.OneTxToSend) {
+	po := btc.TxPrevOut{Hash:t2s.Hash.Hash}
+	for po.Vout = 0; po.Vout < uint32(len(t2s.TxOut)); po.Vout++ {
+		if idx, ok := network.SpentOutputs[po.UIdx()]; ok {
+			if c, ok := network.TransactionsToSend[idx]; ok {
+				res = append(res, c)
+			}
+		}
+	}
+	return
+}
+
+// Make sure to call it with network.TxMutex locked.
+func mempool_entry(t2s *network.OneTxToSend) (r *MempoolEntryResp) {
+	r = new(MempoolEntryResp)
+	r.Vsize = t2s.VSize()
+	r.Weight = t2s.Weight()
+	r.Time = t2s.Firstseen.Unix()
+	r.Wtxid = t2s.WTxID().String()
+
+	var fee uint64
+	fee = t2s.Fee
+	r.Ancestorcount, r.Ancestorsize = 1, r.Vsize
+	for p := range mempool_relatives(t2s, false) {
+		r.Ancestorcount++
+		r.Ancestorsize += p.VSize()
+		fee += p.Fee
+	}
+	r.Fees.Ancestor = BtcAmount(fee)
+
+	fee = t2s.Fee
+	r.Descendantcount, r.Descendantsize = 1, r.Vsize
+	for c := range mempool_relatives(t2s, true) {
+		r.Descendantcount++
+		r.Descendantsize += c.VSize()
+		fee += c.Fee
+	}
+	r.Fees.Descendant = BtcAmount(fee)
+
+	r.Fees.Base = BtcAmount(t2s.Fee)
+	r.Fees.Modified = r.Fees.Base
+
+	r.Depends = []string{}
+	for _, p := range mempool_parents(t2s) {
+		r.Depends = append(r.Depends, p.Hash.String())
+	}
+	r.Spentby = []string{}
+	for _, c := range mempool_children(t2s) {
+		r.Spentby = append(r.Spentby, c.Hash.String())
+	}
+	r.Bip125Replaceable = !t2s.Final
+	return
+}
+
+
+func GetRawMempool(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 0, "verbose", "mempool_sequence")
+	if !ok {
+		return
+	}
+	var verbose bool
+	if par[0] != nil {
+		if verbose, ok = ParamBool(par[0]); !ok {
+			resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "verbose must be a boolean"}
+			return
+		}
+	}
+
+	network.TxMutex.Lock()
+	defer network.TxMutex.Unlock()
+	if verbose {
+		res := make(map[string]*MempoolEntryResp, len(network.TransactionsToSend))
+		for _, t2s := range network.TransactionsToSend {
+			res[t2s.Hash.String()] = mempool_entry(t2s)
+		}
+		resp.Result = res
+	} else {
+		res := make([]string, 0, len(network.TransactionsToSend))
+		for _, t2s := range network.TransactionsToSend {
+			res = append(res, t2s.Hash.String())
+		}
+		resp.Result = res
+	}
+}
+
+
+func GetMempoolEntry(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "txid")
+	if !ok {
+		return
+	}
+	txid, ok := ParamHash(resp, par[0], "txid")
+	if !ok {
+		return
+	}
+	network.TxMutex.Lock()
+	defer network.TxMutex.Unlock()
+	t2s, ok := network.TransactionsToSend[txid.BIdx()]
+	if !ok {
+		resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "Transaction not in mempool"}
+		return
+	}
+	resp.Result = mempool_entry(t2s)
+}
+
+
+// Returns a fee (in satoshis per 1000 vbytes) that should get a transaction mined within the given
+// number of blocks, assuming the current mempool content. Returns zero if the mempool is not that big.
+func MempoolFeeForBlocks(blocks uint64) (spkb uint64) {
+	maxweight := blocks * btc.MAX_BLOCK_WEIGHT
+	network.TxMutex.Lock()
+	fees := network.GetMempoolFees(maxweight)
+	network.TxMutex.Unlock()
+
+	var weightsofar uint64
+	for _, f := range fees {
+		weightsofar += f[0]
+		if weightsofar >= maxweight {
+			return 4000 * f[1] / f[0]
+		}
+	}
+	return 0
+}
+
+
+// Returns a fee (in satoshis per 1000 vbytes) that should get a transaction mined within the given
+// number of blocks. If the fee estimator does not have enough data, it is guessed from the mempool.
+func FeeForBlocks(blocks uint32, conservative bool) (spkb uint64, estimated bool) {
+	if spkb, estimated = network.EstimateFee(blocks, conservative); estimated {
+		return
+	}
+	spkb = MempoolFeeForBlocks(uint64(blocks))
+	if min := common.MinFeePerKB(); spkb < min {
+		spkb = min
+	}
+	return
+}
+
+
+func EstimateSmartFee(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "conf_target", "estimate_mode")
+	if !ok {
+		return
+	}
+	blocks, ok := ParamInt(par[0])
+	if !ok {
+		resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "conf_target must be a number"}
+		return
+	}
+	if blocks < 1 || blocks > 1008 {
+		resp.Error = RpcError{Code: RPC_INVALID_PARAMETER, Message: "Invalid conf_target, must be between 1 and 1008"}
+		return
+	}
+
+	conservative := true
+	if par[1] != nil {
+		mode, ok := par[1].(string)
+		if !ok {
+			resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "estimate_mode must be a string"}
+			return
+		}
+		switch strings.ToLower(mode) {
+			case "unset", "conservative":
+			case "economical":
+				conservative = false
+			default:
+				resp.Error = RpcError{Code: RPC_INVALID_PARAMETER, Message: "Invalid estimate_mode parameter, must be one of: \"unset\", \"economical\", \"conservative\""}
+				return
+		}
+	}
+
+	r := new(EstimateFeeResp)
+	r.Blocks = blocks
+	spkb, estimated := FeeForBlocks(uint32(blocks), conservative)
+	if !estimated {
+		r.Errors = []string{"Insufficient data or no feerate found (using mempool content)"}
+	}
+	fee := BtcAmount(spkb)
+	r.Feerate = &fee
+	resp.Result = r
+}
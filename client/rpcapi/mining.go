@@ -65,7 +65,7 @@ func GetNextBlockTemplate(r *GetBlockTemplateResp) {
 	r.Version = 4
 	r.PreviousBlockHash = common.Last.Block.BlockHash.String()
 	r.Transactions, r.Coinbasevalue = GetTransactions(height, uint32(r.Mintime))
-	r.Coinbasevalue += btc.GetBlockReward(height)
+	r.Coinbasevalue += common.BlockChain.GetBlockReward(height)
 	r.Coinbaseaux.Flags = ""
 	r.Longpollid = r.PreviousBlockHash
 	r.Target = hex.EncodeToString(append(zer[:32-len(target)], target...))
@@ -0,0 +1,123 @@
+package rpcapi
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+	"github.com/piotrnar/gocoin"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+type PeerInfoResp struct {
+	Id uint32 `json:"id"`
+	Addr string `json:"addr"`
+	Addrlocal string `json:"addrlocal,omitempty"`
+	Services string `json:"services"`
+	Relaytxes bool `json:"relaytxes"`
+	Lastsend int64 `json:"lastsend"`
+	Lastrecv int64 `json:"lastrecv"`
+	Bytessent uint64 `json:"bytessent"`
+	Bytesrecv uint64 `json:"bytesrecv"`
+	Conntime int64 `json:"conntime"`
+	Pingtime float64 `json:"pingtime,omitempty"`
+	Version uint32 `json:"version"`
+	Subver string `json:"subver"`
+	Inbound bool `json:"inbound"`
+	ConnectionType string `json:"connection_type"`
+	Startingheight uint32 `json:"startingheight"`
+	Inflight int `json:"inflight_blocks"`
+	Minfeefilter float64 `json:"minfeefilter"`
+}
+
+type NetworkInfoResp struct {
+	Version int `json:"version"`
+	Subversion string `json:"subversion"`
+	Protocolversion uint32 `json:"protocolversion"`
+	Localservices string `json:"localservices"`
+	Localrelay bool `json:"localrelay"`
+	Timeoffset int `json:"timeoffset"`
+	Networkactive bool `json:"networkactive"`
+	Connections int `json:"connections"`
+	ConnectionsIn int `json:"connections_in"`
+	ConnectionsOut int `json:"connections_out"`
+	Networks []interface{} `json:"networks"`
+	Relayfee float64 `json:"relayfee"`
+	Incrementalfee float64 `json:"incrementalfee"`
+	Localaddresses []interface{} `json:"localaddresses"`
+	Warnings string `json:"warnings"`
+}
+
+
+func GetPeerInfo(cmd *RpcCommand, resp *RpcResponse) {
+	var ci network.ConnInfo
+
+	res := []*PeerInfoResp{}
+	network.Mutex_net.Lock()
+	for _, v := range network.OpenCons {
+		v.GetStats(&ci)
+		if !ci.VersionReceived {
+			continue
+		}
+		r := new(PeerInfoResp)
+		r.Id = ci.ID
+		r.Addr = ci.RemoteAddr
+		if r.Addr == "" {
+			r.Addr = ci.PeerIp
+		}
+		r.Addrlocal = ci.LocalAddr
+		r.Services = fmt.Sprintf("%016x", ci.Services)
+		r.Relaytxes = !ci.DoNotRelayTxs
+		r.Lastsend = ci.LastSent.Unix()
+		r.Lastrecv = ci.LastDataGot.Unix()
+		r.Bytessent = ci.BytesSent
+		r.Bytesrecv = ci.BytesReceived
+		r.Conntime = ci.ConnectedAt.Unix()
+		r.Pingtime = float64(ci.AveragePing) / 1000.0
+		r.Version = ci.Version
+		r.Subver = ci.Agent
+		r.Inbound = ci.Incomming
+		if ci.Incomming {
+			r.ConnectionType = "inbound"
+		} else {
+			r.ConnectionType = "outbound-full-relay"
+		}
+		r.Startingheight = ci.Height
+		r.Inflight = ci.BlocksInProgress
+		r.Minfeefilter = float64(ci.MinFeeSPKB) / 1e8
+		res = append(res, r)
+	}
+	network.Mutex_net.Unlock()
+	resp.Result = res
+}
+
+
+// Converts gocoin's version string (e.g. "1.9.6") into bitcoind's version number format (e.g. 10906)
+func version_number() (res int) {
+	for _, s := range strings.SplitN(gocoin.Version, ".", 3) {
+		v, _ := strconv.Atoi(s)
+		res = 100*res + v
+	}
+	return
+}
+
+
+func GetNetworkInfo(cmd *RpcCommand, resp *RpcResponse) {
+	r := new(NetworkInfoResp)
+	r.Version = version_number()
+	r.Subversion = common.UserAgent
+	r.Protocolversion = common.Version
+	r.Localservices = fmt.Sprintf("%016x", common.Services)
+	r.Localrelay = true
+	r.Networkactive = !common.NetworkClosed.Get()
+	network.Mutex_net.Lock()
+	r.Connections = len(network.OpenCons)
+	r.ConnectionsIn = int(network.InConsActive)
+	r.ConnectionsOut = int(network.OutConsActive)
+	network.Mutex_net.Unlock()
+	r.Networks = []interface{}{}
+	r.Relayfee = float64(common.RouteMinFeePerKB()) / 1e8
+	r.Incrementalfee = float64(common.MinFeePerKB()) / 1e8
+	r.Localaddresses = []interface{}{}
+	resp.Result = r
+}
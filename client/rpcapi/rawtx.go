@@ -0,0 +1,473 @@
+package rpcapi
+
+import (
+	"strings"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/usif"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+type ScriptSigResp struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+}
+
+type ScriptPubKeyResp struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+	Type string `json:"type"`
+	Address string `json:"address,omitempty"`
+}
+
+type TxInResp struct {
+	Coinbase string `json:"coinbase,omitempty"`
+	Txid string `json:"txid,omitempty"`
+	Vout *uint32 `json:"vout,omitempty"`
+	ScriptSig *ScriptSigResp `json:"scriptSig,omitempty"`
+	Txinwitness []string `json:"txinwitness,omitempty"`
+	Sequence uint32 `json:"sequence"`
+}
+
+type TxOutResp struct {
+	Value json.Number `json:"value"`
+	N int `json:"n"`
+	ScriptPubKey ScriptPubKeyResp `json:"scriptPubKey"`
+}
+
+type TxResp struct {
+	Txid string `json:"txid"`
+	Hash string `json:"hash"`
+	Version uint32 `json:"version"`
+	Size uint32 `json:"size"`
+	Vsize int `json:"vsize"`
+	Weight int `json:"weight"`
+	Locktime uint32 `json:"locktime"`
+	Vin []TxInResp `json:"vin"`
+	Vout []TxOutResp `json:"vout"`
+	Hex string `json:"hex"`
+
+	Blockhash string `json:"blockhash,omitempty"`
+	Confirmations int `json:"confirmations,omitempty"`
+	Time uint32 `json:"time,omitempty"`
+	Blocktime uint32 `json:"blocktime,omitempty"`
+}
+
+type TxOutSetResp struct {
+	Bestblock string `json:"bestblock"`
+	Confirmations uint32 `json:"confirmations"`
+	Value json.Number `json:"value"`
+	ScriptPubKey ScriptPubKeyResp `json:"scriptPubKey"`
+	Coinbase bool `json:"coinbase"`
+}
+
+type PackageTxFees struct {
+	Base json.Number `json:"base"`
+	EffectiveFeerate json.Number `json:"effective-feerate"`
+}
+
+type PackageTxResp struct {
+	Txid string `json:"txid"`
+	Vsize int `json:"vsize"`
+	Fees PackageTxFees `json:"fees"`
+}
+
+type SubmitPackageResp struct {
+	PackageMsg string `json:"package_msg"`
+	TxResults map[string]*PackageTxResp `json:"tx-results"`
+	ReplacedTransactions []string `json:"replaced-transactions"`
+}
+
+
+// Returns the script disassembled, the way bitcoind does it
+func ScriptAsm(scr []byte) string {
+	txt, er := btc.ScriptToText(scr)
+	if er != nil {
+		return "[error]"
+	}
+	return strings.Join(txt, " ")
+}
+
+// Returns bitcoind's name of the output script type
+func ScriptType(scr []byte) string {
+	if version, program := btc.IsWitnessProgram(scr); program != nil {
+		if version == 0 {
+			if len(program) == 20 {
+				return "witness_v0_keyhash"
+			}
+			if len(program) == 32 {
+				return "witness_v0_scripthash"
+			}
+			return "nonstandard"
+		}
+		if version == 1 && len(program) == 32 {
+			return "witness_v1_taproot"
+		}
+		return "witness_unknown"
+	}
+	switch {
+		case len(scr)==25 && scr[0]==0x76 && scr[1]==0xa9 && scr[2]==0x14 && scr[23]==0x88 && scr[24]==0xac:
+			return "pubkeyhash"
+		case btc.IsP2SH(scr):
+			return "scripthash"
+		case len(scr)==35 && scr[0]==0x21 && scr[34]==0xac || len(scr)==67 && scr[0]==0x41 && scr[66]==0xac:
+			return "pubkey"
+		case len(scr)>0 && scr[0]==0x6a:
+			return "nulldata"
+		case len(scr)>3 && scr[0]>=0x51 && scr[0]<=0x60 && scr[len(scr)-1]==0xae:
+			return "multisig"
+	}
+	return "nonstandard"
+}
+
+func ScriptPubKey(scr []byte) (res ScriptPubKeyResp) {
+	res.Asm = ScriptAsm(scr)
+	res.Hex = hex.EncodeToString(scr)
+	res.Type = ScriptType(scr)
+	if res.Type != "pubkey" {
+		if ad := btc.NewAddrFromPkScript(scr, common.Testnet); ad != nil {
+			res.Address = ad.String()
+		}
+	}
+	return
+}
+
+// Decodes the transaction into bitcoind's JSON format
+func TxToResp(tx *btc.Tx) (r *TxResp) {
+	r = new(TxResp)
+	r.Txid = tx.Hash.String()
+	if tx.SegWit != nil && tx.IsCoinBase() {
+		r.Hash = btc.NewSha2Hash(tx.Raw).String() // block's coinbase has its wTxID zeroed
+	} else {
+		r.Hash = tx.WTxID().String()
+	}
+	r.Version = tx.Version
+	r.Size = tx.Size
+	r.Vsize = tx.VSize()
+	r.Weight = tx.Weight()
+	r.Locktime = tx.Lock_time
+	r.Vin = make([]TxInResp, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		vi := &r.Vin[i]
+		vi.Sequence = in.Sequence
+		if tx.IsCoinBase() {
+			vi.Coinbase = hex.EncodeToString(in.ScriptSig)
+		} else {
+			vout := in.Input.Vout
+			vi.Txid = btc.NewUint256(in.Input.Hash[:]).String()
+			vi.Vout = &vout
+			vi.ScriptSig = &ScriptSigResp{Asm:ScriptAsm(in.ScriptSig), Hex:hex.EncodeToString(in.ScriptSig)}
+		}
+		if tx.SegWit != nil && len(tx.SegWit[i]) > 0 {
+			vi.Txinwitness = make([]string, len(tx.SegWit[i]))
+			for j, w := range tx.SegWit[i] {
+				vi.Txinwitness[j] = hex.EncodeToString(w)
+			}
+		}
+	}
+	r.Vout = make([]TxOutResp, len(tx.TxOut))
+	for i, out := range tx.TxOut {
+		r.Vout[i].Value = BtcAmount(out.Value)
+		r.Vout[i].N = i
+		r.Vout[i].ScriptPubKey = ScriptPubKey(out.Pk_script)
+	}
+	r.Hex = hex.EncodeToString(tx.Raw)
+	return
+}
+
+
+func GetRawTransaction(cmd *RpcCommand, resp *RpcResponse) {
+	var tx *btc.Tx
+
+	par, ok := cmd.GetParams(resp, 1, "txid", "verbose", "blockhash")
+	if !ok {
+		return
+	}
+	txid, ok := ParamHash(resp, par[0], "txid")
+	if !ok {
+		return
+	}
+	var verbose bool
+	if par[1] != nil {
+		if verbose, ok = ParamBool(par[1]); !ok {
+			resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "verbose must be a boolean"}
+			return
+		}
+	}
+
+	r := new(TxResp)
+	if par[2] != nil {
+		bh, ok := ParamHash(resp, par[2], "blockhash")
+		if !ok {
+			return
+		}
+		n := FindBlockNode(bh)
+		if n == nil {
+			resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "Block hash not found"}
+			return
+		}
+		raw, _, er := common.BlockChain.Blocks.BlockGet(bh)
+		if er != nil {
+			resp.Error = RpcError{Code: RPC_MISC_ERROR, Message: "Block not available"}
+			return
+		}
+		bl, er := btc.NewBlock(raw)
+		if er == nil {
+			er = bl.BuildTxList()
+		}
+		if er != nil {
+			resp.Error = RpcError{Code: RPC_DESERIALIZATION_ERROR, Message: er.Error()}
+			return
+		}
+		for _, t := range bl.Txs {
+			if t.Hash.Equal(txid) {
+				tx = t
+				break
+			}
+		}
+		if tx == nil {
+			resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY, Message: "No such transaction found in the provided block"}
+			return
+		}
+		r.Blockhash = n.BlockHash.String()
+		r.Confirmations = confirmations(n)
+		r.Time = n.Timestamp()
+		r.Blocktime = r.Time
+	} else {
+		network.TxMutex.Lock()
+		if t2s, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+			tx = t2s.Tx
+		}
+		network.TxMutex.Unlock()
+		if tx == nil && common.BlockChain.TxIdx != nil {
+			if raw, n, er := common.BlockChain.FindTx(txid); er == nil {
+				var offs int
+				if tx, offs = btc.NewTx(raw); tx == nil || offs != len(raw) {
+					resp.Error = RpcError{Code: RPC_DATABASE_ERROR, Message: "Transaction index record cannot be decoded"}
+					return
+				}
+				tx.SetHash(raw)
+				r.Blockhash = n.BlockHash.String()
+				r.Confirmations = confirmations(n)
+				r.Time = n.Timestamp()
+				r.Blocktime = r.Time
+			}
+		}
+		if tx == nil {
+			if common.BlockChain.TxIdx != nil {
+				resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY,
+					Message: "No such mempool or blockchain transaction"}
+			} else {
+				resp.Error = RpcError{Code: RPC_INVALID_ADDRESS_OR_KEY,
+					Message: "No such mempool transaction. Use -txindex or provide a block hash to enable blockchain transaction queries"}
+			}
+			return
+		}
+	}
+
+	if !verbose {
+		resp.Result = hex.EncodeToString(tx.Raw)
+		return
+	}
+	blk := *r
+	r = TxToResp(tx)
+	r.Blockhash, r.Confirmations, r.Time, r.Blocktime = blk.Blockhash, blk.Confirmations, blk.Time, blk.Blocktime
+	resp.Result = r
+}
+
+
+func SendRawTransaction(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "hexstring", "maxfeerate")
+	if !ok {
+		return
+	}
+	s, _ := ParamString(par[0])
+	raw, er := hex.DecodeString(s)
+	if er != nil {
+		resp.Error = RpcError{Code: RPC_DESERIALIZATION_ERROR, Message: "TX decode failed"}
+		return
+	}
+	tx, le := btc.NewTx(raw)
+	if tx == nil || le != len(raw) {
+		resp.Error = RpcError{Code: RPC_DESERIALIZATION_ERROR, Message: "TX decode failed"}
+		return
+	}
+	tx.SetHash(raw)
+
+	// The memory pool is being modified by the main thread, so synchronize with it
+	lck := new(usif.OneLock)
+	lck.In.Add(1)
+	lck.Out.Add(1)
+	usif.LocksChan <- lck
+	lck.In.Wait()
+	defer lck.Out.Done()
+
+	network.TxMutex.Lock()
+	_, inmem := network.TransactionsToSend[tx.Hash.BIdx()]
+	network.TxMutex.Unlock()
+
+	if !inmem {
+		if common.BlockChain.Unspent.TxPresent(&tx.Hash) {
+			resp.Error = RpcError{Code: RPC_VERIFY_ALREADY_IN_CHAIN, Message: "Transaction already in block chain"}
+			return
+		}
+
+		network.RemoveFromRejected(&tx.Hash) // in case we rejected it eariler, to try it again as trusted
+		if !network.SubmitLocalTx(tx, raw) {
+			network.TxMutex.Lock()
+			rr := network.TransactionsRejected[tx.Hash.BIdx()]
+			network.TxMutex.Unlock()
+			if rr != nil {
+				resp.Error = RpcError{Code: RPC_VERIFY_REJECTED, Message: network.ReasonToString(rr.Reason)}
+			} else {
+				resp.Error = RpcError{Code: RPC_VERIFY_ERROR, Message: "Transaction rejected"}
+			}
+			return
+		}
+	}
+
+	network.TxMutex.Lock()
+	t2s, ok := network.TransactionsToSend[tx.Hash.BIdx()]
+	if ok {
+		t2s.Local = true // make as own
+	}
+	network.TxMutex.Unlock()
+	if !ok {
+		resp.Error = RpcError{Code: RPC_VERIFY_ERROR, Message: "Transaction not accepted to the memory pool"}
+		return
+	}
+	t2s.Invsentcnt += network.NetRouteInv(network.MSG_TX, &tx.Hash, nil)
+	resp.Result = tx.Hash.String()
+}
+
+
+// Submits a child with its unconfirmed parents, sorted topologically
+func SubmitPackage(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 1, "package", "maxfeerate", "maxburnamount")
+	if !ok {
+		return
+	}
+	list, _ := par[0].([]interface{})
+	if len(list) == 0 || len(list) > network.MAX_PACKAGE_COUNT {
+		resp.Error = RpcError{Code: RPC_INVALID_PARAMETER, Message: "Array must contain between 1 and 25 transactions."}
+		return
+	}
+	txs := make([]*btc.Tx, len(list))
+	for i, v := range list {
+		s, _ := ParamString(v)
+		raw, er := hex.DecodeString(s)
+		if er != nil {
+			resp.Error = RpcError{Code: RPC_DESERIALIZATION_ERROR, Message: "TX decode failed: " + s}
+			return
+		}
+		tx, le := btc.NewTx(raw)
+		if tx == nil || le != len(raw) {
+			resp.Error = RpcError{Code: RPC_DESERIALIZATION_ERROR, Message: "TX decode failed: " + s}
+			return
+		}
+		tx.SetHash(raw)
+		txs[i] = tx
+	}
+
+	// The memory pool is being modified by the main thread, so synchronize with it
+	lck := new(usif.OneLock)
+	lck.In.Add(1)
+	lck.Out.Add(1)
+	usif.LocksChan <- lck
+	lck.In.Wait()
+	defer lck.Out.Done()
+
+	for _, tx := range txs {
+		network.RemoveFromRejected(&tx.Hash) // in case we rejected it eariler, to try it again as trusted
+	}
+	res, e := network.SubmitLocalPackage(txs)
+	if e != nil {
+		resp.Error = RpcError{Code: RPC_VERIFY_REJECTED, Message: e.Error()}
+		return
+	}
+
+	r := &SubmitPackageResp{PackageMsg: "success", TxResults: make(map[string]*PackageTxResp, len(res.Txs)),
+		ReplacedTransactions: make([]string, len(res.Replaced))}
+	var fee_spkb uint64
+	if res.VSize > 0 {
+		fee_spkb = 1000 * res.Fee / uint64(res.VSize)
+	}
+	network.TxMutex.Lock()
+	for _, t2s := range res.Txs {
+		t2s.Local = true // make as own
+		r.TxResults[t2s.WTxID().String()] = &PackageTxResp{Txid: t2s.Hash.String(), Vsize: t2s.VSize(),
+			Fees: PackageTxFees{Base: BtcAmount(t2s.Fee), EffectiveFeerate: BtcAmount(fee_spkb)}}
+	}
+	network.TxMutex.Unlock()
+	for i, h := range res.Replaced {
+		r.ReplacedTransactions[i] = h.String()
+	}
+	for _, t2s := range res.Txs {
+		if fee_spkb > 0 {
+			t2s.Invsentcnt += network.NetRouteInvExt(network.MSG_TX, &t2s.Hash, nil, fee_spkb)
+		} else {
+			t2s.Invsentcnt += network.NetRouteInv(network.MSG_TX, &t2s.Hash, nil)
+		}
+	}
+	resp.Result = r
+}
+
+
+func GetTxOut(cmd *RpcCommand, resp *RpcResponse) {
+	par, ok := cmd.GetParams(resp, 2, "txid", "n", "include_mempool")
+	if !ok {
+		return
+	}
+	txid, ok := ParamHash(resp, par[0], "txid")
+	if !ok {
+		return
+	}
+	vout, ok := ParamInt(par[1])
+	if !ok || vout < 0 || vout > 0xffffffff {
+		resp.Error = RpcError{Code: RPC_INVALID_PARAMETER, Message: "Invalid vout"}
+		return
+	}
+	include_mempool := true
+	if par[2] != nil {
+		if include_mempool, ok = ParamBool(par[2]); !ok {
+			resp.Error = RpcError{Code: RPC_TYPE_ERROR, Message: "include_mempool must be a boolean"}
+			return
+		}
+	}
+
+	po := &btc.TxPrevOut{Hash:txid.Hash, Vout:uint32(vout)}
+	last := common.BlockChain.LastBlock()
+	r := new(TxOutSetResp)
+	r.Bestblock = last.BlockHash.String()
+
+	if include_mempool {
+		network.TxMutex.Lock()
+		_, spent := network.SpentOutputs[po.UIdx()]
+		t2s := network.TransactionsToSend[txid.BIdx()]
+		network.TxMutex.Unlock()
+		if spent {
+			return // spent by a mempool transaction - result is null
+		}
+		if t2s != nil {
+			if int(vout) < len(t2s.TxOut) {
+				out := t2s.TxOut[vout]
+				r.Value = BtcAmount(out.Value)
+				r.ScriptPubKey = ScriptPubKey(out.Pk_script)
+				resp.Result = r
+			}
+			return
+		}
+	}
+
+	out := common.BlockChain.Unspent.UnspentGet(po)
+	if out == nil {
+		return
+	}
+	r.Confirmations = last.Height - out.BlockHeight + 1
+	r.Value = BtcAmount(out.Value)
+	r.ScriptPubKey = ScriptPubKey(out.Pk_script)
+	r.Coinbase = out.WasCoinbase
+	resp.Result = r
+}
@@ -10,6 +10,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os/exec"
+	"strings"
+	"time"
+	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
@@ -38,18 +41,40 @@ func process_rpc(b []byte) (out []byte) {
 	return
 }
 
+// Error codes as defined by bitcoind's rpc/protocol.h
+const (
+	RPC_INVALID_REQUEST = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS = -32602
+	RPC_INTERNAL_ERROR = -32603
+	RPC_PARSE_ERROR = -32700
+
+	RPC_MISC_ERROR = -1
+	RPC_TYPE_ERROR = -3
+	RPC_INVALID_ADDRESS_OR_KEY = -5
+	RPC_INVALID_PARAMETER = -8
+	RPC_DATABASE_ERROR = -20
+	RPC_DESERIALIZATION_ERROR = -22
+	RPC_VERIFY_ERROR = -25
+	RPC_VERIFY_REJECTED = -26
+	RPC_VERIFY_ALREADY_IN_CHAIN = -27
+)
+
 func my_handler(w http.ResponseWriter, r *http.Request) {
 	u, p, ok := r.BasicAuth()
 	if !ok {
 		println("No HTTP Authentication data")
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	if u != common.CFG.RPC.Username {
 		println("HTTP Authentication: bad username")
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	if p != common.CFG.RPC.Password {
 		println("HTTP Authentication: bad password")
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	//fmt.Println("========================handler", r.Method, r.URL.String(), u, p, ok, "=================")
@@ -59,16 +84,55 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var out interface{}
+	w.Header().Set("Content-Type", "application/json")
+
+	if tb := bytes.TrimSpace(b); len(tb) > 0 && tb[0] == '[' {
+		// JSON-RPC batch request
+		var batch []json.RawMessage
+		if e = json.Unmarshal(tb, &batch); e != nil {
+			out = &RpcResponse{Error: RpcError{Code: RPC_PARSE_ERROR, Message: "Parse error"}}
+		} else if len(batch) == 0 {
+			out = &RpcResponse{Error: RpcError{Code: RPC_INVALID_REQUEST, Message: "Invalid Request object"}}
+		} else {
+			res := make([]interface{}, len(batch))
+			for i := range batch {
+				res[i] = process_request(batch[i])
+			}
+			out = res
+		}
+	} else {
+		out = process_request(b)
+	}
+
+	b, e = json.Marshal(out)
+	if e != nil {
+		println("json.Marshal(&resp):", e.Error())
+	}
+
+	//ioutil.WriteFile(RpcCmd.Method+"_resp.json", b, 0777)
+	w.Write(append(b, 0x0a))
+}
+
+// Decodes and executes a single JSON-RPC request
+func process_request(b []byte) (interface{}) {
 	var RpcCmd RpcCommand
+	var resp RpcResponse
+
 	jd := json.NewDecoder(bytes.NewReader(b))
 	jd.UseNumber()
-	e = jd.Decode(&RpcCmd)
-	if e != nil {
+	if e := jd.Decode(&RpcCmd); e != nil {
 		println(e.Error())
+		resp.Error = RpcError{Code: RPC_PARSE_ERROR, Message: "Parse error"}
+		return &resp
 	}
 
-	var resp RpcResponse
 	resp.Id = RpcCmd.Id
+	if RpcCmd.Method == "" {
+		resp.Error = RpcError{Code: RPC_INVALID_REQUEST, Message: "Method must be a string"}
+		return &resp
+	}
+
 	switch RpcCmd.Method {
 		case "getblocktemplate":
 			var resp_my RpcGetBlockTemplateResp
@@ -84,7 +148,7 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 
 				jd = json.NewDecoder(bytes.NewReader(bitcoind_result))
 				jd.UseNumber()
-				e = jd.Decode(&resp_ok)
+				jd.Decode(&resp_ok)
 
 				if resp_my.Result.PreviousBlockHash != resp_ok.Result.PreviousBlockHash {
 					println("satoshi @", resp_ok.Result.PreviousBlockHash, resp_ok.Result.Height)
@@ -103,10 +167,8 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
-			b, _ = json.Marshal(&resp_my)
-			//ioutil.WriteFile("json/"+RpcCmd.Method+"_resp_my.json", b, 0777)
-			w.Write(append(b, 0x0a))
-			return
+			resp_my.Id = RpcCmd.Id
+			return &resp_my
 
 
 		case "validateaddress":
@@ -123,19 +185,170 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 			//ioutil.WriteFile("submitblock.json", b, 0777)
 			SubmitBlock(&RpcCmd, &resp, b)
 
+		case "generatetoaddress":
+			GenerateToAddress(&RpcCmd, &resp)
+
+		case "getblockchaininfo":
+			GetBlockchainInfo(&RpcCmd, &resp)
+
+		case "getblockhash":
+			GetBlockHash(&RpcCmd, &resp)
+
+		case "getblock":
+			GetBlock(&RpcCmd, &resp)
+
+		case "getblockheader":
+			GetBlockHeader(&RpcCmd, &resp)
+
+		case "getrawtransaction":
+			GetRawTransaction(&RpcCmd, &resp)
+
+		case "sendrawtransaction":
+			SendRawTransaction(&RpcCmd, &resp)
+
+		case "submitpackage":
+			SubmitPackage(&RpcCmd, &resp)
+
+		case "gettxout":
+			GetTxOut(&RpcCmd, &resp)
+
+		case "getmempoolinfo":
+			GetMempoolInfo(&RpcCmd, &resp)
+
+		case "getrawmempool":
+			GetRawMempool(&RpcCmd, &resp)
+
+		case "getmempoolentry":
+			GetMempoolEntry(&RpcCmd, &resp)
+
+		case "estimatesmartfee":
+			EstimateSmartFee(&RpcCmd, &resp)
+
+		case "getpeerinfo":
+			GetPeerInfo(&RpcCmd, &resp)
+
+		case "getnetworkinfo":
+			GetNetworkInfo(&RpcCmd, &resp)
+
+		case "getaddresstxids":
+			GetAddressTxids(&RpcCmd, &resp)
+
+		case "getaddressdeltas":
+			GetAddressDeltas(&RpcCmd, &resp)
+
+		case "getaddressbalance":
+			GetAddressBalance(&RpcCmd, &resp)
+
+		case "getaddressutxos":
+			GetAddressUtxos(&RpcCmd, &resp)
+
+		case "uptime":
+			resp.Result = int64(time.Now().Sub(common.StartTime).Seconds())
+
 		default:
 			fmt.Println("Method:", RpcCmd.Method, len(b))
 			//w.Write(bitcoind_result)
-			resp.Error = RpcError{Code: -32601, Message: "Method not found"}
+			resp.Error = RpcError{Code: RPC_METHOD_NOT_FOUND, Message: "Method not found"}
 	}
 
-	b, e = json.Marshal(&resp)
-	if e != nil {
-		println("json.Marshal(&resp):", e.Error())
+	return &resp
+}
+
+// Returns the command's parameters, given either by position or by name, aligned with the names list.
+// On error it fills up resp.Error and returns false.
+func (cmd *RpcCommand) GetParams(resp *RpcResponse, required int, names ...string) (res []interface{}, ok bool) {
+	res = make([]interface{}, len(names))
+	switch pars := cmd.Params.(type) {
+		case nil:
+		case []interface{}:
+			if len(pars) > len(names) {
+				goto wrong_count
+			}
+			copy(res, pars)
+		case map[string]interface{}:
+			for k, v := range pars {
+				var found bool
+				for i := range names {
+					if names[i] == k {
+						res[i] = v
+						found = true
+						break
+					}
+				}
+				if !found {
+					resp.Error = RpcError{Code: RPC_MISC_ERROR, Message: "Unknown named parameter " + k}
+					return
+				}
+			}
+		default:
+			resp.Error = RpcError{Code: RPC_INVALID_REQUEST, Message: "Params must be an array or object"}
+			return
 	}
+	for i := 0; i < required; i++ {
+		if res[i] == nil {
+			goto wrong_count
+		}
+	}
+	ok = true
+	return
 
-	//ioutil.WriteFile(RpcCmd.Method+"_resp.json", b, 0777)
-	w.Write(append(b, 0x0a))
+wrong_count:
+	resp.Error = RpcError{Code: RPC_MISC_ERROR, Message: cmd.Method + " " + strings.Join(names, " ")}
+	return
+}
+
+// Converts JSON parameter to an integer. Booleans are accepted as 0 and 1.
+func ParamInt(v interface{}) (res int64, ok bool) {
+	switch vv := v.(type) {
+		case json.Number:
+			var e error
+			if res, e = vv.Int64(); e == nil {
+				ok = true
+			}
+		case bool:
+			if vv {
+				res = 1
+			}
+			ok = true
+	}
+	return
+}
+
+func ParamString(v interface{}) (res string, ok bool) {
+	res, ok = v.(string)
+	return
+}
+
+// Converts JSON parameter to a bool. Numbers are accepted as false for zero and true otherwise.
+func ParamBool(v interface{}) (res bool, ok bool) {
+	switch vv := v.(type) {
+		case bool:
+			res, ok = vv, true
+		case json.Number:
+			var f float64
+			var e error
+			if f, e = vv.Float64(); e == nil {
+				res, ok = f != 0, true
+			}
+	}
+	return
+}
+
+// Reads a hash from the params, returning false (with resp.Error set) if it was not a valid one.
+func ParamHash(resp *RpcResponse, v interface{}, name string) (res *btc.Uint256, ok bool) {
+	if s, _ := ParamString(v); len(s) == 64 {
+		if res = btc.NewUint256FromString(s); res != nil {
+			ok = true
+			return
+		}
+	}
+	resp.Error = RpcError{Code: RPC_INVALID_PARAMETER, Message: name + " must be of length 64 (hexadecimal string)"}
+	return
+}
+
+// Returns the BTC amount as a JSON number with 8 decimal places
+func BtcAmount(val uint64) json.Number {
+	return json.Number(btc.UintToBtc(val))
 }
 
 func StartServer(port uint32) {
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/gob"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"os"
 	"sync"
@@ -11,6 +12,7 @@ import (
 
 const (
 	BLKFES_FILE_NAME = "blkfees.gob"
+	FEEEST_FILE_NAME = "feeest.gob"
 )
 
 var (
@@ -110,3 +112,32 @@ func LoadBlockFees() {
 
 	f.Close()
 }
+
+func SaveFeeEstimator() {
+	f, er := os.Create(common.GocoinHomeDir + FEEEST_FILE_NAME)
+	if er != nil {
+		println("SaveFeeEstimator:", er.Error())
+		return
+	}
+
+	buf := bufio.NewWriter(f)
+	if er = network.FeeEstimator.Save(buf); er != nil {
+		println("SaveFeeEstimator:", er.Error())
+	}
+
+	buf.Flush()
+	f.Close()
+}
+
+func LoadFeeEstimator() {
+	f, er := os.Open(common.GocoinHomeDir + FEEEST_FILE_NAME)
+	if er != nil {
+		return // nothing collected yet
+	}
+
+	if er = network.FeeEstimator.Load(bufio.NewReader(f)); er != nil {
+		println("LoadFeeEstimator:", er.Error())
+	}
+
+	f.Close()
+}
@@ -0,0 +1,39 @@
+package usif
+
+import (
+	"fmt"
+	"github.com/piotrnar/gocoin/client/common"
+	"time"
+)
+
+var (
+	UTXOSnapshotAt uint32 // if not zero, UTXO snapshot will be written when the chain reaches this height
+)
+
+// UTXOSnapshotFileName returns the name of the snapshot file for the given block height
+func UTXOSnapshotFileName(height uint32) string {
+	return common.GocoinHomeDir + fmt.Sprint("utxo-", height, ".snap")
+}
+
+// WriteUTXOSnapshot stores the current UTXO set in GocoinHomeDir - call it from the main thread
+func WriteUTXOSnapshot() {
+	height := common.BlockChain.LastBlock().Height
+	fn := UTXOSnapshotFileName(height)
+	fmt.Println("Writing UTXO snapshot at block", height, "to", fn, "...")
+	sta := time.Now()
+	hash, cnt, er := common.BlockChain.WriteSnapshot(fn)
+	if er != nil {
+		fmt.Println("WriteUTXOSnapshot:", er.Error())
+		return
+	}
+	fmt.Println(cnt, "records written in", time.Now().Sub(sta).String())
+	fmt.Println("Snapshot hash (AssumeUTXO):", hash.String())
+}
+
+// Called from the main thread, after a new block has been connected
+func UTXOSnapshotCheck(height uint32) {
+	if UTXOSnapshotAt != 0 && height >= UTXOSnapshotAt {
+		UTXOSnapshotAt = 0
+		WriteUTXOSnapshot()
+	}
+}
@@ -219,6 +219,40 @@ func show_counters(par string) {
 }
 
 func show_pending(par string) {
+	dl := network.GetBlockDlInfo()
+	if dl.WindowStart != 0 {
+		fmt.Printf("Download window: %d ... %d,  Full: %t,  Stall timeout: %s\n", dl.WindowStart, dl.WindowEnd,
+			dl.WindowFull, dl.StallTimeout.String())
+		if dl.LowestHash != nil {
+			fmt.Print("Lowest block: ", dl.LowestHash.String(), "  in progress from ", dl.LowestFrom)
+			if !dl.LowestSince.IsZero() {
+				fmt.Print(" - waiting ", time.Now().Sub(dl.LowestSince).String())
+			}
+			fmt.Println()
+		}
+	} else {
+		fmt.Println("Download window empty,  Stall timeout:", dl.StallTimeout.String())
+	}
+
+	var peers []*network.ConnInfo
+	network.Mutex_net.Lock()
+	for _, v := range network.OpenCons {
+		r := new(network.ConnInfo)
+		v.GetStats(r)
+		if r.BlocksInProgress > 0 || r.DlBytes > 0 {
+			peers = append(peers, r)
+		}
+	}
+	network.Mutex_net.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].DlSpeed > peers[j].DlSpeed })
+	for _, r := range peers {
+		fmt.Printf(" %5d %-22s  %8.1f KB/s  %5d in progress  %9d KB got  %3d stall(s)\n", r.ID, r.PeerIp,
+			r.DlSpeed/1e3, r.BlocksInProgress, r.DlBytes>>10, r.DlStalls)
+	}
+	if par == "peers" {
+		return
+	}
+
 	network.MutexRcv.Lock()
 	out := make([]string, len(network.BlocksToGet))
 	var idx int
@@ -388,7 +422,16 @@ func save_config(s string) {
 }
 
 func show_addresses(par string) {
-	fmt.Println(peersdb.PeerDB.Count(), "peers in the database")
+	fmt.Print(peersdb.PeerDB.Count(), " peers in the database:")
+	for id, cnt := range peersdb.NetworkCounts() {
+		if cnt > 0 {
+			fmt.Print("  ", btc.NetName(byte(id)), ":", cnt)
+			if !peersdb.NetReachable[id] {
+				fmt.Print("(unreachable)")
+			}
+		}
+	}
+	fmt.Println()
 	if par == "list" {
 		cnt := 0
 		peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
@@ -456,7 +499,7 @@ func unban_peer(par string) {
 		peer := peersdb.NewPeer(v)
 		if peer.Banned != 0 {
 			if ad == nil || peer.Ip() == ad.Ip() {
-				fmt.Println(" -", peer.NetAddr.String())
+				fmt.Println(" -", peer.Ip())
 				peer.Banned = 0
 				keys = append(keys, k)
 				vals = append(vals, peer.Bytes())
@@ -562,6 +605,32 @@ func purge_utxo(par string) {
 	common.BlockChain.Unspent.PurgeUnspendable(par == "all")
 }
 
+func utxo_snapshot(par string) {
+	last := common.BlockChain.LastBlock().Height
+	if par == "" {
+		if usif.UTXOSnapshotAt != 0 {
+			fmt.Println("UTXO snapshot scheduled at block", usif.UTXOSnapshotAt)
+		}
+		usif.WriteUTXOSnapshot()
+		return
+	}
+	h, er := strconv.ParseUint(par, 10, 32)
+	if er != nil {
+		fmt.Println("Specify block height")
+		return
+	}
+	if uint32(h) < last {
+		fmt.Println("The chain is already at block", last, "- cannot go back")
+		return
+	}
+	if uint32(h) == last {
+		usif.WriteUTXOSnapshot()
+		return
+	}
+	usif.UTXOSnapshotAt = uint32(h)
+	fmt.Println("UTXO snapshot will be written at block", h, "to", usif.UTXOSnapshotFileName(uint32(h)))
+}
+
 func init() {
 	newUi("bchain b", true, blchain_stats, "Display blockchain statistics")
 	newUi("bip9", true, analyze_bip9, "Analyze current blockchain for BIP9 bits (add 'all' to see more)")
@@ -576,7 +645,7 @@ func init() {
 	newUi("inv", false, send_inv, "Send inv message to all the peers - specify type & hash")
 	newUi("mem", false, show_mem, "Show detailed memory stats (optionally free, gc or a numeric param)")
 	newUi("peers", false, show_addresses, "Dump pers database (specify number)")
-	newUi("pend", false, show_pending, "Show pending blocks, to be fetched")
+	newUi("pend", false, show_pending, "Show block download state and pending blocks, to be fetched (add 'peers' to skip the blocks)")
 	newUi("purge", true, purge_utxo, "Purge unspendable outputs from UTXO database (add 'all' to purge everything)")
 	newUi("quit q", false, ui_quit, "Quit the node")
 	newUi("savebl", false, dump_block, "Saves a block with a given hash to a binary file")
@@ -585,4 +654,5 @@ func init() {
 	newUi("ulimit ul", false, set_ulmax, "Set maximum upload speed. The value is in KB/second - 0 for unlimited")
 	newUi("unban", false, unban_peer, "Unban a peer specified by IP[:port] (or 'unban all')")
 	newUi("utxo u", true, blchain_utxodb, "Display UTXO-db statistics")
+	newUi("utxosnap", true, utxo_snapshot, "Write UTXO snapshot now, or when the chain reaches the given height (see -loadsnap)")
 }
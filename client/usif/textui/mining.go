@@ -5,8 +5,10 @@ import (
 	"time"
 	"regexp"
 	"strconv"
+	"strings"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/rpcapi"
 )
 
 
@@ -95,6 +97,36 @@ func do_mining(s string) {
 }
 
 
+func do_generate(s string) {
+	pars := strings.Fields(s)
+	if len(pars) < 1 || len(pars) > 2 {
+		fmt.Println("Specify the number of blocks and optionally an address to mine to")
+		return
+	}
+	cnt, er := strconv.ParseUint(pars[0], 10, 32)
+	if er != nil {
+		fmt.Println("Incorrect number of blocks:", er.Error())
+		return
+	}
+	pk_script := rpcapi.AnyoneCanSpendScript()
+	if len(pars) == 2 {
+		addr, er := btc.NewAddrFromString(pars[1])
+		if er != nil || addr == nil {
+			fmt.Println("Incorrect address:", pars[1])
+			return
+		}
+		pk_script = addr.OutScript()
+	}
+	hashes, er := rpcapi.GenerateBlocks(int(cnt), pk_script)
+	for _, h := range hashes {
+		fmt.Println("Mined", h)
+	}
+	if er != nil {
+		fmt.Println("Error:", er.Error())
+	}
+}
+
 func init() {
+	newUi("generate", false, do_generate, "Mine N blocks on regtest - optionally to an address (by default anyone-can-spend)")
 	newUi("minerstat m", false, do_mining, "Look for the miner ID in recent blocks (optionally specify number of hours)")
 }
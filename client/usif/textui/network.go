@@ -70,6 +70,18 @@ func node_info(par string) {
 	}
 	if !r.ConnectedAt.IsZero() {
 		fmt.Println("Connected at", r.ConnectedAt.Format("2006-01-02 15:04:05"))
+		if r.V2Transport {
+			fmt.Println("Transport: v2 (encrypted) / Session ID:", r.SessionID)
+		} else {
+			fmt.Println("Transport: v1 (plaintext)")
+		}
+		if r.Proxied {
+			if r.Incomming {
+				fmt.Println("Via our onion service")
+			} else {
+				fmt.Println("Via proxy")
+			}
+		}
 		if r.Version!=0 {
 			fmt.Println("Node Version:", r.Version, "/ Services:", fmt.Sprintf("0x%x", r.Services))
 			fmt.Println("User Agent:", r.Agent)
@@ -87,6 +99,7 @@ func node_info(par string) {
 		fmt.Print("Bytes to send:", r.BytesToSend, " (", r.MaxSentBufSize, " max)\n")
 		fmt.Print("BlockInProgress:", r.BlocksInProgress, "  GetHeadersInProgress:", r.GetHeadersInProgress, "\n")
 		fmt.Println("GetBlocksDataNow:", r.GetBlocksDataNow)
+		fmt.Printf("Block download: %.1f KB/s,  %d KB got,  %d stall(s)\n", r.DlSpeed/1e3, r.DlBytes>>10, r.DlStalls)
 		fmt.Println("AllHeadersReceived:", r.AllHeadersReceived)
 		fmt.Println("Total Received:", r.BytesReceived, " /  Sent:", r.BytesSent)
 		for k, v := range r.Counters {
@@ -139,6 +152,16 @@ func net_stats(par string) {
 		} else {
 			fmt.Print(" ->")
 		}
+		if v.X.V2Transport {
+			fmt.Print(" v2")
+		} else {
+			fmt.Print(" v1")
+		}
+		if v.X.Proxied {
+			fmt.Print("T")
+		} else {
+			fmt.Print(" ")
+		}
 		fmt.Printf(" %21s %5dms %7d : %-16s %7d : %-16s", v.PeerAddr.Ip(),
 			v.GetAveragePing(), v.X.LastBtsRcvd, v.X.LastCmdRcvd, v.X.LastBtsSent, v.X.LastCmdSent)
 		fmt.Printf("%9s %9s", common.BytesToString(v.X.Counters["BytesReceived"]), common.BytesToString(v.X.Counters["BytesSent"]))
@@ -162,6 +185,9 @@ func net_stats(par string) {
 	} else {
 		fmt.Println("No known external address")
 	}
+	if network.OnionAddress != "" {
+		fmt.Println("Onion service:", network.OnionAddress)
+	}
 
 	network.Mutex_net.Unlock()
 
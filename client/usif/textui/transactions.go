@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -30,6 +31,24 @@ func load_tx(par string) {
 	fmt.Println(usif.LoadRawTx(buf))
 }
 
+func submit_package(par string) {
+	files := strings.Fields(par)
+	if len(files) == 0 {
+		fmt.Println("Specify names of the transaction files - the parents first and the child last")
+		return
+	}
+	bufs := make([][]byte, len(files))
+	for i, fn := range files {
+		buf, e := ioutil.ReadFile(fn)
+		if e != nil {
+			println(e.Error())
+			return
+		}
+		bufs[i] = buf
+	}
+	fmt.Print(usif.LoadRawPackage(bufs))
+}
+
 func send_tx(par string) {
 	txid := btc.NewUint256FromString(par)
 	if txid == nil {
@@ -102,6 +121,15 @@ func dec_tx(par string) {
 	if tx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
 		s, _, _, _, _ := usif.DecodeTx(tx.Tx)
 		fmt.Println(s)
+	} else if raw, n, er := common.BlockChain.FindTx(txid); er == nil {
+		if tx, offs := btc.NewTx(raw); tx != nil && offs == len(raw) {
+			tx.SetHash(raw)
+			s, _, _, _, _ := usif.DecodeTx(tx)
+			fmt.Println(s)
+		} else {
+			fmt.Println("Transaction index record cannot be decoded")
+		}
+		fmt.Println("Mined in block", n.Height, n.BlockHash.String())
 	} else {
 		fmt.Println("No such transaction ID in the memory pool.")
 	}
@@ -118,11 +146,28 @@ func save_tx(par string) {
 		fn := tx.Hash.String() + ".tx"
 		ioutil.WriteFile(fn, tx.Raw, 0600)
 		fmt.Println("Saved to", fn)
+	} else if raw, _, er := common.BlockChain.FindTx(txid); er == nil {
+		fn := txid.String() + ".tx"
+		ioutil.WriteFile(fn, raw, 0600)
+		fmt.Println("Saved to", fn)
 	} else {
 		fmt.Println("No such transaction ID in the memory pool.")
 	}
 }
 
+func tx_index(par string) {
+	if common.BlockChain.TxIdx == nil {
+		fmt.Println("Transaction index is not enabled (see -txindex switch)")
+		return
+	}
+	if par == "rebuild" {
+		common.BlockChain.ResetTxIndex()
+		fmt.Println("Transaction index is being rebuilt in the background")
+		return
+	}
+	fmt.Print(common.BlockChain.TxIdx.Stats())
+}
+
 func mempool_stats(par string) {
 	fmt.Print(usif.MemoryPoolFees())
 }
@@ -181,15 +226,20 @@ func baned_txs(par string) {
 }
 
 func send_all_tx(par string) {
+	var local []*network.OneTxToSend
 	network.TxMutex.Lock()
-	for k, v := range network.TransactionsToSend {
+	for _, v := range network.TransactionsToSend {
 		if v.Local {
-			cnt := network.NetRouteInv(1, btc.NewUint256(k[:]), nil)
-			v.Invsentcnt += cnt
-			fmt.Println("INV for TxID", v.Hash.String(), "sent to", cnt, "node(s)")
+			local = append(local, v)
 		}
 	}
 	network.TxMutex.Unlock()
+	// NetRouteInv locks TxMutex itself
+	for _, v := range local {
+		cnt := network.NetRouteInv(1, &v.Hash, nil)
+		v.Invsentcnt += cnt
+		fmt.Println("INV for TxID", v.Hash.String(), "sent to", cnt, "node(s)")
+	}
 }
 
 func save_mempool(par string) {
@@ -244,15 +294,17 @@ func get_mempool(par string) {
 
 func init() {
 	newUi("txload tx", true, load_tx, "Load transaction data from the given file, decode it and store in memory")
+	newUi("submitpackage txpkg", true, submit_package, "Load a package of transactions (parents first, child last) from the given files and store it in memory")
 	newUi("txsend stx", true, send_tx, "Broadcast transaction from memory pool (identified by a given <txid>)")
 	newUi("tx1send stx1", true, send1_tx, "Broadcast transaction to a single random peer (identified by a given <txid>)")
 	newUi("txsendall stxa", true, send_all_tx, "Broadcast all the transactions (what you see after ltx)")
 	newUi("txdel dtx", true, del_tx, "Remove a transaction from memory pool (identified by a given <txid>)")
-	newUi("txdecode td", true, dec_tx, "Decode a transaction from memory pool (identified by a given <txid>)")
+	newUi("txdecode td", true, dec_tx, "Decode a transaction from memory pool or txindex (identified by a given <txid>)")
 	newUi("txlist ltx", true, list_txs, "List all the transaction loaded into memory pool up to 1MB space <max_size>")
 	newUi("txlistban ltxb", true, baned_txs, "List the transaction that we have rejected")
 	newUi("mempool mp", true, mempool_stats, "Show the mempool statistics")
-	newUi("txsave", true, save_tx, "Save raw transaction from memory pool to disk")
+	newUi("txsave", true, save_tx, "Save raw transaction from memory pool or txindex to disk")
+	newUi("txindex txi", false, tx_index, "Show transaction index status (or 'txindex rebuild' to rebuild it)")
 	newUi("txmpsave mps", true, save_mempool, "Save memory pool to disk")
 	newUi("txcheck txc", true, check_txs, "Verify consistency of mempool")
 	newUi("txmpload mpl", true, load_mempool, "Load transaction from the given file (must be in mempool.dmp format)")
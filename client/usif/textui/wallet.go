@@ -7,8 +7,10 @@ import (
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/wallet"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/descriptor"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 type OneWalletAddrs struct {
@@ -55,17 +57,18 @@ func new_slice(in []byte) (kk []byte) {
 func all_addrs(par string) {
 	var ptkh_outs, ptkh_vals, ptsh_outs, ptsh_vals uint64
 	var ptwkh_outs, ptwkh_vals, ptwsh_outs, ptwsh_vals uint64
+	var ptr_outs, ptr_vals uint64
 	var best SortedWalletAddrs
 	var cnt int = 15
 	var mode int
 
 	if par != "" {
 		if c, e := strconv.ParseUint(par, 10, 32); e == nil {
-			if c > 3 {
+			if c > 4 {
 				cnt = int(c)
 			} else {
 				mode = int(c+1)
-				fmt.Println("Counting only addr type", ([]string{"P2KH", "P2SH", "P2WKH", "P2WSH"})[int(c)])
+				fmt.Println("Counting only addr type", ([]string{"P2KH", "P2SH", "P2WKH", "P2WSH", "P2TR"})[int(c)])
 			}
 		}
 	}
@@ -122,6 +125,17 @@ func all_addrs(par string) {
 		fmt.Println(btc.UintToBtc(ptwsh_vals), "BTC in", ptwsh_outs, "unspent recs from", len(wallet.AllBalancesP2WSH), "P2WSH addresses")
 	}
 
+	if mode==0 || mode==5 {
+		for k, rec := range wallet.AllBalancesP2TR {
+			ptr_vals += rec.Value
+			ptr_outs += uint64(rec.Count())
+			if sort_by_cnt && rec.Count() >= MIN_OUTS || !sort_by_cnt && rec.Value >= MIN_BTC {
+				best = append(best, OneWalletAddrs{Typ:3, Key: new_slice(k[:]), rec: rec})
+			}
+		}
+		fmt.Println(btc.UintToBtc(ptr_vals), "BTC in", ptr_outs, "unspent recs from", len(wallet.AllBalancesP2TR), "P2TR addresses")
+	}
+
 
 	if sort_by_cnt {
 		fmt.Println("Top addresses with at least", MIN_OUTS, "unspent outputs:", len(best))
@@ -149,15 +163,18 @@ func all_addrs(par string) {
 		switch best[i].Typ {
 			case 0:
 				copy(pkscr_p2kh[3:23], best[i].Key)
-				ad = btc.NewAddrFromPkScript(pkscr_p2kh[:], common.CFG.Testnet)
+				ad = btc.NewAddrFromPkScript(pkscr_p2kh[:], common.Testnet)
 			case 1:
 				copy(pkscr_p2sk[2:22], best[i].Key)
-				ad = btc.NewAddrFromPkScript(pkscr_p2sk[:], common.CFG.Testnet)
+				ad = btc.NewAddrFromPkScript(pkscr_p2sk[:], common.Testnet)
 			case 2:
 				ad = new(btc.BtcAddr)
 				ad.SegwitProg = new(btc.SegwitProg)
-				ad.SegwitProg.HRP = btc.GetSegwitHRP(common.CFG.Testnet)
+				ad.SegwitProg.HRP = btc.GetSegwitHRP(common.Testnet)
 				ad.SegwitProg.Program = best[i].Key
+			case 3:
+				ad = new(btc.BtcAddr)
+				ad.SegwitProg = &btc.SegwitProg{HRP:btc.GetSegwitHRP(common.Testnet), Version:1, Program:best[i].Key}
 		}
 		fmt.Println(i+1, ad.String(), btc.UintToBtc(best[i].rec.Value), "BTC in", best[i].rec.Count(), "inputs")
 	}
@@ -212,6 +229,47 @@ func list_unspent(addr string) {
 	network.TxMutex.Unlock()
 }
 
+func desc_balance(par string) {
+	pars := strings.Fields(par)
+	if len(pars) == 0 {
+		fmt.Println("Specify output descriptor and optionally the gap limit")
+		return
+	}
+	d, e := descriptor.Parse(pars[0])
+	if e != nil {
+		println(e.Error())
+		return
+	}
+	var gap uint32 = 20
+	if len(pars) > 1 {
+		if v, e := strconv.ParseUint(pars[1], 10, 32); e == nil && v > 0 {
+			gap = uint32(v)
+		}
+	}
+
+	fmt.Println("Checking", d.String())
+	addrs, _, e := wallet.DescriptorAddrs(d, gap)
+	if e != nil {
+		println(e.Error())
+	}
+	var tot uint64
+	var cnt int
+	for _, aa := range addrs {
+		unsp := wallet.GetAllUnspent(aa)
+		if len(unsp) == 0 {
+			continue
+		}
+		var val uint64
+		for i := range unsp {
+			val += unsp[i].Value
+		}
+		fmt.Printf("%15s BTC in %d outputs of %s %s\n", btc.UintToBtc(val), len(unsp), aa.String(), aa.Extra.Label)
+		tot += val
+		cnt += len(unsp)
+	}
+	fmt.Println(btc.UintToBtc(tot), "BTC in", cnt, "unspent outputs from", len(addrs), "addresses checked")
+}
+
 func all_val_stats(s string) {
 	wallet.PrintStat()
 }
@@ -249,9 +307,10 @@ func wallet_on_off(s string) {
 }
 
 func init() {
-	newUi("richest r", true, best_val, "Show addresses with most coins [0,1,2,3 or count]")
-	newUi("maxouts o", true, max_outs, "Show addresses with highest number of outputs [0,1,2,3 or count]")
+	newUi("richest r", true, best_val, "Show addresses with most coins [0,1,2,3,4 or count]")
+	newUi("maxouts o", true, max_outs, "Show addresses with highest number of outputs [0,1,2,3,4 or count]")
 	newUi("balance a", true, list_unspent, "List balance of given bitcoin address")
+	newUi("descbal db", true, desc_balance, "List balance of given output descriptor <desc> [gap_limit]")
 	newUi("allbal ab", true, all_val_stats, "Show Allbalance statistics")
 	newUi("wallet w", false, wallet_on_off, "Enable (on) or disable (off) wallet functionality")
 }
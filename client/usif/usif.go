@@ -11,6 +11,7 @@ import (
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/lib/script"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 )
@@ -41,6 +42,7 @@ func DecodeTxSops(tx *btc.Tx) (s string, missinginp bool, totinp, totout uint64,
 	s += fmt.Sprintln("Transaction details (for your information):")
 	s += fmt.Sprintln(len(tx.TxIn), "Input(s):")
 	sigops = btc.WITNESS_SCALE_FACTOR * tx.GetLegacySigOpCount()
+	network.SetSpentOutputs(tx)
 	for i := range tx.TxIn {
 		s += fmt.Sprintf(" %3d %s", i, tx.TxIn[i].Input.String())
 		var po *btc.TxOut
@@ -171,6 +173,45 @@ func LoadRawTx(buf []byte) (s string) {
 	return
 }
 
+// Same as LoadRawTx, but for a package (parents first, the child last)
+func LoadRawPackage(bufs [][]byte) (s string) {
+	txs := make([]*btc.Tx, len(bufs))
+	for i, buf := range bufs {
+		txd, er := hex.DecodeString(strings.TrimSpace(string(buf)))
+		if er != nil {
+			txd = buf
+		}
+		tx, le := btc.NewTx(txd)
+		if tx == nil || le != len(txd) {
+			s += fmt.Sprintln("Could not decode transaction file", i+1, "or it has some extra data")
+			return
+		}
+		tx.SetHash(txd)
+		txs[i] = tx
+		network.RemoveFromRejected(&tx.Hash) // in case we rejected it eariler, to try it again as trusted
+	}
+
+	res, e := network.SubmitLocalPackage(txs)
+	if e != nil {
+		s += fmt.Sprintln("Package rejected:", e.Error())
+		return
+	}
+
+	network.TxMutex.Lock()
+	for _, t2s := range res.Txs {
+		t2s.Local = true // make as own
+		s += fmt.Sprintln(" ", t2s.Hash.String(), "fee", t2s.Fee, "vsize", t2s.VSize())
+	}
+	network.TxMutex.Unlock()
+	if res.VSize > 0 {
+		s += fmt.Sprintf("Package added to the memory pool at %.1f SPB. You can broadcast it now.\n", float64(res.Fee)/float64(res.VSize))
+	}
+	for _, h := range res.Replaced {
+		s += fmt.Sprintln("Replaced", h.String())
+	}
+	return
+}
+
 func SendInvToRandomPeer(typ uint32, h *btc.Uint256) {
 	common.CountSafe(fmt.Sprint("NetSendOneInv", typ))
 
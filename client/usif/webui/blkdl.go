@@ -0,0 +1,93 @@
+package webui
+
+import (
+	"encoding/json"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+	"net/http"
+	"sort"
+	"time"
+)
+
+func p_blkdl(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	write_html_head(w, r)
+	w.Write([]byte(load_template("blkdl.html")))
+	write_html_tail(w)
+}
+
+func json_blkdl(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	type one_peer struct {
+		ID               uint32
+		PeerIp           string
+		Agent            string
+		Height           uint32
+		BlocksInProgress int
+		DlSpeed          float64
+		DlBytes          uint64
+		DlStalls         uint
+	}
+
+	var out struct {
+		Height          uint32
+		LastHeader      uint32
+		BlocksToGet     int
+		WindowStart     uint32
+		WindowEnd       uint32
+		WindowFull      bool
+		StallTimeout    int // in milliseconds
+		LowestHash      string
+		LowestFrom      []uint32
+		LowestWaitingMs int
+		Peers           []*one_peer
+	}
+
+	dl := network.GetBlockDlInfo()
+	out.WindowStart = dl.WindowStart
+	out.WindowEnd = dl.WindowEnd
+	out.WindowFull = dl.WindowFull
+	out.StallTimeout = int(dl.StallTimeout / time.Millisecond)
+	if dl.LowestHash != nil {
+		out.LowestHash = dl.LowestHash.String()
+	}
+	out.LowestFrom = dl.LowestFrom
+	if !dl.LowestSince.IsZero() {
+		out.LowestWaitingMs = int(time.Now().Sub(dl.LowestSince) / time.Millisecond)
+	}
+
+	common.Last.Mutex.Lock()
+	out.Height = common.Last.Block.Height
+	common.Last.Mutex.Unlock()
+
+	network.MutexRcv.Lock()
+	out.BlocksToGet = len(network.BlocksToGet)
+	out.LastHeader = network.LastCommitedHeader.Height
+	network.MutexRcv.Unlock()
+
+	var ci network.ConnInfo
+	network.Mutex_net.Lock()
+	for _, v := range network.OpenCons {
+		v.GetStats(&ci)
+		if ci.BlocksInProgress > 0 || ci.DlBytes > 0 {
+			out.Peers = append(out.Peers, &one_peer{ID: ci.ID, PeerIp: ci.PeerIp, Agent: ci.Agent, Height: ci.Height,
+				BlocksInProgress: ci.BlocksInProgress, DlSpeed: ci.DlSpeed, DlBytes: ci.DlBytes, DlStalls: ci.DlStalls})
+		}
+	}
+	network.Mutex_net.Unlock()
+	sort.Slice(out.Peers, func(i, j int) bool { return out.Peers[i].DlSpeed > out.Peers[j].DlSpeed })
+
+	bx, er := json.Marshal(&out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
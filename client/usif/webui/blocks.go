@@ -86,7 +86,7 @@ func json_blocks(w http.ResponseWriter, r *http.Request) {
 
 		b.Miner, _ = common.TxMiner(cbasetx)
 		if len(bl)-block.TxOffset-cbaselen != 0 {
-			b.FeeSPB = float64(b.Reward-btc.GetBlockReward(end.Height)) / float64(len(bl)-block.TxOffset-cbaselen)
+			b.FeeSPB = float64(b.Reward-common.BlockChain.GetBlockReward(end.Height)) / float64(len(bl)-block.TxOffset-cbaselen)
 		}
 
 		common.BlockChain.BlockIndexAccess.Lock()
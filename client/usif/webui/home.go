@@ -119,6 +119,8 @@ func json_system(w http.ResponseWriter, r *http.Request) {
 		LastHeaderHeight uint32
 		NetworkHashRate float64
 		SavingUTXO bool
+		Pruning bool
+		PruneHeight uint32
 	}
 
 	out.Blocks_cached = network.CachedBlocksLen.Get()
@@ -147,6 +149,8 @@ func json_system(w http.ResponseWriter, r *http.Request) {
 	mutexHrate.Unlock()
 
 	out.SavingUTXO = common.BlockChain.Unspent.WritingInProgress.Get()
+	out.Pruning = common.BlockChain.Blocks.PruneEnabled()
+	out.PruneHeight = common.BlockChain.Blocks.PruneHeight()
 
 	bx, er := json.Marshal(out)
 	if er == nil {
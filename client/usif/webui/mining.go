@@ -150,7 +150,7 @@ func json_miners(w http.ResponseWriter, r *http.Request) {
 		for o := range cbasetx.TxOut {
 			rew += cbasetx.TxOut[o].Value
 		}
-		fees := rew - btc.GetBlockReward(end.Height)
+		fees := rew - common.BlockChain.GetBlockReward(end.Height)
 		if int64(fees) > 0 { // solution for a possibility of a miner not claiming the reward (see block #501726)
 			om.fees += fees
 		}
@@ -25,6 +25,11 @@ func p_net(w http.ResponseWriter, r *http.Request) {
 	network.Mutex_net.Lock()
 	net_page = strings.Replace(net_page, "{LISTEN_TCP}", fmt.Sprint(common.IsListenTCP(), network.TCPServerStarted), 1)
 	net_page = strings.Replace(net_page, "{EXTERNAL_ADDR}", btc.NewNetAddr(network.BestExternalAddr()).String(), 1)
+	if network.OnionAddress != "" {
+		net_page = strings.Replace(net_page, "{ONION_SERVICE}", "Onion service: <b>"+network.OnionAddress+"</b><br>", 1)
+	} else {
+		net_page = strings.Replace(net_page, "{ONION_SERVICE}", "", 1)
+	}
 
 	network.Mutex_net.Unlock()
 
@@ -2,16 +2,15 @@ package webui
 
 import (
 	"fmt"
-	"bytes"
 	"strings"
 	"strconv"
 	"net/http"
-	"archive/zip"
-	"encoding/hex"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/psbt"
 	"github.com/piotrnar/gocoin/lib/utxo"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/rpcapi"
 )
 
 
@@ -38,7 +37,7 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 
 	if len(r.Form["outcnt"])==1 {
 		var thisbal utxo.AllUnspentTx
-		var pay_cmd string
+		var spent []*btc.TxOut
 		var totalinput, spentsofar uint64
 		var change_addr *btc.BtcAddr
 
@@ -76,6 +75,7 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 								MinedAt:res.BlockHeight, Coinbase:res.WasCoinbase, BtcAddr:addr}
 
 							thisbal = append(thisbal, unsp)
+							spent = append(spent, res)
 
 							// Add the input to our tx
 							tin := new(btc.TxIn)
@@ -114,14 +114,7 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 				if er == nil {
 					am, er := btc.StringToSatoshis(r.Form[btcidx][0])
 					if er==nil && am>0 {
-						if pay_cmd=="" {
-							pay_cmd = "wallet -a=false -useallinputs -send "
-						} else {
-							pay_cmd += ","
-						}
-						pay_cmd += addr.String() + "=" + btc.UintToBtc(am)
-
-						outs, er := btc.NewSpendOutputs(addr, am, common.CFG.Testnet)
+						outs, er := btc.NewSpendOutputs(addr, am, common.Testnet)
 						if er != nil {
 							err = er.Error()
 							goto error
@@ -140,20 +133,17 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		if pay_cmd=="" {
-			err = "No inputs selected"
+		if len(tx.TxOut)==0 {
+			err = "No outputs specified"
 			goto error
 		}
 
-		pay_cmd += fmt.Sprint(" -seq ", seq)
-
 		am, er := btc.StringToSatoshis(r.Form["txfee"][0])
 		if er != nil {
 			err = "Incorrect fee value: " + r.Form["txfee"][0]
 			goto error
 		}
 
-		pay_cmd += " -fee " + r.Form["txfee"][0]
 		spentsofar += am
 
 		if len(r.Form["change"][0])>1 {
@@ -164,11 +154,10 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 			}
 			change_addr = addr
 		}
-		pay_cmd += " -change " + change_addr.String()
 
 		if totalinput > spentsofar {
 			// Add change output
-			outs, er := btc.NewSpendOutputs(change_addr, totalinput - spentsofar, common.CFG.Testnet)
+			outs, er := btc.NewSpendOutputs(change_addr, totalinput - spentsofar, common.Testnet)
 			if er != nil {
 				err = er.Error()
 				goto error
@@ -176,42 +165,39 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 			tx.TxOut = append(tx.TxOut, outs...)
 		}
 
-		buf := new(bytes.Buffer)
-		zi := zip.NewWriter(buf)
+		pt, er := psbt.New(tx)
+		if er != nil {
+			err = er.Error()
+			goto error
+		}
 
-		was_tx := make(map [[32]byte] bool, len(thisbal))
+		// Signers need the transactions (or just the outputs, for segwit) that are being spent
+		prv_txs := make(map [[32]byte] *btc.Tx, len(thisbal))
 		for i := range thisbal {
-			if was_tx[thisbal[i].TxPrevOut.Hash] {
-				continue
+			in := pt.Inputs[i]
+			ptx, ok := prv_txs[in.PrevOut.Hash]
+			if !ok {
+				txid := btc.NewUint256(in.PrevOut.Hash[:])
+				if dat, er := common.GetRawTx(thisbal[i].MinedAt, txid); er == nil {
+					if ptx, _ = btc.NewTx(dat); ptx != nil {
+						ptx.SetHash(dat)
+					}
+				} else {
+					println(er.Error())
+				}
+				prv_txs[in.PrevOut.Hash] = ptx
 			}
-			was_tx[thisbal[i].TxPrevOut.Hash] = true
-			txid := btc.NewUint256(thisbal[i].TxPrevOut.Hash[:])
-			fz, _ := zi.Create("balance/" + txid.String() + ".tx")
-			if dat, er := common.GetRawTx(thisbal[i].MinedAt, txid); er == nil {
-				fz.Write(dat)
-			} else {
-				println(er.Error())
+			if ptx != nil && int(in.PrevOut.Vout) < len(ptx.TxOut) {
+				in.NonWitnessUtxo = ptx
+			}
+			if _, prog := btc.IsWitnessProgram(spent[i].Pk_script); prog != nil {
+				in.WitnessUtxo = &btc.TxOut{Value:spent[i].Value, Pk_script:spent[i].Pk_script}
 			}
 		}
 
-		fz, _ := zi.Create("balance/unspent.txt")
-		for i := range thisbal {
-			fmt.Fprintln(fz, thisbal[i].UnspentTextLine())
-		}
-
-		if pay_cmd!="" {
-			fz, _ = zi.Create(common.CFG.WebUI.PayCmdName)
-			fz.Write([]byte(pay_cmd))
-		}
-
-		// Non-multisig transaction ...
-		fz, _ = zi.Create("tx2sign.txt")
-		fz.Write([]byte(hex.EncodeToString(tx.Serialize())))
-
-
-		zi.Close()
-		w.Header()["Content-Type"] = []string{"application/zip"}
-		w.Write(buf.Bytes())
+		w.Header()["Content-Type"] = []string{"application/octet-stream"}
+		w.Header()["Content-Disposition"] = []string{"attachment; filename=\"" + pt.UnsignedTx().Hash.String()[:8] + ".psbt\""}
+		w.Write(pt.Serialize())
 		return
 	} else {
 		err = "Bad request"
@@ -236,8 +222,25 @@ func p_snd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s := load_template("send.html")
+	s = strings.Replace(s, "/*_FEE_ESTIMATES_*/", fee_estimates_js(), 1)
 
 	write_html_head(w, r)
 	w.Write([]byte(s))
 	write_html_tail(w)
 }
+
+// Confirmation targets (in blocks) for which we give fee estimates
+var fee_targets = []uint32{1, 2, 3, 6, 12, 24, 48, 144, 504, 1008}
+
+// Returns JS array of [blocks, SPB, estimated] for the confirmation target selector
+func fee_estimates_js() string {
+	var s string
+	for i, blocks := range fee_targets {
+		spkb, estimated := rpcapi.FeeForBlocks(blocks, false)
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("[%d,%.3f,%t]", blocks, float64(spkb)/1000, estimated)
+	}
+	return "var fee_estimates = [" + s + "]"
+}
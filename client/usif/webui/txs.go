@@ -12,6 +12,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/script"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
@@ -76,6 +77,7 @@ func p_txs(w http.ResponseWriter, r *http.Request) {
 
 func output_tx_xml(w http.ResponseWriter, tx *btc.Tx) {
 	w.Write([]byte("<input_list>"))
+	network.SetSpentOutputs(tx)
 	for i := range tx.TxIn {
 		w.Write([]byte("<input>"))
 		w.Write([]byte("<script_sig>"))
@@ -281,15 +283,23 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		network.TxMutex.Lock()
-		defer network.TxMutex.Unlock()
-		if t2s, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+		t2s, ok := network.TransactionsToSend[txid.BIdx()]
+		if ok {
 			tx_xml(w, t2s, true)
-		} else {
-			w.Write([]byte("<tx>"))
-			fmt.Fprint(w, "<id>", txid.String(), "</id>")
-			w.Write([]byte("<status>Not found</status>"))
-			w.Write([]byte("</tx>"))
 		}
+		network.TxMutex.Unlock()
+		if ok {
+			return
+		}
+		// not in mempool - try confirmed transactions
+		if _, n, er := common.BlockChain.FindTx(txid); er == nil {
+			output_utxo_tx_xml(w, txid.String(), fmt.Sprint(n.Height))
+			return
+		}
+		w.Write([]byte("<tx>"))
+		fmt.Fprint(w, "<id>", txid.String(), "</id>")
+		w.Write([]byte("<status>Not found</status>"))
+		w.Write([]byte("</tx>"))
 		return
 	}
 
@@ -453,12 +463,69 @@ func raw_tx(w http.ResponseWriter, r *http.Request) {
 	if tx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
 		s, _, _, _, _ := usif.DecodeTx(tx.Tx)
 		w.Write([]byte(s))
+	} else if raw, n, er := common.BlockChain.FindTx(txid); er == nil {
+		if tx, offs := btc.NewTx(raw); tx != nil && offs == len(raw) {
+			tx.SetHash(raw)
+			s, _, _, _, _ := usif.DecodeTx(tx)
+			w.Write([]byte(s))
+		} else {
+			fmt.Fprintln(w, "Transaction index record cannot be decoded")
+		}
+		fmt.Fprintln(w, "Mined in block", n.Height, n.BlockHash.String())
 	} else {
 		fmt.Fprintln(w, "Not found")
 	}
 }
 
 
+// Returns history of the address given in the "addr" field (needs the address index)
+func json_addrhist(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) || len(r.Form["addr"])!=1 {
+		return
+	}
+
+	type one_rec struct {
+		Height uint32
+		TxID string
+		Index uint32
+		Value uint64
+		Spending bool
+	}
+	var out struct {
+		Error string `json:",omitempty"`
+		Height uint32
+		Recs []one_rec
+	}
+
+	if common.BlockChain.AddrIdx == nil {
+		out.Error = "Address index not enabled (use -addrindex)"
+	} else if ad, er := btc.NewAddrFromString(r.Form["addr"][0]); er != nil {
+		out.Error = er.Error()
+	} else {
+		common.BlockChain.AddrIdx.Lock()
+		out.Height = common.BlockChain.AddrIdx.Height
+		common.BlockChain.AddrIdx.Unlock()
+		sh := chain.ScriptHash(ad.OutScript())
+		if recs, er := common.BlockChain.GetAddrHistory(sh[:]); er != nil {
+			out.Error = er.Error()
+		} else {
+			for _, rec := range recs {
+				out.Recs = append(out.Recs, one_rec{Height:rec.Height, TxID:rec.TxID.String(),
+					Index:rec.Index, Value:rec.Value, Spending:rec.Spent!=nil})
+			}
+		}
+	}
+
+	bx, er := json.Marshal(out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
+
+
 func json_txstat(w http.ResponseWriter, r *http.Request) {
 	if !ipchecker(r) {
 		return
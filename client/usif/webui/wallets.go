@@ -14,10 +14,12 @@ import (
 	"encoding/json"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/utxo"
+	"github.com/piotrnar/gocoin/lib/descriptor"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/wallet"
+	"github.com/piotrnar/gocoin/client/rpcapi"
 )
 
 
@@ -394,6 +396,13 @@ func dl_balance(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(fz, thisbal[i].UnspentTextLine())
 	}
 
+	// fee estimates for "wallet -fee auto"
+	fz, _ = zi.Create("balance/fees.txt")
+	for _, blocks := range fee_targets {
+		spkb, _ := rpcapi.FeeForBlocks(blocks, false)
+		fmt.Fprintf(fz, "%d %.3f\n", blocks, float64(spkb)/1000)
+	}
+
 	zi.Close()
 	w.Header()["Content-Type"] = []string{"application/zip"}
 	w.Write(buf.Bytes())
@@ -401,6 +410,65 @@ func dl_balance(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// Expands the descriptor given in the "desc" form field into addresses
+func json_descriptor(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) || !common.GetBool(&common.WalletON)  {
+		return
+	}
+
+	if r.Method!="POST" || len(r.Form["desc"])!=1 {
+		return
+	}
+
+	var gap uint32 = 20
+	if len(r.Form["gap"])==1 {
+		if v, er := strconv.ParseUint(r.Form["gap"][0], 10, 32); er==nil && v>0 {
+			gap = uint32(v)
+		}
+	}
+
+	type one_addr struct {
+		Addr string
+		Label string
+		OutCnt int
+	}
+	var out struct {
+		Error string `json:",omitempty"`
+		Desc string `json:",omitempty"`
+		Addrs []one_addr
+	}
+
+	if d, er := descriptor.Parse(r.Form["desc"][0]); er != nil {
+		out.Error = er.Error()
+	} else {
+		out.Desc = d.String()
+
+		lck := new(usif.OneLock)
+		lck.In.Add(1)
+		lck.Out.Add(1)
+		usif.LocksChan <- lck
+		lck.In.Wait()
+		addrs, cnts, er := wallet.DescriptorAddrs(d, gap)
+		lck.Out.Done()
+
+		if er != nil {
+			out.Error = er.Error()
+		}
+		for i, aa := range addrs {
+			out.Addrs = append(out.Addrs, one_addr{Addr:aa.String(), Label:aa.Extra.Label, OutCnt:cnts[i]})
+		}
+	}
+
+	bx, er := json.Marshal(out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
+
+
 func json_wallet_status(w http.ResponseWriter, r *http.Request) {
 	if !ipchecker(r) {
 		return
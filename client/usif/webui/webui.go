@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/piotrnar/gocoin"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/pubsub"
 	"github.com/piotrnar/gocoin/client/usif"
 	"io/ioutil"
 	"net/http"
@@ -128,7 +129,9 @@ func write_html_head(w http.ResponseWriter, r *http.Request) {
 		s = strings.Replace(s, "{HELPURL}", "help", 1)
 	}
 	s = strings.Replace(s, "{VERSION}", gocoin.Version, 1)
-	if common.Testnet {
+	if common.Regtest {
+		s = strings.Replace(s, "{TESTNET}", " Regtest ", 1)
+	} else if common.Testnet {
 		s = strings.Replace(s, "{TESTNET}", " Testnet ", 1)
 	} else {
 		s = strings.Replace(s, "{TESTNET}", "", 1)
@@ -172,18 +175,32 @@ func p_wallet_is_off(w http.ResponseWriter, r *http.Request) {
 	write_html_tail(w)
 }
 
+// WebSocket feed of the block and transaction events (see pubsub.ServeWebSocket)
+func ws_events(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+	if !common.CFG.Notify.Enabled || !common.CFG.Notify.WebSocket {
+		http.NotFound(w, r)
+		return
+	}
+	pubsub.ServeWebSocket(w, r)
+}
+
 func ServerThread(iface string) {
 	http.HandleFunc("/webui/", p_webui)
 
 	http.HandleFunc("/wal", p_wal)
 	http.HandleFunc("/snd", p_snd)
 	http.HandleFunc("/balance.json", json_balance)
-	http.HandleFunc("/payment.zip", dl_payment)
+	http.HandleFunc("/payment.psbt", dl_payment)
 	http.HandleFunc("/balance.zip", dl_balance)
+	http.HandleFunc("/descriptor.json", json_descriptor)
 
 	http.HandleFunc("/net", p_net)
 	http.HandleFunc("/txs", p_txs)
 	http.HandleFunc("/blocks", p_blocks)
+	http.HandleFunc("/blkdl", p_blkdl)
 	http.HandleFunc("/miners", p_miners)
 	http.HandleFunc("/counts", p_counts)
 	http.HandleFunc("/cfg", p_cfg)
@@ -193,6 +210,7 @@ func ServerThread(iface string) {
 	http.HandleFunc("/txsre.xml", xml_txsre)
 	http.HandleFunc("/txw4i.xml", xml_txw4i)
 	http.HandleFunc("/raw_tx", raw_tx)
+	http.HandleFunc("/addrhist.json", json_addrhist)
 
 	http.HandleFunc("/", p_home)
 	http.HandleFunc("/status.json", json_status)
@@ -202,6 +220,7 @@ func ServerThread(iface string) {
 	http.HandleFunc("/txstat.json", json_txstat)
 	http.HandleFunc("/netcon.json", json_netcon)
 	http.HandleFunc("/blocks.json", json_blocks)
+	http.HandleFunc("/blkdl.json", json_blkdl)
 	http.HandleFunc("/peerst.json", json_peerst)
 	http.HandleFunc("/bwchar.json", json_bwchar)
 	http.HandleFunc("/mempool_stats.json", json_mempool_stats)
@@ -212,6 +231,7 @@ func ServerThread(iface string) {
 	http.HandleFunc("/walsta.json", json_wallet_status)
 
 	http.HandleFunc("/mempool_fees.txt", txt_mempool_fees)
+	http.HandleFunc("/events", ws_events)
 
 	go start_ssl_server()
 	http.ListenAndServe(iface, nil)
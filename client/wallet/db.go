@@ -2,16 +2,28 @@ package wallet
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/descriptor"
 	"github.com/piotrnar/gocoin/lib/utxo"
+	"sync"
 )
 
 var (
+	// Only the main thread modifies the balance records, so it does not need to lock it for reading.
+	// Other threads (Electrum server) must hold it for reading.
+	BalanceMutex sync.RWMutex
+
 	AllBalancesP2KH, AllBalancesP2SH, AllBalancesP2WKH map[[20]byte]*OneAllAddrBal
-	AllBalancesP2WSH                                   map[[32]byte]*OneAllAddrBal
+	AllBalancesP2WSH, AllBalancesP2TR                  map[[32]byte]*OneAllAddrBal
+
+	// sha256 of the output script (Electrum's script hash) -> balance record
+	// It is only maintained if the Electrum server is enabled (otherwise nil)
+	AllScriptHashes map[[32]byte]*OneAllAddrBal
 )
 
 type OneAllAddrInp [utxo.UtxoIdxLen + 4]byte
@@ -79,12 +91,24 @@ func NewUTXO(tx *utxo.UtxoRec) {
 				rec = &OneAllAddrBal{}
 				AllBalancesP2WSH[uidx] = rec
 			}
+		} else if out.IsP2TR() {
+			var uidx [32]byte
+			copy(uidx[:], out.PKScr[2:34])
+			rec = AllBalancesP2TR[uidx]
+			if rec == nil {
+				rec = &OneAllAddrBal{}
+				AllBalancesP2TR[uidx] = rec
+			}
 		} else {
 			continue
 		}
 
 		binary.LittleEndian.PutUint32(nr[utxo.UtxoIdxLen:], vout)
 
+		if AllScriptHashes != nil && rec.Count() == 0 { // a new record
+			AllScriptHashes[sha256.Sum256(out.PKScr)] = rec
+		}
+
 		rec.Value += out.Value
 
 		if rec.unspMap != nil {
@@ -112,7 +136,7 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 	var rec *OneAllAddrBal
 	var i int
 	var nr OneAllAddrInp
-	var typ int                            // 0 - P2KH, 1 - P2SH, 2 - P2WKH
+	var typ int                            // 0 - P2KH, 1 - P2SH, 2 - P2WKH, 3 - P2WSH, 4 - P2TR
 	copy(nr[:utxo.UtxoIdxLen], tx.TxID[:]) //RecIdx
 	for vout := uint32(0); vout < uint32(len(tx.Outs)); vout++ {
 		if !outs[vout] {
@@ -141,12 +165,16 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 			typ = 3
 			copy(uidx32[:], out.PKScr[2:34])
 			rec = AllBalancesP2WSH[uidx32]
+		} else if out.IsP2TR() {
+			typ = 4
+			copy(uidx32[:], out.PKScr[2:34])
+			rec = AllBalancesP2TR[uidx32]
 		} else {
 			continue
 		}
 
 		if rec == nil {
-			println("balance rec not found for", btc.NewAddrFromPkScript(out.PKScr, common.CFG.Testnet).String(),
+			println("balance rec not found for", btc.NewAddrFromPkScript(out.PKScr, common.Testnet).String(),
 				btc.NewUint256(tx.TxID[:]).String(), vout, btc.UintToBtc(out.Value))
 			continue
 		}
@@ -155,7 +183,7 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 
 		if rec.unspMap != nil {
 			if _, ok := rec.unspMap[nr]; !ok {
-				println("unspent rec not in map for", btc.NewAddrFromPkScript(out.PKScr, common.CFG.Testnet).String())
+				println("unspent rec not in map for", btc.NewAddrFromPkScript(out.PKScr, common.Testnet).String())
 				continue
 			}
 			delete(rec.unspMap, nr)
@@ -169,6 +197,11 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 					delete(AllBalancesP2WKH, uidx)
 				case 3:
 					delete(AllBalancesP2WSH, uidx32)
+				case 4:
+					delete(AllBalancesP2TR, uidx32)
+				}
+				if AllScriptHashes != nil {
+					delete(AllScriptHashes, sha256.Sum256(out.PKScr))
 				}
 			} else {
 				rec.Value -= out.Value
@@ -182,7 +215,7 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 			}
 		}
 		if i == len(rec.unsp) {
-			println("unspent rec not in list for", btc.NewAddrFromPkScript(out.PKScr, common.CFG.Testnet).String())
+			println("unspent rec not in list for", btc.NewAddrFromPkScript(out.PKScr, common.Testnet).String())
 			continue
 		}
 		if len(rec.unsp) == 1 {
@@ -195,6 +228,11 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 				delete(AllBalancesP2WKH, uidx)
 			case 3:
 				delete(AllBalancesP2WSH, uidx32)
+			case 4:
+				delete(AllBalancesP2TR, uidx32)
+			}
+			if AllScriptHashes != nil {
+				delete(AllScriptHashes, sha256.Sum256(out.PKScr))
 			}
 		} else {
 			rec.Value -= out.Value
@@ -205,12 +243,16 @@ func all_del_utxos(tx *utxo.UtxoRec, outs []bool) {
 
 // This is called while accepting the block (from the chain's thread)
 func TxNotifyAdd(tx *utxo.UtxoRec) {
+	BalanceMutex.Lock()
 	NewUTXO(tx)
+	BalanceMutex.Unlock()
 }
 
 // This is called while accepting the block (from the chain's thread)
 func TxNotifyDel(tx *utxo.UtxoRec, outs []bool) {
+	BalanceMutex.Lock()
 	all_del_utxos(tx, outs)
+	BalanceMutex.Unlock()
 }
 
 // Call the cb function for each unspent record
@@ -238,16 +280,17 @@ func GetAllUnspent(aa *btc.BtcAddr) (thisbal utxo.AllUnspentTx) {
 	var rec *OneAllAddrBal
 	if aa.SegwitProg != nil {
 		var uidx [32]byte
-		if aa.SegwitProg.Version != 0 {
-			return
-		}
-		switch len(aa.SegwitProg.Program) {
-		case 20:
-			copy(aa.Hash160[:], aa.SegwitProg.Program)
+		prog := aa.SegwitProg.Program
+		switch {
+		case aa.SegwitProg.Version == 0 && len(prog) == 20:
+			copy(aa.Hash160[:], prog)
 			rec = AllBalancesP2WKH[aa.Hash160]
-		case 32:
-			copy(uidx[:], aa.SegwitProg.Program)
+		case aa.SegwitProg.Version == 0 && len(prog) == 32:
+			copy(uidx[:], prog)
 			rec = AllBalancesP2WSH[uidx]
+		case aa.SegwitProg.Version == 1 && len(prog) == 32:
+			copy(uidx[:], prog)
+			rec = AllBalancesP2TR[uidx]
 		default:
 			return
 		}
@@ -259,32 +302,92 @@ func GetAllUnspent(aa *btc.BtcAddr) (thisbal utxo.AllUnspentTx) {
 		return
 	}
 	if rec != nil {
-		rec.Browse(func(v *OneAllAddrInp) {
-			if qr, vout := v.GetRec(); qr != nil {
-				if oo := qr.Outs[vout]; oo != nil {
-					unsp := &utxo.OneUnspentTx{TxPrevOut: btc.TxPrevOut{Hash: qr.TxID, Vout: vout},
-						Value: oo.Value, MinedAt: qr.InBlock, Coinbase: qr.Coinbase, BtcAddr: aa}
-
-					if int(vout+1) < len(qr.Outs) {
-						var msg []byte
-						if qr.Outs[vout+1] != nil && len(qr.Outs[vout+1].PKScr) > 1 && qr.Outs[vout+1].PKScr[0] == 0x6a {
-							msg = qr.Outs[vout+1].PKScr[1:]
-						} else if int(vout+1) != len(qr.Outs) && qr.Outs[len(qr.Outs)-1] != nil &&
-							len(qr.Outs[len(qr.Outs)-1].PKScr) > 1 && qr.Outs[len(qr.Outs)-1].PKScr[0] == 0x6a {
-							msg = qr.Outs[len(qr.Outs)-1].PKScr[1:]
-						}
-						if msg != nil {
-							_, unsp.Message, _, _ = btc.GetOpcode(msg)
-						}
+		thisbal = rec.unspent(aa)
+	}
+	return
+}
+
+// Returns unspent outputs of the script with the given sha256 hash (Electrum's script hash).
+// BtcAddr of the returned records is set to nil. It can be called from any thread.
+func GetScriptHashUnspent(sh [32]byte) (thisbal utxo.AllUnspentTx) {
+	BalanceMutex.RLock()
+	if rec := AllScriptHashes[sh]; rec != nil {
+		thisbal = rec.unspent(nil)
+	}
+	BalanceMutex.RUnlock()
+	return
+}
+
+// Returns true if the script hash lookups (GetScriptHashUnspent) can be used. It can be called from any thread.
+func ScriptHashesReady() (res bool) {
+	if !common.GetBool(&common.WalletON) {
+		return // do not wait for the balances being loaded
+	}
+	BalanceMutex.RLock()
+	res = AllScriptHashes != nil
+	BalanceMutex.RUnlock()
+	return
+}
+
+func (rec *OneAllAddrBal) unspent(aa *btc.BtcAddr) (thisbal utxo.AllUnspentTx) {
+	rec.Browse(func(v *OneAllAddrInp) {
+		if qr, vout := v.GetRec(); qr != nil {
+			if oo := qr.Outs[vout]; oo != nil {
+				unsp := &utxo.OneUnspentTx{TxPrevOut: btc.TxPrevOut{Hash: qr.TxID, Vout: vout},
+					Value: oo.Value, MinedAt: qr.InBlock, Coinbase: qr.Coinbase, BtcAddr: aa}
+
+				if int(vout+1) < len(qr.Outs) {
+					var msg []byte
+					if qr.Outs[vout+1] != nil && len(qr.Outs[vout+1].PKScr) > 1 && qr.Outs[vout+1].PKScr[0] == 0x6a {
+						msg = qr.Outs[vout+1].PKScr[1:]
+					} else if int(vout+1) != len(qr.Outs) && qr.Outs[len(qr.Outs)-1] != nil &&
+						len(qr.Outs[len(qr.Outs)-1].PKScr) > 1 && qr.Outs[len(qr.Outs)-1].PKScr[0] == 0x6a {
+						msg = qr.Outs[len(qr.Outs)-1].PKScr[1:]
+					}
+					if msg != nil {
+						_, unsp.Message, _, _ = btc.GetOpcode(msg)
 					}
-					thisbal = append(thisbal, unsp)
 				}
+				thisbal = append(thisbal, unsp)
 			}
-		})
-	}
+		}
+	})
 	return
 }
 
+// DescriptorAddrs expands the descriptor into addresses, setting their labels.
+// Ranged descriptors are expanded until gap consecutive addresses with no unspent outputs.
+// Returns the number of unspent outputs found for each of the addresses.
+// Must be called with the wallet maps locked (i.e. from the usif lock).
+func DescriptorAddrs(d *descriptor.Descriptor, gap uint32) (res []*btc.BtcAddr, cnt []int, e error) {
+	var idx, unused uint32
+	for {
+		var aa *btc.BtcAddr
+		if aa, e = d.Address(idx, common.Testnet); e != nil {
+			return
+		}
+		if aa == nil {
+			e = errors.New("Descriptor has no address form")
+			return
+		}
+		aa.Extra.Label = d.Label(idx)
+		n := len(GetAllUnspent(aa))
+		res = append(res, aa)
+		cnt = append(cnt, n)
+		if !d.IsRange() {
+			return
+		}
+		if n > 0 {
+			unused = 0
+		} else if unused++; unused >= gap {
+			return
+		}
+		if idx++; idx == btc.HardenedKeyStart {
+			return
+		}
+	}
+}
+
 func PrintStat() {
 	var p2kh_maps, p2kh_outs, p2kh_vals uint64
 	for _, r := range AllBalancesP2KH {
@@ -353,6 +456,17 @@ func PrintStat() {
 		}
 	}
 
+	var p2tr_maps, p2tr_outs, p2tr_vals uint64
+	for _, r := range AllBalancesP2TR {
+		p2tr_vals += r.Value
+		if r.unspMap != nil {
+			p2tr_maps++
+			p2tr_outs += uint64(len(r.unspMap))
+		} else {
+			p2tr_outs += uint64(len(r.unsp))
+		}
+	}
+
 	fmt.Println("AllBalMinVal:", btc.UintToBtc(common.AllBalMinVal()), "  UseMapCnt:", common.CFG.AllBalances.UseMapCnt)
 
 	fmt.Println("AllBalancesP2KH: ", len(AllBalancesP2KH), "records,",
@@ -366,4 +480,7 @@ func PrintStat() {
 
 	fmt.Println("AllBalancesP2WSH: ", len(AllBalancesP2WSH), "records,",
 		p2wsh_outs, "outputs,", btc.UintToBtc(p2wsh_vals), "BTC,", p2wsh_maps, "maps")
+
+	fmt.Println("AllBalancesP2TR: ", len(AllBalancesP2TR), "records,",
+		p2tr_outs, "outputs,", btc.UintToBtc(p2tr_vals), "BTC,", p2tr_maps, "maps")
 }
@@ -13,8 +13,9 @@ var (
 	OnOff               chan bool = make(chan bool, 1)
 )
 
+// Call it with BalanceMutex locked
 func InitMaps(empty bool) {
-	var szs [4]int
+	var szs [5]int
 	var ok bool
 
 	if empty {
@@ -27,7 +28,7 @@ func InitMaps(empty bool) {
 		//fmt.Println("Have map sizes for MinBal", common.AllBalMinVal(), ":", szs[0], szs[1], szs[2], szs[3])
 	} else {
 		//fmt.Println("No map sizes for MinBal", common.AllBalMinVal())
-		szs = [4]int{10e6, 3e6, 10e3, 1e3} // defaults
+		szs = [5]int{10e6, 3e6, 10e3, 1e3, 1e3} // defaults
 	}
 
 init:
@@ -35,6 +36,12 @@ init:
 	AllBalancesP2SH = make(map[[20]byte]*OneAllAddrBal, szs[1])
 	AllBalancesP2WKH = make(map[[20]byte]*OneAllAddrBal, szs[2])
 	AllBalancesP2WSH = make(map[[32]byte]*OneAllAddrBal, szs[3])
+	AllBalancesP2TR = make(map[[32]byte]*OneAllAddrBal, szs[4])
+	if common.CFG.Electrum.Enabled {
+		AllScriptHashes = make(map[[32]byte]*OneAllAddrBal, szs[0]+szs[1]+szs[2]+szs[3]+szs[4])
+	} else {
+		AllScriptHashes = nil
+	}
 }
 
 func LoadBalance() {
@@ -48,6 +55,9 @@ func LoadBalance() {
 	common.SetUint32(&common.WalletProgress, 1)
 	common.ApplyBalMinVal()
 
+	BalanceMutex.Lock()
+	defer BalanceMutex.Unlock()
+
 	InitMaps(false)
 
 	common.BlockChain.Unspent.RWMutex.RLock()
@@ -90,20 +100,22 @@ func Disable() {
 	common.BlockChain.Unspent.CB.NotifyTxAdd = nil
 	common.BlockChain.Unspent.CB.NotifyTxDel = nil
 	common.SetBool(&common.WalletON, false)
+	BalanceMutex.Lock()
 	InitMaps(true)
+	BalanceMutex.Unlock()
 }
 
 const (
-	MAPSIZ_FILE_NAME = "mapsize.gob"
+	MAPSIZ_FILE_NAME = "mapsize5.gob"
 )
 
 var (
-	WalletAddrsCount map[uint64][4]int = make(map[uint64][4]int) //index:MinValue, [0]-P2KH, [1]-P2SH, [2]-P2WSH, [3]-P2WKH
+	WalletAddrsCount map[uint64][5]int = make(map[uint64][5]int) //index:MinValue, [0]-P2KH, [1]-P2SH, [2]-P2WSH, [3]-P2WKH, [4]-P2TR
 )
 
 func UpdateMapSizes() {
-	WalletAddrsCount[common.AllBalMinVal()] = [4]int{len(AllBalancesP2KH),
-		len(AllBalancesP2SH), len(AllBalancesP2WKH), len(AllBalancesP2WSH)}
+	WalletAddrsCount[common.AllBalMinVal()] = [5]int{len(AllBalancesP2KH),
+		len(AllBalancesP2SH), len(AllBalancesP2WKH), len(AllBalancesP2WSH), len(AllBalancesP2TR)}
 
 	buf := new(bytes.Buffer)
 	gob.NewEncoder(buf).Encode(WalletAddrsCount)
@@ -0,0 +1,172 @@
+package bip324
+
+import (
+	"bytes"
+	"testing"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+var magic = []byte{0xf9, 0xbe, 0xb4, 0xd9}
+
+func handshake(t *testing.T) (a, b *Cipher) {
+	a = NewCipher()
+	b = NewCipher()
+	if e := a.Initialize(b.OurPubkey, true, magic); e != nil {
+		t.Fatal(e)
+	}
+	if e := b.Initialize(a.OurPubkey, false, magic); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(a.SessionID, b.SessionID) {
+		t.Fatal("Session ID mismatch")
+	}
+	if !bytes.Equal(a.SendTerminator, b.RecvTerminator) || !bytes.Equal(a.RecvTerminator, b.SendTerminator) {
+		t.Fatal("Garbage terminators mismatch")
+	}
+	return
+}
+
+func transfer(t *testing.T, from, to *Cipher, pkt, aad []byte) (contents []byte, ignore bool) {
+	le := to.DecryptLength(pkt[:LENGTH_LEN])
+	if le != len(pkt) - LENGTH_LEN {
+		t.Fatal("Bad length", le, len(pkt) - LENGTH_LEN)
+	}
+	var e error
+	if contents, ignore, e = to.Decrypt(pkt[LENGTH_LEN:], aad); e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+func TestPackets(t *testing.T) {
+	a, b := handshake(t)
+	garbage := []byte("some garbage")
+	contents, ignore := transfer(t, a, b, a.Encrypt(nil, garbage, false), garbage)
+	if ignore || len(contents) != 0 {
+		t.Fatal("Bad version packet")
+	}
+	contents, ignore = transfer(t, b, a, b.Encrypt([]byte("decoy"), nil, true), nil)
+	if !ignore || string(contents) != "decoy" {
+		t.Fatal("Bad decoy packet")
+	}
+	// enough packets to go through a few rekeys
+	for i := 0; i < 3*REKEY_INTERVAL + 10; i++ {
+		pl := make([]byte, i)
+		rand.Read(pl)
+		cmd := "block"
+		if i&1 != 0 {
+			cmd = "wtxidrelay"
+		}
+		contents, _ = transfer(t, a, b, a.EncryptMsg(cmd, pl), nil)
+		c, p, e := DecodeMsg(contents)
+		if e != nil || c != cmd || !bytes.Equal(p, pl) {
+			t.Fatal("Message mismatch at", i, c, e)
+		}
+		contents, _ = transfer(t, b, a, b.EncryptMsg(cmd, pl), nil)
+		if c, p, _ = DecodeMsg(contents); c != cmd || !bytes.Equal(p, pl) {
+			t.Fatal("Reply mismatch at", i, c)
+		}
+	}
+}
+
+// From BIP324 packet_encoding_test_vectors.csv
+var packetVectors = []struct {
+	in_idx int
+	in_priv_ours, in_ellswift_ours, in_ellswift_theirs string
+	in_initiating bool
+	in_contents string
+	mid_x_ours, mid_x_theirs, mid_x_shared string
+	out_session_id, out_ciphertext string
+}{
+	{
+		in_idx: 1,
+		in_priv_ours: "61062ea5071d800bbfd59e2e8b53d47d194b095ae5a4df04936b49772ef0d4d7",
+		in_ellswift_ours: "ec0adff257bbfe500c188c80b4fdd640f6b45a482bbc15fc7cef5931deff0aa186f6eb9bba7b85dc4dcc28b28722de1e3d9108b985e2967045668f66098e475b",
+		in_ellswift_theirs: "a4a94dfce69b4a2a0a099313d10f9f7e7d649d60501c9e1d274c300e0d89aafaffffffffffffffffffffffffffffffffffffffffffffffffffffffff8faf88d5",
+		in_initiating: true,
+		in_contents: "8e",
+		mid_x_ours: "19e965bc20fc40614e33f2f82d4eeff81b5e7516b12a5c6c0d6053527eba0923",
+		mid_x_theirs: "0c71defa3fafd74cb835102acd81490963f6b72d889495e06561375bd65f6ffc",
+		mid_x_shared: "4eb2bf85bd00939468ea2abb25b63bc642e3d1eb8b967fb90caa2d89e716050e",
+		out_session_id: "ce72dffb015da62b0d0f5474cab8bc72605225b0cee3f62312ec680ec5f41ba5",
+		out_ciphertext: "7530d2a18720162ac09c25329a60d75adf36eda3c3",
+	},
+	{
+		in_idx: 999,
+		in_priv_ours: "1f9c581b35231838f0f17cf0c979835baccb7f3abbbb96ffcc318ab71e6e126f",
+		in_ellswift_ours: "a1855e10e94e00baa23041d916e259f7044e491da6171269694763f018c7e63693d29575dcb464ac816baa1be353ba12e3876cba7628bd0bd8e755e721eb0140",
+		in_ellswift_theirs: "fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f0000000000000000000000000000000000000000000000000000000000000000",
+		in_initiating: false,
+		in_contents: "3eb1d4e98035cfd8eeb29bac969ed3824a",
+		mid_x_ours: "45b6f1f684fd9f2b16e2651ddc47156c0695c8c5cd2c0c9df6d79a1056c61120",
+		mid_x_theirs: "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca9743be5aa0c",
+		mid_x_shared: "c40eb6190caf399c9007254ad5e5fa20d64af2b41696599c59b2191d16992955",
+		out_session_id: "9267c54560607de73f18c563b76a2442718879c52dd39852885d4a3c9912c9ea",
+		out_ciphertext: "1da1bcf589f9b61872f45b7fa5371dd3f8bdf5d515b0c5f9fe9f0044afb8dc0aa1cd39a8c4",
+	},
+}
+
+func fromHex(s string) []byte {
+	b, e := hex.DecodeString(s)
+	if e != nil {
+		panic(e)
+	}
+	return b
+}
+
+func TestPacketVectors(t *testing.T) {
+	for n, v := range packetVectors {
+		priv := fromHex(v.in_priv_ours)
+		ours, theirs := fromHex(v.in_ellswift_ours), fromHex(v.in_ellswift_theirs)
+		if x := hex.EncodeToString(secp256k1.EllSwiftDecode(ours)); x != v.mid_x_ours {
+			t.Error(n, "Bad x_ours", x)
+		}
+		if x := hex.EncodeToString(secp256k1.EllSwiftDecode(theirs)); x != v.mid_x_theirs {
+			t.Error(n, "Bad x_theirs", x)
+		}
+		if x := hex.EncodeToString(secp256k1.EllSwiftXDH(theirs, priv)); x != v.mid_x_shared {
+			t.Error(n, "Bad x_shared", x)
+		}
+
+		c := &Cipher{priv: priv, OurPubkey: ours}
+		if e := c.Initialize(theirs, v.in_initiating, magic); e != nil {
+			t.Fatal(n, e)
+		}
+		if s := hex.EncodeToString(c.SessionID); s != v.out_session_id {
+			t.Error(n, "Bad session id", s)
+		}
+		for i := 0; i < v.in_idx; i++ {
+			c.Encrypt(nil, nil, false)
+		}
+		if s := hex.EncodeToString(c.Encrypt(fromHex(v.in_contents), nil, false)); s != v.out_ciphertext {
+			t.Error(n, "Bad ciphertext", s)
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	a, b := handshake(t)
+	pkt := a.EncryptMsg("ping", []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	pkt[len(pkt)-1] ^= 1
+	b.DecryptLength(pkt)
+	if _, _, e := b.Decrypt(pkt[LENGTH_LEN:], nil); e == nil {
+		t.Error("Tampered packet accepted")
+	}
+}
+
+func TestMsgIDs(t *testing.T) {
+	if p := MsgPrefix("addrv2"); len(p) != 1 || p[0] != 28 {
+		t.Error("Bad addrv2 ID")
+	}
+	if p := MsgPrefix("version"); len(p) != 13 || p[0] != 0 || string(p[1:8]) != "version" {
+		t.Error("Bad version prefix")
+	}
+	if c, _, e := DecodeMsg([]byte{200, 1, 2}); e != nil || c != "" {
+		t.Error("Unknown ID not ignored")
+	}
+	if _, _, e := DecodeMsg([]byte{0, 'x'}); e == nil {
+		t.Error("Short message accepted")
+	}
+}
@@ -0,0 +1,223 @@
+package bip324
+
+import (
+	"errors"
+	"math/big"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/cipher"
+	"encoding/binary"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+// BIP324 - Version 2 P2P Encrypted Transport Protocol
+
+const (
+	ELLSWIFT_LEN = 64
+	LENGTH_LEN = 3 // encrypted length of the packet's contents
+	HEADER_LEN = 1
+	EXPANSION = 16 // Poly1305 tag
+	GARBAGE_TERMINATOR_LEN = 16
+	MAX_GARBAGE_LEN = 4095
+	MAX_CONTENTS_LEN = 1<<24 - 1
+
+	IGNORE_BIT = 0x80 // set in the header byte of decoy packets
+	REKEY_INTERVAL = 224 // packets
+)
+
+
+// ChaCha20 used to encrypt the length fields - the key stream continues across the packets
+type fs_chacha20 struct {
+	key [32]byte
+	c *chacha20.Cipher
+	chunks uint32
+	rekeys uint64
+}
+
+func new_fs_chacha20(key []byte) (f *fs_chacha20) {
+	f = new(fs_chacha20)
+	copy(f.key[:], key)
+	f.reset()
+	return
+}
+
+func (f *fs_chacha20) reset() {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], f.rekeys)
+	f.c, _ = chacha20.NewUnauthenticatedCipher(f.key[:], nonce[:])
+}
+
+func (f *fs_chacha20) crypt(dst, src []byte) {
+	f.c.XORKeyStream(dst, src)
+	if f.chunks++; f.chunks == REKEY_INTERVAL {
+		var zero [32]byte
+		f.c.XORKeyStream(f.key[:], zero[:])
+		f.chunks = 0
+		f.rekeys++
+		f.reset()
+	}
+}
+
+
+// ChaCha20Poly1305 used to encrypt the packets - each one with a new nonce
+type fs_aead struct {
+	key [32]byte
+	aead cipher.AEAD
+	packets uint32
+	rekeys uint64
+}
+
+func new_fs_aead(key []byte) (f *fs_aead) {
+	f = new(fs_aead)
+	copy(f.key[:], key)
+	f.aead, _ = chacha20poly1305.New(f.key[:])
+	return
+}
+
+func (f *fs_aead) nonce(packet uint32) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint32(nonce[:4], packet)
+	binary.LittleEndian.PutUint64(nonce[4:], f.rekeys)
+	return nonce
+}
+
+func (f *fs_aead) next() {
+	if f.packets++; f.packets == REKEY_INTERVAL {
+		var zero [32]byte
+		copy(f.key[:], f.aead.Seal(nil, f.nonce(0xffffffff), zero[:], nil))
+		f.aead, _ = chacha20poly1305.New(f.key[:])
+		f.packets = 0
+		f.rekeys++
+	}
+}
+
+func (f *fs_aead) seal(dst, plain, aad []byte) (res []byte) {
+	res = f.aead.Seal(dst, f.nonce(f.packets), plain, aad)
+	f.next()
+	return
+}
+
+func (f *fs_aead) open(ct, aad []byte) (res []byte, e error) {
+	res, e = f.aead.Open(ct[:0], f.nonce(f.packets), ct, aad)
+	f.next()
+	return
+}
+
+
+// Cipher keeps the state of one BIP324 connection
+type Cipher struct {
+	priv []byte
+	OurPubkey []byte // ElligatorSwift encoded, to be sent to the peer
+
+	send_L, recv_L *fs_chacha20
+	send_P, recv_P *fs_aead
+
+	SendTerminator, RecvTerminator []byte
+	SessionID []byte
+}
+
+// Generates a new ephemeral key pair
+func NewCipher() (c *Cipher) {
+	c = new(Cipher)
+	var k big.Int
+	c.priv = make([]byte, 32)
+	for {
+		rand.Read(c.priv)
+		if k.SetBytes(c.priv); k.Sign() > 0 && k.Cmp(&secp256k1.TheCurve.Order.Int) < 0 {
+			break
+		}
+	}
+	c.OurPubkey = secp256k1.EllSwiftCreate(c.priv)
+	return
+}
+
+// Derives the session keys from the peer's public key (ElligatorSwift encoded)
+func (c *Cipher) Initialize(their_pubkey []byte, initiator bool, magic []byte) error {
+	if len(their_pubkey) != ELLSWIFT_LEN {
+		return errors.New("BIP324: bad public key length")
+	}
+	x := secp256k1.EllSwiftXDH(their_pubkey, c.priv)
+	if x == nil {
+		return errors.New("BIP324: ECDH failed")
+	}
+	var secret []byte
+	if initiator {
+		secret = secp256k1.TaggedHash("bip324_ellswift_xonly_ecdh", c.OurPubkey, their_pubkey, x)
+	} else {
+		secret = secp256k1.TaggedHash("bip324_ellswift_xonly_ecdh", their_pubkey, c.OurPubkey, x)
+	}
+	prk := hkdf.Extract(sha256.New, secret, append([]byte("bitcoin_v2_shared_secret"), magic...))
+	key := func(name string) []byte {
+		res := make([]byte, 32)
+		hkdf.Expand(sha256.New, prk, []byte(name)).Read(res)
+		return res
+	}
+	terms := key("garbage_terminators")
+	if initiator {
+		c.send_L, c.send_P = new_fs_chacha20(key("initiator_L")), new_fs_aead(key("initiator_P"))
+		c.recv_L, c.recv_P = new_fs_chacha20(key("responder_L")), new_fs_aead(key("responder_P"))
+		c.SendTerminator, c.RecvTerminator = terms[:16], terms[16:]
+	} else {
+		c.recv_L, c.recv_P = new_fs_chacha20(key("initiator_L")), new_fs_aead(key("initiator_P"))
+		c.send_L, c.send_P = new_fs_chacha20(key("responder_L")), new_fs_aead(key("responder_P"))
+		c.RecvTerminator, c.SendTerminator = terms[:16], terms[16:]
+	}
+	c.SessionID = key("session_id")
+	c.priv = nil
+	return nil
+}
+
+func (c *Cipher) encrypt(prefix, contents, aad []byte, ignore bool) (pkt []byte) {
+	var l [4]byte
+	le := len(prefix) + len(contents)
+	pkt = make([]byte, LENGTH_LEN + HEADER_LEN + le, LENGTH_LEN + HEADER_LEN + le + EXPANSION)
+	binary.LittleEndian.PutUint32(l[:], uint32(le))
+	c.send_L.crypt(pkt[:LENGTH_LEN], l[:LENGTH_LEN])
+	if ignore {
+		pkt[LENGTH_LEN] = IGNORE_BIT
+	}
+	copy(pkt[LENGTH_LEN+HEADER_LEN:], prefix)
+	copy(pkt[LENGTH_LEN+HEADER_LEN+len(prefix):], contents)
+	return c.send_P.seal(pkt[:LENGTH_LEN], pkt[LENGTH_LEN:], aad)
+}
+
+// Returns the encrypted packet with the given contents.
+// aad is only used with the first packet (it's the garbage that we sent).
+func (c *Cipher) Encrypt(contents, aad []byte, ignore bool) []byte {
+	return c.encrypt(nil, contents, aad, ignore)
+}
+
+// Returns the encrypted packet with the given message
+func (c *Cipher) EncryptMsg(cmd string, pl []byte) []byte {
+	return c.encrypt(MsgPrefix(cmd), pl, nil, false)
+}
+
+// Decrypts the length field - returns the number of bytes that follow it in the packet
+func (c *Cipher) DecryptLength(enc []byte) int {
+	var l [4]byte
+	c.recv_L.crypt(l[:LENGTH_LEN], enc[:LENGTH_LEN])
+	return int(binary.LittleEndian.Uint32(l[:])) + HEADER_LEN + EXPANSION
+}
+
+// Decrypts the rest of the packet (in place) and returns its contents
+func (c *Cipher) Decrypt(pkt, aad []byte) (contents []byte, ignore bool, e error) {
+	var plain []byte
+	if plain, e = c.recv_P.open(pkt, aad); e != nil {
+		e = errors.New("BIP324: packet authentication failed")
+		return
+	}
+	ignore = (plain[0] & IGNORE_BIT) != 0
+	contents = plain[HEADER_LEN:]
+	return
+}
+
+// Returns the first 16 bytes that a v1 peer sends (magic and "version" command)
+func V1Prefix(magic []byte) (res []byte) {
+	res = make([]byte, 16)
+	copy(res, magic)
+	copy(res[4:], "version")
+	return
+}
@@ -0,0 +1,55 @@
+package bip324
+
+import (
+	"errors"
+	"strings"
+)
+
+// Short message IDs (one byte instead of 12 byte long command)
+var short_ids = []string{"",
+	"addr", "block", "blocktxn", "cmpctblock", "feefilter", "filteradd", "filterclear",
+	"filterload", "getblocks", "getblocktxn", "getdata", "getheaders", "headers", "inv",
+	"mempool", "merkleblock", "notfound", "ping", "pong", "sendcmpct", "tx",
+	"getcfilters", "cfilter", "getcfheaders", "cfheaders", "getcfcheckpt", "cfcheckpt", "addrv2"}
+
+var short_id_map map[string]byte
+
+func init() {
+	short_id_map = make(map[string]byte, len(short_ids))
+	for i := 1; i < len(short_ids); i++ {
+		short_id_map[short_ids[i]] = byte(i)
+	}
+}
+
+// Returns the bytes that preceed the message's payload in the packet contents
+func MsgPrefix(cmd string) (res []byte) {
+	if id, ok := short_id_map[cmd]; ok {
+		return []byte{id}
+	}
+	res = make([]byte, 13)
+	copy(res[1:], cmd)
+	return
+}
+
+// Splits the packet contents into the message's command and payload.
+// For short IDs not known to us, cmd is returned empty (such messages shall be ignored).
+func DecodeMsg(contents []byte) (cmd string, pl []byte, e error) {
+	if len(contents) == 0 {
+		e = errors.New("BIP324: empty message")
+		return
+	}
+	if contents[0] != 0 {
+		if int(contents[0]) < len(short_ids) {
+			cmd = short_ids[contents[0]]
+		}
+		pl = contents[1:]
+		return
+	}
+	if len(contents) < 13 {
+		e = errors.New("BIP324: message too short")
+		return
+	}
+	cmd = strings.TrimRight(string(contents[1:13]), "\000")
+	pl = contents[13:]
+	return
+}
@@ -0,0 +1,72 @@
+package blockfilter
+
+import (
+	"errors"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Basic block filter (BIP158) and filter headers (BIP157)
+
+// Returns the elements of the block's basic filter: all the output scripts created by the block
+// (except OP_RETURN ones) and all the output scripts spent by it.
+// Spent_outputs of the block's (non-coinbase) transactions must be set.
+func BasicElements(bl *btc.Block) (res [][]byte, e error) {
+	done := make(map[string]bool)
+	add := func(pk []byte) {
+		if len(pk) == 0 || pk[0] == 0x6a || done[string(pk)] {
+			return
+		}
+		done[string(pk)] = true
+		res = append(res, pk)
+	}
+	for i, tx := range bl.Txs {
+		for _, out := range tx.TxOut {
+			add(out.Pk_script)
+		}
+		if i == 0 {
+			continue // coinbase
+		}
+		if len(tx.Spent_outputs) != len(tx.TxIn) {
+			e = errors.New("BasicElements: Spent_outputs not set in tx " + tx.Hash.String())
+			return
+		}
+		for _, out := range tx.Spent_outputs {
+			if out != nil {
+				add(out.Pk_script)
+			}
+		}
+	}
+	return
+}
+
+// Builds basic filter for the block (the list of transactions must be built and their Spent_outputs set)
+func NewBasicFilter(bl *btc.Block) (f *Filter, e error) {
+	var els [][]byte
+	if els, e = BasicElements(bl); e != nil {
+		return
+	}
+	var key [16]byte
+	copy(key[:], bl.Hash.Hash[:16])
+	f = BuildGCS(key, els, BASIC_FILTER_P, BASIC_FILTER_M)
+	return
+}
+
+// Decodes the block's basic filter from its serialized form
+func DecodeBasicFilter(block_hash *btc.Uint256, raw []byte) (*Filter, error) {
+	var key [16]byte
+	copy(key[:], block_hash.Hash[:16])
+	return NewGCS(key, raw, BASIC_FILTER_P, BASIC_FILTER_M)
+}
+
+// Returns double SHA256 of the serialized filter
+func FilterHash(raw []byte) (res [32]byte) {
+	btc.ShaHash(raw, res[:])
+	return
+}
+
+// Returns the filter header, as defined in BIP157 (prev_header is all zeros for the genesis block)
+func FilterHeader(raw []byte, prev_header []byte) (res [32]byte) {
+	h := FilterHash(raw)
+	btc.ShaHash(append(h[:], prev_header...), res[:])
+	return
+}
@@ -0,0 +1,91 @@
+package blockfilter
+
+import (
+	"bytes"
+	"testing"
+	"math/rand"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Testnet3 genesis block
+const testnet_genesis = "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4adae5494dffff001d1aa4ae18" +
+	"0101000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+func TestGenesis(t *testing.T) {
+	raw, _ := hex.DecodeString(testnet_genesis)
+	bl, e := btc.NewBlock(raw)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if bl.Hash.String() != "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943" {
+		t.Fatal("Bad genesis hash", bl.Hash.String())
+	}
+	if e = bl.BuildTxList(); e != nil {
+		t.Fatal(e)
+	}
+	f, e := NewBasicFilter(bl)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// test vectors from BIP158 (testnet-19.json)
+	if s := hex.EncodeToString(f.Bytes()); s != "019dfca8" {
+		t.Error("Bad filter", s)
+	}
+	hdr := FilterHeader(f.Bytes(), make([]byte, 32))
+	if s := btc.NewUint256(hdr[:]).String(); s != "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750" {
+		t.Error("Bad filter header", s)
+	}
+	if !f.Match(bl.Txs[0].TxOut[0].Pk_script) {
+		t.Error("Output script not matched")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	var key [16]byte
+	rand.Read(key[:])
+	els := make([][]byte, 1000)
+	for i := range els {
+		els[i] = make([]byte, 34)
+		rand.Read(els[i])
+	}
+	f := BuildGCS(key, els, BASIC_FILTER_P, BASIC_FILTER_M)
+
+	f2, e := NewGCS(key, f.Bytes(), BASIC_FILTER_P, BASIC_FILTER_M)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(f.Bytes(), f2.Bytes()) {
+		t.Fatal("Filter serialization mismatch")
+	}
+	for i := range els {
+		if !f2.Match(els[i]) {
+			t.Fatal("Element", i, "not matched")
+		}
+	}
+	var fp int
+	for i := 0; i < 10000; i++ {
+		el := make([]byte, 34)
+		rand.Read(el)
+		if f2.Match(el) {
+			fp++
+		}
+	}
+	if fp > 10 {
+		t.Error("Too many false positives", fp)
+	}
+	if !f2.MatchAny([][]byte{[]byte("foo"), els[500], []byte("bar")}) {
+		t.Error("MatchAny failed")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var key [16]byte
+	f := BuildGCS(key, nil, BASIC_FILTER_P, BASIC_FILTER_M)
+	if !bytes.Equal(f.Bytes(), []byte{0}) {
+		t.Error("Bad empty filter", hex.EncodeToString(f.Bytes()))
+	}
+	if f.Match([]byte{1, 2, 3}) {
+		t.Error("Empty filter matched")
+	}
+}
@@ -0,0 +1,201 @@
+package blockfilter
+
+import (
+	"sort"
+	"bytes"
+	"errors"
+	"math/bits"
+	"encoding/binary"
+	"github.com/dchest/siphash"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Golomb-coded set, as specified in BIP158
+
+const (
+	BASIC_FILTER = 0 // the only filter type defined so far
+	BASIC_FILTER_P = 19
+	BASIC_FILTER_M = 784931
+)
+
+type Filter struct {
+	N uint32 // number of elements
+	P uint8
+	M uint64
+	key [16]byte
+	data []byte // Golomb-Rice encoded deltas
+}
+
+
+type bit_writer struct {
+	buf []byte
+	nbits uint // number of bits used in the last byte
+}
+
+func (w *bit_writer) write_bit(b bool) {
+	if w.nbits == 0 {
+		w.buf = append(w.buf, 0)
+		w.nbits = 8
+	}
+	w.nbits--
+	if b {
+		w.buf[len(w.buf)-1] |= 1 << w.nbits
+	}
+}
+
+func (w *bit_writer) write_bits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		w.write_bit((v>>n) & 1 != 0)
+	}
+}
+
+type bit_reader struct {
+	buf []byte
+	pos uint // in bits
+}
+
+func (r *bit_reader) read_bit() (bool, error) {
+	if r.pos >= uint(len(r.buf)) * 8 {
+		return false, errors.New("GCS: unexpected end of data")
+	}
+	b := (r.buf[r.pos>>3] >> (7-(r.pos&7))) & 1
+	r.pos++
+	return b != 0, nil
+}
+
+func (r *bit_reader) read_bits(n uint) (v uint64, e error) {
+	var b bool
+	for ; n > 0; n-- {
+		if b, e = r.read_bit(); e != nil {
+			return
+		}
+		v <<= 1
+		if b {
+			v |= 1
+		}
+	}
+	return
+}
+
+
+// Maps the element uniformly onto the range [0, f)
+func hash_to_range(key *[16]byte, item []byte, f uint64) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	hi, _ := bits.Mul64(siphash.Hash(k0, k1, item), f)
+	return hi
+}
+
+// Returns sorted hashed values of the elements, mapped onto the range [0, N*M)
+func hashed_set(key *[16]byte, elements [][]byte, m uint64) (res []uint64) {
+	f := uint64(len(elements)) * m
+	res = make([]uint64, len(elements))
+	for i := range elements {
+		res[i] = hash_to_range(key, elements[i], f)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return
+}
+
+// Builds the filter out of the given elements (they must be unique).
+func BuildGCS(key [16]byte, elements [][]byte, p uint8, m uint64) (f *Filter) {
+	f = &Filter{N:uint32(len(elements)), P:p, M:m, key:key}
+	var w bit_writer
+	var last uint64
+	for _, v := range hashed_set(&key, elements, m) {
+		delta := v - last
+		last = v
+		for q := delta >> p; q > 0; q-- {
+			w.write_bit(true)
+		}
+		w.write_bit(false)
+		w.write_bits(delta, uint(p))
+	}
+	f.data = w.buf
+	return
+}
+
+// Decodes the filter from its serialized form (as returned by Bytes)
+func NewGCS(key [16]byte, raw []byte, p uint8, m uint64) (f *Filter, e error) {
+	rd := bytes.NewReader(raw)
+	var n uint64
+	if n, e = btc.ReadVLen(rd); e != nil {
+		return
+	}
+	if n > 0xffffffff {
+		e = errors.New("GCS: too many elements")
+		return
+	}
+	f = &Filter{N:uint32(n), P:p, M:m, key:key, data:raw[len(raw)-rd.Len():]}
+	return
+}
+
+// Returns the serialized filter: N (as CompactSize) followed by the bit stream.
+func (f *Filter) Bytes() []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(f.N))
+	b.Write(f.data)
+	return b.Bytes()
+}
+
+// Calls cb for each value of the set, in ascending order, until it returns false
+func (f *Filter) iterate(cb func(uint64) bool) error {
+	r := bit_reader{buf:f.data}
+	var last uint64
+	for i := uint32(0); i < f.N; i++ {
+		var q uint64
+		for {
+			b, e := r.read_bit()
+			if e != nil {
+				return e
+			}
+			if !b {
+				break
+			}
+			q++
+		}
+		rem, e := r.read_bits(uint(f.P))
+		if e != nil {
+			return e
+		}
+		last += q<<f.P | rem
+		if !cb(last) {
+			break
+		}
+	}
+	return nil
+}
+
+// Returns true if the element is (probably) in the set.
+func (f *Filter) Match(element []byte) bool {
+	return f.MatchAny([][]byte{element})
+}
+
+// Returns true if any of the elements is (probably) in the set.
+func (f *Filter) MatchAny(elements [][]byte) (res bool) {
+	if f.N == 0 || len(elements) == 0 {
+		return
+	}
+	query := make([]uint64, 0, len(elements))
+	fnm := uint64(f.N) * f.M
+	for _, el := range elements {
+		query = append(query, hash_to_range(&f.key, el, fnm))
+	}
+	sort.Slice(query, func(i, j int) bool { return query[i] < query[j] })
+	var qi int
+	f.iterate(func(v uint64) bool {
+		for qi < len(query) && query[qi] < v {
+			qi++
+		}
+		if qi == len(query) {
+			return false
+		}
+		if query[qi] == v {
+			res = true
+			return false
+		}
+		return true
+	})
+	return
+}
@@ -36,8 +36,8 @@ type SegwitProg struct {
 
 
 func NewAddrFromString(hs string) (a *BtcAddr, e error) {
-	if strings.HasPrefix(hs, "bc1") || strings.HasPrefix(hs, "tb1") {
-		var sw = &SegwitProg{HRP:hs[:2]}
+	if strings.HasPrefix(hs, "bc1") || strings.HasPrefix(hs, "tb1") || strings.HasPrefix(hs, "bcrt1") {
+		var sw = &SegwitProg{HRP:hs[:strings.LastIndex(hs, "1")]}
 		sw.Version, sw.Program = bech32.SegwitDecode(sw.HRP, hs)
 		if sw.Program != nil {
 			a = &BtcAddr{SegwitProg:sw}
@@ -90,6 +90,22 @@ func NewAddrFromPubkey(in []byte, ver byte) (a *BtcAddr) {
 }
 
 
+// Returns P2TR address of the given public key (used as the internal key, without a script tree - see BIP86).
+// pubkey can be 33 bytes compressed or 32 bytes x-only key. Returns nil if the key is invalid.
+func NewAddrP2TR(pubkey []byte, testnet bool) (a *BtcAddr) {
+	if len(pubkey) == 33 {
+		pubkey = pubkey[1:]
+	}
+	q, _ := TaprootOutputKey(pubkey, nil)
+	if q == nil {
+		return
+	}
+	a = new(BtcAddr)
+	a.SegwitProg = &SegwitProg{HRP:GetSegwitHRP(testnet), Version:1, Program:q}
+	return
+}
+
+
 func AddrVerPubkey(testnet bool) byte {
 	if testnet {
 		return 111
@@ -231,11 +247,16 @@ func (a *BtcAddr) Owns(scr []byte) (yes bool) {
 
 func (a *BtcAddr) OutScript() (res []byte) {
 	if a.SegwitProg != nil {
-		if a.SegwitProg.Version != 0 || ( len(a.SegwitProg.Program) != 20 && len(a.SegwitProg.Program) != 32  ) {
-			panic("Only Segwit programs version 0 and length 20 or 32 supported")
+		if a.SegwitProg.Version < 0 || a.SegwitProg.Version > 16 || len(a.SegwitProg.Program) < 2 || len(a.SegwitProg.Program) > 40 ||
+			a.SegwitProg.Version == 0 && len(a.SegwitProg.Program) != 20 && len(a.SegwitProg.Program) != 32 {
+			panic("Unsupported Segwit program")
 		}
 		res = make([]byte, 2 + len(a.SegwitProg.Program))
-		res[0] = 0x00 // OP_0
+		if a.SegwitProg.Version == 0 {
+			res[0] = OP_0
+		} else {
+			res[0] = OP_1 - 1 + byte(a.SegwitProg.Version)
+		}
 		res[1] = byte(len(a.SegwitProg.Program))
 		copy(res[2:], a.SegwitProg.Program)
 	} else if a.Version==AddrVerPubkey(false) || a.Version==AddrVerPubkey(true) || a.Version==48 /*Litecoin*/ {
@@ -325,10 +346,20 @@ func (sw *SegwitProg) String() (res string) {
 	return
 }
 
+// Human readable parts of bech32 addresses
+const (
+	MainnetHRP = "bc"
+	SignetHRP = "tb" // same as testnet3
+	RegtestHRP = "bcrt"
+)
+
+// Human readable part of bech32 addresses used when testnet is set (change it for signet or regtest)
+var TestnetHRP string = "tb"
+
 func GetSegwitHRP(testnet bool) string {
 	if testnet {
-		return "tb"
+		return TestnetHRP
 	} else {
-		return "bc"
+		return MainnetHRP
 	}
 }
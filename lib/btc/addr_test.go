@@ -94,6 +94,30 @@ func TestAddr(t *testing.T) {
 	}
 }
 
+func TestAddrP2TR(t *testing.T) {
+	// BIP86 test vector: m/86'/0'/0'/0/0
+	pub, _ := hex.DecodeString("cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115")
+	a := NewAddrP2TR(pub, false)
+	if a == nil || a.String() != "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr" {
+		t.Fatal("NewAddrP2TR failed")
+	}
+	scr := a.OutScript()
+	if hex.EncodeToString(scr) != "5120a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c" {
+		t.Error("Bad P2TR OutScript", hex.EncodeToString(scr))
+	}
+	if !IsP2TR(scr) {
+		t.Error("IsP2TR failed")
+	}
+	b, _ := NewAddrFromString(a.String())
+	if b == nil || !bytes.Equal(b.OutScript(), scr) {
+		t.Error("NewAddrFromString failed")
+	}
+	if c := NewAddrFromPkScript(scr, false); c == nil || c.String() != a.String() {
+		t.Error("NewAddrFromPkScript failed")
+	}
+}
+
+
 func TestBase58(t *testing.T) {
 	d, _ := ioutil.ReadFile("../test/base58_encode_decode.json")
 	var vecs [][2]string
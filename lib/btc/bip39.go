@@ -0,0 +1,87 @@
+package btc
+
+import (
+	"fmt"
+	"errors"
+	"strings"
+	"math/big"
+	"crypto/sha256"
+	"crypto/sha512"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// BIP39 - Mnemonic code for generating deterministic keys
+
+var (
+	Bip39Words []string
+	bip39_index map[string]int
+)
+
+func init() {
+	Bip39Words = strings.Fields(bip39_english)
+	bip39_index = make(map[string]int, len(Bip39Words))
+	for i, w := range Bip39Words {
+		bip39_index[w] = i
+	}
+}
+
+
+// Returns mnemonic sentence for the given entropy (16, 20, 24, 28 or 32 bytes)
+func NewMnemonic(entropy []byte) (string, error) {
+	if len(entropy) < 16 || len(entropy) > 32 || (len(entropy) % 4) != 0 {
+		return "", errors.New(fmt.Sprint("NewMnemonic: Unsupported entropy length ", len(entropy)))
+	}
+	cs_bits := uint(len(entropy) / 4)
+	h := sha256.Sum256(entropy)
+
+	// entropy followed by the checksum bits
+	v := new(big.Int).SetBytes(entropy)
+	v.Lsh(v, cs_bits)
+	v.Or(v, big.NewInt(int64(h[0] >> (8 - cs_bits))))
+
+	words := make([]string, (len(entropy)*8 + int(cs_bits)) / 11)
+	mask := big.NewInt(0x7ff)
+	for i := len(words)-1; i >= 0; i-- {
+		words[i] = Bip39Words[new(big.Int).And(v, mask).Int64()]
+		v.Rsh(v, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+
+// Decodes the mnemonic sentence and verifies its checksum
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || (len(words) % 3) != 0 {
+		return nil, errors.New(fmt.Sprint("MnemonicToEntropy: Unsupported number of words ", len(words)))
+	}
+	v := new(big.Int)
+	for _, w := range words {
+		idx, ok := bip39_index[strings.ToLower(w)]
+		if !ok {
+			return nil, errors.New("MnemonicToEntropy: Unknown word " + w)
+		}
+		v.Lsh(v, 11)
+		v.Or(v, big.NewInt(int64(idx)))
+	}
+	cs_bits := uint(len(words) / 3)
+	cs := byte(new(big.Int).And(v, big.NewInt(int64(1 << cs_bits) - 1)).Int64())
+	v.Rsh(v, cs_bits)
+
+	entropy := make([]byte, len(words) * 4 / 3)
+	b := v.Bytes()
+	copy(entropy[len(entropy)-len(b):], b)
+
+	h := sha256.Sum256(entropy)
+	if h[0] >> (8 - cs_bits) != cs {
+		return nil, errors.New("MnemonicToEntropy: Checksum error")
+	}
+	return entropy, nil
+}
+
+
+// Returns 64 bytes seed for the given mnemonic and passphrase (both are expected to be ASCII)
+func MnemonicToSeed(mnemonic, passphrase string) []byte {
+	mnemonic = strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	return pbkdf2.Key([]byte(mnemonic), []byte("mnemonic" + passphrase), 2048, 64, sha512.New)
+}
@@ -231,9 +231,10 @@ func WriteVlen(b io.Writer, var_len uint64) {
 }
 
 // Writes opcode to put a specific number of bytes to stack
+// (OP_PUSHDATA1 from 76 bytes, as 0x4c itself is OP_PUSHDATA1 opcode)
 func WritePutLen(b io.Writer, data_len uint32) {
 	switch {
-		case data_len <= OP_PUSHDATA1:
+		case data_len < OP_PUSHDATA1:
 			b.Write([]byte{byte(data_len)})
 
 		case data_len < 0x100:
@@ -348,6 +349,11 @@ func IsP2SH(d []byte) bool {
 	return len(d)==23 && d[0]==0xa9 && d[1]==20 && d[22]==0x87
 }
 
+// Return true if the given PK_script is a taproot output (segwit version 1)
+func IsP2TR(d []byte) bool {
+	return len(d)==34 && d[0]==OP_1 && d[1]==32
+}
+
 // Returns true if the given PK_script is anyhow usefull to gocoin's node
 func IsUsefullOutScript(v []byte) bool {
 	if len(v)==25 && v[0]==0x76 && v[1]==0xa9 && v[2]==0x14 && v[23]==0x88 && v[24]==0xac {
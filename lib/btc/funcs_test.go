@@ -1,7 +1,9 @@
 package btc
 
 import (
+	"bytes"
 	"testing"
+	"encoding/hex"
 )
 
 func TestParseAmount(t *testing.T) {
@@ -59,3 +61,30 @@ func TestParseAmount(t *testing.T) {
 		}
 	}
 }
+
+func TestWritePutLen(t *testing.T) {
+	var tv = []struct {
+		le uint32
+		pref string
+	} {
+		{1, "01"},
+		{75, "4b"},
+		{76, "4c4c"},
+		{255, "4cff"},
+		{256, "4d0001"},
+		{65535, "4dffff"},
+	}
+	for _, v := range tv {
+		buf := new(bytes.Buffer)
+		WritePutLen(buf, v.le)
+		if hex.EncodeToString(buf.Bytes()) != v.pref {
+			t.Error("Bad prefix for", v.le, hex.EncodeToString(buf.Bytes()))
+			continue
+		}
+		buf.Write(make([]byte, v.le))
+		_, data, n, e := GetOpcode(buf.Bytes())
+		if e != nil || n != buf.Len() || len(data) != int(v.le) {
+			t.Error("Push of", v.le, "bytes not parsed back", n, len(data), e)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package btc
 
 import (
+	"io"
 	"fmt"
+	"bytes"
+	"errors"
 	"encoding/binary"
 )
 
@@ -38,3 +41,91 @@ func (a *NetAddr) Bytes() (res []byte) {
 func (a *NetAddr) String() string {
 	return fmt.Sprintf("%d.%d.%d.%d:%d", a.Ip4[0], a.Ip4[1], a.Ip4[2], a.Ip4[3], a.Port)
 }
+
+
+// BIP155 network IDs
+const (
+	NET_IPV4 = 1
+	NET_IPV6 = 2
+	NET_TORV2 = 3 // deprecated - we ignore such addresses
+	NET_TORV3 = 4
+	NET_I2P = 5
+	NET_CJDNS = 6
+
+	MAX_ADDRV2_LEN = 512
+	MAX_ADDRV2_PER_MESSAGE = 1000
+)
+
+var net_names = []string{"", "IPv4", "IPv6", "TorV2", "TorV3", "I2P", "CJDNS"}
+
+// Address lengths of the known networks
+var net_addr_len = []int{0, 4, 16, 10, 32, 32, 16}
+
+// Returns name of the given network (BIP155 ID)
+func NetName(id byte) string {
+	if int(id) < len(net_names) && id != 0 {
+		return net_names[id]
+	}
+	return fmt.Sprint("Net-", id)
+}
+
+// Returns true if the network ID is known and the address has the correct length for it
+func NetAddrLenOK(id byte, le int) bool {
+	return id != 0 && int(id) < len(net_addr_len) && net_addr_len[id] == le
+}
+
+
+// One entry of "addrv2" message (BIP155)
+type AddrV2 struct {
+	Time uint32
+	Services uint64
+	NetID byte
+	Addr []byte
+	Port uint16
+}
+
+// Reads one entry of "addrv2" message
+func ReadAddrV2(rd io.Reader) (a *AddrV2, e error) {
+	var b [4]byte
+	a = new(AddrV2)
+	if e = ReadAll(rd, b[:4]); e != nil {
+		return
+	}
+	a.Time = binary.LittleEndian.Uint32(b[:4])
+	if a.Services, e = ReadVLen(rd); e != nil {
+		return
+	}
+	if e = ReadAll(rd, b[:1]); e != nil {
+		return
+	}
+	a.NetID = b[0]
+	le, e := ReadVLen(rd)
+	if e != nil {
+		return
+	}
+	if le > MAX_ADDRV2_LEN {
+		e = errors.New("AddrV2: address too long")
+		return
+	}
+	a.Addr = make([]byte, int(le))
+	if e = ReadAll(rd, a.Addr); e != nil {
+		return
+	}
+	if e = ReadAll(rd, b[:2]); e != nil {
+		return
+	}
+	a.Port = binary.BigEndian.Uint16(b[:2])
+	return
+}
+
+// Serializes the entry for "addrv2" message
+func (a *AddrV2) Bytes() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, a.Time)
+	WriteVlen(b, a.Services)
+	b.WriteByte(a.NetID)
+	WriteVlen(b, uint64(len(a.Addr)))
+	b.Write(a.Addr)
+	binary.Write(b, binary.BigEndian, a.Port)
+	return b.Bytes()
+}
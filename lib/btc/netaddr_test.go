@@ -0,0 +1,44 @@
+package btc
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+)
+
+func TestAddrV2(t *testing.T) {
+	a := &AddrV2{Time:0x5f5e1000, Services:0x409, NetID:NET_TORV3, Addr:bytes.Repeat([]byte{0xab}, 32), Port:8333}
+	raw := a.Bytes()
+	if exp := "00105e5ffd090404" + "20" + hex.EncodeToString(a.Addr) + "208d"; hex.EncodeToString(raw) != exp {
+		t.Fatal("Bad serialization", hex.EncodeToString(raw))
+	}
+	b, e := ReadAddrV2(bytes.NewReader(raw))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if b.Time != a.Time || b.Services != a.Services || b.NetID != a.NetID || !bytes.Equal(b.Addr, a.Addr) || b.Port != a.Port {
+		t.Error("Roundtrip failed")
+	}
+	if _, e = ReadAddrV2(bytes.NewReader(raw[:len(raw)-1])); e == nil {
+		t.Error("Truncated entry accepted")
+	}
+
+	// unknown networks shall be parsed, but not with addresses longer than 512 bytes
+	a = &AddrV2{NetID:99, Addr:make([]byte, MAX_ADDRV2_LEN)}
+	if _, e = ReadAddrV2(bytes.NewReader(a.Bytes())); e != nil {
+		t.Error(e)
+	}
+	a.Addr = append(a.Addr, 0)
+	if _, e = ReadAddrV2(bytes.NewReader(a.Bytes())); e == nil {
+		t.Error("Too long address accepted")
+	}
+}
+
+func TestNetAddrLen(t *testing.T) {
+	if !NetAddrLenOK(NET_IPV4, 4) || !NetAddrLenOK(NET_IPV6, 16) || !NetAddrLenOK(NET_I2P, 32) || !NetAddrLenOK(NET_CJDNS, 16) {
+		t.Error("Valid length rejected")
+	}
+	if NetAddrLenOK(NET_TORV3, 16) || NetAddrLenOK(0, 0) || NetAddrLenOK(7, 16) {
+		t.Error("Invalid length accepted")
+	}
+}
@@ -0,0 +1,36 @@
+package btc
+
+import (
+	"sync/atomic"
+	"crypto/rand"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+var (
+	schnorrVerifyCnt uint64
+	Schnorr_Verify func(pkey, sig, msg []byte) bool
+)
+
+
+func SchnorrVerifyCnt() uint64 {
+	return atomic.LoadUint64(&schnorrVerifyCnt)
+}
+
+// Verifies BIP340 signature (64 bytes) of the 32 bytes message, against the x-only public key
+func SchnorrVerify(pkey, sig, msg []byte) bool {
+	atomic.AddUint64(&schnorrVerifyCnt, 1)
+	if len(pkey) != 32 || len(sig) != 64 {
+		return false
+	}
+	if Schnorr_Verify != nil {
+		return Schnorr_Verify(pkey, sig, msg)
+	}
+	return secp256k1.SchnorrVerify(pkey, sig, msg)
+}
+
+// Creates BIP340 signature of the 32 bytes hash
+func SchnorrSign(priv, hash []byte) (sig []byte) {
+	var aux [32]byte
+	rand.Read(aux[:])
+	return secp256k1.SchnorrSign(priv, hash, aux[:])
+}
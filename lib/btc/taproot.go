@@ -0,0 +1,223 @@
+package btc
+
+import (
+	"bytes"
+	"errors"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+const (
+	SIGHASH_DEFAULT = 0 // taproot only - same as SIGHASH_ALL
+	TAPROOT_LEAF_MASK = 0xfe
+	TAPROOT_LEAF_TAPSCRIPT = 0xc0
+	TAPROOT_CONTROL_BASE_SIZE = 33
+	TAPROOT_CONTROL_NODE_SIZE = 32
+	TAPROOT_CONTROL_MAX_NODE_COUNT = 128
+	TAPROOT_CONTROL_MAX_SIZE = TAPROOT_CONTROL_BASE_SIZE + TAPROOT_CONTROL_NODE_SIZE * TAPROOT_CONTROL_MAX_NODE_COUNT
+	ANNEX_TAG = 0x50
+)
+
+// Data of the input being verified, which is committed to by the taproot signature hash
+type TaprootExecData struct {
+	AnnexHash []byte // nil if there is no annex
+	TapLeafHash []byte // nil for key path spending
+	CodeSepPos uint32 // position of the last executed OP_CODESEPARATOR (0xffffffff if none)
+}
+
+
+// Returns BIP340 tagged hash of the data
+func TaggedHash(tag string, data ...[]byte) []byte {
+	return secp256k1.TaggedHash(tag, data...)
+}
+
+// Returns the hash of the tapscript leaf
+func TapLeafHash(leaf_ver byte, script []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(leaf_ver)
+	WriteVlen(buf, uint64(len(script)))
+	buf.Write(script)
+	return TaggedHash("TapLeaf", buf.Bytes())
+}
+
+// Returns the hash of the branch with two children (sorted lexicographically)
+func TapBranchHash(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return TaggedHash("TapBranch", a, b)
+}
+
+// Returns the tweak for the internal key, committing to the script tree (merkle_root can be nil)
+func TapTweak(internal_key, merkle_root []byte) []byte {
+	return TaggedHash("TapTweak", internal_key, merkle_root)
+}
+
+// Returns the taproot output key for the given internal key and script tree root (can be nil).
+// The second value tells whether the Y coordinate of the output key is odd.
+func TaprootOutputKey(internal_key, merkle_root []byte) ([]byte, bool) {
+	return secp256k1.XOnlyPubkeyTweakAdd(internal_key, TapTweak(internal_key, merkle_root))
+}
+
+// Returns the tweaked private key, to be used for taproot key path spending
+func TaprootTweakPrivKey(priv, merkle_root []byte) []byte {
+	var pub [33]byte
+	secp256k1.BaseMultiply(priv, pub[:])
+	return secp256k1.XOnlySeckeyTweakAdd(priv, TapTweak(pub[1:], merkle_root))
+}
+
+// Returns the merkle root of the script tree, calculated from the control block and the leaf hash
+func TaprootMerkleRoot(control, leaf_hash []byte) (k []byte) {
+	k = leaf_hash
+	for i := TAPROOT_CONTROL_BASE_SIZE; i+TAPROOT_CONTROL_NODE_SIZE <= len(control); i += TAPROOT_CONTROL_NODE_SIZE {
+		k = TapBranchHash(k, control[i:i+TAPROOT_CONTROL_NODE_SIZE])
+	}
+	return
+}
+
+
+// Calculates BIP341 hashes of the transaction. Call it with hash_lock locked.
+func (tx *Tx) tapHashes() {
+	if tx.tapPrevouts != nil {
+		return
+	}
+	sha := sha256.New()
+	for _, vin := range tx.TxIn {
+		sha.Write(vin.Input.Hash[:])
+		binary.Write(sha, binary.LittleEndian, vin.Input.Vout)
+	}
+	tx.tapPrevouts = sha.Sum(nil)
+
+	sha.Reset()
+	for _, out := range tx.Spent_outputs {
+		binary.Write(sha, binary.LittleEndian, out.Value)
+	}
+	tx.tapAmounts = sha.Sum(nil)
+
+	sha.Reset()
+	for _, out := range tx.Spent_outputs {
+		WriteVlen(sha, uint64(len(out.Pk_script)))
+		sha.Write(out.Pk_script)
+	}
+	tx.tapScriptPubKeys = sha.Sum(nil)
+
+	sha.Reset()
+	for _, vin := range tx.TxIn {
+		binary.Write(sha, binary.LittleEndian, vin.Sequence)
+	}
+	tx.tapSequences = sha.Sum(nil)
+
+	sha.Reset()
+	for _, vout := range tx.TxOut {
+		binary.Write(sha, binary.LittleEndian, vout.Value)
+		WriteVlen(sha, uint64(len(vout.Pk_script)))
+		sha.Write(vout.Pk_script)
+	}
+	tx.tapOutputs = sha.Sum(nil)
+}
+
+
+// Returns BIP341 signature hash of the given input, or nil if it cannot be calculated
+// (unknown hash type, SIGHASH_SINGLE without the matching output, missing Spent_outputs).
+func (tx *Tx) TaprootSigHash(ed *TaprootExecData, nIn int, hashType byte) []byte {
+	if hashType > 3 && (hashType < 0x81 || hashType > 0x83) {
+		return nil
+	}
+	if len(tx.Spent_outputs) != len(tx.TxIn) || nIn >= len(tx.TxIn) {
+		return nil
+	}
+	output_type := hashType & 3
+	if hashType == SIGHASH_DEFAULT {
+		output_type = SIGHASH_ALL
+	}
+	anyonecanpay := (hashType & SIGHASH_ANYONECANPAY) != 0
+	if output_type == SIGHASH_SINGLE && nIn >= len(tx.TxOut) {
+		return nil
+	}
+
+	tx.hash_lock.Lock()
+	tx.tapHashes()
+	tx.hash_lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(0) // epoch
+	buf.WriteByte(hashType)
+	binary.Write(buf, binary.LittleEndian, tx.Version)
+	binary.Write(buf, binary.LittleEndian, tx.Lock_time)
+	if !anyonecanpay {
+		buf.Write(tx.tapPrevouts)
+		buf.Write(tx.tapAmounts)
+		buf.Write(tx.tapScriptPubKeys)
+		buf.Write(tx.tapSequences)
+	}
+	if output_type != SIGHASH_NONE && output_type != SIGHASH_SINGLE {
+		buf.Write(tx.tapOutputs)
+	}
+
+	var spend_type byte
+	if ed.TapLeafHash != nil {
+		spend_type = 2
+	}
+	if ed.AnnexHash != nil {
+		spend_type |= 1
+	}
+	buf.WriteByte(spend_type)
+
+	if anyonecanpay {
+		buf.Write(tx.TxIn[nIn].Input.Hash[:])
+		binary.Write(buf, binary.LittleEndian, tx.TxIn[nIn].Input.Vout)
+		binary.Write(buf, binary.LittleEndian, tx.Spent_outputs[nIn].Value)
+		WriteVlen(buf, uint64(len(tx.Spent_outputs[nIn].Pk_script)))
+		buf.Write(tx.Spent_outputs[nIn].Pk_script)
+		binary.Write(buf, binary.LittleEndian, tx.TxIn[nIn].Sequence)
+	} else {
+		binary.Write(buf, binary.LittleEndian, uint32(nIn))
+	}
+	if ed.AnnexHash != nil {
+		buf.Write(ed.AnnexHash)
+	}
+
+	if output_type == SIGHASH_SINGLE {
+		h := sha256.New()
+		binary.Write(h, binary.LittleEndian, tx.TxOut[nIn].Value)
+		WriteVlen(h, uint64(len(tx.TxOut[nIn].Pk_script)))
+		h.Write(tx.TxOut[nIn].Pk_script)
+		buf.Write(h.Sum(nil))
+	}
+
+	if ed.TapLeafHash != nil {
+		buf.Write(ed.TapLeafHash)
+		buf.WriteByte(0) // key_version
+		binary.Write(buf, binary.LittleEndian, ed.CodeSepPos)
+	}
+
+	return TaggedHash("TapSighash", buf.Bytes())
+}
+
+
+// Signs taproot key path spending input (pk_script must be P2TR) with the given (untweaked) private key.
+// Spent_outputs must be set. merkle_root is the script tree's root (nil if there is no script tree).
+func (tx *Tx) SignTaprootKeyPath(in int, hash_type byte, priv_key, merkle_root []byte) error {
+	h := tx.TaprootSigHash(&TaprootExecData{CodeSepPos:0xffffffff}, in, hash_type)
+	if h == nil {
+		return errors.New("tx.SignTaprootKeyPath() - cannot calculate signature hash")
+	}
+	key := TaprootTweakPrivKey(priv_key, merkle_root)
+	if key == nil {
+		return errors.New("tx.SignTaprootKeyPath() - invalid private key")
+	}
+	sig := SchnorrSign(key, h)
+	if sig == nil {
+		return errors.New("tx.SignTaprootKeyPath() - SchnorrSign failed")
+	}
+	if hash_type != SIGHASH_DEFAULT {
+		sig = append(sig, hash_type)
+	}
+
+	if tx.SegWit == nil {
+		tx.SegWit = make([][][]byte, len(tx.TxIn))
+	}
+	tx.SegWit[in] = [][]byte{sig}
+	return nil
+}
@@ -0,0 +1,154 @@
+package btc
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+// BIP341 test vectors (wallet-test-vectors.json)
+
+func TestTaprootScriptPubKey(t *testing.T) {
+	var vs = []struct {
+		internal, leaf, root, tweak, output string
+	} {
+		{
+			internal: "d6889cb081036e0faefa3a35157ad71086b123b2b144b649798b494c300a961d",
+			tweak: "b86e7be8f39bab32a6f2c0443abbc210f0edac0e2c53d501b36b64437d9c6c70",
+			output: "53a1f6e454df1aa2776a2814a721372d6258050de330b3c6d10ee8f4e0dda343",
+		},
+		{
+			internal: "187791b6f712a8ea41c8ecdd0ee77fab3e85263b37e1ec18a3651926b3a6cf27",
+			leaf: "20d85a959b0290bf19bb89ed43c916be835475d013da4b362117393e25a48229b8ac",
+			root: "5b75adecf53548f3ec6ad7d78383bf84cc57b55a3127c72b9a2481752dd88b21",
+			tweak: "cbd8679ba636c1110ea247542cfbd964131a6be84f873f7f3b62a777528ed001",
+			output: "147c9c57132f6e7ecddba9800bb0c4449251c92a1e60371ee77557b6620f3ea3",
+		},
+	}
+	for i, v := range vs {
+		ik, _ := hex.DecodeString(v.internal)
+		var root []byte
+		if v.leaf != "" {
+			leaf, _ := hex.DecodeString(v.leaf)
+			root = TapLeafHash(TAPROOT_LEAF_TAPSCRIPT, leaf)
+			if hex.EncodeToString(root) != v.root {
+				t.Error(i, "Bad leaf hash", hex.EncodeToString(root))
+			}
+		}
+		if tw := TapTweak(ik, root); hex.EncodeToString(tw) != v.tweak {
+			t.Error(i, "Bad tweak", hex.EncodeToString(tw))
+		}
+		q, odd := TaprootOutputKey(ik, root)
+		if hex.EncodeToString(q) != v.output {
+			t.Error(i, "Bad output key", hex.EncodeToString(q))
+		}
+		if i == 1 {
+			// control block of the script path spending
+			control := append([]byte{TAPROOT_LEAF_TAPSCRIPT}, ik...)
+			if odd {
+				control[0] |= 1
+			}
+			if control[0] != 0xc1 {
+				t.Error(i, "Bad control block")
+			}
+			if !secp256k1.CheckPayToContract(q, odd, ik, TapTweak(ik, TaprootMerkleRoot(control, root))) {
+				t.Error(i, "CheckPayToContract failed")
+			}
+		}
+	}
+}
+
+
+func TestTaprootSigHash(t *testing.T) {
+	raw, _ := hex.DecodeString("02000000097de20cbff686da83a54981d2b9bab3586f4ca7e48f57f5b55963115f3b334e9c010000000000000000d7b7cab57b1393ace2d064f4d4a2cb8af6def61273e127517d44759b6dafdd990000000000fffffffff8e1f583384333689228c5d28eac13366be082dc57441760d957275419a418420000000000fffffffff0689180aa63b30cb162a73c6d2a38b7eeda2a83ece74310fda0843ad604853b0100000000feffffffaa5202bdf6d8ccd2ee0f0202afbbb7461d9264a25e5bfd3c5a52ee1239e0ba6c0000000000feffffff956149bdc66faa968eb2be2d2faa29718acbfe3941215893a2a3446d32acd050000000000000000000e664b9773b88c09c32cb70a2a3e4da0ced63b7ba3b22f848531bbb1d5d5f4c94010000000000000000e9aa6b8e6c9de67619e6a3924ae25696bb7b694bb677a632a74ef7eadfd4eabf0000000000ffffffffa778eb6a263dc090464cd125c466b5a99667720b1c110468831d058aa1b82af10100000000ffffffff0200ca9a3b000000001976a91406afd46bcdfd22ef94ac122aa11f241244a37ecc88ac807840cb0000000020ac9a87f5594be208f8532db38cff670c450ed2fea8fcdefcc9a663f78bab962b0065cd1d")
+	amounts := []uint64{420000000, 462000000, 294000000, 504000000, 630000000, 378000000, 672000000, 546000000, 588000000}
+	scripts := []string{
+		"512053a1f6e454df1aa2776a2814a721372d6258050de330b3c6d10ee8f4e0dda343",
+		"5120147c9c57132f6e7ecddba9800bb0c4449251c92a1e60371ee77557b6620f3ea3",
+		"76a914751e76e8199196d454941c45d1b3a323f1433bd688ac",
+		"5120e4d810fd50586274face62b8a807eb9719cef49c04177cc6b76a9a4251d5450e",
+		"512091b64d5324723a985170e4dc5a0f84c041804f2cd12660fa5dec09fc21783605",
+		"00147dd65592d0ab2fe0d0257d571abf032cd9db93dc",
+		"512075169f4001aa68f15bbed28b218df1d0a62cbbcf1188c6665110c293c907b831",
+		"5120712447206d7a5238acc7ff53fbe94a3b64539ad291c7cdbc490b7577e4b17df5",
+		"512077e30a5522dd9f894c3f8b8bd4c4b2cf82ca7da8a3ea6a239655c39c050ab220",
+	}
+
+	tx, n := NewTx(raw)
+	if tx == nil || n != len(raw) {
+		t.Fatal("Cannot decode the transaction")
+	}
+	if tx.TaprootSigHash(&TaprootExecData{CodeSepPos:0xffffffff}, 0, SIGHASH_DEFAULT) != nil {
+		t.Error("TaprootSigHash should fail without Spent_outputs")
+	}
+	for i := range amounts {
+		scr, _ := hex.DecodeString(scripts[i])
+		tx.Spent_outputs = append(tx.Spent_outputs, &TxOut{Value:amounts[i], Pk_script:scr})
+	}
+
+	tx.hash_lock.Lock()
+	tx.tapHashes()
+	tx.hash_lock.Unlock()
+	for _, v := range [][2]interface{} {
+		{tx.tapAmounts, "58a6964a4f5f8f0b642ded0a8a553be7622a719da71d1f5befcefcdee8e0fde6"},
+		{tx.tapOutputs, "a2e6dab7c1f0dcd297c8d61647fd17d821541ea69c3cc37dcbad7f90d4eb4bc5"},
+		{tx.tapPrevouts, "e3b33bb4ef3a52ad1fffb555c0d82828eb22737036eaeb02a235d82b909c4c3f"},
+		{tx.tapScriptPubKeys, "23ad0f61ad2bca5ba6a7693f50fce988e17c3780bf2b1e720cfbb38fbdd52e21"},
+		{tx.tapSequences, "18959c7221ab5ce9e26c3cd67b22c24f8baa54bac281d8e6b05e400e6c3a957e"},
+	} {
+		if res := hex.EncodeToString(v[0].([]byte)); res != v[1].(string) {
+			t.Error("Intermediary hash mismatch", res, v[1])
+		}
+	}
+
+	var vs = []struct {
+		in int
+		hash_type byte
+		priv, root, sighash, witness string
+	} {
+		{0, 3, "6b973d88838f27366ed61c9ad6367663045cb456e28335c109e30717ae0c6baa", "",
+			"2514a6272f85cfa0f45eb907fcb0d121b808ed37c6ea160a5a9046ed5526d555",
+			"ed7c1647cb97379e76892be0cacff57ec4a7102aa24296ca39af7541246d8ff14d38958d4cc1e2e478e4d4a764bbfd835b16d4e314b72937b29833060b87276c03"},
+		{1, 0x83, "1e4da49f6aaf4e5cd175fe08a32bb5cb4863d963921255f33d3bc31e1343907f", "5b75adecf53548f3ec6ad7d78383bf84cc57b55a3127c72b9a2481752dd88b21",
+			"325a644af47e8a5a2591cda0ab0723978537318f10e6a63d4eed783b96a71a4d",
+			"052aedffc554b41f52b521071793a6b88d6dbca9dba94cf34c83696de0c1ec35ca9c5ed4ab28059bd606a4f3a657eec0bb96661d42921b5f50a95ad33675b54f83"},
+		{3, 1, "", "", "bf013ea93474aa67815b1b6cc441d23b64fa310911d991e713cd34c7f5d46669", ""},
+		{4, 0, "", "", "4f900a0bae3f1446fd48490c2958b5a023228f01661cda3496a11da502a7f7ef", ""},
+	}
+	var aux [32]byte
+	for _, v := range vs {
+		h := tx.TaprootSigHash(&TaprootExecData{CodeSepPos:0xffffffff}, v.in, v.hash_type)
+		if hex.EncodeToString(h) != v.sighash {
+			t.Error(v.in, "Bad sighash", hex.EncodeToString(h))
+			continue
+		}
+		if v.priv == "" {
+			continue
+		}
+		priv, _ := hex.DecodeString(v.priv)
+		root, _ := hex.DecodeString(v.root)
+		if len(root) == 0 {
+			root = nil
+		}
+		sig := secp256k1.SchnorrSign(TaprootTweakPrivKey(priv, root), h, aux[:])
+		if v.hash_type != SIGHASH_DEFAULT {
+			sig = append(sig, v.hash_type)
+		}
+		exp, _ := hex.DecodeString(v.witness)
+		if !bytes.Equal(sig, exp) {
+			t.Error(v.in, "Bad signature", hex.EncodeToString(sig))
+		}
+		if !SchnorrVerify(tx.Spent_outputs[v.in].Pk_script[2:], sig[:64], h) {
+			t.Error(v.in, "SchnorrVerify failed")
+		}
+	}
+
+	// SIGHASH_SINGLE without the matching output and unknown hash types
+	if tx.TaprootSigHash(&TaprootExecData{CodeSepPos:0xffffffff}, 2, SIGHASH_SINGLE) != nil {
+		t.Error("TaprootSigHash should fail for SIGHASH_SINGLE without output")
+	}
+	if tx.TaprootSigHash(&TaprootExecData{CodeSepPos:0xffffffff}, 0, 0x04) != nil {
+		t.Error("TaprootSigHash should fail for hash type 0x04")
+	}
+}
@@ -54,12 +54,19 @@ type Tx struct {
 	// This field is only set in chain's ProcessBlockTransactions:
 	Fee uint64
 
+	// Outputs spent by this transaction's inputs (needed for taproot signature hashes).
+	// It must be set before verifying scripts that may use taproot.
+	Spent_outputs []*TxOut
+
 	wTxID Uint256
 
 	hash_lock sync.Mutex
 	hashPrevouts []byte
 	hashSequence []byte
 	hashOutputs []byte
+
+	// BIP341 (single SHA256) hashes:
+	tapPrevouts, tapAmounts, tapScriptPubKeys, tapSequences, tapOutputs []byte
 }
 
 
@@ -6,7 +6,10 @@ This code originates from:
 package btc
 
 import (
+	"fmt"
 	"bytes"
+	"strconv"
+	"strings"
 	"crypto/hmac"
 	"crypto/sha512"
 	"errors"
@@ -122,7 +125,7 @@ func (w *HDWallet) Pub() *HDWallet {
 		*r = *w
 		return r
 	} else {
-		return &HDWallet{Prefix:Public, Depth:w.Depth, Checksum:w.Checksum,
+		return &HDWallet{Prefix:HDKeyPrefix(false, w.Prefix==TestPrivate), Depth:w.Depth, Checksum:w.Checksum,
 			I:w.I, ChCode:w.ChCode, Key:PublicFromPrivate(w.Key[1:], true)}
 	}
 }
@@ -220,3 +223,76 @@ func HDKeyPrefix(private, testnet bool) uint32 {
 		}
 	}
 }
+
+
+const HardenedKeyStart = uint32(0x80000000)
+
+// Parses derivation path string, like m/84'/0'/0'/0/5 (h or H can be used instead of ')
+func ParseDerivationPath(s string) (path []uint32, e error) {
+	s = strings.TrimSpace(s)
+	if s == "m" || s == "M" || s == "" {
+		return
+	}
+	if strings.HasPrefix(s, "m/") || strings.HasPrefix(s, "M/") {
+		s = s[2:]
+	}
+	for _, el := range strings.Split(s, "/") {
+		var hardened bool
+		if strings.HasSuffix(el, "'") || strings.HasSuffix(el, "h") || strings.HasSuffix(el, "H") {
+			hardened = true
+			el = el[:len(el)-1]
+		}
+		v, er := strconv.ParseUint(el, 10, 32)
+		if er != nil || v >= uint64(HardenedKeyStart) {
+			e = errors.New("ParseDerivationPath: Invalid path element " + el)
+			return
+		}
+		if hardened {
+			v |= uint64(HardenedKeyStart)
+		}
+		path = append(path, uint32(v))
+	}
+	return
+}
+
+// Returns string representation of the derivation path
+func DerivationPathString(path []uint32) string {
+	s := "m"
+	for _, v := range path {
+		if v >= HardenedKeyStart {
+			s += fmt.Sprint("/", v-HardenedKeyStart, "'")
+		} else {
+			s += fmt.Sprint("/", v)
+		}
+	}
+	return s
+}
+
+// Derive returns the child key at the given path (relative to w)
+func (w *HDWallet) Derive(path []uint32) (res *HDWallet, e error) {
+	pub := w.Prefix==Public || w.Prefix==TestPublic
+	res = w
+	for _, i := range path {
+		if pub && i >= HardenedKeyStart {
+			return nil, errors.New("HDWallet.Derive: Hardened derivation on public key")
+		}
+		res = res.Child(i)
+	}
+	return
+}
+
+// Fingerprint returns the key identifier's first 4 bytes (as used in key origin info)
+func (w *HDWallet) Fingerprint() uint32 {
+	var h [20]byte
+	RimpHash(w.Pub().Key, h[:])
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+// DerivePath returns the child key at the given path string (relative to w)
+func (w *HDWallet) DerivePath(s string) (*HDWallet, error) {
+	path, e := ParseDerivationPath(s)
+	if e != nil {
+		return nil, e
+	}
+	return w.Derive(path)
+}
@@ -210,6 +210,62 @@ func TestChildren(t *testing.T) {
 	}
 }
 
+func TestDerivationPath(t *testing.T) {
+	path, e := ParseDerivationPath("m/84'/0h/0H/1/5")
+	if e != nil || len(path) != 5 || path[0] != 0x80000054 || path[1] != 0x80000000 || path[3] != 1 || path[4] != 5 {
+		t.Error("ParseDerivationPath failed", path, e)
+	}
+	if s := DerivationPathString(path); s != "m/84'/0'/0'/1/5" {
+		t.Error("DerivationPathString failed", s)
+	}
+	for _, s := range []string{"m/1/x", "m/2147483648", "m//1", "m/-1"} {
+		if _, e := ParseDerivationPath(s); e == nil {
+			t.Error("Invalid path accepted", s)
+		}
+	}
+
+	// Test vectors from BIP44, BIP49, BIP84 and BIP86
+	seed := MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	pubkey := func(path string, testnet bool) []byte {
+		w, e := MasterKey(seed, testnet).DerivePath(path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return w.Pub().Key
+	}
+	h160 := func(d []byte) []byte {
+		h := Rimp160AfterSha256(d)
+		return h[:]
+	}
+	if a := NewAddrFromPubkey(pubkey("m/44'/0'/0'/0/0", false), AddrVerPubkey(false)).String(); a != "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA" {
+		t.Error("BIP44 address mismatch", a)
+	}
+	wpkh := append([]byte{0, 20}, h160(pubkey("m/49'/1'/0'/0/0", true))...)
+	if a := NewAddrFromHash160(h160(wpkh), AddrVerScript(true)).String(); a != "2Mww8dCYPUpKHofjgcXcBCEGmniw9CoaiD2" {
+		t.Error("BIP49 address mismatch", a)
+	}
+	for _, v := range [][2]string{
+		{"m/84'/0'/0'/0/0", "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{"m/84'/0'/0'/0/1", "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{"m/84'/0'/0'/1/0", "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"} } {
+		if a := NewAddrFromPkScript(append([]byte{0, 20}, h160(pubkey(v[0], false))...), false).String(); a != v[1] {
+			t.Error("BIP84 address mismatch", v[0], a)
+		}
+	}
+	if a := NewAddrP2TR(pubkey("m/86'/0'/0'/0/0", false), false).String(); a != "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr" {
+		t.Error("BIP86 address mismatch", a)
+	}
+
+	// public derivation must give the same keys
+	acc, _ := MasterKey(seed, false).DerivePath("m/84'/0'/0'")
+	if w, e := acc.Pub().DerivePath("0/1"); e != nil || !bytes.Equal(w.Key, pubkey("m/84'/0'/0'/0/1", false)) {
+		t.Error("Public derivation mismatch", e)
+	}
+	if _, e := acc.Pub().DerivePath("0'"); e == nil {
+		t.Error("Hardened derivation on public key accepted")
+	}
+}
+
 // benchmarks
 
 func BenchmarkStringChildPub(b *testing.B) {
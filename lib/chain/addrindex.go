@@ -0,0 +1,476 @@
+package chain
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+)
+
+// Optional address index: sha256(pk_script) -> history of all the outputs paying to the script
+// and of all the inputs spending them. Key of a record is the first 8 bytes of the script hash.
+// Each entry of a record starts with the next 4 bytes of the hash, to tell apart colliding scripts.
+//
+// The record (head) keeps the number of chunks (4 bytes LE) followed by the most recent entries.
+// Once there is addridx_chunk_size bytes of the entries, they are moved to a new chunk record,
+// so adding a block never rewrites more than that. Key of the chunk number N (starting from 1)
+// is the first 8 bytes of sha256(head's key (8 bytes LE) + N (4 bytes LE)).
+// The entries are ordered by block height - the oldest in the chunk 1, the newest in the head.
+// The history always starts at the genesis block - a new index is built by RebuildAddrIndex().
+//
+// Entry layout (little endian):
+//  [0:4] - script hash check
+//  [4:8] - block height
+//  [8:40] - txid
+//  [40:44] - output index (funding) or input index with the highest bit set (spending)
+//  [44:52] - value
+//  [52:88] - only for spending: the spent output (txid + vout)
+
+const (
+	addridx_fund_len = 52
+	addridx_spend_len = 88
+	addridx_spend_bit = 0x80000000
+
+	addridx_chunk_size = 4096
+	addridx_format = 2 // version of the records format, stored in the "height" file
+)
+
+type AddrIndex struct {
+	sync.Mutex
+	db *qdb.DB
+	dir string
+
+	Height uint32 // all the main chain blocks up to this height have been indexed
+	hash [32]byte // hash of the block at Height
+	saved uint32 // value of Height stored on disk
+
+	Rebuilding bool
+}
+
+// One entry of the address history
+type AddrHistRec struct {
+	Height uint32
+	TxID btc.Uint256
+	Index uint32 // output index (funding) or input index (spending)
+	Value uint64
+	Spent *btc.TxPrevOut // nil for funding entries
+}
+
+
+// Returns the script hash, as used by the address index (and Electrum servers)
+func ScriptHash(pkscr []byte) [32]byte {
+	return sha256.Sum256(pkscr)
+}
+
+func addridx_key(sh []byte) qdb.KeyType {
+	return qdb.KeyType(binary.LittleEndian.Uint64(sh[:8]))
+}
+
+
+// Opens (or creates) the address index in the given folder
+func NewAddrIndex(dir string) (idx *AddrIndex) {
+	idx = &AddrIndex{dir:dir}
+	idx.open()
+	return
+}
+
+func (idx *AddrIndex) open() {
+	var e error
+	if idx.db, e = qdb.NewDB(idx.dir, false); e != nil {
+		panic("AddrIndex: " + e.Error())
+	}
+	// bytes 36:40 keep the height the history starts from - an index not started at genesis gets rebuilt
+	if d, _ := ioutil.ReadFile(idx.dir + "height"); len(d) == 44 && binary.LittleEndian.Uint32(d[40:44]) == addridx_format &&
+		binary.LittleEndian.Uint32(d[36:40]) == 0 {
+		idx.Height = binary.LittleEndian.Uint32(d[:4])
+		copy(idx.hash[:], d[4:36])
+		idx.saved = idx.Height
+	} else {
+		idx.saved = 0xffffffff
+	}
+}
+
+// Removes all the records
+func (idx *AddrIndex) reset(genesis *btc.Uint256) {
+	idx.db.Close()
+	os.RemoveAll(idx.dir)
+	idx.open()
+	idx.Height = 0
+	idx.hash = genesis.Hash
+	idx.saved = 0xffffffff
+}
+
+// Stores the current height on disk, after all the records are written
+func (idx *AddrIndex) sync() {
+	if idx.saved == idx.Height {
+		return
+	}
+	idx.db.Sync()
+	idx.db.Mutex.Lock() // wait for the background sync to finish
+	idx.db.Mutex.Unlock()
+	d := make([]byte, 44)
+	binary.LittleEndian.PutUint32(d[:4], idx.Height)
+	copy(d[4:36], idx.hash[:])
+	binary.LittleEndian.PutUint32(d[40:44], addridx_format)
+	ioutil.WriteFile(idx.dir + "height", d, 0600)
+	idx.saved = idx.Height
+}
+
+// Stores the current height on disk (unless the index is being rebuilt)
+func (idx *AddrIndex) Idle() {
+	idx.Lock()
+	if idx.db != nil && !idx.Rebuilding {
+		idx.sync()
+	}
+	idx.Unlock()
+}
+
+func (idx *AddrIndex) Close() {
+	idx.Lock()
+	idx.sync()
+	idx.db.Close()
+	idx.db = nil // stops RebuildAddrIndex()
+	idx.Unlock()
+}
+
+func (idx *AddrIndex) Stats() (s string) {
+	idx.Lock()
+	if idx.db == nil {
+		idx.Unlock()
+		return
+	}
+	s = fmt.Sprintf("ADDRINDEX: Height:%d  Records:%d  Rebuilding:%t\n", idx.Height, idx.db.Count(), idx.Rebuilding)
+	idx.Unlock()
+	return
+}
+
+
+// Returns length of the entry at the beginning of v (or 0 if the data is broken)
+func addridx_entry_len(v []byte) int {
+	if len(v) < addridx_fund_len {
+		return 0
+	}
+	if (binary.LittleEndian.Uint32(v[40:44]) & addridx_spend_bit) == 0 {
+		return addridx_fund_len
+	}
+	if len(v) < addridx_spend_len {
+		return 0
+	}
+	return addridx_spend_len
+}
+
+// Returns the leading entries of v that are below the given height
+func addridx_below(v []byte, height uint32) []byte {
+	var n int
+	for n < len(v) {
+		l := addridx_entry_len(v[n:])
+		if l == 0 || binary.LittleEndian.Uint32(v[n+4:n+8]) >= height {
+			break
+		}
+		n += l
+	}
+	return v[:n]
+}
+
+func addridx_chunk_key(k qdb.KeyType, no uint32) qdb.KeyType {
+	var d [12]byte
+	binary.LittleEndian.PutUint64(d[:8], uint64(k))
+	binary.LittleEndian.PutUint32(d[8:12], no)
+	h := sha256.Sum256(d[:])
+	return qdb.KeyType(binary.LittleEndian.Uint64(h[:8]))
+}
+
+// Returns the number of chunks and the entries kept in the head record
+func addridx_head(v []byte) (chunks uint32, ents []byte) {
+	if len(v) >= 4 {
+		chunks = binary.LittleEndian.Uint32(v[:4])
+		ents = v[4:]
+	}
+	return
+}
+
+func (idx *AddrIndex) putHead(k qdb.KeyType, chunks uint32, ents []byte) {
+	if chunks == 0 && len(ents) == 0 {
+		idx.db.Del(k)
+		return
+	}
+	v := make([]byte, 4 + len(ents))
+	binary.LittleEndian.PutUint32(v[:4], chunks)
+	copy(v[4:], ents)
+	idx.db.PutExt(k, v, qdb.NO_CACHE)
+}
+
+// Removes the entries at (or above) the given height - they can only be at the end of the history.
+// Returns the head record's content that is left, which the caller needs to store if changed.
+func (idx *AddrIndex) trim(k qdb.KeyType, height uint32) (chunks uint32, ents []byte, changed bool) {
+	var all []byte
+	chunks, all = addridx_head(idx.db.GetNoCache(k))
+	ents = addridx_below(all, height)
+	changed = len(ents) != len(all)
+	// the head might have been moved to a chunk while adding the entries of this block
+	for len(ents) == 0 && chunks > 0 {
+		ck := addridx_chunk_key(k, chunks)
+		v := idx.db.GetNoCache(ck)
+		below := addridx_below(v, height)
+		if len(below) == len(v) {
+			break
+		}
+		idx.db.Del(ck)
+		chunks--
+		ents = below
+		changed = true
+	}
+	return
+}
+
+// Appends the given entries to the records. Make sure idx is locked.
+func (idx *AddrIndex) addBlock(recs map[qdb.KeyType][]byte, height uint32, hash []byte) {
+	for k, add := range recs {
+		// drop the entries that may be left after the index was not properly closed
+		chunks, ents, _ := idx.trim(k, height)
+		ents = append(append(make([]byte, 0, len(ents) + len(add)), ents...), add...)
+		if len(ents) >= addridx_chunk_size {
+			chunks++
+			idx.db.PutExt(addridx_chunk_key(k, chunks), ents, qdb.NO_CACHE)
+			ents = nil
+		}
+		idx.putHead(k, chunks, ents)
+	}
+	idx.Height = height
+	copy(idx.hash[:], hash)
+}
+
+// Removes all the entries at (or above) the given height from the records. Make sure idx is locked.
+func (idx *AddrIndex) delBlock(keys map[qdb.KeyType]bool, height uint32, parent []byte) {
+	for k := range keys {
+		if chunks, ents, changed := idx.trim(k, height); changed {
+			idx.putHead(k, chunks, ents)
+		}
+	}
+	copy(idx.hash[:], parent)
+	idx.Height = height - 1
+}
+
+
+func addridx_entry(sh []byte, height uint32, txid []byte, index uint32, value uint64, spent *btc.TxPrevOut) (rec []byte) {
+	if spent == nil {
+		rec = make([]byte, addridx_fund_len)
+	} else {
+		rec = make([]byte, addridx_spend_len)
+		index |= addridx_spend_bit
+		copy(rec[52:84], spent.Hash[:])
+		binary.LittleEndian.PutUint32(rec[84:88], spent.Vout)
+	}
+	copy(rec[0:4], sh[8:12])
+	binary.LittleEndian.PutUint32(rec[4:8], height)
+	copy(rec[8:40], txid)
+	binary.LittleEndian.PutUint32(rec[40:44], index)
+	binary.LittleEndian.PutUint64(rec[44:52], value)
+	return
+}
+
+// Returns the entries of the block for each record (Spent_outputs of its txs must be set)
+func addridx_block_entries(bl *btc.Block, height uint32) (recs map[qdb.KeyType][]byte) {
+	recs = make(map[qdb.KeyType][]byte)
+	for _, tx := range bl.Txs {
+		for i, in := range tx.TxIn {
+			if i >= len(tx.Spent_outputs) || tx.Spent_outputs[i] == nil {
+				break // coinbase
+			}
+			sh := ScriptHash(tx.Spent_outputs[i].Pk_script)
+			k := addridx_key(sh[:])
+			recs[k] = append(recs[k], addridx_entry(sh[:], height, tx.Hash.Hash[:], uint32(i),
+				tx.Spent_outputs[i].Value, &in.Input)...)
+		}
+		for i, out := range tx.TxOut {
+			sh := ScriptHash(out.Pk_script)
+			k := addridx_key(sh[:])
+			recs[k] = append(recs[k], addridx_entry(sh[:], height, tx.Hash.Hash[:], uint32(i), out.Value, nil)...)
+		}
+	}
+	return
+}
+
+// Called after the block has been applied to the UTXO set (Spent_outputs of its txs must be set)
+func (ch *Chain) addrIndexAdd(bl *btc.Block, height uint32) {
+	if ch.AddrIdx == nil {
+		return
+	}
+	ch.AddrIdx.Lock()
+	// only add the next block - otherwise RebuildAddrIndex() will get to it
+	if ch.AddrIdx.db != nil && ch.AddrIdx.Height+1 == height && bytes.Equal(ch.AddrIdx.hash[:], bl.ParentHash()) {
+		ch.AddrIdx.addBlock(addridx_block_entries(bl, height), height, bl.Hash.Hash[:])
+	}
+	ch.AddrIdx.Unlock()
+}
+
+// Called after the block has been removed from the UTXO set (so the outputs it spent are back there)
+func (ch *Chain) addrIndexDel(bl *btc.Block, height uint32) {
+	if ch.AddrIdx == nil {
+		return
+	}
+	ch.AddrIdx.Lock()
+	defer ch.AddrIdx.Unlock()
+	if ch.AddrIdx.db == nil || ch.AddrIdx.Height != height || ch.AddrIdx.hash != bl.Hash.Hash {
+		return
+	}
+	keys := make(map[qdb.KeyType]bool)
+	outs := make(map[[32]byte][]*btc.TxOut, len(bl.Txs))
+	for _, tx := range bl.Txs {
+		for _, out := range tx.TxOut {
+			sh := ScriptHash(out.Pk_script)
+			keys[addridx_key(sh[:])] = true
+		}
+		outs[tx.Hash.Hash] = tx.TxOut
+	}
+	for _, tx := range bl.Txs[1:] {
+		for _, in := range tx.TxIn {
+			var pk_script []byte
+			if out := ch.Unspent.UnspentGet(&in.Input); out != nil {
+				pk_script = out.Pk_script
+			} else if t, ok := outs[in.Input.Hash]; ok && int(in.Input.Vout) < len(t) {
+				pk_script = t[in.Input.Vout].Pk_script // spent within the same block
+			} else {
+				continue
+			}
+			sh := ScriptHash(pk_script)
+			keys[addridx_key(sh[:])] = true
+		}
+	}
+	ch.AddrIdx.delBlock(keys, height, bl.ParentHash())
+}
+
+
+// Makes sure that the index matches the current chain - call it after loading the block index
+func (ch *Chain) addrIndexCheck() {
+	idx := ch.AddrIdx
+	idx.Lock()
+	if idx.saved == 0xffffffff {
+		idx.reset(ch.Genesis) // new index
+	} else if n := ch.BlockAtHeight(idx.Height); n == nil || n.Height != idx.Height || n.BlockHash.Hash != idx.hash {
+		fmt.Println("AddrIndex does not match the chain - it will be rebuilt")
+		idx.reset(ch.Genesis)
+	}
+	idx.Unlock()
+}
+
+
+// Indexes all the main chain blocks that have not been indexed yet (see indexBlock).
+// It can be running in the background, while new blocks are being committed.
+func (ch *Chain) RebuildAddrIndex() {
+	idx := ch.AddrIdx
+	if idx == nil {
+		return
+	}
+	idx.Lock()
+	if idx.Rebuilding {
+		idx.Unlock()
+		return
+	}
+	idx.Rebuilding = true
+	idx.db.NoSync()
+	idx.Unlock()
+
+	for {
+		idx.Lock() // the lock is held at every exit from the loop
+		if AbortNow || idx.db == nil {
+			break
+		}
+		n := ch.BlockAtHeight(idx.Height+1)
+		if n == nil || n.Height != idx.Height+1 {
+			break // we are at the top
+		}
+		if n.Parent.BlockHash.Hash != idx.hash {
+			fmt.Println("AddrIndex does not match the chain - it will be rebuilt")
+			idx.reset(ch.Genesis)
+			idx.db.NoSync()
+			idx.Unlock()
+			continue
+		}
+		bl, er := ch.indexBlock(n)
+		if er != nil {
+			fmt.Println("RebuildAddrIndex:", n.Height, er.Error())
+			break
+		}
+		idx.addBlock(addridx_block_entries(bl, n.Height), n.Height, bl.Hash.Hash[:])
+		if (n.Height % 10000) == 0 {
+			idx.sync()
+			idx.db.NoSync()
+		}
+		idx.Unlock()
+	}
+	idx.Rebuilding = false
+	if idx.db != nil {
+		idx.sync()
+	}
+	idx.Unlock()
+}
+
+
+// Returns true if the history of all the main chain blocks is in the index. Make sure AddrIdx is locked.
+func (ch *Chain) addrIndexComplete() bool {
+	return ch.AddrIdx.db != nil && !ch.AddrIdx.Rebuilding && ch.AddrIdx.Height == ch.LastBlock().Height
+}
+
+// Returns the history of the given script hash, ordered by block height.
+// It fails while the index is being built, as the history of the recent blocks is not known yet.
+func (ch *Chain) GetAddrHistory(sh []byte) (res []*AddrHistRec, er error) {
+	if ch.AddrIdx == nil {
+		er = errors.New("GetAddrHistory: addrindex not enabled")
+		return
+	}
+	var v []byte
+	ch.AddrIdx.Lock()
+	if ch.AddrIdx.db != nil && !ch.addrIndexComplete() {
+		er = errors.New(fmt.Sprint("GetAddrHistory: addrindex is not complete - indexed up to block ", ch.AddrIdx.Height))
+		ch.AddrIdx.Unlock()
+		return
+	}
+	if ch.AddrIdx.db != nil {
+		k := addridx_key(sh)
+		chunks, ents := addridx_head(ch.AddrIdx.db.GetNoCache(k))
+		for i := uint32(1); i <= chunks; i++ {
+			v = append(v, ch.AddrIdx.db.GetNoCache(addridx_chunk_key(k, i))...)
+		}
+		v = append(v, ents...)
+	}
+	ch.AddrIdx.Unlock()
+	for len(v) > 0 {
+		l := addridx_entry_len(v)
+		if l == 0 {
+			er = errors.New("GetAddrHistory: broken record")
+			return
+		}
+		if bytes.Equal(v[0:4], sh[8:12]) {
+			r := new(AddrHistRec)
+			r.Height = binary.LittleEndian.Uint32(v[4:8])
+			copy(r.TxID.Hash[:], v[8:40])
+			r.Index = binary.LittleEndian.Uint32(v[40:44]) &^ addridx_spend_bit
+			r.Value = binary.LittleEndian.Uint64(v[44:52])
+			if l == addridx_spend_len {
+				r.Spent = new(btc.TxPrevOut)
+				copy(r.Spent.Hash[:], v[52:84])
+				r.Spent.Vout = binary.LittleEndian.Uint32(v[84:88])
+			}
+			res = append(res, r)
+		}
+		v = v[l:]
+	}
+	return
+}
+
+// Returns true if the address index is enabled and has the history of all the blocks
+func (ch *Chain) AddrIndexReady() (res bool) {
+	if ch.AddrIdx != nil {
+		ch.AddrIdx.Lock()
+		res = ch.addrIndexComplete()
+		ch.AddrIdx.Unlock()
+	}
+	return
+}
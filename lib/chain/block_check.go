@@ -108,28 +108,42 @@ func (ch *Chain) PreCheckBlock(bl *btc.Block) (er error, dos bool, maybelater bo
 
 
 func (ch *Chain) ApplyBlockFlags(bl *btc.Block) {
-	if bl.BlockTime() >= BIP16SwitchTime {
-		bl.VerifyFlags = script.VER_P2SH
-	} else {
-		bl.VerifyFlags = 0
+	bl.VerifyFlags = ch.blockFlags(bl.Height, bl.BlockTime())
+}
+
+
+// NextBlockFlags returns script verification flags for the block that would extend the current chain.
+func (ch *Chain) NextBlockFlags() uint32 {
+	last := ch.LastBlock()
+	return ch.blockFlags(last.Height+1, last.Timestamp())
+}
+
+
+func (ch *Chain) blockFlags(height, timestamp uint32) (flags uint32) {
+	if timestamp >= BIP16SwitchTime {
+		flags = script.VER_P2SH
 	}
 
-	if bl.Height >= ch.Consensus.BIP66Height {
-		bl.VerifyFlags |= script.VER_DERSIG
+	if height >= ch.Consensus.BIP66Height {
+		flags |= script.VER_DERSIG
 	}
 
-	if bl.Height >= ch.Consensus.BIP65Height {
-		bl.VerifyFlags |= script.VER_CLTV
+	if height >= ch.Consensus.BIP65Height {
+		flags |= script.VER_CLTV
 	}
 
-	if ch.Consensus.Enforce_CSV != 0 && bl.Height >= ch.Consensus.Enforce_CSV {
-		bl.VerifyFlags |= script.VER_CSV
+	if ch.Consensus.Enforce_CSV != 0 && height >= ch.Consensus.Enforce_CSV {
+		flags |= script.VER_CSV
 	}
 
-	if ch.Consensus.Enforce_SEGWIT != 0 && bl.Height >= ch.Consensus.Enforce_SEGWIT {
-		bl.VerifyFlags |= script.VER_WITNESS | script.VER_NULLDUMMY
+	if ch.Consensus.Enforce_SEGWIT != 0 && height >= ch.Consensus.Enforce_SEGWIT {
+		flags |= script.VER_WITNESS | script.VER_NULLDUMMY
 	}
 
+	if ch.Consensus.Enforce_TAPROOT != 0 && height >= ch.Consensus.Enforce_TAPROOT {
+		flags |= script.VER_TAPROOT
+	}
+	return
 }
 
 
@@ -163,14 +177,20 @@ func (ch *Chain) PostCheckBlock(bl *btc.Block) (er error) {
 		if bl.Height>=ch.Consensus.BIP34Height {
 			var exp [6]byte
 			var exp_len int
-			binary.LittleEndian.PutUint32(exp[1:5], bl.Height)
-			for exp_len=5; exp_len>1; exp_len-- {
-				if exp[exp_len]!=0 || exp[exp_len-1]>=0x80 {
-					break
+			if bl.Height <= 16 {
+				// small numbers are pushed as OP_1 .. OP_16
+				exp[0] = byte(0x50 + bl.Height)
+				exp_len = 1
+			} else {
+				binary.LittleEndian.PutUint32(exp[1:5], bl.Height)
+				for exp_len=5; exp_len>1; exp_len-- {
+					if exp[exp_len]!=0 || exp[exp_len-1]>=0x80 {
+						break
+					}
 				}
+				exp[0] = byte(exp_len)
+				exp_len++
 			}
-			exp[0] = byte(exp_len)
-			exp_len++
 
 			if !bytes.HasPrefix(bl.Txs[0].TxIn[0].ScriptSig, exp[:exp_len]) {
 				er = errors.New("CheckBlock() : Unexpected block number in coinbase: "+bl.Hash.String()+" - RPC_Result:bad-cb-height")
@@ -250,6 +270,12 @@ func (ch *Chain) PostCheckBlock(bl *btc.Block) (er error) {
 			}
 		}
 
+		if ch.Consensus.SignetChallenge != nil {
+			if er = ch.CheckSignetSolution(bl); er != nil {
+				return
+			}
+		}
+
 		// Check transactions - this is the most time consuming task
 		er = CheckTransactions(bl.Txs, bl.Height, blockTime)
 	}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"compress/gzip"
+	"sync/atomic"
 	"encoding/binary"
 	"github.com/golang/snappy"
 	"github.com/piotrnar/gocoin/lib/btc"
@@ -81,6 +82,7 @@ type BlockDBOpts struct {
 	MaxCachedBlocks int
 	MaxDataFileSize uint64
 	DataFilesKeep uint32
+	PruneTargetSize uint64 // remove the oldest data files when their total size exceeds it (0 to keep all)
 }
 
 type oneB2W struct {
@@ -108,6 +110,12 @@ type BlockDB struct {
 
 	max_data_file_size uint64
 	data_files_keep uint32
+
+	prune_target uint64
+	datfiles map[uint32] *datFileInfo
+	maxheight uint32
+	pruned_idx uint32 // data files below this one have been pruned (access it atomically)
+	prune_height uint32 // (access it atomically)
 }
 
 
@@ -132,6 +140,16 @@ func NewBlockDBExt(dir string, opts *BlockDBOpts) (db *BlockDB) {
 		}
 		db.max_data_file_size = opts.MaxDataFileSize
 		db.data_files_keep = opts.DataFilesKeep
+		db.prune_target = opts.PruneTargetSize
+	}
+
+	if db.prune_target != 0 {
+		if db.prune_target < PRUNE_MIN_TARGET {
+			db.prune_target = PRUNE_MIN_TARGET
+		}
+		if db.max_data_file_size == 0 || db.max_data_file_size > db.prune_target/4 {
+			db.max_data_file_size = db.prune_target/4 // pruning works on whole files
+		}
 	}
 
 	if db.max_cached_blocks == 0 {
@@ -191,6 +209,10 @@ func (db *BlockDB) GetStats() (s string) {
 	db.mutex.Lock()
 	s += fmt.Sprintf("BlockDB: %d blocks, %d/%d in cache.  ToWriteCnt:%d (%dKB)\n",
 		len(db.blockIndex), len(db.cache), db.max_cached_blocks, len(db.blocksToWrite), db.datToWrite>>10)
+	if db.prune_target != 0 {
+		s += fmt.Sprintf("BlockDB: pruning to %dMB - pruned %d data files, up to block %d\n",
+			db.prune_target>>20, atomic.LoadUint32(&db.pruned_idx), db.PruneHeight())
+	}
 	db.mutex.Unlock()
 	return
 }
@@ -208,7 +230,8 @@ func (db *BlockDB) BlockAdd(height uint32, bl *btc.Block) (e error) {
 
 	db.mutex.Lock()
 	idx := bl.Hash.BIdx()
-	if rec, ok := db.blockIndex[idx]; !ok {
+	if rec, ok := db.blockIndex[idx]; !ok || rec.blen==0 && rec.ipos!=-1 {
+		// not in the index yet, or only its header was there (see BlockAddPurged)
 		db.blockIndex[idx] = &oneBl{ipos:-1, trusted:bl.Trusted}
 		db.addToCache(bl.Hash, bl.Raw, bl)
 		db.datToWrite += uint64(len(bl.Raw))
@@ -244,6 +267,26 @@ func (db *BlockDB) BlockAdd(height uint32, bl *btc.Block) (e error) {
 	return
 }
 
+// BlockAddPurged only stores the block's header in the index (used for the blocks
+// below a UTXO snapshot). The block's data can be added later with BlockAdd.
+func (db *BlockDB) BlockAddPurged(height uint32, hdr []byte) {
+	var fl [136]byte
+	fl[0] = BLOCK_INDEX
+	binary.LittleEndian.PutUint32(fl[28:32], 0xffffffff)
+	binary.LittleEndian.PutUint32(fl[36:40], height)
+	copy(fl[56:136], hdr[:80])
+
+	db.disk_access.Lock()
+	if _, e := db.blockindx.Write(fl[:]); e != nil {
+		panic(e.Error())
+	}
+	db.mutex.Lock()
+	db.blockIndex[btc.NewSha2Hash(hdr[:80]).BIdx()] = &oneBl{ipos:db.maxidxfilepos, datfileidx:0xffffffff}
+	db.mutex.Unlock()
+	db.maxidxfilepos += 136
+	db.disk_access.Unlock()
+}
+
 func (db *BlockDB) writeAll() (sync bool) {
 	//sta := time.Now()
 	for db.writeOne() {
@@ -297,6 +340,7 @@ func (db *BlockDB) writeOne() (written bool) {
 				os.Remove(db.dat_fname(db.maxdatfileidx - db.data_files_keep, false))
 			}
 			db.maxdatfileidx++
+			db.prune()
 		} else {
 			println("Cannot create", db.dat_fname(db.maxdatfileidx, false))
 		}
@@ -330,6 +374,7 @@ func (db *BlockDB) writeOne() (written bool) {
 
 	db.maxidxfilepos += 136
 	db.maxdatfilepos += int64(rec.blen)
+	db.datFileAdd(rec.datfileidx, rec.blen, b2w.height)
 
 	db.disk_access.Unlock()
 
@@ -441,6 +486,11 @@ func (db *BlockDB) BlockGetInternal(hash *btc.Uint256, do_not_cache bool) (cache
 		return
 	}
 
+	if rec.pruned(db) {
+		e = errors.New("Block pruned from disk")
+		return
+	}
+
 	bl := make([]byte, rec.blen)
 
 	db.disk_access.Lock()
@@ -595,6 +645,10 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 
 		db.blockIndex[BlockHash.BIdx()] = ob
 
+		if ob.blen > 0 && ob.datfileidx != 0xffffffff {
+			db.datFileAdd(ob.datfileidx, ob.blen, bh)
+		}
+
 		if int64(ob.fpos)+int64(ob.blen) > db.maxdatfilepos {
 			db.maxdatfilepos = int64(ob.fpos)+int64(ob.blen)
 		}
@@ -605,6 +659,8 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 	// In case if there was some trash at the end of data or index file, this should truncate it:
 	db.blockindx.Seek(db.maxidxfilepos, os.SEEK_SET)
 
+	db.pruneInit()
+
 	db.blockdata, _ = os.OpenFile(db.dat_fname(db.maxdatfileidx, false), os.O_RDWR|os.O_CREATE, 0660)
 	if db.blockdata == nil {
 		panic("Cannot open blockchain.dat")
@@ -0,0 +1,127 @@
+package chain
+
+import (
+	"os"
+	"fmt"
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+	Automatic pruning of the block data files.
+	When the total size of blockchain-%08x.dat files exceeds the target, the oldest ones
+	get removed - as long as all the blocks inside them are at least PRUNE_MIN_DEPTH deep.
+	The block index (blockchain.new) is kept as it was, so the chain can still be loaded.
+*/
+
+const (
+	PRUNE_MIN_DEPTH = 288 // never prune blocks less deep than this (must be bigger than UTXO's UnwindBufLen)
+	PRUNE_MIN_TARGET = 550 << 20
+)
+
+type datFileInfo struct {
+	size uint64 // total length of the blocks stored in the file
+	maxheight uint32 // the highest block stored in the file
+}
+
+
+// Make sure to call it with disk_access locked (or before the database is in use)
+func (db *BlockDB) datFileAdd(idx uint32, blen, height uint32) {
+	if db.datfiles == nil {
+		db.datfiles = make(map[uint32] *datFileInfo)
+	}
+	f := db.datfiles[idx]
+	if f == nil {
+		f = new(datFileInfo)
+		db.datfiles[idx] = f
+	}
+	f.size += uint64(blen)
+	if height > f.maxheight {
+		f.maxheight = height
+	}
+	if height > db.maxheight {
+		db.maxheight = height
+	}
+}
+
+
+// Called at the end of LoadBlockIndex - sets the first data file that has not been pruned
+func (db *BlockDB) pruneInit() {
+	if db.prune_target == 0 {
+		return
+	}
+	var idx uint32
+	for idx = 0; idx < db.maxdatfileidx; idx++ {
+		if _, er := os.Stat(db.dat_fname(idx, false)); er == nil {
+			break
+		}
+		db.prunedFile(idx)
+	}
+	db.prune()
+}
+
+
+// Make sure to call it with disk_access locked (or before the database is in use)
+func (db *BlockDB) prunedFile(idx uint32) {
+	if f := db.datfiles[idx]; f != nil {
+		if f.maxheight > atomic.LoadUint32(&db.prune_height) {
+			atomic.StoreUint32(&db.prune_height, f.maxheight)
+		}
+		delete(db.datfiles, idx)
+	}
+	atomic.StoreUint32(&db.pruned_idx, idx+1)
+}
+
+
+// Removes the oldest data files, if needed.
+// Make sure to call it with disk_access locked.
+func (db *BlockDB) prune() {
+	if db.prune_target == 0 {
+		return
+	}
+	var tot uint64
+	for _, f := range db.datfiles {
+		tot += f.size
+	}
+	for idx := atomic.LoadUint32(&db.pruned_idx); tot > db.prune_target && idx < db.maxdatfileidx; idx++ {
+		f := db.datfiles[idx]
+		if f != nil {
+			if f.maxheight + PRUNE_MIN_DEPTH > db.maxheight {
+				break // the blocks are too recent
+			}
+			tot -= f.size
+		}
+		if er := os.Remove(db.dat_fname(idx, false)); er != nil && !os.IsNotExist(er) {
+			println("BlockDB prune:", er.Error())
+			break
+		}
+		db.prunedFile(idx)
+		fmt.Println("BlockDB: pruned", db.dat_fname(idx, false), "- blocks up to", db.PruneHeight(), "are gone")
+	}
+}
+
+
+// PruneEnabled returns true if the database is in the pruning mode.
+func (db *BlockDB) PruneEnabled() bool {
+	return db.prune_target != 0
+}
+
+// PruneHeight returns the height of the highest block that has been pruned (zero if none).
+func (db *BlockDB) PruneHeight() uint32 {
+	return atomic.LoadUint32(&db.prune_height)
+}
+
+// BlockPruned returns true if the block's data has been removed by pruning.
+func (db *BlockDB) BlockPruned(hash *btc.Uint256) (res bool) {
+	db.mutex.Lock()
+	if rec, ok := db.blockIndex[hash.BIdx()]; ok {
+		res = rec.pruned(db)
+	}
+	db.mutex.Unlock()
+	return
+}
+
+func (rec *oneBl) pruned(db *BlockDB) bool {
+	return rec.blen != 0 && rec.ipos != -1 && rec.datfileidx != 0xffffffff &&
+		rec.datfileidx < atomic.LoadUint32(&db.pruned_idx)
+}
@@ -0,0 +1,296 @@
+package chain
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/blockfilter"
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+)
+
+// Optional index of BIP158 basic block filters, together with their BIP157 filter headers.
+// Key of a record is the first 8 bytes of the block hash. As the filter headers form a chain
+// that starts at the genesis block, a new index is built by RebuildBlockFilters() from the stored blocks.
+// Records of the blocks that got orphaned are not removed.
+//
+// Record layout:
+//  [0:32] - block hash
+//  [32:64] - filter header
+//  [64:96] - filter hash
+//  [96:] - serialized filter
+
+// Output script of the genesis block's coinbase (the same for all the supported networks)
+var genesis_pk_script, _ = hex.DecodeString("4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac")
+
+type FilterIndex struct {
+	sync.Mutex
+	db *qdb.DB
+	dir string
+
+	Height uint32 // all the main chain blocks up to this height have their filters
+	hash [32]byte // hash of the block at Height
+	saved uint32 // value of Height stored on disk
+
+	Rebuilding bool
+}
+
+type BlockFilterRec struct {
+	Header [32]byte
+	FilterHash [32]byte
+	Filter []byte
+}
+
+
+func bfidx_key(hash []byte) qdb.KeyType {
+	return qdb.KeyType(binary.LittleEndian.Uint64(hash[:8]))
+}
+
+
+// Opens (or creates) the block filters index in the given folder
+func NewFilterIndex(dir string) (idx *FilterIndex) {
+	idx = &FilterIndex{dir:dir}
+	idx.open()
+	return
+}
+
+func (idx *FilterIndex) open() {
+	var e error
+	if idx.db, e = qdb.NewDB(idx.dir, false); e != nil {
+		panic("FilterIndex: " + e.Error())
+	}
+	if d, _ := ioutil.ReadFile(idx.dir + "height"); len(d) == 36 {
+		idx.Height = binary.LittleEndian.Uint32(d[:4])
+		copy(idx.hash[:], d[4:])
+		idx.saved = idx.Height
+	} else {
+		idx.saved = 0xffffffff
+	}
+}
+
+// Removes all the records and adds the one of the genesis block
+func (idx *FilterIndex) reset(genesis *btc.Uint256) {
+	idx.db.Close()
+	os.RemoveAll(idx.dir)
+	idx.open()
+	var key [16]byte
+	copy(key[:], genesis.Hash[:16])
+	raw := blockfilter.BuildGCS(key, [][]byte{genesis_pk_script}, blockfilter.BASIC_FILTER_P, blockfilter.BASIC_FILTER_M).Bytes()
+	idx.put(genesis.Hash[:], blockfilter.FilterHeader(raw, make([]byte, 32)), raw)
+	idx.Height = 0
+	idx.hash = genesis.Hash
+	idx.saved = 0xffffffff
+}
+
+// Stores the current height on disk, after all the records are written
+func (idx *FilterIndex) sync() {
+	if idx.saved == idx.Height {
+		return
+	}
+	idx.db.Sync()
+	idx.db.Mutex.Lock() // wait for the background sync to finish
+	idx.db.Mutex.Unlock()
+	d := make([]byte, 36)
+	binary.LittleEndian.PutUint32(d[:4], idx.Height)
+	copy(d[4:], idx.hash[:])
+	ioutil.WriteFile(idx.dir + "height", d, 0600)
+	idx.saved = idx.Height
+}
+
+// Stores the current height on disk (unless the index is being rebuilt)
+func (idx *FilterIndex) Idle() {
+	idx.Lock()
+	if idx.db != nil && !idx.Rebuilding {
+		idx.sync()
+	}
+	idx.Unlock()
+}
+
+func (idx *FilterIndex) Close() {
+	idx.Lock()
+	if idx.db != nil {
+		idx.sync()
+		idx.db.Close()
+		idx.db = nil // stops RebuildBlockFilters()
+	}
+	idx.Unlock()
+}
+
+func (idx *FilterIndex) Stats() (s string) {
+	idx.Lock()
+	if idx.db != nil {
+		s = fmt.Sprintf("BLOCKFILTERS: Height:%d  Filters:%d  Rebuilding:%t\n", idx.Height, idx.db.Count(), idx.Rebuilding)
+	}
+	idx.Unlock()
+	return
+}
+
+// Make sure idx is locked
+func (idx *FilterIndex) put(hash []byte, header [32]byte, raw []byte) {
+	rec := make([]byte, 96 + len(raw))
+	copy(rec[0:32], hash)
+	copy(rec[32:64], header[:])
+	fh := blockfilter.FilterHash(raw)
+	copy(rec[64:96], fh[:])
+	copy(rec[96:], raw)
+	idx.db.PutExt(bfidx_key(hash), rec, qdb.NO_CACHE)
+}
+
+// Make sure idx is locked
+func (idx *FilterIndex) get(hash []byte) (rec []byte) {
+	if v := idx.db.GetNoCache(bfidx_key(hash)); len(v) >= 96 && bytes.Equal(v[:32], hash) {
+		rec = v
+	}
+	return
+}
+
+// Adds the filter of the next block (Spent_outputs of its txs must be set). Make sure idx is locked.
+func (idx *FilterIndex) addBlock(bl *btc.Block, height uint32) (e error) {
+	prev := idx.get(bl.ParentHash())
+	if prev == nil {
+		return errors.New("no filter of the parent block")
+	}
+	f, e := blockfilter.NewBasicFilter(bl)
+	if e != nil {
+		return
+	}
+	raw := f.Bytes()
+	idx.put(bl.Hash.Hash[:], blockfilter.FilterHeader(raw, prev[32:64]), raw)
+	idx.Height = height
+	idx.hash = bl.Hash.Hash
+	return
+}
+
+
+// Called after the block has been applied to the UTXO set (Spent_outputs of its txs must be set)
+func (ch *Chain) filterIndexAdd(bl *btc.Block, height uint32) {
+	if ch.FilterIdx == nil {
+		return
+	}
+	idx := ch.FilterIdx
+	idx.Lock()
+	// only add the next block - otherwise RebuildBlockFilters() will get to it
+	if idx.db != nil && idx.Height+1 == height && bytes.Equal(idx.hash[:], bl.ParentHash()) {
+		if e := idx.addBlock(bl, height); e != nil {
+			println("FilterIndex:", e.Error())
+		}
+	}
+	idx.Unlock()
+}
+
+// Called after the block has been removed from the chain (its record stays in the index)
+func (ch *Chain) filterIndexDel(bl *btc.Block, height uint32) {
+	if ch.FilterIdx == nil {
+		return
+	}
+	idx := ch.FilterIdx
+	idx.Lock()
+	if idx.db != nil && idx.Height == height && idx.hash == bl.Hash.Hash {
+		idx.Height = height - 1
+		copy(idx.hash[:], bl.ParentHash())
+	}
+	idx.Unlock()
+}
+
+
+// Makes sure that the index matches the current chain - call it after loading the block index
+func (ch *Chain) filterIndexCheck() {
+	idx := ch.FilterIdx
+	idx.Lock()
+	if idx.saved == 0xffffffff {
+		idx.reset(ch.Genesis) // new index
+	} else if n := ch.BlockAtHeight(idx.Height); n == nil || n.Height != idx.Height || n.BlockHash.Hash != idx.hash {
+		fmt.Println("BlockFilters index does not match the chain - it will be rebuilt")
+		idx.reset(ch.Genesis)
+	}
+	idx.Unlock()
+}
+
+
+// Adds filters of all the main chain blocks that do not have them yet (see indexBlock).
+// It can be running in the background, while new blocks are being committed.
+func (ch *Chain) RebuildBlockFilters() {
+	idx := ch.FilterIdx
+	if idx == nil {
+		return
+	}
+	idx.Lock()
+	if idx.Rebuilding {
+		idx.Unlock()
+		return
+	}
+	idx.Rebuilding = true
+	idx.db.NoSync()
+	idx.Unlock()
+
+	for {
+		idx.Lock() // the lock is held at every exit from the loop
+		if AbortNow || idx.db == nil {
+			break
+		}
+		n := ch.BlockAtHeight(idx.Height+1)
+		if n == nil || n.Height != idx.Height+1 {
+			break // we are at the top
+		}
+		if n.Parent.BlockHash.Hash != idx.hash {
+			fmt.Println("BlockFilters index does not match the chain - it will be rebuilt")
+			idx.reset(ch.Genesis)
+			idx.db.NoSync()
+			idx.Unlock()
+			continue
+		}
+		bl, er := ch.indexBlock(n)
+		if er == nil {
+			er = idx.addBlock(bl, n.Height)
+		}
+		if er != nil {
+			fmt.Println("RebuildBlockFilters:", n.Height, er.Error())
+			break
+		}
+		if (n.Height % 10000) == 0 {
+			idx.sync()
+			idx.db.NoSync()
+		}
+		idx.Unlock()
+	}
+	idx.Rebuilding = false
+	if idx.db != nil {
+		idx.sync()
+	}
+	idx.Unlock()
+}
+
+
+// Returns the basic filter of the given block, with its header (nil if not found)
+func (ch *Chain) GetBlockFilter(hash *btc.Uint256) (res *BlockFilterRec) {
+	if ch.FilterIdx == nil {
+		return
+	}
+	idx := ch.FilterIdx
+	idx.Lock()
+	if idx.db != nil {
+		if v := idx.get(hash.Hash[:]); v != nil {
+			res = new(BlockFilterRec)
+			copy(res.Header[:], v[32:64])
+			copy(res.FilterHash[:], v[64:96])
+			res.Filter = v[96:]
+		}
+	}
+	idx.Unlock()
+	return
+}
+
+// Returns true if the block filters index is enabled and has the filters of all the blocks
+func (ch *Chain) BlockFiltersReady() (res bool) {
+	if ch.FilterIdx != nil {
+		ch.FilterIdx.Lock()
+		res = ch.FilterIdx.db != nil && !ch.FilterIdx.Rebuilding && ch.FilterIdx.Height == ch.LastBlock().Height
+		ch.FilterIdx.Unlock()
+	}
+	return
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/utxo"
+	"github.com/piotrnar/gocoin/lib/script"
 )
 
 
@@ -16,9 +17,14 @@ var AbortNow bool  // set it to true to abort any activity
 type Chain struct {
 	Blocks *BlockDB      // blockchain.dat and blockchain.idx
 	Unspent *utxo.UnspentDB    // unspent folder
+	TxIdx *TxIndex // txindex folder (nil if not enabled)
+	AddrIdx *AddrIndex // addrindex folder (nil if not enabled)
+	FilterIdx *FilterIndex // blockfilters folder (nil if not enabled)
+	Backfill *Backfill // not nil if the chain has been started from a UTXO snapshot
 
 	BlockTreeRoot *BlockTreeNode
 	blockTreeEnd *BlockTreeNode
+	mainChain []*BlockTreeNode // nodes of the main chain, by height (protected by blockTreeAccess)
 	blockTreeAccess sync.Mutex
 	Genesis *btc.Uint256
 
@@ -34,12 +40,16 @@ type Chain struct {
 		GensisTimestamp uint32
 		Enforce_CSV uint32 // if non zero CVS verifications will be enforced from this block onwards
 		Enforce_SEGWIT uint32 // if non zero CVS verifications will be enforced from this block onwards
+		Enforce_TAPROOT uint32 // if non zero BIP341/BIP342 verifications will be enforced from this block onwards
 		BIP9_Treshold uint32 // It is not really used at this moment, but maybe one day...
 		BIP34Height uint32
 		BIP65Height uint32
 		BIP66Height uint32
 		BIP91Height uint32
 		S2XHeight uint32
+		SubsidyHalvingInterval uint32
+		NoPOWRetargeting bool // if true, the difficulty never changes (regtest)
+		SignetChallenge []byte // if not nil, blocks must carry a valid BIP325 solution
 	}
 }
 
@@ -48,6 +58,11 @@ type NewChanOpts struct {
 	UndoBlocks uint // undo this many blocks when opening the chain
 	UTXOCallbacks utxo.CallbackFunctions
 	BlockMinedCB func(*btc.Block) // used to remove mined txs from memory pool
+	BlockUndoneCB func(*btc.Block) // called after a block has been removed from the chain (during a reorg)
+	SignetChallenge []byte // for a custom signet (nil for the default one)
+	TxIndex bool // maintain the transaction index (see RebuildTxIndex)
+	AddrIndex bool // maintain the address history index
+	BlockFilters bool // maintain BIP158 block filters (must be built from the genesis block)
 }
 
 
@@ -65,12 +80,43 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 	ch.Consensus.GensisTimestamp = 1231006505
 	ch.Consensus.MaxPOWBits = 0x1d00ffff
 	ch.Consensus.MaxPOWValue, _ = new(big.Int).SetString("00000000FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
-	if ch.testnet() {
+	ch.Consensus.SubsidyHalvingInterval = 210000
+	if ch.regtest() {
+		ch.Consensus.GensisTimestamp = 1296688602
+		ch.Consensus.MaxPOWBits = 0x207fffff
+		ch.Consensus.MaxPOWValue, _ = new(big.Int).SetString("7FFFFF0000000000000000000000000000000000000000000000000000000000", 16)
+		ch.Consensus.SubsidyHalvingInterval = 150
+		ch.Consensus.NoPOWRetargeting = true
+		ch.Consensus.BIP34Height = 1
+		ch.Consensus.BIP65Height = 1
+		ch.Consensus.BIP66Height = 1
+		ch.Consensus.Enforce_CSV = 1
+		ch.Consensus.Enforce_SEGWIT = 1
+		ch.Consensus.Enforce_TAPROOT = 1
+		ch.Consensus.BIP9_Treshold = 108
+	} else if ch.signet() {
+		ch.Consensus.GensisTimestamp = 1598918400
+		ch.Consensus.MaxPOWBits = 0x1e0377ae
+		ch.Consensus.MaxPOWValue, _ = new(big.Int).SetString("00000377AE000000000000000000000000000000000000000000000000000000", 16)
+		ch.Consensus.BIP34Height = 1
+		ch.Consensus.BIP65Height = 1
+		ch.Consensus.BIP66Height = 1
+		ch.Consensus.Enforce_CSV = 1
+		ch.Consensus.Enforce_SEGWIT = 1
+		ch.Consensus.Enforce_TAPROOT = 1
+		ch.Consensus.BIP9_Treshold = 1815
+		if opts.SignetChallenge != nil {
+			ch.Consensus.SignetChallenge = opts.SignetChallenge
+		} else {
+			ch.Consensus.SignetChallenge = SignetChallenge()
+		}
+	} else if ch.testnet() {
 		ch.Consensus.BIP34Height = 21111
 		ch.Consensus.BIP65Height = 581885
 		ch.Consensus.BIP66Height = 330776
 		ch.Consensus.Enforce_CSV = 770112
 		ch.Consensus.Enforce_SEGWIT = 834624
+		ch.Consensus.Enforce_TAPROOT = 2011968
 		ch.Consensus.BIP9_Treshold = 1512
 	} else {
 		ch.Consensus.BIP34Height = 227931
@@ -79,6 +125,7 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 		ch.Consensus.Enforce_CSV = 419328
 		ch.Consensus.Enforce_SEGWIT = 481824 // https://www.reddit.com/r/Bitcoin/comments/6okd1n/bip91_lock_in_is_guaranteed_as_of_block_476768/
 		ch.Consensus.BIP91Height = 477120
+		ch.Consensus.Enforce_TAPROOT = 709632
 		ch.Consensus.BIP9_Treshold = 1916
 	}
 
@@ -96,11 +143,27 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 	if AbortNow {
 		return
 	}
+	ch.loadBackfill()
+
+	if opts.TxIndex {
+		ch.TxIdx = NewTxIndex(ch.Blocks.dirname + "txindex/")
+		ch.txIndexCheck()
+	}
 
 	if rescan {
 		ch.SetLast(ch.BlockTreeRoot)
 	}
 
+	if opts.AddrIndex {
+		ch.AddrIdx = NewAddrIndex(ch.Blocks.dirname + "addrindex/")
+		ch.addrIndexCheck()
+	}
+
+	if opts.BlockFilters {
+		ch.FilterIdx = NewFilterIndex(ch.Blocks.dirname + "blockfilters/")
+		ch.filterIndexCheck()
+	}
+
 	if AbortNow {
 		return
 	}
@@ -108,7 +171,10 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 	if opts.UndoBlocks > 0 {
 		fmt.Println("Undo", opts.UndoBlocks, "block(s) and exit...")
 		for opts.UndoBlocks > 0 {
-			ch.UndoLastBlock()
+			if e := ch.UndoLastBlock(); e != nil {
+				fmt.Println(e.Error())
+				break
+			}
 			opts.UndoBlocks--
 		}
 		return
@@ -141,6 +207,18 @@ func (ch *Chain) RebuildGenesisHeader() {
 // when your client is idle, to defragment databases.
 func (ch *Chain) Idle() bool {
 	ch.Blocks.Idle()
+	if ch.TxIdx != nil {
+		ch.TxIdx.Idle()
+	}
+	if ch.AddrIdx != nil {
+		ch.AddrIdx.Idle()
+	}
+	if ch.FilterIdx != nil {
+		ch.FilterIdx.Idle()
+	}
+	if ch.Backfill != nil {
+		ch.Backfill.Idle()
+	}
 	return ch.Unspent.Idle()
 }
 
@@ -154,6 +232,19 @@ func (ch *Chain) Stats() (s string) {
 	ch.BlockIndexAccess.Unlock()
 	s += ch.Blocks.GetStats()
 	s += ch.Unspent.GetStats()
+	if ch.TxIdx != nil {
+		s += ch.TxIdx.Stats()
+	}
+	if ch.AddrIdx != nil {
+		s += ch.AddrIdx.Stats()
+	}
+	if ch.FilterIdx != nil {
+		s += ch.FilterIdx.Stats()
+	}
+	if ch.Backfill != nil {
+		s += ch.Backfill.Stats()
+	}
+	s += script.VerifyCacheStats()
 	return
 }
 
@@ -162,6 +253,18 @@ func (ch *Chain) Stats() (s string) {
 func (ch *Chain) Close() {
 	ch.Blocks.Close()
 	ch.Unspent.Close()
+	if ch.TxIdx != nil {
+		ch.TxIdx.Close()
+	}
+	if ch.AddrIdx != nil {
+		ch.AddrIdx.Close()
+	}
+	if ch.FilterIdx != nil {
+		ch.FilterIdx.Close()
+	}
+	if ch.Backfill != nil {
+		ch.Backfill.close()
+	}
 }
 
 
@@ -171,6 +274,24 @@ func (ch *Chain) testnet() bool {
 }
 
 
+// Returns true if we are on Regtest chain
+func (ch *Chain) regtest() bool {
+	return ch.Genesis.Hash[0]==0x06 // same trick as for testnet
+}
+
+
+// Returns true if we are on Signet chain (any challenge - they all share the genesis block)
+func (ch *Chain) signet() bool {
+	return ch.Genesis.Hash[0]==0xf6
+}
+
+
+// Returns the block subsidy (without fees) for the given height
+func (ch *Chain) GetBlockReward(height uint32) (uint64) {
+	return 50e8 >> (height/ch.Consensus.SubsidyHalvingInterval)
+}
+
+
 // For SegWit2X
 func (ch *Chain) MaxBlockWeight(height uint32) uint {
 	if ch.Consensus.S2XHeight != 0 && height >= ch.Consensus.S2XHeight {
@@ -200,6 +321,25 @@ func (ch *Chain) LastBlock() (res *BlockTreeNode) {
 func (ch *Chain) SetLast(val *BlockTreeNode) {
 	ch.blockTreeAccess.Lock()
 	ch.blockTreeEnd = val
+	// update the height index - only down to the point where the chains fork
+	if int(val.Height) < len(ch.mainChain) {
+		ch.mainChain = ch.mainChain[:val.Height+1]
+	} else {
+		ch.mainChain = append(ch.mainChain, make([]*BlockTreeNode, int(val.Height)+1-len(ch.mainChain))...)
+	}
+	for n := val; n != nil && ch.mainChain[n.Height] != n; n = n.Parent {
+		ch.mainChain[n.Height] = n
+	}
+	ch.blockTreeAccess.Unlock()
+	return
+}
+
+// BlockAtHeight returns the main chain's block at the given height (nil if above the last block).
+func (ch *Chain) BlockAtHeight(height uint32) (res *BlockTreeNode) {
+	ch.blockTreeAccess.Lock()
+	if int(height) < len(ch.mainChain) {
+		res = ch.mainChain[height]
+	}
 	ch.blockTreeAccess.Unlock()
 	return
 }
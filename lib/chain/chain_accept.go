@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"sync"
 	"errors"
-	"sync/atomic"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/utxo"
 	"github.com/piotrnar/gocoin/lib/script"
@@ -82,7 +81,13 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 			ch.Blocks.BlockAdd(cur.Height, bl)
 			// Apply the block's trabnsactions to the unspent database:
 			ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+			if ch.Blocks.PruneEnabled() {
+				ch.Unspent.PruneUndo(ch.Blocks.PruneHeight())
+			}
 			ch.SetLast(cur) // Advance the head
+			ch.txIndexAdd(bl, cur.Height)
+			ch.addrIndexAdd(bl, cur.Height)
+			ch.filterIndexAdd(bl, cur.Height)
 			if ch.CB.BlockMinedCB != nil {
 				ch.CB.BlockMinedCB(bl)
 			}
@@ -95,8 +100,9 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 
 		// If it has more POW than the current head, move the head to it
 		if cur.MorePOW(ch.LastBlock()) {
-			ch.MoveToBlock(cur)
-			if ch.LastBlock() != cur {
+			if e = ch.MoveToBlock(cur); e != nil {
+				e = errors.New("CommitBlock: " + e.Error())
+			} else if ch.LastBlock() != cur {
 				e = errors.New("CommitBlock: MoveToBlock failed")
 			}
 		} else {
@@ -110,17 +116,22 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 
 // This isusually the most time consuming process when applying a new block
 func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost uint32, e error) {
-	sumblockin := btc.GetBlockReward(changes.Height)
+	sumblockin := ch.GetBlockReward(changes.Height)
 	var txoutsum, txinsum, sumblockout uint64
 
-	if changes.Height+ch.Unspent.UnwindBufLen >= changes.LastKnownHeight {
+	if !ch.Unspent.DoNotWriteUndoFiles {
 		changes.UndoData = make(map[[32]byte] *utxo.UtxoRec)
 	}
 
 	blUnsp := make(map[[32]byte] []*btc.TxOut, len(bl.Txs))
 
-	var wg sync.WaitGroup
-	var ver_err_cnt uint32
+	// script failures of the inputs that come before any other error take precedence
+	vj := newScriptVerifyJob(bl.VerifyFlags)
+	defer func() {
+		if er := vj.wait(); er != nil {
+			e = er
+		}
+	}()
 
 	for i := range bl.Txs {
 		txoutsum, txinsum = 0, 0
@@ -130,10 +141,16 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 		// Check each tx for a valid input, except from the first one
 		if i > 0 {
 			tx_trusted := bl.Trusted
+			if !tx_trusted && script.ScriptCacheGet(bl.Txs[i], bl.VerifyFlags) {
+				tx_trusted = true // its scripts have been verified already (in the memory pool) - the cache record is gone now
+			}
 			if !tx_trusted && TrustedTxChecker!=nil && TrustedTxChecker(bl.Txs[i]) {
 				tx_trusted = true
 			}
 
+			// all the spent outputs need to be known before verifying any taproot input
+			bl.Txs[i].Spent_outputs = make([]*btc.TxOut, len(bl.Txs[i].TxIn))
+
 			for j := 0; j < len(bl.Txs[i].TxIn); j++ {
 				inp := &bl.Txs[i].TxIn[j].Input
 				spent_map, was_spent := changes.DeledTxs[inp.Hash]
@@ -208,15 +225,7 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 					}
 				}
 
-				if !tx_trusted { // run VerifyTxScript() in a parallel task
-					wg.Add(1)
-					go func (prv []byte, amount uint64, i int, tx *btc.Tx) {
-						if !script.VerifyTxScript(prv, amount, i, tx, bl.VerifyFlags) {
-							atomic.AddUint32(&ver_err_cnt, 1)
-						}
-						wg.Done()
-					}(tout.Pk_script, tout.Value, j, bl.Txs[i])
-				}
+				bl.Txs[i].Spent_outputs[j] = tout
 
 				if btc.IsP2SH(tout.Pk_script) {
 					sigopscost += uint32(btc.WITNESS_SCALE_FACTOR * btc.GetP2SHSigOpCount(bl.Txs[i].TxIn[j].ScriptSig))
@@ -228,11 +237,9 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 			}
 
 			if !tx_trusted {
-				wg.Wait()
-				if ver_err_cnt > 0 {
-					println("VerifyScript failed", ver_err_cnt, "time (s)")
-					e = errors.New(fmt.Sprint("VerifyScripts failed ", ver_err_cnt, "time (s)"))
-					return
+				vj.add(bl.Txs[i]) // VerifyTxScript() runs in the workers' pool
+				if vj.failedAlready() {
+					break // no point going further
 				}
 			}
 		} else {
@@ -268,6 +275,11 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 		blUnsp[bl.Txs[i].Hash.Hash] = outs
 	}
 
+	if e = vj.wait(); e != nil {
+		println(e.Error())
+		return
+	}
+
 	if sumblockin < sumblockout {
 		e = errors.New(fmt.Sprintf("Out:%d > In:%d", sumblockout, sumblockin))
 		return
@@ -8,7 +8,13 @@ import (
 
 func nextBlock(ch *Chain, hash, header []byte, height, blen, txs uint32) {
 	bh := btc.NewUint256(hash[:])
-	if _, ok := ch.BlockIndex[bh.BIdx()]; ok {
+	if v, ok := ch.BlockIndex[bh.BIdx()]; ok {
+		if v.BlockSize == 0 && blen != 0 {
+			// block's data added after its header (see BlockAddPurged)
+			v.BlockSize = blen
+			v.TxCount = txs
+			return
+		}
 		println("nextBlock:", bh.String(), "- already in")
 		return
 	}
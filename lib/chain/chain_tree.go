@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"time"
 	"sort"
+	"errors"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
 )
 
 
@@ -101,9 +103,15 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 		}
 
 		ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+		if ch.Blocks.PruneEnabled() {
+			ch.Unspent.PruneUndo(ch.Blocks.PruneHeight())
+		}
 
 		ch.SetLast(nxt)
 		last = nxt
+		ch.txIndexAdd(bl, nxt.Height)
+		ch.addrIndexAdd(bl, nxt.Height)
+		ch.filterIndexAdd(bl, nxt.Height)
 
 		if ch.CB.BlockMinedCB != nil {
 			bl.Height = nxt.Height
@@ -115,7 +123,9 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 	if !AbortNow && last != end {
 		end, _ = ch.BlockTreeRoot.FindFarthestNode()
 		fmt.Println("ParseTillBlock failed - now go to", end.Height)
-		ch.MoveToBlock(end)
+		if e := ch.MoveToBlock(end); e != nil {
+			fmt.Println("ParseTillBlock:", e.Error())
+		}
 	}
 }
 
@@ -225,8 +235,9 @@ func (ch *Chain) OnActiveBranch(dst *BlockTreeNode) bool {
 }
 
 
-// Performs channel reorg
-func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
+// Performs channel reorg. If a block cannot be undone, it stops and returns the error
+// (the chain is then left at the last block that could not be undone).
+func (ch *Chain) MoveToBlock(dst *BlockTreeNode) (e error) {
 	cur := dst
 	for cur.Height > ch.LastBlock().Height {
 		cur = cur.Parent
@@ -236,7 +247,7 @@ func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
 			fmt.Println("MoveToBlock cannot continue A")
 			fmt.Println("Trying to go:", dst.BlockHash.String())
 			fmt.Println("Cannot go at:", cur.BlockHash.String())
-			return
+			return errors.New("MoveToBlock: no data of block " + cur.BlockHash.String())
 		}
 	}
 
@@ -246,7 +257,7 @@ func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
 			fmt.Println("MoveToBlock cannot continue B")
 			fmt.Println("Trying to go:", dst.BlockHash.String())
 			fmt.Println("Cannot go at:", cur.Parent.BlockHash.String())
-			return
+			return errors.New("MoveToBlock: no data of block " + cur.Parent.BlockHash.String())
 		}
 		cur = cur.Parent
 	}
@@ -256,26 +267,51 @@ func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
 		if AbortNow {
 			return
 		}
-		ch.UndoLastBlock()
+		if e = ch.UndoLastBlock(); e != nil {
+			fmt.Println("MoveToBlock cannot continue C:", e.Error())
+			return
+		}
 	}
 	ch.ParseTillBlock(dst)
+	return
 }
 
 
-func (ch *Chain) UndoLastBlock() {
+// Takes the last block off the chain.
+// Returns an error if the block's data or its undo data is not available - the chain is then not changed.
+func (ch *Chain) UndoLastBlock() (e error) {
 	last := ch.LastBlock()
 	fmt.Println("Undo block", last.Height, last.BlockHash.String(), last.BlockSize>>10, "KB")
 
-	crec, _, er := ch.Blocks.BlockGetInternal(last.BlockHash, true)
-	if er != nil {
-		panic(er.Error())
+	// the block is needed to update the indexes and to notify about the disconnected txs
+	crec, _, e := ch.Blocks.BlockGetInternal(last.BlockHash, true)
+	if e != nil {
+		return errors.New(fmt.Sprint("UndoLastBlock: block ", last.Height, " not available - ", e.Error()))
+	}
+	bl, e := btc.NewBlock(crec.Data)
+	if e == nil {
+		e = bl.BuildTxList()
+	}
+	if e != nil {
+		return errors.New(fmt.Sprint("UndoLastBlock: block ", last.Height, " broken - ", e.Error()))
 	}
 
-	bl, _ := btc.NewBlock(crec.Data)
-	bl.BuildTxList()
-
-	ch.Unspent.UndoBlockTxs(bl, last.Parent.BlockHash.Hash[:])
+	if e = ch.Unspent.UndoBlock(last.BlockHash.Hash[:], last.Parent.BlockHash.Hash[:]); e != nil {
+		if e != utxo.ErrNoUndoRecord {
+			println("UndoLastBlock:", e.Error(), "- using the block's data")
+		}
+		if e = ch.Unspent.UndoBlockTxs(bl, last.Parent.BlockHash.Hash[:]); e != nil {
+			return errors.New("UndoLastBlock: " + e.Error())
+		}
+	}
 	ch.SetLast(last.Parent)
+	ch.txIndexDel(bl, last.Height)
+	ch.addrIndexDel(bl, last.Height)
+	ch.filterIndexDel(bl, last.Height)
+	if ch.CB.BlockUndoneCB != nil {
+		ch.CB.BlockUndoneCB(bl)
+	}
+	return
 }
 
 
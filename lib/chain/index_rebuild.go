@@ -0,0 +1,54 @@
+package chain
+
+import (
+	"fmt"
+	"errors"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+// The indexes that need the outputs spent by each block (AddrIndex and FilterIndex) are built
+// in the background from the blocks stored in BlockDB, taking the spent outputs from UTXO undo records.
+
+
+// Reads the main chain block from BlockDB and sets Spent_outputs of its transactions
+func (ch *Chain) indexBlock(n *BlockTreeNode) (bl *btc.Block, er error) {
+	crec, _, er := ch.Blocks.BlockGetInternal(n.BlockHash, true)
+	if er != nil {
+		return
+	}
+	if bl, er = btc.NewBlock(crec.Data); er != nil {
+		return
+	}
+	if er = bl.BuildTxList(); er != nil {
+		return
+	}
+	u, er := ch.Unspent.GetUndo(n.Height, n.BlockHash.Hash[:])
+	if er != nil {
+		return nil, errors.New(fmt.Sprint("no undo record of block ", n.Height, " (", er.Error(), ") - use -r to build the index"))
+	}
+
+	spent := make(map[[32]byte]*utxo.UtxoRec, len(u.Spent))
+	for _, rec := range u.Spent {
+		spent[rec.TxID] = rec
+	}
+	outs := make(map[[32]byte][]*btc.TxOut, len(bl.Txs))
+	outs[bl.Txs[0].Hash.Hash] = bl.Txs[0].TxOut
+	for _, tx := range bl.Txs[1:] {
+		tx.Spent_outputs = make([]*btc.TxOut, len(tx.TxIn))
+		for i, in := range tx.TxIn {
+			vout := int(in.Input.Vout)
+			if rec := spent[in.Input.Hash]; rec != nil && vout < len(rec.Outs) && rec.Outs[vout] != nil {
+				tx.Spent_outputs[i] = &btc.TxOut{Value:rec.Outs[vout].Value, Pk_script:rec.Outs[vout].PKScr,
+					BlockHeight:rec.InBlock, WasCoinbase:rec.Coinbase}
+			} else if t, ok := outs[in.Input.Hash]; ok && vout < len(t) {
+				tx.Spent_outputs[i] = t[vout] // spent within the same block
+			} else {
+				return nil, errors.New(fmt.Sprint("undo record of block ", n.Height, " misses ",
+					btc.NewUint256(in.Input.Hash[:]).String(), "-", in.Input.Vout))
+			}
+		}
+		outs[tx.Hash.Hash] = tx.TxOut
+	}
+	return
+}
@@ -0,0 +1,175 @@
+package chain
+
+import (
+	"fmt"
+	"sync"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+/*
+	Pool of workers verifying input scripts of a block in parallel.
+	Inputs are numbered in the order of the block and if any of them fails,
+	the workers skip all the inputs that come after it - still verifying those
+	before it, so the reported failure is always the first one in the block.
+*/
+
+const (
+	SCRIPT_VERIFY_BATCH = 16 // number of inputs sent to a worker at once
+	SCRIPT_VERIFY_QUEUE = 1024 // max number of batches waiting for a worker
+
+	noScriptFail = int64(^uint64(0)>>1)
+)
+
+var (
+	verifyThreads int
+	verifyMutex sync.Mutex
+	verifyQueue chan *scriptVerifyBatch = make(chan *scriptVerifyBatch, SCRIPT_VERIFY_QUEUE)
+	verifyStop chan bool = make(chan bool)
+)
+
+type scriptCheck struct {
+	tx *btc.Tx
+	inp int
+	idx int64 // position of the input inside the block
+}
+
+type scriptVerifyBatch struct {
+	job *scriptVerifyJob
+	checks []scriptCheck
+}
+
+type scriptVerifyJob struct {
+	flags uint32
+	fail int64 // idx of the first failed input (access it atomically)
+	failed scriptCheck
+	sync.Mutex
+	wg sync.WaitGroup
+	cnt int64
+	pending []scriptCheck
+}
+
+
+// SetScriptVerifyThreads sets the number of script verification workers (0 for one per CPU core).
+func SetScriptVerifyThreads(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	verifyMutex.Lock()
+	for ; verifyThreads < n; verifyThreads++ {
+		go scriptVerifyWorker()
+	}
+	for ; verifyThreads > n; verifyThreads-- {
+		verifyStop <- true
+	}
+	verifyMutex.Unlock()
+}
+
+// ScriptVerifyThreads returns the number of script verification workers.
+func ScriptVerifyThreads() (n int) {
+	verifyMutex.Lock()
+	n = verifyThreads
+	verifyMutex.Unlock()
+	return
+}
+
+
+func scriptVerifyWorker() {
+	for {
+		select {
+			case b := <- verifyQueue:
+				b.run()
+			case <- verifyStop:
+				return
+		}
+	}
+}
+
+
+func (b *scriptVerifyBatch) run() {
+	j := b.job
+	for i := range b.checks {
+		c := &b.checks[i]
+		if c.idx >= atomic.LoadInt64(&j.fail) {
+			break // an earlier input has failed already
+		}
+		tx := c.tx
+		tout := tx.Spent_outputs[c.inp]
+		if !script.VerifyTxScript(tout.Pk_script, tout.Value, c.inp, tx, j.flags) {
+			j.Lock()
+			if c.idx < j.fail {
+				j.failed = *c
+				atomic.StoreInt64(&j.fail, c.idx)
+			}
+			j.Unlock()
+			break
+		}
+	}
+	j.wg.Done()
+}
+
+
+func newScriptVerifyJob(flags uint32) (j *scriptVerifyJob) {
+	if ScriptVerifyThreads() == 0 {
+		SetScriptVerifyThreads(0)
+	}
+	j = new(scriptVerifyJob)
+	j.flags = flags
+	j.fail = noScriptFail
+	return
+}
+
+// add queues verification of all the inputs of the given tx (its Spent_outputs must be set)
+func (j *scriptVerifyJob) add(tx *btc.Tx) {
+	for i := range tx.TxIn {
+		j.pending = append(j.pending, scriptCheck{tx:tx, inp:i, idx:j.cnt})
+		j.cnt++
+		if len(j.pending) >= SCRIPT_VERIFY_BATCH {
+			j.flush()
+		}
+	}
+}
+
+func (j *scriptVerifyJob) flush() {
+	if len(j.pending) == 0 {
+		return
+	}
+	if !j.failedAlready() {
+		j.wg.Add(1)
+		verifyQueue <- &scriptVerifyBatch{job:j, checks:j.pending}
+	}
+	j.pending = nil
+}
+
+// failedAlready returns true if any of the inputs has failed (so far)
+func (j *scriptVerifyJob) failedAlready() bool {
+	return atomic.LoadInt64(&j.fail) != noScriptFail
+}
+
+// wait returns the first failure in the block's order, after all the queued inputs have been verified
+func (j *scriptVerifyJob) wait() (e error) {
+	j.flush()
+	j.wg.Wait()
+	if j.failedAlready() {
+		e = errors.New(fmt.Sprint("VerifyScript failed for input ", j.failed.inp, " of tx ",
+			j.failed.tx.Hash.String(), " - RPC_Result:mandatory-script-verify-flag-failed"))
+	}
+	return
+}
+
+
+// VerifyBlockScripts verifies all the input scripts of the block in parallel.
+// Spent_outputs of each transaction (except the coinbase) must be set.
+func VerifyBlockScripts(bl *btc.Block) (e error) {
+	j := newScriptVerifyJob(bl.VerifyFlags)
+	for _, tx := range bl.Txs[1:] {
+		j.add(tx)
+		if j.failedAlready() {
+			break
+		}
+	}
+	return j.wait()
+}
@@ -0,0 +1,84 @@
+package chain
+
+import (
+	"fmt"
+	"bytes"
+	"strings"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+// Makes a block with txs of n_inp inputs each. The function returns the script of the output spent
+// by the input at the given position (counting from the first input of the block).
+func verifyTestBlock(n_txs, n_inp int, spent func(pos int) []byte) (bl *btc.Block) {
+	bl = new(btc.Block)
+	bl.VerifyFlags = script.VER_P2SH | script.VER_WITNESS | script.VER_DERSIG | script.VER_NULLDUMMY
+	bl.Txs = []*btc.Tx{new(btc.Tx)} // coinbase is not verified
+	var pos int
+	for i := 0; i < n_txs; i++ {
+		tx := new(btc.Tx)
+		tx.Version = 2
+		tx.TxOut = []*btc.TxOut{&btc.TxOut{Value:1000, Pk_script:[]byte{0x51}}}
+		for j := 0; j < n_inp; j++ {
+			prv := btc.Sha2Sum([]byte(fmt.Sprint(i, "-", j)))
+			tx.TxIn = append(tx.TxIn, &btc.TxIn{Input:btc.TxPrevOut{Hash:prv}, Sequence:0xffffffff})
+			tx.Spent_outputs = append(tx.Spent_outputs, &btc.TxOut{Value:1000, Pk_script:spent(pos)})
+			pos++
+		}
+		tx.SetHash(tx.Serialize())
+		bl.Txs = append(bl.Txs, tx)
+	}
+	return
+}
+
+func TestVerifyBlockScripts(t *testing.T) {
+	const n_txs, n_inp = 300, 5
+	prv := script.DBG_ERR
+	script.DBG_ERR = false
+	defer func() {
+		script.DBG_ERR = prv
+	}()
+
+	op_true := []byte{0x51}
+	op_false := []byte{0x00}
+	// OP_TRUE followed by OP_SHA256 repeated 200 times
+	slow := append([]byte{0x51}, bytes.Repeat([]byte{0xa8}, 200)...)
+
+	good := verifyTestBlock(n_txs, n_inp, func(pos int) []byte {
+		return op_true
+	})
+
+	// The first invalid input is in the middle of the block, at the end of its batch (after slow inputs).
+	// The next batch starts with an invalid one, which gets found earlier, but must not be reported.
+	first := (n_txs * n_inp / 2 / SCRIPT_VERIFY_BATCH) * SCRIPT_VERIFY_BATCH - 1
+	bad := verifyTestBlock(n_txs, n_inp, func(pos int) []byte {
+		switch {
+			case pos == first || pos == first + 1 || pos == first + 40 || pos == n_txs * n_inp - 1:
+				return op_false
+			case pos > first - SCRIPT_VERIFY_BATCH && pos < first:
+				return slow
+		}
+		return op_true
+	})
+	exp := fmt.Sprint("input ", first % n_inp, " of tx ", bad.Txs[1 + first / n_inp].Hash.String(), " ")
+
+	for _, threads := range []int{1, 2, 3, 8, 32} {
+		SetScriptVerifyThreads(threads)
+		if ScriptVerifyThreads() != threads {
+			t.Fatal("Bad number of threads", ScriptVerifyThreads())
+		}
+		for i := 0; i < 20; i++ {
+			if e := VerifyBlockScripts(good); e != nil {
+				t.Fatal(threads, "threads: valid block failed:", e.Error())
+			}
+			e := VerifyBlockScripts(bad)
+			if e == nil {
+				t.Fatal(threads, "threads: invalid block passed")
+			}
+			if !strings.Contains(e.Error(), exp) {
+				t.Fatal(threads, "threads: failure reported for another input:", e.Error())
+			}
+		}
+	}
+}
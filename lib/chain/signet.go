@@ -0,0 +1,173 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+const (
+	// Challenge script of the default (public) signet - 1-of-2 multisig
+	SignetDefaultChallenge = "512103ad5e0edad18cb1f0fc0d28a3d4f1f3e445640337489abb10404f2d1e086be430210359ef5021964fe22d6f8e05b2463c9540ce96883fe3b278760f048f5189f2e6c452ae"
+
+	// Flags used to verify the block solution against the challenge (BIP325)
+	SignetVerifyFlags = script.VER_P2SH | script.VER_WITNESS | script.VER_DERSIG | script.VER_NULLDUMMY
+)
+
+var SignetHeader = []byte{0xec, 0xc7, 0xda, 0xa2}
+
+
+// Returns the default signet challenge script
+func SignetChallenge() (res []byte) {
+	res, _ = hex.DecodeString(SignetDefaultChallenge)
+	return
+}
+
+
+// Returns the network magic bytes for a signet with the given challenge
+func SignetMagic(challenge []byte) (magic [4]byte) {
+	buf := new(bytes.Buffer)
+	btc.WriteVlen(buf, uint64(len(challenge)))
+	buf.Write(challenge)
+	h := btc.Sha2Sum(buf.Bytes())
+	copy(magic[:], h[:4])
+	return
+}
+
+
+// Looks for the first push in the witness commitment script that starts with SignetHeader
+// and has some data after it. Returns the data following the header and the commitment
+// script with the data removed (only the header left in the push).
+func fetchSignetSolution(pk_script []byte) (solution, stripped []byte) {
+	var pc int
+	buf := new(bytes.Buffer)
+	for pc < len(pk_script) {
+		opcode, data, le, e := btc.GetOpcode(pk_script[pc:])
+		if e != nil {
+			break
+		}
+		pc += le
+		if len(data) == 0 {
+			buf.WriteByte(byte(opcode))
+			continue
+		}
+		if solution == nil && len(data) > len(SignetHeader) && bytes.Equal(data[:len(SignetHeader)], SignetHeader) {
+			solution = data[len(SignetHeader):]
+			data = data[:len(SignetHeader)]
+		}
+		btc.WritePutLen(buf, uint32(len(data)))
+		buf.Write(data)
+	}
+	if solution != nil {
+		stripped = buf.Bytes()
+	}
+	return
+}
+
+
+// Parses the signet solution (scriptSig followed by the witness stack)
+func parseSignetSolution(d []byte) (sig []byte, wit [][]byte, er error) {
+	le, n := btc.VLen(d)
+	if n == 0 || le < 0 || n+le > len(d) {
+		er = errors.New("bad scriptSig")
+		return
+	}
+	sig = d[n:n+le]
+	d = d[n+le:]
+
+	cnt, n := btc.VLen(d)
+	if n == 0 || cnt < 0 || cnt > len(d)-n {
+		er = errors.New("bad witness")
+		return
+	}
+	d = d[n:]
+	wit = make([][]byte, cnt)
+	for i := range wit {
+		le, n = btc.VLen(d)
+		if n == 0 || le < 0 || n+le > len(d) {
+			er = errors.New("bad witness item")
+			return
+		}
+		wit[i] = d[n:n+le]
+		d = d[n+le:]
+	}
+
+	if len(d) != 0 {
+		er = errors.New("extraneous data")
+	}
+	return
+}
+
+
+// Verifies the signet block solution against the challenge (BIP325).
+// Make sure to call it after the coinbase witness commitment has been checked.
+func (ch *Chain) CheckSignetSolution(bl *btc.Block) (er error) {
+	cb := bl.Txs[0]
+
+	var cidx int
+	for cidx = len(cb.TxOut)-1; cidx >= 0; cidx-- {
+		o := cb.TxOut[cidx].Pk_script
+		if len(o) >= 38 && bytes.Equal(o[:6], []byte{0x6a,0x24,0xaa,0x21,0xa9,0xed}) {
+			break
+		}
+	}
+	if cidx < 0 {
+		er = errors.New("CheckBlock() : signet block has no witness commitment - RPC_Result:bad-signet-blksig")
+		return
+	}
+
+	// Calculate merkle root of the block with the solution removed from the coinbase.
+	// Without a solution, the coinbase is serialized as it is and the solution is empty
+	// (as in Core - it allows trivial challenges, like OP_TRUE).
+	mcb := &btc.Tx{Version:cb.Version, TxIn:cb.TxIn, Lock_time:cb.Lock_time}
+	mcb.TxOut = make([]*btc.TxOut, len(cb.TxOut))
+	copy(mcb.TxOut, cb.TxOut)
+
+	var sig []byte
+	var wit [][]byte
+	solution, stripped := fetchSignetSolution(cb.TxOut[cidx].Pk_script)
+	if solution != nil {
+		if sig, wit, er = parseSignetSolution(solution); er != nil {
+			er = errors.New("CheckBlock() : signet solution parse failure: " + er.Error() + " - RPC_Result:bad-signet-blksig")
+			return
+		}
+		mcb.TxOut[cidx] = &btc.TxOut{Value:cb.TxOut[cidx].Value, Pk_script:stripped}
+	}
+
+	mtr := make([][32]byte, len(bl.Txs))
+	mtr[0] = btc.Sha2Sum(mcb.Serialize())
+	for i := 1; i < len(bl.Txs); i++ {
+		mtr[i] = bl.Txs[i].Hash.Hash
+	}
+	merkle, _ := btc.CalcMerkle(mtr)
+
+	var block_data [72]byte
+	copy(block_data[0:4], bl.Raw[0:4]) // version
+	copy(block_data[4:36], bl.ParentHash())
+	copy(block_data[36:68], merkle)
+	binary.LittleEndian.PutUint32(block_data[68:72], bl.BlockTime())
+
+	// The virtual transaction which pays to the challenge...
+	to_spend := new(btc.Tx)
+	to_spend.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Vout:0xffffffff},
+		ScriptSig:append([]byte{0x00, 72}, block_data[:]...)}}
+	to_spend.TxOut = []*btc.TxOut{&btc.TxOut{Pk_script:ch.Consensus.SignetChallenge}}
+	to_spend.SetHash(to_spend.Serialize())
+
+	// ... and the one which spends it, using the solution
+	spending := new(btc.Tx)
+	spending.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Hash:to_spend.Hash.Hash}, ScriptSig:sig}}
+	spending.TxOut = []*btc.TxOut{&btc.TxOut{Pk_script:[]byte{0x6a}}}
+	if len(wit) > 0 {
+		spending.SegWit = [][][]byte{wit}
+	}
+	spending.SetHash(spending.SerializeNew())
+
+	if !script.VerifyTxScript(ch.Consensus.SignetChallenge, 0, 0, spending, SignetVerifyFlags) {
+		er = errors.New("CheckBlock() : signet block solution invalid - RPC_Result:bad-signet-blksig")
+	}
+	return
+}
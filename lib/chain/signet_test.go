@@ -0,0 +1,221 @@
+package chain
+
+import (
+	"bytes"
+	"testing"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+var signetWitnessCommitment = append([]byte{0x6a,0x24,0xaa,0x21,0xa9,0xed}, bytes.Repeat([]byte{0x5a}, 32)...)
+
+// Returns the coinbase with the witness commitment extended by the given script
+func signetCoinbase(commitment_ext []byte) (cb *btc.Tx) {
+	cb = new(btc.Tx)
+	cb.Version = 2
+	cb.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Vout:0xffffffff}, ScriptSig:[]byte{0x01, 0x65}, Sequence:0xffffffff}}
+	cb.TxOut = []*btc.TxOut{&btc.TxOut{Value:50e8, Pk_script:[]byte{0x51}},
+		&btc.TxOut{Pk_script:append(append([]byte{}, signetWitnessCommitment...), commitment_ext...)}}
+	cb.SetHash(cb.Serialize())
+	return
+}
+
+func signetHeader(merkle []byte) (hdr []byte) {
+	hdr = make([]byte, 80)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0x20000000)
+	copy(hdr[4:36], bytes.Repeat([]byte{0x11}, 32))
+	copy(hdr[36:68], merkle)
+	binary.LittleEndian.PutUint32(hdr[68:72], 1700000000)
+	binary.LittleEndian.PutUint32(hdr[72:76], 0x1e0377ae)
+	return
+}
+
+func signetBlock(t *testing.T, hdr []byte, txs ...*btc.Tx) (bl *btc.Block) {
+	raw := new(bytes.Buffer)
+	raw.Write(hdr)
+	btc.WriteVlen(raw, uint64(len(txs)))
+	for _, tx := range txs {
+		raw.Write(tx.Serialize())
+	}
+	var er error
+	if bl, er = btc.NewBlock(raw.Bytes()); er == nil {
+		er = bl.BuildTxList()
+	}
+	if er != nil {
+		t.Fatal(er)
+	}
+	return
+}
+
+// Independent implementation of BIP325 signing: returns the transaction spending the challenge
+// for the block made of the given header fields and txs (coinbase with the empty solution header).
+func signetSpending(challenge, hdr []byte, txs []*btc.Tx) (spending *btc.Tx) {
+	mtr := make([][32]byte, len(txs))
+	for i, tx := range txs {
+		mtr[i] = tx.Hash.Hash
+	}
+	merkle, _ := btc.CalcMerkle(mtr)
+	data := append(append([]byte{}, hdr[:36]...), merkle...)
+	data = append(data, hdr[68:72]...)
+
+	to_spend := new(btc.Tx)
+	to_spend.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Vout:0xffffffff}, ScriptSig:append([]byte{0x00, 72}, data...)}}
+	to_spend.TxOut = []*btc.TxOut{&btc.TxOut{Pk_script:challenge}}
+	to_spend.SetHash(to_spend.Serialize())
+
+	spending = new(btc.Tx)
+	spending.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Hash:to_spend.Hash.Hash}}}
+	spending.TxOut = []*btc.TxOut{&btc.TxOut{Pk_script:[]byte{0x6a}}}
+	return
+}
+
+func signetSign(t *testing.T, priv, hash []byte) []byte {
+	r, s, er := btc.EcdsaSign(priv, hash)
+	if er != nil {
+		t.Fatal(er)
+	}
+	sig := new(btc.Signature)
+	sig.R.Set(r)
+	sig.S.Set(s)
+	sig.HashType = btc.SIGHASH_ALL
+	return sig.Bytes()
+}
+
+// Serializes the solution (scriptSig and the witness stack)
+func signetSolution(sig []byte, wit [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	btc.WriteVlen(buf, uint64(len(sig)))
+	buf.Write(sig)
+	btc.WriteVlen(buf, uint64(len(wit)))
+	for _, w := range wit {
+		btc.WriteVlen(buf, uint64(len(w)))
+		buf.Write(w)
+	}
+	return buf.Bytes()
+}
+
+// Returns the push of the signet header followed by the solution
+func signetPush(solution []byte) []byte {
+	buf := new(bytes.Buffer)
+	d := append(append([]byte{}, SignetHeader...), solution...)
+	btc.WritePutLen(buf, uint32(len(d)))
+	buf.Write(d)
+	return buf.Bytes()
+}
+
+func signetCheck(challenge []byte, bl *btc.Block) error {
+	ch := new(Chain)
+	ch.Consensus.SignetChallenge = challenge
+	return ch.CheckSignetSolution(bl)
+}
+
+// Makes a block with its solution for the challenge, using the given function to sign it
+func signetSolvedBlock(t *testing.T, challenge []byte, sign func(spending *btc.Tx) ([]byte, [][]byte)) (bl *btc.Block, hdr []byte, sol []byte) {
+	tx := new(btc.Tx)
+	tx.Version = 2
+	tx.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Hash:btc.Sha2Sum([]byte("prev")), Vout:3}, ScriptSig:[]byte{0x51}, Sequence:0xfffffffd}}
+	tx.TxOut = []*btc.TxOut{&btc.TxOut{Value:12345, Pk_script:[]byte{0x51}}}
+	tx.SetHash(tx.Serialize())
+
+	hdr = signetHeader(nil)
+	spending := signetSpending(challenge, hdr, []*btc.Tx{signetCoinbase(signetHeaderPush()), tx})
+	sol = signetSolution(sign(spending))
+
+	cb := signetCoinbase(signetPush(sol))
+	merkle, _ := btc.CalcMerkle([][32]byte{cb.Hash.Hash, tx.Hash.Hash})
+	hdr = signetHeader(merkle)
+	bl = signetBlock(t, hdr, cb, tx)
+	return
+}
+
+// The commitment with the solution removed has just the header pushed
+func signetHeaderPush() []byte {
+	return append([]byte{byte(len(SignetHeader))}, SignetHeader...)
+}
+
+func TestSignetMultisig(t *testing.T) {
+	priv1, priv2 := bytes.Repeat([]byte{0x07}, 32), bytes.Repeat([]byte{0x08}, 32)
+	// 1-of-2 bare multisig - the same kind of challenge as the default signet has
+	challenge := []byte{0x51, 33}
+	challenge = append(challenge, btc.PublicFromPrivate(priv1, true)...)
+	challenge = append(challenge, 33)
+	challenge = append(challenge, btc.PublicFromPrivate(priv2, true)...)
+	challenge = append(challenge, 0x52, 0xae)
+
+	bl, hdr, sol := signetSolvedBlock(t, challenge, func(spending *btc.Tx) ([]byte, [][]byte) {
+		sig := signetSign(t, priv2, spending.SignatureHash(challenge, 0, btc.SIGHASH_ALL))
+		return append([]byte{0x00, byte(len(sig))}, sig...), nil
+	})
+	if er := signetCheck(challenge, bl); er != nil {
+		t.Fatal("Valid solution rejected:", er)
+	}
+
+	// corrupted signature
+	bad := append([]byte{}, sol...)
+	bad[10] ^= 0x01
+	cb := signetCoinbase(signetPush(bad))
+	merkle, _ := btc.CalcMerkle([][32]byte{cb.Hash.Hash, bl.Txs[1].Hash.Hash})
+	if er := signetCheck(challenge, signetBlock(t, signetHeader(merkle), cb, bl.Txs[1])); er == nil {
+		t.Error("Corrupted solution accepted")
+	}
+
+	// a different block time is not covered by the signature
+	hdr2 := append([]byte{}, hdr...)
+	hdr2[68]++
+	if er := signetCheck(challenge, signetBlock(t, hdr2, bl.Txs...)); er == nil {
+		t.Error("Solution of another header accepted")
+	}
+
+	// extra data after the solution
+	cb = signetCoinbase(signetPush(append(append([]byte{}, sol...), 0x00)))
+	merkle, _ = btc.CalcMerkle([][32]byte{cb.Hash.Hash, bl.Txs[1].Hash.Hash})
+	if er := signetCheck(challenge, signetBlock(t, signetHeader(merkle), cb, bl.Txs[1])); er == nil {
+		t.Error("Solution with extra data accepted")
+	}
+
+	// missing solution
+	cb = signetCoinbase(nil)
+	merkle, _ = btc.CalcMerkle([][32]byte{cb.Hash.Hash, bl.Txs[1].Hash.Hash})
+	if er := signetCheck(challenge, signetBlock(t, signetHeader(merkle), cb, bl.Txs[1])); er == nil {
+		t.Error("Block without solution accepted")
+	}
+
+	// no witness commitment
+	cb = signetCoinbase(nil)
+	cb.TxOut = cb.TxOut[:1]
+	cb.SetHash(cb.Serialize())
+	merkle, _ = btc.CalcMerkle([][32]byte{cb.Hash.Hash, bl.Txs[1].Hash.Hash})
+	if er := signetCheck(challenge, signetBlock(t, signetHeader(merkle), cb, bl.Txs[1])); er == nil {
+		t.Error("Block without witness commitment accepted")
+	}
+}
+
+func TestSignetWitness(t *testing.T) {
+	priv := bytes.Repeat([]byte{0x09}, 32)
+	pub := btc.PublicFromPrivate(priv, true)
+	h160 := btc.Rimp160AfterSha256(pub)
+	challenge := append([]byte{0x00, 20}, h160[:]...) // P2WPKH
+	script_code := append(append([]byte{0x76, 0xa9, 20}, h160[:]...), 0x88, 0xac)
+
+	// solution pushed with OP_PUSHDATA1 (longer than 75 bytes)
+	bl, _, _ := signetSolvedBlock(t, challenge, func(spending *btc.Tx) ([]byte, [][]byte) {
+		return nil, [][]byte{signetSign(t, priv, spending.WitnessSigHash(script_code, 0, 0, btc.SIGHASH_ALL)), pub}
+	})
+	if er := signetCheck(challenge, bl); er != nil {
+		t.Fatal("Valid witness solution rejected:", er)
+	}
+	if er := signetCheck(SignetChallenge(), bl); er == nil {
+		t.Error("Solution accepted for another challenge")
+	}
+}
+
+func TestSignetNoSolution(t *testing.T) {
+	// With no solution present, the coinbase is taken as it is and the trivial challenge passes
+	for _, ext := range [][]byte{nil, signetHeaderPush(), {0x00, 0x4c, 0x00, 0x51}} {
+		cb := signetCoinbase(ext)
+		bl := signetBlock(t, signetHeader(cb.Hash.Hash[:]), cb)
+		if er := signetCheck([]byte{0x51}, bl); er != nil {
+			t.Errorf("OP_TRUE challenge with commitment %x rejected: %s", cb.TxOut[1].Pk_script, er.Error())
+		}
+	}
+}
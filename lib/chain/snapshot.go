@@ -0,0 +1,464 @@
+package chain
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+/*
+	UTXO snapshot file:
+		[8] - "GOCOUTXO"
+		[4] - version (LE)
+		[4] - number of block headers that follow (LE)
+		[80 * N] - headers of blocks 1 ... N
+		[...] - UTXO set at block N (see lib/utxo/snapshot.go)
+
+	The snapshot's hash (the one to be verified) is the hash of the UTXO set section.
+*/
+
+const (
+	SNAPSHOT_MAGIC = "GOCOUTXO"
+	SNAPSHOT_VERSION = 1
+
+	SNAPSHOT_BASE_FILE = "snapshot.base" // exists until the history below the snapshot gets validated
+	SNAPSHOT_UTXO_DIR = "snapshot/" // UTXO set rebuilt by the background validation
+
+	BACKFILL_MAX_PENDING = 1000 // max number of blocks waiting for their parents
+)
+
+
+// WriteSnapshot stores the current UTXO set, along with the headers of the main chain, in the given file.
+// Returns the hash of the UTXO set and the number of its records.
+func (ch *Chain) WriteSnapshot(fn string) (hash *btc.Uint256, cnt uint64, e error) {
+	last := ch.LastBlock()
+	if !bytes.Equal(ch.Unspent.LastBlockHash, last.BlockHash.Hash[:]) {
+		e = errors.New("WriteSnapshot: UTXO set does not match the last block")
+		return
+	}
+
+	hdrs := make([][80]byte, last.Height)
+	for n := last; n.Height > 0; n = n.Parent {
+		hdrs[n.Height-1] = n.BlockHeader
+	}
+
+	f, e := os.Create(fn + ".tmp")
+	if e != nil {
+		return
+	}
+	wr := bufio.NewWriterSize(f, 0x100000)
+	wr.Write([]byte(SNAPSHOT_MAGIC))
+	binary.Write(wr, binary.LittleEndian, uint32(SNAPSHOT_VERSION))
+	binary.Write(wr, binary.LittleEndian, uint32(len(hdrs)))
+	for i := range hdrs {
+		wr.Write(hdrs[i][:])
+	}
+
+	hash, cnt, e = ch.Unspent.WriteSnapshot(wr)
+	if e == nil {
+		e = wr.Flush()
+	}
+	f.Close()
+	if e == nil && ch.Unspent.LastBlockHeight != last.Height {
+		e = errors.New("WriteSnapshot: the chain has moved while writing")
+	}
+	if e != nil {
+		os.Remove(fn + ".tmp")
+		return
+	}
+	e = os.Rename(fn + ".tmp", fn)
+	return
+}
+
+
+// LoadSnapshot bootstraps an empty chain from the UTXO snapshot stored in the given file.
+// The UTXO set's hash must match the expected one. Blocks below the snapshot are
+// not available, until they get downloaded and verified in the background (see Backfill).
+func (ch *Chain) LoadSnapshot(fn string, expected *btc.Uint256) (e error) {
+	var magic [8]byte
+	var ver, cnt uint32
+	var nodes []*BlockTreeNode
+
+	if expected == nil {
+		return errors.New("LoadSnapshot: expected hash not specified")
+	}
+	if ch.LastBlock() != ch.BlockTreeRoot || len(ch.BlockTreeRoot.Childs) != 0 || len(ch.Unspent.HashMap) != 0 {
+		return errors.New("LoadSnapshot: the chain is not empty")
+	}
+	if ch.TxIdx != nil || ch.AddrIdx != nil || ch.FilterIdx != nil {
+		return errors.New("LoadSnapshot: indexes must be built from the genesis block - disable them")
+	}
+
+	f, e := os.Open(fn)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	rd := bufio.NewReaderSize(f, 0x100000)
+
+	if e = btc.ReadAll(rd, magic[:]); e != nil {
+		return
+	}
+	if string(magic[:]) != SNAPSHOT_MAGIC {
+		return errors.New("LoadSnapshot: not a snapshot file")
+	}
+	binary.Read(rd, binary.LittleEndian, &ver)
+	if e = binary.Read(rd, binary.LittleEndian, &cnt); e != nil {
+		return
+	}
+	if ver != SNAPSHOT_VERSION || cnt == 0 {
+		return errors.New("LoadSnapshot: unsupported snapshot version / empty chain")
+	}
+
+	defer func() {
+		if e != nil && len(nodes) > 0 {
+			// remove the headers we have accepted
+			ch.BlockIndexAccess.Lock()
+			for _, n := range nodes {
+				delete(ch.BlockIndex, n.BlockHash.BIdx())
+			}
+			ch.BlockTreeRoot.delChild(nodes[0])
+			ch.BlockIndexAccess.Unlock()
+		}
+	}()
+
+	nodes = make([]*BlockTreeNode, 0, cnt)
+	for i := uint32(0); i < cnt; i++ {
+		hdr := make([]byte, 80)
+		if e = btc.ReadAll(rd, hdr); e != nil {
+			return
+		}
+		bl, _ := btc.NewBlock(hdr)
+		if len(nodes) > 0 && !bytes.Equal(bl.ParentHash(), nodes[len(nodes)-1].BlockHash.Hash[:]) {
+			e = errors.New(fmt.Sprint("LoadSnapshot: header ", i+1, " does not connect"))
+			return
+		}
+		ch.BlockIndexAccess.Lock()
+		if e, _, _ = ch.PreCheckBlock(bl); e == nil {
+			nodes = append(nodes, ch.AcceptHeader(bl))
+		}
+		ch.BlockIndexAccess.Unlock()
+		if e != nil {
+			return
+		}
+	}
+	base := nodes[len(nodes)-1]
+
+	// UTXO section must be at the last header
+	var hdr []byte
+	if hdr, e = rd.Peek(36); e != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(hdr[:4]) != base.Height || !bytes.Equal(hdr[4:36], base.BlockHash.Hash[:]) {
+		return errors.New("LoadSnapshot: UTXO set does not match the headers")
+	}
+
+	if _, e = ch.Unspent.LoadSnapshot(rd, expected); e != nil {
+		return
+	}
+
+	for _, n := range nodes {
+		ch.Blocks.BlockAddPurged(n.Height, n.BlockHeader[:])
+	}
+	ch.SetLast(base)
+	ch.Unspent.Save()
+	ch.Unspent.HurryUp()
+
+	ioutil.WriteFile(ch.Blocks.dirname + SNAPSHOT_BASE_FILE, append(base.BlockHash.Hash[:], expected.Hash[:]...), 0600)
+	ch.Backfill = ch.newBackfill(base, expected)
+	return
+}
+
+
+// Backfill downloads and verifies the blocks below the UTXO snapshot the chain was started from.
+// It rebuilds the UTXO set from the genesis block and, when it reaches the snapshot's
+// base block, it checks the UTXO set's hash against the snapshot's one.
+// AddBlock and ProcessStored must be called from the same thread.
+type Backfill struct {
+	Base *BlockTreeNode
+	Hash *btc.Uint256 // expected hash of the UTXO set at the base block
+
+	ch *Chain
+	bg *Chain // only keeps the UTXO set for the background verification
+	nodes []*BlockTreeNode // main chain nodes, by height
+
+	sync.Mutex // protects the fields below
+	height uint32 // last verified block
+	pending map[uint32] *btc.Block // blocks waiting for their parent
+	done bool
+	err error
+}
+
+
+func (ch *Chain) newBackfill(base *BlockTreeNode, hash *btc.Uint256) (bf *Backfill) {
+	bf = &Backfill{Base:base, Hash:hash, ch:ch}
+	bf.nodes = make([]*BlockTreeNode, base.Height+1)
+	for n := base; n != nil; n = n.Parent {
+		bf.nodes[n.Height] = n
+	}
+	bf.pending = make(map[uint32] *btc.Block)
+
+	dir := ch.Blocks.dirname + SNAPSHOT_UTXO_DIR
+	_, er := os.Stat(dir + "UTXO.db")
+	bf.bg = new(Chain)
+	bf.bg.Genesis = ch.Genesis
+	bf.bg.Consensus = ch.Consensus
+	bf.bg.Unspent = utxo.NewUnspentDb(&utxo.NewUnspentOpts{Dir:dir, Rescan:er != nil,
+		VolatimeMode:ch.CB.UTXOVolatileMode, AbortNow:&AbortNow})
+	bf.bg.Unspent.DoNotWriteUndoFiles = true // it is never going to be undone
+	bf.height = bf.bg.Unspent.LastBlockHeight
+	if bf.height >= base.Height {
+		// we must have been closed before finishing it
+		if bf.err = bf.check(); bf.err == nil {
+			bf.done = true
+		} else {
+			println("Backfill:", bf.err.Error())
+		}
+	}
+	return
+}
+
+
+// Called when opening the chain
+func (ch *Chain) loadBackfill() {
+	d, _ := ioutil.ReadFile(ch.Blocks.dirname + SNAPSHOT_BASE_FILE)
+	if len(d) != 64 {
+		return
+	}
+	base, ok := ch.BlockIndex[btc.NewUint256(d[:32]).BIdx()]
+	if !ok {
+		println("loadBackfill: snapshot's base block", btc.NewUint256(d[:32]).String(), "not found")
+		return
+	}
+	ch.Backfill = ch.newBackfill(base, btc.NewUint256(d[32:]))
+}
+
+
+// SnapshotPending returns true if the chain has been started from a UTXO
+// snapshot and the blocks below it have not been verified yet.
+func (ch *Chain) SnapshotPending() bool {
+	return ch.Backfill != nil && !ch.Backfill.Done()
+}
+
+
+// Height of the last verified block below the snapshot.
+func (bf *Backfill) Height() uint32 {
+	bf.Mutex.Lock()
+	defer bf.Mutex.Unlock()
+	return bf.height
+}
+
+
+// Done returns true if the history below the snapshot has been verified.
+func (bf *Backfill) Done() bool {
+	bf.Mutex.Lock()
+	defer bf.Mutex.Unlock()
+	return bf.done
+}
+
+
+// Error returns non nil if the background verification has failed.
+func (bf *Backfill) Error() error {
+	bf.Mutex.Lock()
+	defer bf.Mutex.Unlock()
+	return bf.err
+}
+
+
+// Wanted returns up to max nodes of the blocks that need to be downloaded next.
+func (bf *Backfill) Wanted(max int) (res []*BlockTreeNode) {
+	bf.Mutex.Lock()
+	defer bf.Mutex.Unlock()
+	if bf.done || bf.err != nil {
+		return
+	}
+	for h := bf.height+1; h <= bf.Base.Height && len(res) < max; h++ {
+		if _, ok := bf.pending[h]; !ok && bf.nodes[h].BlockSize == 0 {
+			res = append(res, bf.nodes[h])
+		}
+	}
+	return
+}
+
+
+// Returns the node of the given block, if it is the one we are waiting for.
+func (bf *Backfill) wanted(hash *btc.Uint256) *BlockTreeNode {
+	bf.ch.BlockIndexAccess.Lock()
+	n, ok := bf.ch.BlockIndex[hash.BIdx()]
+	bf.ch.BlockIndexAccess.Unlock()
+	if !ok || n.Height > bf.Base.Height || bf.nodes[n.Height] != n || n.BlockSize != 0 {
+		return nil
+	}
+	bf.Mutex.Lock()
+	defer bf.Mutex.Unlock()
+	if _, pend := bf.pending[n.Height]; pend || bf.done || bf.err != nil || n.Height <= bf.height {
+		return nil
+	}
+	return n
+}
+
+
+// AddBlock takes a downloaded block from below the snapshot and verifies
+// it, along with all the pending ones that can follow it.
+// Returns an error if the block is invalid (it does not stop the backfill).
+func (bf *Backfill) AddBlock(bl *btc.Block) (e error) {
+	n := bf.wanted(bl.Hash)
+	if n == nil {
+		return
+	}
+	bl.Height = n.Height
+	bl.MedianPastTime = n.Parent.GetMedianTimePast()
+	bl.Trusted = n.Trusted
+	if e = bf.ch.PostCheckBlock(bl); e != nil {
+		return
+	}
+
+	bf.Mutex.Lock()
+	if len(bf.pending) < BACKFILL_MAX_PENDING || n.Height == bf.height+1 {
+		bf.pending[n.Height] = bl
+	}
+	bf.Mutex.Unlock()
+
+	bf.process()
+	return
+}
+
+
+// ProcessStored verifies up to max blocks that had already been stored in the database
+// (i.e. before the client was restarted). Returns the number of blocks processed.
+func (bf *Backfill) ProcessStored(max int) (cnt int) {
+	for ; cnt < max; cnt++ {
+		bf.Mutex.Lock()
+		h := bf.height + 1
+		_, pend := bf.pending[h]
+		stop := bf.done || bf.err != nil || pend || h > bf.Base.Height || bf.nodes[h].BlockSize == 0
+		bf.Mutex.Unlock()
+		if stop {
+			break
+		}
+
+		raw, _, e := bf.ch.Blocks.BlockGet(bf.nodes[h].BlockHash)
+		if e == nil {
+			bl, _ := btc.NewBlock(raw)
+			if e = bl.BuildTxList(); e == nil {
+				bl.Height = h
+				bl.Trusted = true // it had been verified before it was stored
+				bf.Mutex.Lock()
+				bf.pending[h] = bl
+				bf.Mutex.Unlock()
+				bf.process()
+				continue
+			}
+		}
+		bf.Mutex.Lock()
+		bf.err = e
+		bf.Mutex.Unlock()
+		break
+	}
+	return
+}
+
+
+// Verifies all the blocks that are ready for it
+func (bf *Backfill) process() {
+	for !AbortNow {
+		bf.Mutex.Lock()
+		h := bf.height + 1
+		bl, ok := bf.pending[h]
+		delete(bf.pending, h)
+		ok = ok && !bf.done && bf.err == nil
+		bf.Mutex.Unlock()
+		if !ok {
+			return
+		}
+		e := bf.commit(bf.nodes[h], bl)
+		bf.Mutex.Lock()
+		if e != nil {
+			bf.err = e
+			println("Backfill:", e.Error())
+		} else {
+			bf.height = h
+			bf.done = h == bf.Base.Height
+		}
+		bf.Mutex.Unlock()
+	}
+}
+
+
+// Applies the next block to the background UTXO set
+func (bf *Backfill) commit(n *BlockTreeNode, bl *btc.Block) (e error) {
+	changes, sigopscost, e := bf.bg.ProcessBlockTransactions(bl, n.Height, ^uint32(0))
+	if e != nil {
+		return errors.New(fmt.Sprint("Block ", n.Height, " ", n.BlockHash.String(), ": ", e.Error()))
+	}
+	bf.bg.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+
+	bl.Trusted = true
+	bf.ch.Blocks.BlockAdd(n.Height, bl)
+	n.SigopsCost = sigopscost
+	n.TxCount = uint32(bl.TxCount)
+	n.BlockSize = uint32(len(bl.Raw))
+
+	if n == bf.Base {
+		e = bf.check()
+	}
+	return
+}
+
+
+// Compares the background UTXO set with the snapshot and, if they match, removes the former.
+func (bf *Backfill) check() (e error) {
+	if bf.bg.Unspent.LastBlockHeight != bf.Base.Height {
+		return errors.New(fmt.Sprint("Background UTXO set is at block ", bf.bg.Unspent.LastBlockHeight,
+			" - expected ", bf.Base.Height))
+	}
+	hash, _, _ := bf.bg.Unspent.WriteSnapshot(ioutil.Discard)
+	if !hash.Equal(bf.Hash) {
+		return errors.New("UTXO set at block " + bf.Base.BlockHash.String() + " has hash " + hash.String() +
+			" - expected " + bf.Hash.String())
+	}
+	bf.bg.Unspent.AbortWriting()
+	bf.bg.Unspent.DirtyDB.Clr()
+	bf.bg.Unspent.Close()
+	bf.bg.Unspent.HashMap = nil
+	os.RemoveAll(bf.ch.Blocks.dirname + SNAPSHOT_UTXO_DIR)
+	os.Remove(bf.ch.Blocks.dirname + SNAPSHOT_BASE_FILE)
+	fmt.Println("UTXO snapshot at block", bf.Base.Height, "has been verified")
+	return
+}
+
+
+// Call it when the client is idle, to save the background UTXO set.
+func (bf *Backfill) Idle() {
+	if !bf.Done() {
+		bf.bg.Unspent.Idle()
+	}
+}
+
+
+// Stats returns the background verification status in one line.
+func (bf *Backfill) Stats() (s string) {
+	bf.Mutex.Lock()
+	defer bf.Mutex.Unlock()
+	s = fmt.Sprintf("SNAPSHOT: base:%d  verified:%d  pending:%d", bf.Base.Height, bf.height, len(bf.pending))
+	if bf.done {
+		s += "  DONE"
+	} else if bf.err != nil {
+		s += "  ERROR: " + bf.err.Error()
+	}
+	return s + "\n"
+}
+
+
+func (bf *Backfill) close() {
+	if !bf.Done() {
+		bf.bg.Unspent.Close()
+	}
+}
@@ -0,0 +1,310 @@
+package chain
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+)
+
+// Optional transaction index: txid -> (block height, offset and length of the tx within the block)
+// Key of a record is the first 8 bytes of the txid. In case of collisions the record has more than one entry.
+// The entries are always verified against the actual block's data, so we do not need to store the entire txid.
+
+const txidx_rec_len = 12
+
+type TxIndex struct {
+	sync.Mutex
+	db *qdb.DB
+	dir string
+
+	Height uint32 // all the main chain blocks up to this height have been indexed
+	hash [32]byte // hash of the block at Height
+	saved uint32 // value of Height stored on disk
+
+	Rebuilding bool
+}
+
+
+func txidx_key(txid []byte) qdb.KeyType {
+	return qdb.KeyType(binary.LittleEndian.Uint64(txid[:8]))
+}
+
+
+// Opens (or creates) the tx index in the given folder
+func NewTxIndex(dir string) (idx *TxIndex) {
+	idx = &TxIndex{dir:dir}
+	idx.open()
+	return
+}
+
+func (idx *TxIndex) open() {
+	var e error
+	if idx.db, e = qdb.NewDB(idx.dir, false); e != nil {
+		panic("TxIndex: " + e.Error())
+	}
+	if d, _ := ioutil.ReadFile(idx.dir + "height"); len(d) == 36 {
+		idx.Height = binary.LittleEndian.Uint32(d[:4])
+		copy(idx.hash[:], d[4:])
+		idx.saved = idx.Height
+	}
+}
+
+// Removes all the records
+func (idx *TxIndex) reset(genesis *btc.Uint256) {
+	idx.db.Close()
+	os.RemoveAll(idx.dir)
+	idx.open()
+	idx.Height = 0
+	idx.hash = genesis.Hash
+	idx.saved = 0xffffffff
+}
+
+// Stores the current height on disk, after all the records are written
+func (idx *TxIndex) sync() {
+	if idx.saved == idx.Height {
+		return
+	}
+	idx.db.Sync()
+	idx.db.Mutex.Lock() // wait for the background sync to finish
+	idx.db.Mutex.Unlock()
+	d := make([]byte, 36)
+	binary.LittleEndian.PutUint32(d[:4], idx.Height)
+	copy(d[4:], idx.hash[:])
+	ioutil.WriteFile(idx.dir + "height", d, 0600)
+	idx.saved = idx.Height
+}
+
+// Stores the current height on disk (unless the index is being rebuilt)
+func (idx *TxIndex) Idle() {
+	idx.Lock()
+	if idx.db != nil && !idx.Rebuilding {
+		idx.sync()
+	}
+	idx.Unlock()
+}
+
+func (idx *TxIndex) Close() {
+	idx.Lock()
+	idx.sync()
+	idx.db.Close()
+	idx.db = nil // stops RebuildTxIndex()
+	idx.Unlock()
+}
+
+func (idx *TxIndex) Stats() (s string) {
+	idx.Lock()
+	if idx.db == nil {
+		idx.Unlock()
+		return
+	}
+	s = fmt.Sprintf("TXINDEX: Height:%d  Records:%d  Rebuilding:%t\n", idx.Height, idx.db.Count(), idx.Rebuilding)
+	idx.Unlock()
+	return
+}
+
+
+// Adds all the transactions of the block. Make sure idx is locked.
+func (idx *TxIndex) addBlock(bl *btc.Block, height uint32) {
+	offs := uint32(bl.TxOffset)
+	for _, tx := range bl.Txs {
+		rec := make([]byte, txidx_rec_len)
+		binary.LittleEndian.PutUint32(rec[0:4], height)
+		binary.LittleEndian.PutUint32(rec[4:8], offs)
+		binary.LittleEndian.PutUint32(rec[8:12], uint32(len(tx.Raw)))
+		offs += uint32(len(tx.Raw))
+
+		k := txidx_key(tx.Hash.Hash[:])
+		v := idx.db.GetNoCache(k)
+		var have bool
+		for i := 0; i+txidx_rec_len <= len(v); i += txidx_rec_len {
+			if binary.LittleEndian.Uint64(v[i:i+8]) == binary.LittleEndian.Uint64(rec[:8]) {
+				have = true // the index was not properly closed
+				break
+			}
+		}
+		if !have {
+			idx.db.PutExt(k, append(append([]byte{}, v...), rec...), qdb.NO_CACHE)
+		}
+	}
+	idx.Height = height
+	idx.hash = bl.Hash.Hash
+}
+
+// Removes all the transactions of the block. Make sure idx is locked.
+func (idx *TxIndex) delBlock(bl *btc.Block, height uint32) {
+	for _, tx := range bl.Txs {
+		k := txidx_key(tx.Hash.Hash[:])
+		v := idx.db.GetNoCache(k)
+		var nv []byte
+		for i := 0; i+txidx_rec_len <= len(v); i += txidx_rec_len {
+			if binary.LittleEndian.Uint32(v[i:i+4]) != height {
+				nv = append(nv, v[i:i+txidx_rec_len]...)
+			}
+		}
+		if len(nv) == 0 {
+			idx.db.Del(k)
+		} else if len(nv) != len(v) {
+			idx.db.PutExt(k, nv, qdb.NO_CACHE)
+		}
+	}
+	copy(idx.hash[:], bl.ParentHash())
+	idx.Height = height - 1
+}
+
+
+// Called after the block has been applied to the UTXO set
+func (ch *Chain) txIndexAdd(bl *btc.Block, height uint32) {
+	if ch.TxIdx == nil {
+		return
+	}
+	ch.TxIdx.Lock()
+	// only add the next block - otherwise RebuildTxIndex() will get to it
+	if ch.TxIdx.db != nil && ch.TxIdx.Height+1 == height && bytes.Equal(ch.TxIdx.hash[:], bl.ParentHash()) {
+		ch.TxIdx.addBlock(bl, height)
+	}
+	ch.TxIdx.Unlock()
+}
+
+// Called after the block has been removed from the UTXO set
+func (ch *Chain) txIndexDel(bl *btc.Block, height uint32) {
+	if ch.TxIdx == nil {
+		return
+	}
+	ch.TxIdx.Lock()
+	if ch.TxIdx.db != nil && ch.TxIdx.Height == height && ch.TxIdx.hash == bl.Hash.Hash {
+		ch.TxIdx.delBlock(bl, height)
+	}
+	ch.TxIdx.Unlock()
+}
+
+
+// Makes sure that the index matches the current chain - call it after loading the block index
+func (ch *Chain) txIndexCheck() {
+	idx := ch.TxIdx
+	idx.Lock()
+	if idx.Height == 0 {
+		idx.hash = ch.Genesis.Hash
+	} else if n := ch.BlockAtHeight(idx.Height); n == nil || n.Height != idx.Height || n.BlockHash.Hash != idx.hash {
+		fmt.Println("TxIndex does not match the chain - it will be rebuilt")
+		idx.reset(ch.Genesis)
+	}
+	idx.Unlock()
+}
+
+
+// Indexes all the main chain blocks that have not been indexed yet.
+// It can be running in the background, while new blocks are being committed.
+func (ch *Chain) RebuildTxIndex() {
+	idx := ch.TxIdx
+	if idx == nil {
+		return
+	}
+	idx.Lock()
+	if idx.Rebuilding {
+		idx.Unlock()
+		return
+	}
+	idx.Rebuilding = true
+	idx.db.NoSync()
+	idx.Unlock()
+
+	for {
+		idx.Lock() // the lock is held at every exit from the loop
+		if AbortNow || idx.db == nil {
+			break
+		}
+		n := ch.BlockAtHeight(idx.Height+1)
+		if n == nil || n.Height != idx.Height+1 {
+			break // we are at the top
+		}
+		if n.Parent.BlockHash.Hash != idx.hash {
+			fmt.Println("TxIndex does not match the chain - it will be rebuilt")
+			idx.reset(ch.Genesis)
+			idx.db.NoSync()
+			idx.Unlock()
+			continue
+		}
+		crec, _, er := ch.Blocks.BlockGetInternal(n.BlockHash, true)
+		if er != nil {
+			fmt.Println("RebuildTxIndex:", n.Height, er.Error())
+			break
+		}
+		bl, er := btc.NewBlock(crec.Data)
+		if er == nil {
+			er = bl.BuildTxList()
+		}
+		if er != nil {
+			fmt.Println("RebuildTxIndex:", n.Height, er.Error())
+			break
+		}
+		idx.addBlock(bl, n.Height)
+		if (n.Height % 10000) == 0 {
+			idx.sync()
+			idx.db.NoSync()
+		}
+		idx.Unlock()
+	}
+	idx.Rebuilding = false
+	if idx.db != nil {
+		idx.sync()
+	}
+	idx.Unlock()
+}
+
+// Removes all the records and rebuilds the index from the scratch
+func (ch *Chain) ResetTxIndex() {
+	if ch.TxIdx == nil {
+		return
+	}
+	ch.TxIdx.Lock()
+	ch.TxIdx.reset(ch.Genesis)
+	ch.TxIdx.Unlock()
+	go ch.RebuildTxIndex()
+}
+
+
+// Looks up a confirmed transaction in the tx index.
+// Returns the raw transaction (with witness data) and the block it was mined in.
+func (ch *Chain) FindTx(txid *btc.Uint256) (raw []byte, n *BlockTreeNode, er error) {
+	if ch.TxIdx == nil {
+		er = errors.New("FindTx: txindex not enabled")
+		return
+	}
+	var v []byte
+	ch.TxIdx.Lock()
+	if ch.TxIdx.db != nil {
+		v = ch.TxIdx.db.GetNoCache(txidx_key(txid.Hash[:]))
+	}
+	ch.TxIdx.Unlock()
+	for i := 0; i+txidx_rec_len <= len(v); i += txidx_rec_len {
+		height := binary.LittleEndian.Uint32(v[i:i+4])
+		offs := binary.LittleEndian.Uint32(v[i+4:i+8])
+		le := binary.LittleEndian.Uint32(v[i+8:i+12])
+
+		if n = ch.BlockAtHeight(height); n == nil || n.Height != height {
+			continue
+		}
+		bd, _, e := ch.Blocks.BlockGet(n.BlockHash)
+		if e != nil || int(offs+le) > len(bd) {
+			continue
+		}
+		tx, l := btc.NewTx(bd[offs:offs+le])
+		if tx == nil || l != int(le) {
+			continue
+		}
+		tx.SetHash(bd[offs:offs+le])
+		if tx.Hash.Equal(txid) {
+			raw = tx.Raw
+			return
+		}
+	}
+	n = nil
+	er = errors.New("FindTx: transaction not found in the index")
+	return
+}
@@ -0,0 +1,71 @@
+package descriptor
+
+import (
+	"strings"
+	"errors"
+)
+
+// Descriptor checksum - see BIP380
+
+const (
+	input_charset = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	checksum_charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+func polymod(c uint64, val int) uint64 {
+	c0 := c >> 35
+	c = ((c & 0x7ffffffff) << 5) ^ uint64(val)
+	if (c0 & 1) != 0 {
+		c ^= 0xf5dee51989
+	}
+	if (c0 & 2) != 0 {
+		c ^= 0xa9fdca3312
+	}
+	if (c0 & 4) != 0 {
+		c ^= 0x1bab10e32d
+	}
+	if (c0 & 8) != 0 {
+		c ^= 0x3706b1677a
+	}
+	if (c0 & 16) != 0 {
+		c ^= 0x644d626ffd
+	}
+	return c
+}
+
+// Returns 8 characters checksum of the given descriptor (without the '#' part)
+func Checksum(s string) (string, error) {
+	var c uint64 = 1
+	var cls, clscount int
+	for i := range s {
+		pos := strings.IndexByte(input_charset, s[i])
+		if pos < 0 {
+			return "", errors.New("Descriptor: Invalid character in descriptor")
+		}
+		c = polymod(c, pos & 31)
+		cls = cls * 3 + (pos >> 5)
+		if clscount++; clscount == 3 {
+			c = polymod(c, cls)
+			cls, clscount = 0, 0
+		}
+	}
+	if clscount > 0 {
+		c = polymod(c, cls)
+	}
+	for j := 0; j < 8; j++ {
+		c = polymod(c, 0)
+	}
+	c ^= 1
+
+	res := make([]byte, 8)
+	for j := range res {
+		res[j] = checksum_charset[(c >> (5 * uint(7 - j))) & 31]
+	}
+	return string(res), nil
+}
+
+// Appends the checksum to the descriptor string
+func AddChecksum(s string) string {
+	cs, _ := Checksum(s)
+	return s + "#" + cs
+}
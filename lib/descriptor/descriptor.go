@@ -0,0 +1,483 @@
+package descriptor
+
+import (
+	"fmt"
+	"sort"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Output Script Descriptors - BIP380, BIP381 (pk, pkh, sh), BIP382 (wpkh, wsh), BIP383 (multi, sortedmulti),
+// BIP385 (addr, raw) and BIP386 (tr - key path only)
+
+// Context in which the expression is being parsed
+const (
+	CTX_TOP = iota
+	CTX_SH
+	CTX_WSH
+	CTX_TR
+)
+
+// Key expression, either a fixed public key or an extended key with a derivation path
+type Key struct {
+	HasOrigin bool
+	Fingerprint uint32
+	OriginPath []uint32
+
+	Pubkey []byte // fixed public key (32 bytes x-only is allowed inside tr)
+
+	XKey *btc.HDWallet // extended key (xpub or xprv)
+	Path []uint32 // derivation path following the extended key (without the range element)
+	Range byte // 0 if not ranged, otherwise '*' for /* and '\'' for /*'
+
+	xkey_str string
+	base *btc.HDWallet // XKey derived at Path (cached)
+}
+
+type Descriptor struct {
+	Func string // pk, pkh, wpkh, sh, wsh, multi, sortedmulti, tr, addr or raw
+	Keys []*Key
+	Threshold int // for multi and sortedmulti
+	Sub *Descriptor // for sh and wsh
+	Data []byte // output script of addr or raw
+
+	addr string
+}
+
+// Scripts of a descriptor expanded at the given index
+type Output struct {
+	Script []byte // the output script (scriptPubKey)
+	RedeemScript []byte // for sh(...)
+	WitnessScript []byte // for wsh(...)
+	Pubkeys [][]byte
+}
+
+
+func path_string(path []uint32) string {
+	return btc.DerivationPathString(path)[1:]
+}
+
+func parse_path_element(el string) (uint32, error) {
+	var hardened uint32
+	if strings.HasSuffix(el, "'") || strings.HasSuffix(el, "h") {
+		hardened = btc.HardenedKeyStart
+		el = el[:len(el)-1]
+	}
+	v, er := strconv.ParseUint(el, 10, 32)
+	if er != nil || v >= uint64(btc.HardenedKeyStart) {
+		return 0, errors.New("Descriptor: Invalid path element " + el)
+	}
+	return uint32(v) | hardened, nil
+}
+
+
+func parse_key(s string, ctx int) (k *Key, e error) {
+	k = new(Key)
+	if strings.HasPrefix(s, "[") {
+		i := strings.IndexByte(s, ']')
+		if i < 0 {
+			return nil, errors.New("Descriptor: Key origin not closed")
+		}
+		els := strings.Split(s[1:i], "/")
+		fp, er := hex.DecodeString(els[0])
+		if er != nil || len(fp) != 4 {
+			return nil, errors.New("Descriptor: Invalid key origin fingerprint")
+		}
+		k.HasOrigin = true
+		k.Fingerprint = binary.BigEndian.Uint32(fp)
+		for _, el := range els[1:] {
+			var v uint32
+			if v, e = parse_path_element(el); e != nil {
+				return nil, e
+			}
+			k.OriginPath = append(k.OriginPath, v)
+		}
+		s = s[i+1:]
+	}
+
+	els := strings.Split(s, "/")
+	if d, er := hex.DecodeString(els[0]); er == nil {
+		if len(els) > 1 {
+			return nil, errors.New("Descriptor: Derivation path after a fixed public key")
+		}
+		switch {
+			case len(d) == 33 && (d[0] == 2 || d[0] == 3):
+			case len(d) == 65 && d[0] == 4:
+				if ctx == CTX_WSH || ctx == CTX_TR {
+					return nil, errors.New("Descriptor: Uncompressed public key not allowed here")
+				}
+			case len(d) == 32 && ctx == CTX_TR:
+			default:
+				return nil, errors.New("Descriptor: Invalid public key " + els[0])
+		}
+		k.Pubkey = d
+		return
+	}
+
+	if k.XKey, e = btc.StringWallet(els[0]); e != nil {
+		return nil, errors.New("Descriptor: Invalid key " + els[0])
+	}
+	k.xkey_str = els[0]
+	for i, el := range els[1:] {
+		if el == "*" || el == "*'" || el == "*h" {
+			if i != len(els) - 2 {
+				return nil, errors.New("Descriptor: Range must be the last path element")
+			}
+			k.Range = el[len(el)-1]
+			if k.Range == 'h' {
+				k.Range = '\''
+			}
+			break
+		}
+		var v uint32
+		if v, e = parse_path_element(el); e != nil {
+			return nil, e
+		}
+		k.Path = append(k.Path, v)
+	}
+	if k.XKey.Prefix == btc.Public || k.XKey.Prefix == btc.TestPublic {
+		hardened := k.Range == '\''
+		for _, v := range k.Path {
+			hardened = hardened || v >= btc.HardenedKeyStart
+		}
+		if hardened {
+			return nil, errors.New("Descriptor: Hardened derivation from a public key")
+		}
+	}
+	return
+}
+
+
+// Returns the public key at the given index (index is ignored for non-ranged keys)
+func (k *Key) PubkeyAt(idx uint32) ([]byte, error) {
+	if k.XKey == nil {
+		return k.Pubkey, nil
+	}
+	if k.base == nil {
+		w, e := k.XKey.Derive(k.Path)
+		if e != nil {
+			return nil, e
+		}
+		k.base = w
+	}
+	w := k.base
+	if k.Range != 0 {
+		if idx >= btc.HardenedKeyStart {
+			return nil, errors.New("Descriptor: Index out of range")
+		}
+		if k.Range == '\'' {
+			idx |= btc.HardenedKeyStart
+		}
+		var e error
+		if w, e = w.Derive([]uint32{idx}); e != nil {
+			return nil, e
+		}
+	}
+	return w.Pub().Key, nil
+}
+
+func (k *Key) String() (s string) {
+	if k.HasOrigin {
+		s = fmt.Sprintf("[%08x%s]", k.Fingerprint, path_string(k.OriginPath))
+	}
+	if k.XKey == nil {
+		return s + hex.EncodeToString(k.Pubkey)
+	}
+	s += k.xkey_str + path_string(k.Path)
+	if k.Range != 0 {
+		s += "/*"
+		if k.Range == '\'' {
+			s += "'"
+		}
+	}
+	return
+}
+
+
+// Splits arguments at the top level commas
+func split_args(s string) (res []string) {
+	var depth, last int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+			case '(', '[', '{':
+				depth++
+			case ')', ']', '}':
+				depth--
+			case ',':
+				if depth == 0 {
+					res = append(res, s[last:i])
+					last = i + 1
+				}
+		}
+	}
+	return append(res, s[last:])
+}
+
+
+func parse_expr(s string, ctx int) (d *Descriptor, e error) {
+	i := strings.IndexByte(s, '(')
+	if i <= 0 || !strings.HasSuffix(s, ")") {
+		return nil, errors.New("Descriptor: Syntax error in " + s)
+	}
+	d = &Descriptor{Func:s[:i]}
+	args := split_args(s[i+1:len(s)-1])
+
+	switch d.Func {
+		case "pk", "pkh", "wpkh", "tr":
+			if d.Func == "wpkh" && ctx != CTX_TOP && ctx != CTX_SH {
+				return nil, errors.New("Descriptor: wpkh not allowed here")
+			}
+			if d.Func == "tr" {
+				if ctx != CTX_TOP {
+					return nil, errors.New("Descriptor: tr allowed only at the top level")
+				}
+				if len(args) != 1 {
+					return nil, errors.New("Descriptor: tr script trees are not supported")
+				}
+				ctx = CTX_TR
+			}
+			if len(args) != 1 {
+				return nil, errors.New("Descriptor: " + d.Func + " expects one key")
+			}
+			kctx := ctx
+			if d.Func == "wpkh" {
+				kctx = CTX_WSH // compressed keys only
+			}
+			var k *Key
+			if k, e = parse_key(args[0], kctx); e != nil {
+				return nil, e
+			}
+			d.Keys = []*Key{k}
+
+		case "sh", "wsh":
+			if d.Func == "sh" && ctx != CTX_TOP || d.Func == "wsh" && ctx != CTX_TOP && ctx != CTX_SH {
+				return nil, errors.New("Descriptor: " + d.Func + " not allowed here")
+			}
+			if len(args) != 1 {
+				return nil, errors.New("Descriptor: " + d.Func + " expects one argument")
+			}
+			sctx := CTX_SH
+			if d.Func == "wsh" {
+				sctx = CTX_WSH
+			}
+			if d.Sub, e = parse_expr(args[0], sctx); e != nil {
+				return nil, e
+			}
+			if d.Sub.Func == "addr" || d.Sub.Func == "raw" {
+				return nil, errors.New("Descriptor: " + d.Sub.Func + " allowed only at the top level")
+			}
+
+		case "multi", "sortedmulti":
+			if ctx == CTX_TR {
+				return nil, errors.New("Descriptor: " + d.Func + " not allowed here")
+			}
+			if len(args) < 2 {
+				return nil, errors.New("Descriptor: " + d.Func + " expects threshold and keys")
+			}
+			if d.Threshold, e = strconv.Atoi(args[0]); e != nil || d.Threshold < 1 || d.Threshold > len(args) - 1 {
+				return nil, errors.New("Descriptor: Invalid multisig threshold " + args[0])
+			}
+			if len(args) - 1 > 16 {
+				return nil, errors.New("Descriptor: Too many keys in multisig")
+			}
+			for _, a := range args[1:] {
+				var k *Key
+				if k, e = parse_key(a, ctx); e != nil {
+					return nil, e
+				}
+				d.Keys = append(d.Keys, k)
+			}
+
+		case "addr":
+			if ctx != CTX_TOP {
+				return nil, errors.New("Descriptor: addr allowed only at the top level")
+			}
+			var a *btc.BtcAddr
+			if a, e = btc.NewAddrFromString(s[i+1:len(s)-1]); e != nil {
+				return nil, errors.New("Descriptor: " + e.Error())
+			}
+			d.addr = a.String()
+			d.Data = a.OutScript()
+
+		case "raw":
+			if ctx != CTX_TOP {
+				return nil, errors.New("Descriptor: raw allowed only at the top level")
+			}
+			if d.Data, e = hex.DecodeString(s[i+1:len(s)-1]); e != nil {
+				return nil, errors.New("Descriptor: Invalid hex data in raw")
+			}
+
+		default:
+			return nil, errors.New("Descriptor: Unsupported function " + d.Func)
+	}
+	return
+}
+
+
+// Parses the descriptor. Checksum (if present) gets verified.
+func Parse(s string) (d *Descriptor, e error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		var cs string
+		if cs, e = Checksum(s[:i]); e != nil {
+			return
+		}
+		if s[i+1:] != cs {
+			return nil, errors.New("Descriptor: Checksum mismatch")
+		}
+		s = s[:i]
+	} else if _, e = Checksum(s); e != nil {
+		return
+	}
+	return parse_expr(s, CTX_TOP)
+}
+
+
+// Returns true if the descriptor has a ranged key (i.e. expands to many scripts)
+func (d *Descriptor) IsRange() bool {
+	for _, k := range d.Keys {
+		if k.Range != 0 {
+			return true
+		}
+	}
+	return d.Sub != nil && d.Sub.IsRange()
+}
+
+
+// Returns derivation path of the first key at the given index (if its origin is known),
+// or the function name followed by the index
+func (d *Descriptor) Label(idx uint32) string {
+	for d.Sub != nil {
+		d = d.Sub
+	}
+	if len(d.Keys) > 0 && d.Keys[0].HasOrigin {
+		k := d.Keys[0]
+		path := append(append([]uint32{}, k.OriginPath...), k.Path...)
+		if k.Range == '*' {
+			path = append(path, idx)
+		} else if k.Range == '\'' {
+			path = append(path, idx|btc.HardenedKeyStart)
+		}
+		return btc.DerivationPathString(path)
+	}
+	if d.IsRange() {
+		return fmt.Sprint(d.Func, "/", idx)
+	}
+	return d.Func
+}
+
+
+func (d *Descriptor) str() (s string) {
+	s = d.Func + "("
+	switch d.Func {
+		case "sh", "wsh":
+			s += d.Sub.str()
+		case "multi", "sortedmulti":
+			s += fmt.Sprint(d.Threshold)
+			for _, k := range d.Keys {
+				s += "," + k.String()
+			}
+		case "addr":
+			s += d.addr
+		case "raw":
+			s += hex.EncodeToString(d.Data)
+		default:
+			s += d.Keys[0].String()
+	}
+	return s + ")"
+}
+
+// Returns the descriptor with its checksum
+func (d *Descriptor) String() string {
+	return AddChecksum(d.str())
+}
+
+
+func p2sh_script(scr []byte) []byte {
+	h := btc.Rimp160AfterSha256(scr)
+	return append(append([]byte{0xa9, 20}, h[:]...), 0x87)
+}
+
+// Returns the scripts at the given index (index is ignored for non-ranged descriptors)
+func (d *Descriptor) Expand(idx uint32) (o *Output, e error) {
+	o = new(Output)
+	for _, k := range d.Keys {
+		var pk []byte
+		if pk, e = k.PubkeyAt(idx); e != nil {
+			return nil, e
+		}
+		o.Pubkeys = append(o.Pubkeys, pk)
+	}
+
+	switch d.Func {
+		case "pk":
+			o.Script = append(append([]byte{byte(len(o.Pubkeys[0]))}, o.Pubkeys[0]...), 0xac)
+
+		case "pkh":
+			h := btc.Rimp160AfterSha256(o.Pubkeys[0])
+			o.Script = append(append([]byte{0x76, 0xa9, 20}, h[:]...), 0x88, 0xac)
+
+		case "wpkh":
+			h := btc.Rimp160AfterSha256(o.Pubkeys[0])
+			o.Script = append([]byte{0, 20}, h[:]...)
+
+		case "tr":
+			pk := o.Pubkeys[0]
+			if len(pk) == 33 {
+				pk = pk[1:]
+			}
+			q, _ := btc.TaprootOutputKey(pk, nil)
+			if q == nil {
+				return nil, errors.New("Descriptor: Invalid taproot internal key")
+			}
+			o.Script = append([]byte{0x51, 32}, q...)
+
+		case "multi", "sortedmulti":
+			ms := btc.NewMultiSig(uint(d.Threshold))
+			ms.PublicKeys = o.Pubkeys
+			if d.Func == "sortedmulti" {
+				ms.PublicKeys = make([][]byte, len(o.Pubkeys))
+				copy(ms.PublicKeys, o.Pubkeys)
+				sort.Slice(ms.PublicKeys, func(a, b int) bool {
+					return bytes.Compare(ms.PublicKeys[a], ms.PublicKeys[b]) < 0
+				})
+			}
+			o.Script = ms.P2SH()
+
+		case "sh", "wsh":
+			var sub *Output
+			if sub, e = d.Sub.Expand(idx); e != nil {
+				return nil, e
+			}
+			o.Pubkeys = sub.Pubkeys
+			if d.Func == "sh" {
+				o.RedeemScript = sub.Script
+				o.WitnessScript = sub.WitnessScript
+				o.Script = p2sh_script(sub.Script)
+			} else {
+				o.WitnessScript = sub.Script
+				h := sha256.Sum256(sub.Script)
+				o.Script = append([]byte{0, 32}, h[:]...)
+			}
+
+		case "addr", "raw":
+			o.Script = d.Data
+	}
+	return
+}
+
+
+// Returns the address at the given index, or nil if the script has no address
+func (d *Descriptor) Address(idx uint32, testnet bool) (*btc.BtcAddr, error) {
+	o, e := d.Expand(idx)
+	if e != nil {
+		return nil, e
+	}
+	return btc.NewAddrFromPkScript(o.Script, testnet), nil
+}
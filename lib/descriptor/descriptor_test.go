@@ -0,0 +1,164 @@
+package descriptor
+
+import (
+	"testing"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestChecksum(t *testing.T) {
+	if s := AddChecksum("raw(deadbeef)"); s != "raw(deadbeef)#89f8spxm" {
+		t.Error("Bad checksum", s)
+	}
+	if _, e := Parse("raw(deadbeef)#89f8spxm"); e != nil {
+		t.Error(e)
+	}
+	if _, e := Parse("raw(deadbeef)#89f8spxn"); e == nil {
+		t.Error("Bad checksum accepted")
+	}
+}
+
+func TestScripts(t *testing.T) {
+	var tests = []struct {
+		desc, script string
+	} {
+		{"pk(0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798)",
+			"210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798ac"},
+		{"pkh(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5)",
+			"76a91406afd46bcdfd22ef94ac122aa11f241244a37ecc88ac"},
+		{"wpkh(02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9)",
+			"00147dd65592d0ab2fe0d0257d571abf032cd9db93dc"},
+		{"sh(wpkh(03fff97bd5755eeea420453a14355235d382f6472f8568a18b2f057a1460297556))",
+			"a914cc6ffbc0bf31af759451068f90ba7a0272b6b33287"},
+		{"tr(a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd)",
+			"512077aab6e066f8a7419c5ab714c12c67d25007ed55a43cadcacb4d7a970a093f11"},
+		{"raw(deadbeef)", "deadbeef"},
+		{"addr(1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2)",
+			"76a91477bff20c60e522dfaa3350c39b030a5d004e839a88ac"},
+	}
+	for _, tc := range tests {
+		d, e := Parse(tc.desc)
+		if e != nil {
+			t.Error(tc.desc, e)
+			continue
+		}
+		o, e := d.Expand(0)
+		if e != nil {
+			t.Error(tc.desc, e)
+			continue
+		}
+		if hex.EncodeToString(o.Script) != tc.script {
+			t.Error(tc.desc, "bad script", hex.EncodeToString(o.Script))
+		}
+		if d.String() != AddChecksum(tc.desc) {
+			t.Error("Bad string", d.String())
+		}
+	}
+}
+
+func TestMulti(t *testing.T) {
+	k1 := "022f8bde4d1a07209355b4a7250a5c5128e88b84bddc619ab7cba8d569b240efe4"
+	k2 := "025cbdf0646e5db4eaa398f365f2ea7a0e3d419b7e0330e39ce92bddedcac4f9bc"
+	d1, e := Parse("wsh(sortedmulti(2," + k2 + "," + k1 + "))")
+	if e != nil {
+		t.Fatal(e)
+	}
+	d2, e := Parse("wsh(multi(2," + k1 + "," + k2 + "))")
+	if e != nil {
+		t.Fatal(e)
+	}
+	o1, _ := d1.Expand(0)
+	o2, _ := d2.Expand(0)
+	if hex.EncodeToString(o1.Script) != hex.EncodeToString(o2.Script) {
+		t.Error("sortedmulti does not sort the keys")
+	}
+	if hex.EncodeToString(o1.WitnessScript) != "5221" + k1 + "21" + k2 + "52ae" {
+		t.Error("Bad witness script", hex.EncodeToString(o1.WitnessScript))
+	}
+
+	d, e := Parse("sh(wsh(multi(1," + k1 + "," + k2 + ")))")
+	if e != nil {
+		t.Fatal(e)
+	}
+	o, _ := d.Expand(0)
+	if len(o.RedeemScript) != 34 || len(o.WitnessScript) == 0 || !btc.IsP2SH(o.Script) {
+		t.Error("Bad sh(wsh()) expansion")
+	}
+}
+
+func TestRange(t *testing.T) {
+	seed := btc.MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	master := btc.MasterKey(seed, false)
+	if master.Fingerprint() != 0x73c5da0a {
+		t.Errorf("Bad fingerprint %08x", master.Fingerprint())
+	}
+	acc, _ := master.DerivePath("m/84'/0'/0'")
+	desc := "wpkh([73c5da0a/84'/0'/0']" + acc.Pub().String() + "/0/*)"
+
+	d, e := Parse(desc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !d.IsRange() {
+		t.Error("IsRange false")
+	}
+	if d.String() != AddChecksum(desc) {
+		t.Error("Bad string", d.String())
+	}
+	if d.Label(5) != "m/84'/0'/0'/0/5" {
+		t.Error("Bad label", d.Label(5))
+	}
+	for i, exp := range []string{"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"} {
+		a, e := d.Address(uint32(i), false)
+		if e != nil || a == nil || a.String() != exp {
+			t.Error("Bad address", i, a, e)
+		}
+	}
+
+	// the same from the private key, with "h" for hardened path elements
+	d, e = Parse("wpkh(" + master.String() + "/84h/0h/0h/1/*)")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if a, _ := d.Address(0, false); a == nil || a.String() != "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el" {
+		t.Error("Bad change address", a)
+	}
+
+	// BIP86
+	acc, _ = master.DerivePath("m/86'/0'/0'")
+	d, e = Parse("tr(" + acc.Pub().String() + "/0/*)")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if a, _ := d.Address(0, false); a == nil || a.String() != "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr" {
+		t.Error("Bad taproot address", a)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	xpub := "xpub6CatWdiZiodmUeTDp8LT5or8nmbKNcuyvz7WyksVFkKB4RHwCD3XyuvPEbvqAQY3rAPshWcMLoP2fMFMKHPJ4ZeZXYVUhLv1VMrjPC7PW6V"
+	unc := "04a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd5b8dec5235a0fa8722476c7709c02559e3aa73aa03918ba2d492eea75abea235"
+	for _, s := range []string{
+		"",
+		"pkh()",
+		"foo(" + xpub + ")",
+		"wpkh(" + unc + ")",
+		"wsh(pk(" + unc + "))",
+		"sh(sh(pkh(" + xpub + ")))",
+		"wsh(wsh(pkh(" + xpub + ")))",
+		"wsh(wpkh(" + xpub + "))",
+		"sh(raw(deadbeef))",
+		"pkh(" + xpub + "/1h/*)",
+		"pkh(" + xpub + "/*')",
+		"pkh(" + xpub + "/*/1)",
+		"multi(3," + xpub + "," + xpub + ")",
+		"multi(0," + xpub + ")",
+		"tr(" + xpub + ",{pk(" + xpub + ")})",
+		"pkh([73c5da0]" + xpub + ")",
+		"pkh(" + xpub + ")#00000000",
+	} {
+		if _, e := Parse(s); e == nil {
+			t.Error("Invalid descriptor accepted:", s)
+		}
+	}
+}
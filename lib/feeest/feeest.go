@@ -0,0 +1,200 @@
+/*
+Package feeest implements a fee estimator based on confirmation tracking.
+
+It remembers when transactions entered the mempool and in which block they got confirmed,
+groups them by their feerate and then tells the feerate needed to confirm within N blocks,
+with the given certainty. The algorithm follows Bitcoin Core's CBlockPolicyEstimator.
+*/
+package feeest
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	MIN_BUCKET_FEE = 1000     // in satoshis per 1000 vbytes
+	MAX_BUCKET_FEE = 10000000 // in satoshis per 1000 vbytes
+	FEE_SPACING    = 1.05     // each bucket is 5% higher than the previous one
+
+	CERTAINTY_ECONOMICAL   = 0.85
+	CERTAINTY_CONSERVATIVE = 0.95
+
+	SUFFICIENT_FEETXS   = 0.1 // txs per block that are needed in a bucket range, for the medium and long horizon
+	SUFFICIENT_TXS_SHORT = 0.5 // ... and for the short horizon
+
+	FILE_VERSION = 1
+)
+
+type txEntry struct {
+	height uint32
+	bucket int
+	spkb float64
+}
+
+type Estimator struct {
+	sync.Mutex
+	Buckets []float64 // upper feerate limits of the buckets
+	Short, Med, Long *Stats
+	Height uint32 // of the last processed block
+
+	txs map[[32]byte]txEntry // txs from mempool that we are tracking
+}
+
+func NewEstimator() (e *Estimator) {
+	e = new(Estimator)
+	for f := float64(MIN_BUCKET_FEE); f <= MAX_BUCKET_FEE; f *= FEE_SPACING {
+		e.Buckets = append(e.Buckets, f)
+	}
+	e.Buckets = append(e.Buckets, 1e99) // for all the higher ones
+	e.init_stats()
+	e.txs = make(map[[32]byte]txEntry)
+	return
+}
+
+func (e *Estimator) init_stats() {
+	e.Short = newStats(len(e.Buckets), 12, 1, 0.962)
+	e.Med = newStats(len(e.Buckets), 24, 2, 0.9952)
+	e.Long = newStats(len(e.Buckets), 42, 24, 0.99931)
+}
+
+func (e *Estimator) all() [3]*Stats {
+	return [3]*Stats{e.Short, e.Med, e.Long}
+}
+
+// Returns the highest confirmation target that can be estimated
+func (e *Estimator) MaxTarget() uint32 {
+	return e.Long.MaxConfirms()
+}
+
+func (e *Estimator) bucket(spkb uint64) int {
+	return sort.SearchFloat64s(e.Buckets, float64(spkb))
+}
+
+// Call it when a tx enters the mempool, while the chain's tip is at the given height.
+// Do not call it for txs spending unconfirmed outputs - their feerate is not what gets them mined.
+func (e *Estimator) TxAdded(txid [32]byte, height uint32, spkb uint64) {
+	e.Lock()
+	if _, ok := e.txs[txid]; !ok {
+		ent := txEntry{height: height, bucket: e.bucket(spkb), spkb: float64(spkb)}
+		e.txs[txid] = ent
+		for _, st := range e.all() {
+			st.newTx(ent.height, ent.bucket)
+		}
+	}
+	e.Unlock()
+}
+
+// Call it when a tx leaves the mempool for another reason than being mined
+func (e *Estimator) TxRemoved(txid [32]byte) {
+	e.Lock()
+	if ent, ok := e.txs[txid]; ok {
+		for _, st := range e.all() {
+			st.removeTx(ent.height, e.Height, ent.bucket, false)
+		}
+		delete(e.txs, txid)
+	}
+	e.Unlock()
+}
+
+// Call it for each new block, before its txs get removed from the mempool
+func (e *Estimator) BlockConnected(height uint32, txids [][32]byte) {
+	e.Lock()
+	defer e.Unlock()
+	if height <= e.Height {
+		return // we only learn from new blocks (not from the ones that come back after a reorg)
+	}
+	e.Height = height
+	for _, st := range e.all() {
+		st.clearCurrent(height)
+		st.decay()
+	}
+	for _, txid := range txids {
+		ent, ok := e.txs[txid]
+		if !ok {
+			continue
+		}
+		delete(e.txs, txid)
+		if height <= ent.height {
+			continue
+		}
+		for _, st := range e.all() {
+			st.removeTx(ent.height, height, ent.bucket, true)
+			st.record(height-ent.height, ent.bucket, ent.spkb)
+		}
+	}
+}
+
+// Returns number of the mempool txs that are being tracked
+func (e *Estimator) Tracked() (cnt int) {
+	e.Lock()
+	cnt = len(e.txs)
+	e.Unlock()
+	return
+}
+
+// Returns feerate (in satoshis per 1000 vbytes) that should get a tx confirmed within the target
+// number of blocks, with the given certainty (0.0 to 1.0).
+func (e *Estimator) Estimate(target uint32, certainty float64) (spkb uint64, ok bool) {
+	e.Lock()
+	defer e.Unlock()
+	if target < 1 {
+		target = 1
+	}
+	if target > e.MaxTarget() {
+		target = e.MaxTarget()
+	}
+	var feerate float64
+	switch {
+		case target <= e.Short.MaxConfirms():
+			feerate, ok = e.Short.estimate(target, SUFFICIENT_TXS_SHORT, certainty, e.Height)
+		case target <= e.Med.MaxConfirms():
+			feerate, ok = e.Med.estimate(target, SUFFICIENT_FEETXS, certainty, e.Height)
+		default:
+			feerate, ok = e.Long.estimate(target, SUFFICIENT_FEETXS, certainty, e.Height)
+	}
+	if ok {
+		spkb = uint64(feerate + 0.5)
+	}
+	return
+}
+
+type fileData struct {
+	Version uint32
+	Height uint32
+	Buckets []float64
+	Short, Med, Long *Stats
+}
+
+// Stores the collected statistics (the mempool txs that are being tracked are not stored)
+func (e *Estimator) Save(w io.Writer) error {
+	e.Lock()
+	defer e.Unlock()
+	return gob.NewEncoder(w).Encode(&fileData{Version: FILE_VERSION, Height: e.Height,
+		Buckets: e.Buckets, Short: e.Short, Med: e.Med, Long: e.Long})
+}
+
+// Restores the statistics stored by Save()
+func (e *Estimator) Load(r io.Reader) error {
+	var fd fileData
+	if er := gob.NewDecoder(r).Decode(&fd); er != nil {
+		return er
+	}
+	if fd.Version != FILE_VERSION || len(fd.Buckets) != len(e.Buckets) || fd.Short == nil ||
+		fd.Med == nil || fd.Long == nil || !fd.Short.valid(len(e.Buckets)) ||
+		!fd.Med.valid(len(e.Buckets)) || !fd.Long.valid(len(e.Buckets)) {
+		return errors.New("FeeEst: incompatible data")
+	}
+	e.Lock()
+	e.Height = fd.Height
+	e.Short, e.Med, e.Long = fd.Short, fd.Med, fd.Long
+	for _, st := range e.all() {
+		st.resetUnconf()
+	}
+	e.txs = make(map[[32]byte]txEntry)
+	e.Unlock()
+	return nil
+}
@@ -0,0 +1,93 @@
+package feeest
+
+import (
+	"bytes"
+	"testing"
+	"encoding/binary"
+)
+
+// Each block: 20 txs paying 50 SPB get mined in the next block,
+// 20 txs paying 5 SPB wait for 8 blocks.
+func simulate(e *Estimator, from, to uint32) {
+	var seq uint32
+	pending := make(map[uint32][][32]byte)
+	for height := from; height < to; height++ {
+		e.BlockConnected(height, pending[height])
+		delete(pending, height)
+		for i := 0; i < 20; i++ {
+			var fast, slow [32]byte
+			seq++
+			binary.LittleEndian.PutUint32(fast[:], seq)
+			seq++
+			binary.LittleEndian.PutUint32(slow[:], seq)
+			e.TxAdded(fast, height, 50000)
+			e.TxAdded(slow, height, 5000)
+			pending[height+1] = append(pending[height+1], fast)
+			pending[height+8] = append(pending[height+8], slow)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	e := NewEstimator()
+	if _, ok := e.Estimate(2, CERTAINTY_ECONOMICAL); ok {
+		t.Error("Estimate without any data")
+	}
+	simulate(e, 1000, 1500)
+
+	if fee, ok := e.Estimate(1, CERTAINTY_ECONOMICAL); !ok || fee != 50000 {
+		t.Error("Bad estimate for 1 block", fee, ok)
+	}
+	if fee, ok := e.Estimate(4, CERTAINTY_ECONOMICAL); !ok || fee != 50000 {
+		t.Error("Bad estimate for 4 blocks", fee, ok)
+	}
+	if fee, ok := e.Estimate(10, CERTAINTY_ECONOMICAL); !ok || fee != 5000 {
+		t.Error("Bad estimate for 10 blocks", fee, ok)
+	}
+	if fee, ok := e.Estimate(100, CERTAINTY_CONSERVATIVE); !ok || fee != 5000 {
+		t.Error("Bad estimate for 100 blocks", fee, ok)
+	}
+
+	// txs that leave mempool unconfirmed make the estimate go up
+	var txid [32]byte
+	for i := 0; i < 50000; i++ {
+		binary.BigEndian.PutUint32(txid[:], uint32(i))
+		e.TxAdded(txid, 1499, 5000)
+	}
+	e.BlockConnected(1510, nil)
+	for i := 0; i < 50000; i++ {
+		binary.BigEndian.PutUint32(txid[:], uint32(i))
+		e.TxRemoved(txid)
+	}
+	if fee, ok := e.Estimate(10, CERTAINTY_ECONOMICAL); !ok || fee != 50000 {
+		t.Error("Bad estimate after failures", fee, ok)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	e := NewEstimator()
+	simulate(e, 1, 200)
+	buf := new(bytes.Buffer)
+	if er := e.Save(buf); er != nil {
+		t.Fatal(er)
+	}
+
+	e2 := NewEstimator()
+	if er := e2.Load(bytes.NewReader(buf.Bytes())); er != nil {
+		t.Fatal(er)
+	}
+	if e2.Height != e.Height || e2.Tracked() != 0 {
+		t.Error("Bad state after Load", e2.Height, e2.Tracked())
+	}
+	for _, target := range []uint32{1, 10, 30, 500} {
+		f1, ok1 := e.Estimate(target, CERTAINTY_ECONOMICAL)
+		f2, ok2 := e2.Estimate(target, CERTAINTY_ECONOMICAL)
+		if f1 != f2 || ok1 != ok2 {
+			t.Error("Estimate changed after Load", target, f1, f2)
+		}
+	}
+
+	if er := e2.Load(bytes.NewReader(buf.Bytes()[:100])); er == nil {
+		t.Error("Truncated data accepted")
+	}
+}
@@ -0,0 +1,172 @@
+package feeest
+
+// Confirmation statistics of one time horizon (see TxConfirmStats in Bitcoin Core)
+type Stats struct {
+	Decay   float64     // moving averages get multiplied by it with each block
+	Scale   uint32      // number of blocks in one period
+	ConfAvg [][]float64 // [period][bucket] - txs confirmed within (period+1)*Scale blocks
+	FailAvg [][]float64 // [period][bucket] - txs that left mempool unconfirmed after (period+1)*Scale blocks
+	TxCtAvg []float64   // [bucket] - all the confirmed txs
+	FeeSum  []float64   // [bucket] - sum of feerates of the confirmed txs
+
+	unconf    [][]int // [entry_height % MaxConfirms()][bucket] - txs still in mempool
+	oldUnconf []int   // [bucket] - txs that are in mempool for MaxConfirms() blocks or longer
+}
+
+func newStats(buckets, periods int, scale uint32, decay float64) (st *Stats) {
+	st = &Stats{Decay: decay, Scale: scale}
+	st.ConfAvg = make([][]float64, periods)
+	st.FailAvg = make([][]float64, periods)
+	for i := range st.ConfAvg {
+		st.ConfAvg[i] = make([]float64, buckets)
+		st.FailAvg[i] = make([]float64, buckets)
+	}
+	st.TxCtAvg = make([]float64, buckets)
+	st.FeeSum = make([]float64, buckets)
+	st.resetUnconf()
+	return
+}
+
+func (st *Stats) resetUnconf() {
+	st.unconf = make([][]int, st.MaxConfirms())
+	for i := range st.unconf {
+		st.unconf[i] = make([]int, len(st.TxCtAvg))
+	}
+	st.oldUnconf = make([]int, len(st.TxCtAvg))
+}
+
+// Returns the highest confirmation target that this horizon can answer for
+func (st *Stats) MaxConfirms() uint32 {
+	return st.Scale * uint32(len(st.ConfAvg))
+}
+
+// Makes sure the (loaded) stats have the expected dimensions
+func (st *Stats) valid(buckets int) bool {
+	if st.Scale == 0 || len(st.ConfAvg) == 0 || len(st.ConfAvg) != len(st.FailAvg) ||
+		len(st.TxCtAvg) != buckets || len(st.FeeSum) != buckets {
+		return false
+	}
+	for i := range st.ConfAvg {
+		if len(st.ConfAvg[i]) != buckets || len(st.FailAvg[i]) != buckets {
+			return false
+		}
+	}
+	return true
+}
+
+func (st *Stats) record(blocks uint32, bucket int, feerate float64) {
+	if blocks < 1 {
+		return
+	}
+	for p := int((blocks+st.Scale-1)/st.Scale) - 1; p < len(st.ConfAvg); p++ {
+		st.ConfAvg[p][bucket]++
+	}
+	st.TxCtAvg[bucket]++
+	st.FeeSum[bucket] += feerate
+}
+
+func (st *Stats) decay() {
+	for b := range st.TxCtAvg {
+		for p := range st.ConfAvg {
+			st.ConfAvg[p][b] *= st.Decay
+			st.FailAvg[p][b] *= st.Decay
+		}
+		st.TxCtAvg[b] *= st.Decay
+		st.FeeSum[b] *= st.Decay
+	}
+}
+
+func (st *Stats) newTx(height uint32, bucket int) {
+	st.unconf[height%uint32(len(st.unconf))][bucket]++
+}
+
+func (st *Stats) removeTx(entry, best uint32, bucket int, in_block bool) {
+	var blocks_ago uint32
+	if best > entry {
+		blocks_ago = best - entry
+	}
+	if blocks_ago >= uint32(len(st.unconf)) {
+		if st.oldUnconf[bucket] > 0 {
+			st.oldUnconf[bucket]--
+		}
+	} else if row := st.unconf[entry%uint32(len(st.unconf))]; row[bucket] > 0 {
+		row[bucket]--
+	}
+	if !in_block && blocks_ago >= st.Scale {
+		for p := 0; p < int(blocks_ago/st.Scale) && p < len(st.FailAvg); p++ {
+			st.FailAvg[p][bucket]++
+		}
+	}
+}
+
+// Called with each new block, before adding the txs that enter the mempool at this height
+func (st *Stats) clearCurrent(height uint32) {
+	row := st.unconf[height%uint32(len(st.unconf))]
+	for b := range row {
+		st.oldUnconf[b] += row[b]
+		row[b] = 0
+	}
+}
+
+// Returns median feerate of the lowest range of buckets in which at least the given part of txs
+// got confirmed within the target. Starting from the highest feerates, the buckets are grouped
+// until there is enough data in a group (sufficient txs per block on average).
+func (st *Stats) estimate(target uint32, sufficient, success float64, height uint32) (feerate float64, ok bool) {
+	period := int((target+st.Scale-1)/st.Scale) - 1
+	if period < 0 || period >= len(st.ConfAvg) {
+		return
+	}
+	sufficient /= 1 - st.Decay
+	bins := uint32(len(st.unconf))
+
+	var conf, total, fail, extra float64
+	cur_near, cur_far := len(st.TxCtAvg)-1, len(st.TxCtAvg)-1
+	best_near, best_far := -1, -1
+	new_range := true
+	for b := len(st.TxCtAvg) - 1; b >= 0; b-- {
+		if new_range {
+			cur_near = b
+			new_range = false
+		}
+		cur_far = b
+		conf += st.ConfAvg[period][b]
+		total += st.TxCtAvg[b]
+		fail += st.FailAvg[period][b]
+		for c := target; c < bins; c++ {
+			extra += float64(st.unconf[(height+bins-c)%bins][b])
+		}
+		extra += float64(st.oldUnconf[b])
+
+		if total < sufficient {
+			continue
+		}
+		if conf/(total+fail+extra) < success {
+			continue // keep on adding lower buckets - maybe then there will be enough of the confirmed ones
+		}
+		best_near, best_far = cur_near, cur_far
+		conf, total, fail, extra = 0, 0, 0, 0
+		new_range = true
+	}
+	if best_near < 0 {
+		return
+	}
+
+	var tx_sum float64
+	for b := best_far; b <= best_near; b++ {
+		tx_sum += st.TxCtAvg[b]
+	}
+	if tx_sum == 0 {
+		return
+	}
+	tx_sum /= 2
+	for b := best_far; b <= best_near; b++ {
+		if st.TxCtAvg[b] < tx_sum {
+			tx_sum -= st.TxCtAvg[b]
+		} else {
+			feerate = st.FeeSum[b] / st.TxCtAvg[b]
+			ok = true
+			break
+		}
+	}
+	return
+}
@@ -16,6 +16,9 @@ func bech32_polymod_step(pre uint32) uint32 {
 
 const (
 	charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	BECH32_CONST = 1
+	BECH32M_CONST = 0x2bc830a3 // BIP350
 )
 
 var (
@@ -32,6 +35,35 @@ var (
 
 // returns empty string on error
 func Encode(hrp string, data []byte) string {
+	return encode(hrp, data, BECH32_CONST)
+}
+
+// Same as Encode, but with bech32m checksum (BIP350)
+func EncodeM(hrp string, data []byte) string {
+	return encode(hrp, data, BECH32M_CONST)
+}
+
+// returns ("", nil) on error
+func Decode(input string) (res_hrp string, res_data []byte) {
+	var spec uint32
+	res_hrp, res_data, spec = DecodeAny(input)
+	if spec != BECH32_CONST {
+		res_hrp, res_data = "", nil
+	}
+	return
+}
+
+// Same as Decode, but expects bech32m checksum (BIP350)
+func DecodeM(input string) (res_hrp string, res_data []byte) {
+	var spec uint32
+	res_hrp, res_data, spec = DecodeAny(input)
+	if spec != BECH32M_CONST {
+		res_hrp, res_data = "", nil
+	}
+	return
+}
+
+func encode(hrp string, data []byte, spec uint32) string {
 	var chk uint32 = 1
 	var i int
 	output := new(bytes.Buffer)
@@ -68,15 +100,16 @@ func Encode(hrp string, data []byte) string {
 	for i = 0; i < 6; i++ {
 		chk = bech32_polymod_step(chk)
 	}
-	chk ^= 1
+	chk ^= spec
 	for i = 0; i < 6; i++ {
 		output.WriteByte(charset[(chk>>uint((5-i)*5))&0x1f])
 	}
 	return string(output.Bytes())
 }
 
-// returns ("", nil) on error
-func Decode(input string) (res_hrp string, res_data []byte) {
+// Decodes both; bech32 and bech32m strings.
+// spec is BECH32_CONST or BECH32M_CONST, depending on the checksum. Returns ("", nil, 0) on error.
+func DecodeAny(input string) (res_hrp string, res_data []byte, spec uint32) {
 	var chk uint32 = 1
 	var i, data_len, hrp_len int
 	var have_lower, have_upper bool
@@ -135,9 +168,10 @@ func Decode(input string) (res_hrp string, res_data []byte) {
 	if have_lower && have_upper {
 		return
 	}
-	if chk == 1 {
+	if chk == BECH32_CONST || chk == BECH32M_CONST {
 		res_hrp = string(hrp)
 		res_data = data
+		spec = chk
 	}
 	return
 }
@@ -39,15 +39,22 @@ func SegwitEncode(hrp string, witver int, witprog []byte) string {
 	if len(witprog) < 2 || len(witprog) > 40 {
 		return ""
 	}
-	return Encode(hrp, append([]byte{byte(witver)}, convert_bits(5, witprog, 8, true)...))
+	if witver == 0 {
+		return Encode(hrp, append([]byte{byte(witver)}, convert_bits(5, witprog, 8, true)...))
+	}
+	// witness version 1+ uses bech32m (BIP350)
+	return EncodeM(hrp, append([]byte{byte(witver)}, convert_bits(5, witprog, 8, true)...))
 }
 
 // returns (0, nil) on error
 func SegwitDecode(hrp, addr string) (witver int, witdata []byte) {
-	hrp_actual, data := Decode(addr)
+	hrp_actual, data, spec := DecodeAny(addr)
 	if hrp_actual == "" || len(data)==0 || len(data) > 65 {
 		return
 	}
+	if data[0] == 0 && spec != BECH32_CONST || data[0] != 0 && spec != BECH32M_CONST {
+		return
+	}
 	if hrp != hrp_actual {
 		return
 	}
@@ -10,9 +10,12 @@ import (
 	"errors"
 	"strings"
 	"strconv"
+	"encoding/base32"
 	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/others/qdb"
 	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/others/tor"
 	"github.com/piotrnar/gocoin/lib/others/utils"
 )
 
@@ -27,8 +30,14 @@ var (
 	peerdb_mutex sync.Mutex
 
 	Testnet bool
+	Regtest bool // there are no seeds for regtest
+	Signet bool
+	CustomSignet bool // there are no seeds for a signet with a custom challenge
 	ConnectOnly string
 	Services uint64 = 1
+	NetReachable = [btc.NET_CJDNS+1]bool{btc.NET_IPV4:true} // networks we can make outgoing connections to
+
+	i2p_b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
 )
 
 type PeerAddr struct {
@@ -37,9 +46,16 @@ type PeerAddr struct {
 	// The fields below don't get saved, but are used internaly
 	Manual bool  // Manually connected (from UI)
 	Friend bool  // Connected from friends.txt
+	OnionIn bool // Incoming connection via our onion service (not stored in the DB)
 }
 
 func DefaultTcpPort() uint16 {
+	if Regtest {
+		return 18444
+	}
+	if Signet {
+		return 38333
+	}
 	if Testnet {
 		return 18333
 	} else {
@@ -61,10 +77,11 @@ func NewPeer(v []byte) (p *PeerAddr) {
 }
 
 
+// Accepts IPv4, IPv6 (in brackets, if followed by port), .onion or .b32.i2p address with optional port
 func NewAddrFromString(ipstr string, force_default_port bool) (p *PeerAddr, e error) {
 	port := DefaultTcpPort()
-	x := strings.Index(ipstr, ":")
-	if x!=-1 {
+	x := strings.LastIndex(ipstr, ":")
+	if x!=-1 && (strings.Count(ipstr, ":")==1 || strings.HasPrefix(ipstr, "[")) {
 		if !force_default_port {
 			v, er := strconv.ParseUint(ipstr[x+1:], 10, 32)
 			if er != nil {
@@ -79,16 +96,34 @@ func NewAddrFromString(ipstr string, force_default_port bool) (p *PeerAddr, e er
 		}
 		ipstr = ipstr[:x] // remove port number
 	}
-	ip := net.ParseIP(ipstr)
-	if ip != nil && len(ip)==16 {
-		p = NewEmptyPeer()
-		copy(p.Ip4[:], ip[12:16])
-		p.Services = Services
-		copy(p.Ip6[:], ip[:12])
-		p.Port = port
+	ipstr = strings.TrimSuffix(strings.TrimPrefix(ipstr, "["), "]")
+
+	p = NewEmptyPeer()
+	p.Services = Services
+	p.Port = port
+	if tor.IsOnion(ipstr) {
+		p.NetID = btc.NET_TORV3
+		p.Addr, e = tor.DecodeOnion(ipstr)
+	} else if strings.HasSuffix(strings.ToLower(ipstr), ".b32.i2p") {
+		p.NetID = btc.NET_I2P
+		p.Addr, e = i2p_b32.DecodeString(strings.ToUpper(ipstr[:len(ipstr)-8]))
+		if e == nil && len(p.Addr) != 32 {
+			e = errors.New("Not a valid I2P address '"+ipstr+"'")
+		}
+	} else if ip := net.ParseIP(ipstr); ip != nil && len(ip)==16 {
+		if ip[0] == 0xfc {
+			p.NetID = btc.NET_CJDNS
+			p.Addr = []byte(ip)
+		} else {
+			copy(p.Ip6[:], ip[:12])
+			copy(p.Ip4[:], ip[12:16])
+		}
 	} else {
 		e = errors.New("Error parsing IP '"+ipstr+"'")
 	}
+	if e != nil {
+		p = nil
+	}
 	return
 }
 
@@ -99,7 +134,7 @@ func NewPeerFromString(ipstr string, force_default_port bool) (p *PeerAddr, e er
 		return
 	}
 
-	if sys.IsIPBlocked(p.Ip4[:]) {
+	if p.Network() == btc.NET_IPV4 && sys.IsIPBlocked(p.Ip4[:]) {
 		e = errors.New(ipstr+" is blocked")
 		return
 	}
@@ -140,6 +175,9 @@ func ExpirePeers() {
 
 
 func (p *PeerAddr) Save() {
+	if p.OnionIn {
+		return
+	}
 	if p.Time > 0x80000000 {
 		println("saving dupa", int32(p.Time), p.Ip())
 	}
@@ -170,8 +208,41 @@ func (p *PeerAddr) Dead() {
 }
 
 
+// Returns the peer's address as host:port
 func (p *PeerAddr) Ip() (string) {
-	return fmt.Sprintf("%d.%d.%d.%d:%d", p.Ip4[0], p.Ip4[1], p.Ip4[2], p.Ip4[3], p.Port)
+	switch p.Network() {
+		case btc.NET_IPV4:
+			return fmt.Sprintf("%d.%d.%d.%d:%d", p.Ip4[0], p.Ip4[1], p.Ip4[2], p.Ip4[3], p.Port)
+		case btc.NET_IPV6:
+			return net.JoinHostPort(net.IP(append(p.Ip6[:], p.Ip4[:]...)).String(), fmt.Sprint(p.Port))
+		case btc.NET_TORV3:
+			return fmt.Sprint(tor.EncodeOnion(p.Addr), ":", p.Port)
+		case btc.NET_I2P:
+			return fmt.Sprint(strings.ToLower(i2p_b32.EncodeToString(p.Addr)), ".b32.i2p:", p.Port)
+		case btc.NET_CJDNS:
+			return net.JoinHostPort(net.IP(p.Addr).String(), fmt.Sprint(p.Port))
+	}
+	return fmt.Sprint(btc.NetName(p.NetID), ":", p.Port)
+}
+
+
+// Returns true if the address can be used (stored, relayed) - no matter if we can connect to it
+func (p *PeerAddr) Valid() bool {
+	switch p.Network() {
+		case btc.NET_IPV4:
+			return sys.ValidIp4(p.Ip4[:]) && !sys.IsIPBlocked(p.Ip4[:])
+		case btc.NET_IPV6:
+			return sys.ValidIp6(append(p.Ip6[:], p.Ip4[:]...))
+		case btc.NET_CJDNS:
+			return len(p.Addr) == 16 && p.Addr[0] == 0xfc
+	}
+	return btc.NetAddrLenOK(p.NetID, len(p.Addr)) && p.NetID != btc.NET_TORV2
+}
+
+
+// Returns true if we can make an outgoing connection to the peer
+func (p *PeerAddr) Reachable() bool {
+	return NetReachable[p.Network()]
 }
 
 
@@ -211,14 +282,41 @@ func GetBestPeers(limit uint, isConnected func(*PeerAddr)bool) (res manyPeers) {
 		}
 		return manyPeers{}
 	}
+	return get_peers(limit, func(ad *PeerAddr) bool {
+		return ad.Reachable() && (isConnected==nil || !isConnected(ad))
+	})
+}
+
+
+// Fetch the most recenty seen peers, to be sent in "addr" (or "addrv2") message.
+func GetPeersToSend(limit uint, addrv2 bool) (res manyPeers) {
+	return get_peers(limit, func(ad *PeerAddr) bool {
+		return addrv2 || ad.NetID == 0 // only IPv4 and IPv6 fit into "addr" message
+	})
+}
+
+
+// Returns number of peers in the DB, for each network
+func NetworkCounts() (res [btc.NET_CJDNS+1]uint) {
+	peerdb_mutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if n := NewPeer(v).Network(); int(n) < len(res) {
+			res[n]++
+		}
+		return 0
+	})
+	peerdb_mutex.Unlock()
+	return
+}
+
+
+func get_peers(limit uint, accept func(*PeerAddr)bool) (res manyPeers) {
 	peerdb_mutex.Lock()
 	tmp := make(manyPeers, 0)
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		ad := NewPeer(v)
-		if ad.Banned==0 && sys.ValidIp4(ad.Ip4[:]) && !sys.IsIPBlocked(ad.Ip4[:]) {
-			if isConnected==nil || !isConnected(ad) {
-				tmp = append(tmp, ad)
-			}
+		if ad.Banned==0 && ad.Valid() && accept(ad) {
+			tmp = append(tmp, ad)
 		}
 		return 0
 	})
@@ -263,24 +361,32 @@ func InitPeers(dir string) {
 	PeerDB, _ = qdb.NewDB(dir+"peers3", true)
 
 	if ConnectOnly != "" {
-		x := strings.Index(ConnectOnly, ":")
-		if x == -1 {
-			ConnectOnly = fmt.Sprint(ConnectOnly, ":", DefaultTcpPort())
-		}
-		oa, e := net.ResolveTCPAddr("tcp4", ConnectOnly)
-		if e != nil {
-			println(e.Error(), ConnectOnly)
-			os.Exit(1)
+		var e error
+		if proxyPeer, e = NewAddrFromString(ConnectOnly, false); e != nil {
+			// not an address - resolve the host name
+			x := strings.Index(ConnectOnly, ":")
+			if x == -1 {
+				ConnectOnly = fmt.Sprint(ConnectOnly, ":", DefaultTcpPort())
+			}
+			oa, e := net.ResolveTCPAddr("tcp4", ConnectOnly)
+			if e != nil {
+				println(e.Error(), ConnectOnly)
+				os.Exit(1)
+			}
+			proxyPeer = NewEmptyPeer()
+			proxyPeer.Services = Services
+			copy(proxyPeer.Ip4[:], oa.IP[12:16])
+			proxyPeer.Port = uint16(oa.Port)
 		}
-		proxyPeer = NewEmptyPeer()
-		proxyPeer.Services = Services
-		copy(proxyPeer.Ip4[:], oa.IP[12:16])
-		proxyPeer.Port = uint16(oa.Port)
-		fmt.Printf("Connect to bitcoin network via %d.%d.%d.%d:%d\n",
-			proxyPeer.Ip4[0], proxyPeer.Ip4[1], proxyPeer.Ip4[2], proxyPeer.Ip4[3], proxyPeer.Port)
-	} else {
+		fmt.Println("Connect to bitcoin network via", proxyPeer.Ip())
+	} else if !Regtest && !CustomSignet {
 		go func() {
-			if !Testnet {
+			if Signet {
+				initSeeds([]string{
+					"seed.signet.bitcoin.sprovoost.nl",
+					"seed.signet.achownodes.xyz",
+					}, 38333)
+			} else if !Testnet {
 				initSeeds([]string{
 					"seed.bitcoin.sipa.be",
 					"dnsseed.bluematt.me",
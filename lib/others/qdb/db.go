@@ -211,6 +211,24 @@ func (db *DB) Get(key KeyType) (value []byte) {
 }
 
 
+// Returns a copy of the record, which is then marked as NO_CACHE and not kept in memory.
+// Use it for large databases that are read at random (e.g. on requests from peers).
+func (db *DB) GetNoCache(key KeyType) (value []byte) {
+	db.Mutex.Lock()
+	idx := db.Idx.get(key)
+	if idx!=nil {
+		db.loadrec(idx)
+		value = append([]byte{}, idx.Slice()...)
+		idx.aply_browsing_flags(NO_CACHE)
+		if _, pending := db.PendingRecords[key]; !pending && !db.VolatileMode {
+			idx.freerec() // a pending record gets freed after it is written to disk
+		}
+	}
+	db.Mutex.Unlock()
+	return
+}
+
+
 // Use this one inside Browse
 func (db *DB) GetNoMutex(key KeyType) (value []byte) {
 	idx := db.Idx.get(key)
@@ -185,6 +185,40 @@ func TestDatabase(t *testing.T) {
 	os.RemoveAll(dbname)
 }
 
+func TestGetNoCache(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, e := NewDB(dbname, false)
+	if e != nil {
+		t.Fatal("Cannot create db")
+	}
+	val := []byte("some value")
+	db.PutExt(1, val, NO_CACHE)
+	db.Put(2, val)
+
+	// a pending record must stay in memory until it is written
+	if v := db.GetNoCache(1); !bytes.Equal(v, val) {
+		t.Error("Pending record mismatch", hex.EncodeToString(v))
+	}
+	db.Sync()
+	db.Mutex.Lock() // wait for the background sync to finish
+	db.Mutex.Unlock()
+
+	for _, k := range []KeyType{1, 2} {
+		v := db.GetNoCache(k)
+		if !bytes.Equal(v, val) {
+			t.Error("Record mismatch", k, hex.EncodeToString(v))
+		}
+		if db.Idx.get(k).data != nil {
+			t.Error("Record kept in memory", k)
+		}
+	}
+	if v := db.Get(2); !bytes.Equal(v, val) {
+		t.Error("Record mismatch after GetNoCache", hex.EncodeToString(v))
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
 func k2s(k KeyType) string {
 	return fmt.Sprintf("%16x", k)
 }
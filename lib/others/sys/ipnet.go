@@ -1,6 +1,7 @@
 package sys
 
 import (
+	"net"
 )
 
 
@@ -28,3 +29,23 @@ func ValidIp4(ip []byte) bool {
 func IsIPBlocked(ip4 []byte) bool {
 	return false
 }
+
+
+// Discard any IPv6 address that is not globally routable
+func ValidIp6(ip []byte) bool {
+	if len(ip) != 16 || !net.IP(ip).IsGlobalUnicast() || net.IP(ip).To4() != nil {
+		return false
+	}
+
+	// RFC4193 (this also covers OnionCat and CJDNS)
+	if (ip[0] & 0xfe) == 0xfc {
+		return false
+	}
+
+	// RFC3849
+	if ip[0]==0x20 && ip[1]==0x01 && ip[2]==0x0d && ip[3]==0xb8 {
+		return false
+	}
+
+	return true
+}
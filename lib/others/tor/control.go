@@ -0,0 +1,199 @@
+package tor
+
+import (
+	"net"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Connection to Tor's control port (see control-spec.txt)
+type Control struct {
+	conn net.Conn
+	rd *bufio.Reader
+	timeout time.Duration
+}
+
+// Connects to the control port and authenticates.
+// If password is empty, cookie authentication is used (when the control port requires any).
+func NewControl(addr, password string, timeout time.Duration) (c *Control, e error) {
+	c = new(Control)
+	c.timeout = timeout
+	if c.conn, e = net.DialTimeout("tcp", addr, timeout); e != nil {
+		c = nil
+		return
+	}
+	c.rd = bufio.NewReader(c.conn)
+	if e = c.authenticate(password); e != nil {
+		c.conn.Close()
+		c = nil
+	}
+	return
+}
+
+// Closing the control connection removes the onion services that were created through it
+func (c *Control) Close() {
+	c.conn.Close()
+}
+
+// Sends the command and returns the lines of a successful reply (without the status code).
+func (c *Control) Command(cmd string) (lines []string, e error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, e = c.conn.Write([]byte(cmd + "\r\n")); e != nil {
+		return
+	}
+	for {
+		var ln string
+		if ln, e = c.rd.ReadString('\n'); e != nil {
+			return
+		}
+		ln = strings.TrimRight(ln, "\r\n")
+		if len(ln) < 4 {
+			e = errors.New("Tor: bad reply line from control port")
+			return
+		}
+		if ln[:3] != "250" {
+			e = errors.New("Tor: " + ln)
+			return
+		}
+		if ln[3] == '+' { // data reply - we do not need the data
+			for {
+				var dl string
+				if dl, e = c.rd.ReadString('\n'); e != nil {
+					return
+				}
+				if strings.TrimRight(dl, "\r\n") == "." {
+					break
+				}
+			}
+		}
+		lines = append(lines, ln[4:])
+		if ln[3] == ' ' {
+			return
+		}
+	}
+}
+
+// Returns value of the given KEY=value field from the reply line. Quoted values get unquoted.
+func field(ln, key string) (val string, ok bool) {
+	for {
+		i := strings.Index(ln, key + "=")
+		if i == -1 {
+			return
+		}
+		if i == 0 || ln[i-1] == ' ' {
+			ln = ln[i+len(key)+1:]
+			break
+		}
+		ln = ln[i+len(key)+1:]
+	}
+	ok = true
+	if strings.HasPrefix(ln, "\"") {
+		for i := 1; i < len(ln); i++ {
+			if ln[i] == '\\' {
+				i++
+			} else if ln[i] == '"' {
+				val, _ = strconv.Unquote(ln[:i+1])
+				return
+			}
+		}
+	}
+	if i := strings.Index(ln, " "); i != -1 {
+		ln = ln[:i]
+	}
+	val = ln
+	return
+}
+
+func (c *Control) authenticate(password string) (e error) {
+	lines, e := c.Command("PROTOCOLINFO 1")
+	if e != nil {
+		return
+	}
+	var methods, cookie_file string
+	for _, ln := range lines {
+		if strings.HasPrefix(ln, "AUTH ") {
+			methods, _ = field(ln, "METHODS")
+			cookie_file, _ = field(ln, "COOKIEFILE")
+		}
+	}
+	has := func(m string) bool {
+		for _, s := range strings.Split(methods, ",") {
+			if s == m {
+				return true
+			}
+		}
+		return false
+	}
+
+	if password != "" {
+		_, e = c.Command("AUTHENTICATE " + strconv.Quote(password))
+		return
+	}
+	if has("NULL") {
+		_, e = c.Command("AUTHENTICATE")
+		return
+	}
+	if !has("SAFECOOKIE") && !has("COOKIE") {
+		return errors.New("Tor: control port needs a password (methods " + methods + ")")
+	}
+
+	cookie, e := ioutil.ReadFile(cookie_file)
+	if e != nil {
+		return
+	}
+	if !has("SAFECOOKIE") {
+		_, e = c.Command("AUTHENTICATE " + hex.EncodeToString(cookie))
+		return
+	}
+
+	client_nonce := make([]byte, 32)
+	rand.Read(client_nonce)
+	if lines, e = c.Command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(client_nonce)); e != nil {
+		return
+	}
+	shash, _ := field(lines[0], "SERVERHASH")
+	snonce, _ := field(lines[0], "SERVERNONCE")
+	server_hash, _ := hex.DecodeString(shash)
+	server_nonce, _ := hex.DecodeString(snonce)
+	msg := append(append(append([]byte{}, cookie...), client_nonce...), server_nonce...)
+	mac := func(key string) []byte {
+		h := hmac.New(sha256.New, []byte(key))
+		h.Write(msg)
+		return h.Sum(nil)
+	}
+	if !hmac.Equal(server_hash, mac("Tor safe cookie authentication server-to-controller hash")) {
+		return errors.New("Tor: control port failed the cookie challenge")
+	}
+	_, e = c.Command("AUTHENTICATE " + hex.EncodeToString(mac("Tor safe cookie authentication controller-to-server hash")))
+	return
+}
+
+// Creates an onion service, forwarding connections to its virt_port to the target ("host:port").
+// Use key "NEW:ED25519-V3" to create a new service - then the new private key is returned.
+// The service exists as long as the control connection is open.
+func (c *Control) AddOnion(key string, virt_port uint16, target string) (service_id, priv_key string, e error) {
+	lines, e := c.Command("ADD_ONION " + key + " Port=" + strconv.Itoa(int(virt_port)) + "," + target)
+	if e != nil {
+		return
+	}
+	for _, ln := range lines {
+		if strings.HasPrefix(ln, "ServiceID=") {
+			service_id = ln[10:]
+		} else if strings.HasPrefix(ln, "PrivateKey=") {
+			priv_key = ln[11:]
+		}
+	}
+	if service_id == "" {
+		e = errors.New("Tor: no ServiceID in ADD_ONION reply")
+	}
+	return
+}
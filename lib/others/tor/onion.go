@@ -0,0 +1,65 @@
+/*
+Package tor implements what is needed to talk to the Bitcoin network via Tor:
+ * v3 onion addresses
+ * SOCKS5 client (RFC1928, RFC1929) for outgoing connections
+ * control port client, used to create an onion service for incoming connections
+*/
+package tor
+
+import (
+	"errors"
+	"strings"
+	"encoding/base32"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	ONION_PUBKEY_LEN = 32
+	ONION_VERSION = 3
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func onion_checksum(pubkey []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pubkey)
+	h.Write([]byte{ONION_VERSION})
+	return h.Sum(nil)[:2]
+}
+
+// Returns the onion address (with ".onion" suffix) of the given service public key
+func EncodeOnion(pubkey []byte) string {
+	b := make([]byte, 0, ONION_PUBKEY_LEN+3)
+	b = append(b, pubkey...)
+	b = append(b, onion_checksum(pubkey)...)
+	b = append(b, ONION_VERSION)
+	return strings.ToLower(b32.EncodeToString(b)) + ".onion"
+}
+
+// Returns true if the given host name is in the onion domain
+func IsOnion(host string) bool {
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// Decodes v3 onion address (with or without ".onion" suffix) into the service public key
+func DecodeOnion(host string) (pubkey []byte, e error) {
+	if IsOnion(host) {
+		host = host[:len(host)-6]
+	}
+	b, er := b32.DecodeString(strings.ToUpper(host))
+	if er != nil || len(b) != ONION_PUBKEY_LEN+3 {
+		e = errors.New("Tor: not a v3 onion address")
+		return
+	}
+	if b[ONION_PUBKEY_LEN+2] != ONION_VERSION {
+		e = errors.New("Tor: unsupported onion address version")
+		return
+	}
+	pubkey = b[:ONION_PUBKEY_LEN]
+	if string(onion_checksum(pubkey)) != string(b[ONION_PUBKEY_LEN:ONION_PUBKEY_LEN+2]) {
+		e = errors.New("Tor: onion address checksum mismatch")
+		pubkey = nil
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package tor
+
+import (
+	"io"
+	"net"
+	"time"
+	"errors"
+	"strconv"
+)
+
+var socks5_errors = []string{"",
+	"general SOCKS server failure", "connection not allowed by ruleset", "network unreachable",
+	"host unreachable", "connection refused", "TTL expired", "command not supported",
+	"address type not supported"}
+
+// Connects to addr ("host:port") via the SOCKS5 proxy. The host name is resolved by the proxy.
+// user and pass are optional - with Tor, using different ones for each connection
+// makes it go through a different circuit (stream isolation).
+func DialSOCKS5(proxy, addr, user, pass string, timeout time.Duration) (conn net.Conn, e error) {
+	host, sport, e := net.SplitHostPort(addr)
+	if e != nil {
+		return
+	}
+	port, e := strconv.ParseUint(sport, 10, 16)
+	if e != nil {
+		return
+	}
+	if len(host) > 255 || len(user) > 255 || len(pass) > 255 {
+		e = errors.New("SOCKS5: host name or credentials too long")
+		return
+	}
+
+	if conn, e = net.DialTimeout("tcp", proxy, timeout); e != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if e = socks5_connect(conn, host, uint16(port), user, pass); e != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func socks5_connect(conn net.Conn, host string, port uint16, user, pass string) (e error) {
+	var b [2]byte
+
+	if user != "" || pass != "" {
+		_, e = conn.Write([]byte{5, 2, 0, 2}) // no authentication or username/password
+	} else {
+		_, e = conn.Write([]byte{5, 1, 0})
+	}
+	if e != nil {
+		return
+	}
+	if _, e = io.ReadFull(conn, b[:]); e != nil {
+		return
+	}
+	if b[0] != 5 {
+		return errors.New("SOCKS5: bad proxy version")
+	}
+	switch b[1] {
+		case 0:
+		case 2:
+			if user == "" && pass == "" {
+				return errors.New("SOCKS5: proxy wants authentication")
+			}
+			req := []byte{1, byte(len(user))}
+			req = append(req, user...)
+			req = append(req, byte(len(pass)))
+			req = append(req, pass...)
+			if _, e = conn.Write(req); e != nil {
+				return
+			}
+			if _, e = io.ReadFull(conn, b[:]); e != nil {
+				return
+			}
+			if b[1] != 0 {
+				return errors.New("SOCKS5: authentication failed")
+			}
+		default:
+			return errors.New("SOCKS5: no acceptable authentication method")
+	}
+
+	req := []byte{5, 1, 0, 3, byte(len(host))} // CONNECT to domain name
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, e = conn.Write(req); e != nil {
+		return
+	}
+
+	var rep [4]byte
+	if _, e = io.ReadFull(conn, rep[:]); e != nil {
+		return
+	}
+	if rep[0] != 5 {
+		return errors.New("SOCKS5: bad proxy version")
+	}
+	if rep[1] != 0 {
+		if int(rep[1]) < len(socks5_errors) {
+			return errors.New("SOCKS5: " + socks5_errors[rep[1]])
+		}
+		return errors.New("SOCKS5: connect failed with code " + strconv.Itoa(int(rep[1])))
+	}
+
+	// skip the bound address
+	var le int
+	switch rep[3] {
+		case 1: le = 4
+		case 4: le = 16
+		case 3:
+			if _, e = io.ReadFull(conn, b[:1]); e != nil {
+				return
+			}
+			le = int(b[0])
+		default:
+			return errors.New("SOCKS5: bad address type in reply")
+	}
+	_, e = io.ReadFull(conn, make([]byte, le+2))
+	return
+}
@@ -0,0 +1,168 @@
+package tor
+
+import (
+	"io"
+	"net"
+	"time"
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+func TestOnion(t *testing.T) {
+	const addr = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+	pk, e := DecodeOnion(addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if EncodeOnion(pk) != addr {
+		t.Error("Roundtrip failed", EncodeOnion(pk))
+	}
+	if _, e = DecodeOnion(strings.ToUpper(addr[:56])); e != nil {
+		t.Error("Upper case without suffix", e)
+	}
+	if _, e = DecodeOnion("duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczae.onion"); e == nil {
+		t.Error("Bad checksum accepted")
+	}
+	if _, e = DecodeOnion("expyuzz4wqqyqhjn.onion"); e == nil {
+		t.Error("v2 address accepted")
+	}
+}
+
+// Runs a fake server that handles a single connection
+func fake_server(t *testing.T, handle func(c net.Conn)) string {
+	lis, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		defer lis.Close()
+		c, e := lis.Accept()
+		if e != nil {
+			return
+		}
+		c.SetDeadline(time.Now().Add(5*time.Second))
+		handle(c)
+		c.Close()
+	}()
+	return lis.Addr().String()
+}
+
+func TestSOCKS5(t *testing.T) {
+	proxy := fake_server(t, func(c net.Conn) {
+		var b [512]byte
+		io.ReadFull(c, b[:4])
+		if !bytes.Equal(b[:4], []byte{5, 2, 0, 2}) {
+			return
+		}
+		c.Write([]byte{5, 2})
+		io.ReadFull(c, b[:2])
+		io.ReadFull(c, b[2:2+b[1]])
+		user := string(b[2:2+b[1]])
+		io.ReadFull(c, b[:1])
+		io.ReadFull(c, b[1:1+b[0]])
+		if user != "usr" || string(b[1:1+b[0]]) != "pwd" {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+		io.ReadFull(c, b[:5])
+		io.ReadFull(c, b[5:5+b[4]+2])
+		if string(b[5:5+b[4]]) != "example.onion" || b[5+b[4]] != 0x20 || b[6+b[4]] != 0x8d {
+			c.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		c.Write([]byte{5, 0, 0, 3, 3, 'a', 'b', 'c', 0, 0})
+		c.Write([]byte("hello"))
+	})
+	conn, e := DialSOCKS5(proxy, "example.onion:8333", "usr", "pwd", 5*time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	var b [5]byte
+	if _, e = io.ReadFull(conn, b[:]); e != nil || string(b[:]) != "hello" {
+		t.Error("Bad data after connect", e)
+	}
+
+	proxy = fake_server(t, func(c net.Conn) {
+		var b [64]byte
+		io.ReadFull(c, b[:3])
+		c.Write([]byte{5, 0})
+		io.ReadFull(c, b[:5])
+		io.ReadFull(c, b[5:5+b[4]+2])
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+	})
+	if _, e = DialSOCKS5(proxy, "1.2.3.4:8333", "", "", 5*time.Second); e == nil || !strings.Contains(e.Error(), "refused") {
+		t.Error("Expected connection refused error", e)
+	}
+}
+
+func TestControl(t *testing.T) {
+	cookie := []byte("0123456789abcdef0123456789abcdef")
+	cookie_file := filepath.Join(t.TempDir(), "control_auth_cookie")
+	ioutil.WriteFile(cookie_file, cookie, 0600)
+	server_nonce := []byte("server nonce - 32 bytes long....")
+
+	ctrl := fake_server(t, func(c net.Conn) {
+		rd := bufio.NewReader(c)
+		var client_nonce []byte
+		mac := func(key string) []byte {
+			h := hmac.New(sha256.New, []byte(key))
+			h.Write(cookie)
+			h.Write(client_nonce)
+			h.Write(server_nonce)
+			return h.Sum(nil)
+		}
+		for {
+			ln, e := rd.ReadString('\n')
+			if e != nil {
+				return
+			}
+			cmd := strings.Fields(ln)
+			switch cmd[0] {
+				case "PROTOCOLINFO":
+					c.Write([]byte("250-PROTOCOLINFO 1\r\n250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=\"" +
+						cookie_file + "\"\r\n250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n"))
+				case "AUTHCHALLENGE":
+					client_nonce, _ = hex.DecodeString(cmd[2])
+					c.Write([]byte("250 AUTHCHALLENGE SERVERHASH=" +
+						hex.EncodeToString(mac("Tor safe cookie authentication server-to-controller hash")) +
+						" SERVERNONCE=" + hex.EncodeToString(server_nonce) + "\r\n"))
+				case "AUTHENTICATE":
+					if cmd[1] != hex.EncodeToString(mac("Tor safe cookie authentication controller-to-server hash")) {
+						c.Write([]byte("515 Authentication failed\r\n"))
+						return
+					}
+					c.Write([]byte("250 OK\r\n"))
+				case "ADD_ONION":
+					if cmd[1] != "NEW:ED25519-V3" || cmd[2] != "Port=8333,127.0.0.1:1234" {
+						c.Write([]byte("512 Bad arguments\r\n"))
+						continue
+					}
+					c.Write([]byte("250-ServiceID=abcdef\r\n250-PrivateKey=ED25519-V3:a2V5\r\n250 OK\r\n"))
+				default:
+					c.Write([]byte("510 Unrecognized command\r\n"))
+			}
+		}
+	})
+
+	c, e := NewControl(ctrl, "", 5*time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	id, key, e := c.AddOnion("NEW:ED25519-V3", 8333, "127.0.0.1:1234")
+	if e != nil || id != "abcdef" || key != "ED25519-V3:a2V5" {
+		t.Error("AddOnion failed", id, key, e)
+	}
+	if _, e = c.Command("GETINFO version"); e == nil || !strings.HasPrefix(e.Error(), "Tor: 510") {
+		t.Error("Expected error reply", e)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"hash/crc64"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
@@ -10,11 +11,17 @@ type OnePeer struct {
 	btc.NetAddr
 	Time uint32  // When seen last time
 	Banned uint32 // time when this address baned or zero if never
+
+	// For networks other than IPv4 and IPv6 (which use NetAddr fields):
+	NetID byte // BIP155 network ID
+	Addr []byte
 }
 
 
 var crctab = crc64.MakeTable(crc64.ISO)
 
+var ipv4_prefix = []byte{0,0,0,0,0,0,0,0,0,0,0xff,0xff}
+
 
 /*
 Serialized peer record (all values are LSB unless specified otherwise):
@@ -24,6 +31,8 @@ Serialized peer record (all values are LSB unless specified otherwise):
  [24:28] - IPv4 (network order)
  [28:30] - TCP port (big endian)
  [30:34] - OPTIONAL: if present, unix timestamp of when the peer was banned
+ [34] - OPTIONAL: if present, BIP155 network ID of the address that follows (Tor, I2P, CJDNS)
+ [35:] - the address
 */
 
 
@@ -41,12 +50,22 @@ func NewPeer(v []byte) (p *OnePeer) {
 	if len(v)>=34 {
 		p.Banned = binary.LittleEndian.Uint32(v[30:34])
 	}
+	if len(v)>=35 {
+		p.NetID = v[34]
+		p.Addr = make([]byte, len(v)-35)
+		copy(p.Addr, v[35:])
+	}
 	return
 }
 
 
 func (p *OnePeer) Bytes() (res []byte) {
-	if p.Banned != 0 {
+	if p.NetID != 0 {
+		res = make([]byte, 35+len(p.Addr))
+		binary.LittleEndian.PutUint32(res[30:34], p.Banned)
+		res[34] = p.NetID
+		copy(res[35:], p.Addr)
+	} else if p.Banned != 0 {
 		res = make([]byte, 34)
 		binary.LittleEndian.PutUint32(res[30:34], p.Banned)
 	} else {
@@ -63,8 +82,68 @@ func (p *OnePeer) Bytes() (res []byte) {
 
 func (p *OnePeer) UniqID() (uint64) {
 	h := crc64.New(crctab)
+	if p.NetID != 0 {
+		h.Write([]byte{p.NetID})
+		h.Write(p.Addr)
+	}
 	h.Write(p.Ip6[:])
 	h.Write(p.Ip4[:])
 	h.Write([]byte{byte(p.Port>>8),byte(p.Port)})
 	return h.Sum64()
 }
+
+
+// Returns BIP155 network ID of the peer's address
+func (p *OnePeer) Network() byte {
+	if p.NetID != 0 {
+		return p.NetID
+	}
+	if bytes.Equal(p.Ip6[:], ipv4_prefix) || bytes.Equal(p.Ip6[:], make([]byte, 12)) {
+		return btc.NET_IPV4
+	}
+	return btc.NET_IPV6
+}
+
+
+// Makes the peer record from "addrv2" entry (or nil for an unsupported network)
+func NewPeerFromAddrV2(a *btc.AddrV2) (p *OnePeer) {
+	if !btc.NetAddrLenOK(a.NetID, len(a.Addr)) {
+		return
+	}
+	p = new(OnePeer)
+	p.Time = a.Time
+	p.Services = a.Services
+	p.Port = a.Port
+	switch a.NetID {
+		case btc.NET_IPV4:
+			copy(p.Ip6[:], ipv4_prefix)
+			copy(p.Ip4[:], a.Addr)
+		case btc.NET_IPV6:
+			if bytes.Equal(a.Addr[:12], ipv4_prefix) {
+				return nil // BIP155: IPv4 mapped addresses are not allowed here
+			}
+			copy(p.Ip6[:], a.Addr[:12])
+			copy(p.Ip4[:], a.Addr[12:])
+		case btc.NET_TORV2:
+			return nil
+		default:
+			p.NetID = a.NetID
+			p.Addr = append([]byte{}, a.Addr...)
+	}
+	return
+}
+
+
+// Returns the peer as "addrv2" entry
+func (p *OnePeer) AddrV2() (a *btc.AddrV2) {
+	a = &btc.AddrV2{Time:p.Time, Services:p.Services, Port:p.Port}
+	switch a.NetID = p.Network(); a.NetID {
+		case btc.NET_IPV4:
+			a.Addr = append([]byte{}, p.Ip4[:]...)
+		case btc.NET_IPV6:
+			a.Addr = append(append([]byte{}, p.Ip6[:]...), p.Ip4[:]...)
+		default:
+			a.Addr = p.Addr
+	}
+	return
+}
@@ -0,0 +1,519 @@
+package psbt
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/hex"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+type reader struct {
+	b []byte
+	pos int
+}
+
+func (r *reader) vlen() (res uint64, e error) {
+	res, n := btc.VULe(r.b[r.pos:])
+	if n == 0 {
+		e = errors.New("PSBT: unexpected end of data")
+		return
+	}
+	r.pos += n
+	return
+}
+
+func (r *reader) bytes(n uint64) (res []byte, e error) {
+	if n > uint64(len(r.b) - r.pos) {
+		e = errors.New("PSBT: unexpected end of data")
+		return
+	}
+	res = make([]byte, int(n))
+	copy(res, r.b[r.pos:])
+	r.pos += int(n)
+	return
+}
+
+// Reads the next key/value pair. Returns nil key at the end of map.
+func (r *reader) pair() (key, value []byte, e error) {
+	var le uint64
+	if le, e = r.vlen(); e != nil || le == 0 {
+		return
+	}
+	if key, e = r.bytes(le); e != nil {
+		return
+	}
+	if le, e = r.vlen(); e != nil {
+		return
+	}
+	value, e = r.bytes(le)
+	return
+}
+
+// Reads all the pairs of a map, checking for duplicate keys
+func (r *reader) read_map() (res []*KeyValue, e error) {
+	was := make(map[string]bool)
+	for {
+		var key, value []byte
+		if key, value, e = r.pair(); e != nil || key == nil {
+			return
+		}
+		if was[string(key)] {
+			e = errors.New("PSBT: duplicate key " + hex.EncodeToString(key))
+			return
+		}
+		was[string(key)] = true
+		res = append(res, &KeyValue{Key:key, Value:value})
+	}
+}
+
+
+// Splits the key into the type and the key data
+func key_type(key []byte) (typ uint64, data []byte) {
+	typ, n := btc.VULe(key)
+	data = key[n:]
+	return
+}
+
+func expect_nodata(typ uint64, data []byte) error {
+	if len(data) != 0 {
+		return errors.New(fmt.Sprintf("PSBT: unexpected key data for type 0x%02x", typ))
+	}
+	return nil
+}
+
+func expect_u32(typ uint64, value []byte) (uint32, error) {
+	if len(value) != 4 {
+		return 0, errors.New(fmt.Sprintf("PSBT: value of type 0x%02x must be 4 bytes long", typ))
+	}
+	return binary.LittleEndian.Uint32(value), nil
+}
+
+func new_bip32(pubkey, value []byte) (d *Bip32Derivation, e error) {
+	if len(value) < 4 || len(value) % 4 != 0 {
+		e = errors.New("PSBT: bad BIP32 derivation path")
+		return
+	}
+	d = &Bip32Derivation{Pubkey:pubkey, Fingerprint:binary.LittleEndian.Uint32(value)}
+	for i := 4; i < len(value); i += 4 {
+		d.Path = append(d.Path, binary.LittleEndian.Uint32(value[i:]))
+	}
+	return
+}
+
+func is_pubkey(d []byte) bool {
+	return len(d) == 33 && (d[0] == 2 || d[0] == 3) || len(d) == 65 && d[0] == 4
+}
+
+func parse_witness(value []byte) (w [][]byte, e error) {
+	r := &reader{b:value}
+	var cnt, le uint64
+	if cnt, e = r.vlen(); e != nil {
+		return
+	}
+	w = make([][]byte, 0, int(cnt) & 0xff)
+	for i := uint64(0); i < cnt; i++ {
+		var d []byte
+		if le, e = r.vlen(); e != nil {
+			return
+		}
+		if d, e = r.bytes(le); e != nil {
+			return
+		}
+		w = append(w, d)
+	}
+	if r.pos != len(value) {
+		e = errors.New("PSBT: extra data after the witness")
+	}
+	return
+}
+
+
+// Decodes binary PSBT (version 0 or 2)
+func Parse(data []byte) (p *Psbt, e error) {
+	var kvs []*KeyValue
+	var unsigned_tx *btc.Tx
+	var in_cnt, out_cnt uint64
+	var has_txver, has_incnt, has_outcnt bool
+
+	if len(data) < len(Magic) || !bytes.Equal(data[:len(Magic)], Magic) {
+		e = errors.New("PSBT: invalid magic bytes")
+		return
+	}
+	r := &reader{b:data, pos:len(Magic)}
+
+	if kvs, e = r.read_map(); e != nil {
+		return
+	}
+	p = new(Psbt)
+	for _, rec := range kvs {
+		typ, kd := key_type(rec.Key)
+		switch typ {
+			case PSBT_GLOBAL_UNSIGNED_TX:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+				var n int
+				if unsigned_tx, n = btc.NewTx(rec.Value); unsigned_tx == nil || n != len(rec.Value) {
+					e = errors.New("PSBT: cannot decode the unsigned transaction")
+					return
+				}
+				if unsigned_tx.SegWit != nil {
+					e = errors.New("PSBT: the unsigned transaction has witness data")
+					return
+				}
+				for _, in := range unsigned_tx.TxIn {
+					if len(in.ScriptSig) != 0 {
+						e = errors.New("PSBT: the unsigned transaction has non-empty scriptSig")
+						return
+					}
+				}
+
+			case PSBT_GLOBAL_XPUB:
+				if len(kd) != 78 {
+					e = errors.New("PSBT: bad size of global xpub")
+					return
+				}
+				var d *Bip32Derivation
+				if d, e = new_bip32(kd, rec.Value); e != nil {
+					return
+				}
+				p.Xpubs = append(p.Xpubs, d)
+
+			case PSBT_GLOBAL_TX_VERSION:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+				if p.TxVersion, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+				has_txver = true
+
+			case PSBT_GLOBAL_FALLBACK_LOCKTIME:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+				if p.FallbackLocktime, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+
+			case PSBT_GLOBAL_INPUT_COUNT, PSBT_GLOBAL_OUTPUT_COUNT:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+				cnt, n := btc.VULe(rec.Value)
+				if n == 0 || n != len(rec.Value) {
+					e = errors.New("PSBT: bad input/output count")
+					return
+				}
+				if typ == PSBT_GLOBAL_INPUT_COUNT {
+					in_cnt, has_incnt = cnt, true
+				} else {
+					out_cnt, has_outcnt = cnt, true
+				}
+
+			case PSBT_GLOBAL_TX_MODIFIABLE:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+				if len(rec.Value) != 1 {
+					e = errors.New("PSBT: bad size of tx modifiable flags")
+					return
+				}
+				p.TxModifiable = rec.Value[0]
+
+			case PSBT_GLOBAL_VERSION:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+				if p.Version, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+
+			default:
+				p.Unknown = append(p.Unknown, rec)
+		}
+	}
+
+	if p.Version == 0 {
+		if unsigned_tx == nil {
+			e = errors.New("PSBT: no unsigned transaction")
+			return
+		}
+		if has_txver || has_incnt || has_outcnt || p.FallbackLocktime != 0 || p.TxModifiable != 0 {
+			e = errors.New("PSBT: version 2 field in version 0 PSBT")
+			return
+		}
+		var tmp *Psbt
+		if tmp, e = New(unsigned_tx); e != nil {
+			return
+		}
+		p.TxVersion, p.FallbackLocktime = tmp.TxVersion, tmp.FallbackLocktime
+		p.Inputs, p.Outputs = tmp.Inputs, tmp.Outputs
+	} else if p.Version == 2 {
+		if unsigned_tx != nil {
+			e = errors.New("PSBT: unsigned transaction in version 2 PSBT")
+			return
+		}
+		if !has_txver || !has_incnt || !has_outcnt {
+			e = errors.New("PSBT: missing required global field")
+			return
+		}
+		if p.TxVersion < 2 {
+			e = errors.New("PSBT: transaction version must be at least 2")
+			return
+		}
+		if in_cnt > uint64(len(data)) || out_cnt > uint64(len(data)) {
+			e = errors.New("PSBT: too many inputs/outputs")
+			return
+		}
+		p.Inputs = make([]*Input, int(in_cnt))
+		for i := range p.Inputs {
+			p.Inputs[i] = &Input{Sequence:0xffffffff}
+		}
+		p.Outputs = make([]*Output, int(out_cnt))
+		for i := range p.Outputs {
+			p.Outputs[i] = new(Output)
+		}
+	} else {
+		e = errors.New(fmt.Sprint("PSBT: unsupported version ", p.Version))
+		return
+	}
+
+	for i, in := range p.Inputs {
+		if kvs, e = r.read_map(); e != nil {
+			return
+		}
+		if e = p.parse_input(in, kvs); e != nil {
+			e = errors.New(fmt.Sprint(e.Error(), " - input ", i))
+			return
+		}
+	}
+
+	for i, out := range p.Outputs {
+		if kvs, e = r.read_map(); e != nil {
+			return
+		}
+		if e = p.parse_output(out, kvs); e != nil {
+			e = errors.New(fmt.Sprint(e.Error(), " - output ", i))
+			return
+		}
+	}
+
+	if r.pos != len(data) {
+		e = errors.New("PSBT: extra data at the end")
+	}
+	return
+}
+
+
+func (p *Psbt) parse_input(in *Input, kvs []*KeyValue) (e error) {
+	var has_txid, has_index bool
+	var n int
+
+	for _, rec := range kvs {
+		typ, kd := key_type(rec.Key)
+		if typ >= PSBT_IN_PREVIOUS_TXID && typ <= PSBT_IN_REQUIRED_HEIGHT_LOCKTIME && p.Version < 2 {
+			return errors.New("PSBT: version 2 field in version 0 PSBT")
+		}
+		switch typ {
+			case PSBT_IN_NON_WITNESS_UTXO, PSBT_IN_WITNESS_UTXO, PSBT_IN_SIGHASH_TYPE, PSBT_IN_REDEEM_SCRIPT,
+				PSBT_IN_WITNESS_SCRIPT, PSBT_IN_FINAL_SCRIPTSIG, PSBT_IN_FINAL_SCRIPTWITNESS, PSBT_IN_PREVIOUS_TXID,
+				PSBT_IN_OUTPUT_INDEX, PSBT_IN_SEQUENCE, PSBT_IN_REQUIRED_TIME_LOCKTIME, PSBT_IN_REQUIRED_HEIGHT_LOCKTIME,
+				PSBT_IN_TAP_KEY_SIG, PSBT_IN_TAP_INTERNAL_KEY, PSBT_IN_TAP_MERKLE_ROOT:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+		}
+		switch typ {
+			case PSBT_IN_NON_WITNESS_UTXO:
+				if in.NonWitnessUtxo, n = btc.NewTx(rec.Value); in.NonWitnessUtxo == nil || n != len(rec.Value) {
+					return errors.New("PSBT: cannot decode non-witness utxo")
+				}
+				in.NonWitnessUtxo.SetHash(rec.Value)
+
+			case PSBT_IN_WITNESS_UTXO:
+				if in.WitnessUtxo, n = btc.NewTxOut(rec.Value); in.WitnessUtxo == nil || n != len(rec.Value) {
+					return errors.New("PSBT: cannot decode witness utxo")
+				}
+
+			case PSBT_IN_PARTIAL_SIG:
+				if !is_pubkey(kd) {
+					return errors.New("PSBT: invalid public key of partial signature")
+				}
+				in.PartialSigs = append(in.PartialSigs, &PartialSig{Pubkey:kd, Sig:rec.Value})
+
+			case PSBT_IN_SIGHASH_TYPE:
+				if in.SighashType, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+
+			case PSBT_IN_REDEEM_SCRIPT:
+				in.RedeemScript = rec.Value
+
+			case PSBT_IN_WITNESS_SCRIPT:
+				in.WitnessScript = rec.Value
+
+			case PSBT_IN_BIP32_DERIVATION:
+				var d *Bip32Derivation
+				if !is_pubkey(kd) {
+					return errors.New("PSBT: invalid public key of BIP32 derivation")
+				}
+				if d, e = new_bip32(kd, rec.Value); e != nil {
+					return
+				}
+				in.Bip32Derivation = append(in.Bip32Derivation, d)
+
+			case PSBT_IN_FINAL_SCRIPTSIG:
+				in.FinalScriptSig = rec.Value
+
+			case PSBT_IN_FINAL_SCRIPTWITNESS:
+				if in.FinalScriptWitness, e = parse_witness(rec.Value); e != nil {
+					return
+				}
+
+			case PSBT_IN_PREVIOUS_TXID:
+				if len(rec.Value) != 32 {
+					return errors.New("PSBT: bad size of previous txid")
+				}
+				copy(in.PrevOut.Hash[:], rec.Value)
+				has_txid = true
+
+			case PSBT_IN_OUTPUT_INDEX:
+				if in.PrevOut.Vout, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+				has_index = true
+
+			case PSBT_IN_SEQUENCE:
+				if in.Sequence, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+
+			case PSBT_IN_REQUIRED_TIME_LOCKTIME:
+				if in.RequiredTimeLocktime, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+				if in.RequiredTimeLocktime < LOCKTIME_THRESHOLD {
+					return errors.New("PSBT: required time locktime below the threshold")
+				}
+
+			case PSBT_IN_REQUIRED_HEIGHT_LOCKTIME:
+				if in.RequiredHeightLocktime, e = expect_u32(typ, rec.Value); e != nil {
+					return
+				}
+				if in.RequiredHeightLocktime == 0 || in.RequiredHeightLocktime >= LOCKTIME_THRESHOLD {
+					return errors.New("PSBT: bad required height locktime")
+				}
+
+			case PSBT_IN_TAP_KEY_SIG:
+				if len(rec.Value) != 64 && len(rec.Value) != 65 {
+					return errors.New("PSBT: bad size of taproot key signature")
+				}
+				in.TapKeySig = rec.Value
+
+			case PSBT_IN_TAP_INTERNAL_KEY:
+				if len(rec.Value) != 32 {
+					return errors.New("PSBT: bad size of taproot internal key")
+				}
+				in.TapInternalKey = rec.Value
+
+			case PSBT_IN_TAP_MERKLE_ROOT:
+				if len(rec.Value) != 32 {
+					return errors.New("PSBT: bad size of taproot merkle root")
+				}
+				in.TapMerkleRoot = rec.Value
+
+			default:
+				in.Unknown = append(in.Unknown, rec)
+		}
+	}
+
+	if p.Version >= 2 && (!has_txid || !has_index) {
+		return errors.New("PSBT: missing previous txid or output index")
+	}
+	if in.NonWitnessUtxo != nil && in.NonWitnessUtxo.Hash.Hash != in.PrevOut.Hash {
+		return errors.New("PSBT: non-witness utxo does not match the input")
+	}
+	return
+}
+
+
+func (p *Psbt) parse_output(out *Output, kvs []*KeyValue) (e error) {
+	var has_amount, has_script bool
+
+	for _, rec := range kvs {
+		typ, kd := key_type(rec.Key)
+		if (typ == PSBT_OUT_AMOUNT || typ == PSBT_OUT_SCRIPT) && p.Version < 2 {
+			return errors.New("PSBT: version 2 field in version 0 PSBT")
+		}
+		switch typ {
+			case PSBT_OUT_REDEEM_SCRIPT, PSBT_OUT_WITNESS_SCRIPT, PSBT_OUT_SCRIPT, PSBT_OUT_AMOUNT, PSBT_OUT_TAP_INTERNAL_KEY:
+				if e = expect_nodata(typ, kd); e != nil {
+					return
+				}
+		}
+		switch typ {
+			case PSBT_OUT_REDEEM_SCRIPT:
+				out.RedeemScript = rec.Value
+
+			case PSBT_OUT_WITNESS_SCRIPT:
+				out.WitnessScript = rec.Value
+
+			case PSBT_OUT_BIP32_DERIVATION:
+				var d *Bip32Derivation
+				if !is_pubkey(kd) {
+					return errors.New("PSBT: invalid public key of BIP32 derivation")
+				}
+				if d, e = new_bip32(kd, rec.Value); e != nil {
+					return
+				}
+				out.Bip32Derivation = append(out.Bip32Derivation, d)
+
+			case PSBT_OUT_AMOUNT:
+				if len(rec.Value) != 8 {
+					return errors.New("PSBT: bad size of output amount")
+				}
+				out.Amount = binary.LittleEndian.Uint64(rec.Value)
+				has_amount = true
+
+			case PSBT_OUT_SCRIPT:
+				out.Script = rec.Value
+				has_script = true
+
+			case PSBT_OUT_TAP_INTERNAL_KEY:
+				if len(rec.Value) != 32 {
+					return errors.New("PSBT: bad size of taproot internal key")
+				}
+				out.TapInternalKey = rec.Value
+
+			default:
+				out.Unknown = append(out.Unknown, rec)
+		}
+	}
+
+	if p.Version >= 2 && (!has_amount || !has_script) {
+		return errors.New("PSBT: missing output amount or script")
+	}
+	return
+}
+
+
+// Decodes PSBT given as binary, base64 or hex encoded data
+func Decode(data []byte) (*Psbt, error) {
+	if bytes.HasPrefix(data, Magic) {
+		return Parse(data)
+	}
+	s := strings.TrimSpace(string(data))
+	if strings.HasPrefix(s, "70736274ff") { // hex encoded magic
+		if d, er := hex.DecodeString(s); er == nil {
+			return Parse(d)
+		}
+	} else if d, er := base64.StdEncoding.DecodeString(s); er == nil {
+		return Parse(d)
+	}
+	return nil, errors.New("PSBT: unknown data format")
+}
@@ -0,0 +1,420 @@
+package psbt
+
+import (
+	"fmt"
+	"sort"
+	"bytes"
+	"errors"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Partially Signed Bitcoin Transaction - BIP174 (version 0) and BIP370 (version 2)
+
+const (
+	PSBT_GLOBAL_UNSIGNED_TX = 0x00
+	PSBT_GLOBAL_XPUB = 0x01
+	PSBT_GLOBAL_TX_VERSION = 0x02
+	PSBT_GLOBAL_FALLBACK_LOCKTIME = 0x03
+	PSBT_GLOBAL_INPUT_COUNT = 0x04
+	PSBT_GLOBAL_OUTPUT_COUNT = 0x05
+	PSBT_GLOBAL_TX_MODIFIABLE = 0x06
+	PSBT_GLOBAL_VERSION = 0xfb
+
+	PSBT_IN_NON_WITNESS_UTXO = 0x00
+	PSBT_IN_WITNESS_UTXO = 0x01
+	PSBT_IN_PARTIAL_SIG = 0x02
+	PSBT_IN_SIGHASH_TYPE = 0x03
+	PSBT_IN_REDEEM_SCRIPT = 0x04
+	PSBT_IN_WITNESS_SCRIPT = 0x05
+	PSBT_IN_BIP32_DERIVATION = 0x06
+	PSBT_IN_FINAL_SCRIPTSIG = 0x07
+	PSBT_IN_FINAL_SCRIPTWITNESS = 0x08
+	PSBT_IN_PREVIOUS_TXID = 0x0e
+	PSBT_IN_OUTPUT_INDEX = 0x0f
+	PSBT_IN_SEQUENCE = 0x10
+	PSBT_IN_REQUIRED_TIME_LOCKTIME = 0x11
+	PSBT_IN_REQUIRED_HEIGHT_LOCKTIME = 0x12
+	PSBT_IN_TAP_KEY_SIG = 0x13
+	PSBT_IN_TAP_INTERNAL_KEY = 0x17
+	PSBT_IN_TAP_MERKLE_ROOT = 0x18
+
+	PSBT_OUT_REDEEM_SCRIPT = 0x00
+	PSBT_OUT_WITNESS_SCRIPT = 0x01
+	PSBT_OUT_BIP32_DERIVATION = 0x02
+	PSBT_OUT_AMOUNT = 0x03
+	PSBT_OUT_SCRIPT = 0x04
+	PSBT_OUT_TAP_INTERNAL_KEY = 0x05
+
+	LOCKTIME_THRESHOLD = 500000000
+)
+
+var Magic = []byte{'p', 's', 'b', 't', 0xff}
+
+// Record of a key/value pair that we do not interpret (kept as it is)
+type KeyValue struct {
+	Key []byte // including the key type
+	Value []byte
+}
+
+// Master key fingerprint and the derivation path of a public key
+type Bip32Derivation struct {
+	Pubkey []byte // for global xpubs this is the 78 bytes serialized extended key
+	Fingerprint uint32
+	Path []uint32
+}
+
+type PartialSig struct {
+	Pubkey []byte
+	Sig []byte // DER encoded, with the hash type byte
+}
+
+type Input struct {
+	PrevOut btc.TxPrevOut
+	Sequence uint32
+	RequiredTimeLocktime uint32 // version 2 only (zero if not set)
+	RequiredHeightLocktime uint32 // version 2 only (zero if not set)
+
+	NonWitnessUtxo *btc.Tx
+	WitnessUtxo *btc.TxOut
+	PartialSigs []*PartialSig
+	SighashType uint32 // zero if not set
+	RedeemScript []byte
+	WitnessScript []byte
+	Bip32Derivation []*Bip32Derivation
+	FinalScriptSig []byte // not nil if set
+	FinalScriptWitness [][]byte // not nil if set
+	TapKeySig []byte
+	TapInternalKey []byte
+	TapMerkleRoot []byte
+
+	Unknown []*KeyValue
+}
+
+type Output struct {
+	Amount uint64
+	Script []byte
+
+	RedeemScript []byte
+	WitnessScript []byte
+	Bip32Derivation []*Bip32Derivation
+	TapInternalKey []byte
+
+	Unknown []*KeyValue
+}
+
+type Psbt struct {
+	Version uint32 // 0 or 2
+	TxVersion uint32
+	FallbackLocktime uint32 // for version 0 this is lock_time of the unsigned transaction
+	TxModifiable byte // version 2 only
+	Xpubs []*Bip32Derivation
+
+	Inputs []*Input
+	Outputs []*Output
+
+	Unknown []*KeyValue
+}
+
+
+// Creates version 0 PSBT from the given unsigned transaction
+func New(tx *btc.Tx) (p *Psbt, e error) {
+	p = new(Psbt)
+	p.TxVersion = tx.Version
+	p.FallbackLocktime = tx.Lock_time
+	for i := range tx.TxIn {
+		if len(tx.TxIn[i].ScriptSig) > 0 || tx.SegWit != nil && len(tx.SegWit[i]) > 0 {
+			e = errors.New(fmt.Sprint("PSBT: input ", i, " of the transaction is signed"))
+			return
+		}
+		p.Inputs = append(p.Inputs, &Input{PrevOut:tx.TxIn[i].Input, Sequence:tx.TxIn[i].Sequence})
+	}
+	for i := range tx.TxOut {
+		p.Outputs = append(p.Outputs, &Output{Amount:tx.TxOut[i].Value, Script:tx.TxOut[i].Pk_script})
+	}
+	return
+}
+
+
+// Returns the transaction's lock time (see BIP370 for version 2)
+func (p *Psbt) LockTime() uint32 {
+	if p.Version < 2 {
+		return p.FallbackLocktime
+	}
+	var has_time, has_height bool
+	var time_lock, height_lock uint32
+	for _, in := range p.Inputs {
+		if in.RequiredTimeLocktime != 0 {
+			has_time = true
+			if in.RequiredTimeLocktime > time_lock {
+				time_lock = in.RequiredTimeLocktime
+			}
+		}
+		if in.RequiredHeightLocktime != 0 {
+			has_height = true
+			if in.RequiredHeightLocktime > height_lock {
+				height_lock = in.RequiredHeightLocktime
+			}
+		}
+	}
+	for _, in := range p.Inputs {
+		// inputs that specify only one type of lock time decide which one is used
+		if in.RequiredTimeLocktime != 0 && in.RequiredHeightLocktime == 0 {
+			has_height = false
+		}
+		if in.RequiredHeightLocktime != 0 && in.RequiredTimeLocktime == 0 {
+			has_time = false
+		}
+	}
+	if has_height {
+		return height_lock
+	}
+	if has_time {
+		return time_lock
+	}
+	return p.FallbackLocktime
+}
+
+
+// Returns the unsigned transaction
+func (p *Psbt) UnsignedTx() (tx *btc.Tx) {
+	tx = new(btc.Tx)
+	tx.Version = p.TxVersion
+	tx.Lock_time = p.LockTime()
+	tx.TxIn = make([]*btc.TxIn, len(p.Inputs))
+	for i, in := range p.Inputs {
+		tx.TxIn[i] = &btc.TxIn{Input:in.PrevOut, Sequence:in.Sequence}
+	}
+	tx.TxOut = make([]*btc.TxOut, len(p.Outputs))
+	for i, out := range p.Outputs {
+		tx.TxOut[i] = &btc.TxOut{Value:out.Amount, Pk_script:out.Script}
+	}
+	tx.SetHash(tx.Serialize())
+	return
+}
+
+
+// Returns the output spent by the given input (nil if unknown)
+func (p *Psbt) SpentOutput(i int) *btc.TxOut {
+	in := p.Inputs[i]
+	if in.WitnessUtxo != nil {
+		return in.WitnessUtxo
+	}
+	if in.NonWitnessUtxo != nil && int(in.PrevOut.Vout) < len(in.NonWitnessUtxo.TxOut) {
+		return in.NonWitnessUtxo.TxOut[in.PrevOut.Vout]
+	}
+	return nil
+}
+
+
+// Returns the transaction fee (or an error if some input values are unknown)
+func (p *Psbt) Fee() (fee uint64, e error) {
+	var totin, totout uint64
+	for i := range p.Inputs {
+		out := p.SpentOutput(i)
+		if out == nil {
+			e = errors.New(fmt.Sprint("PSBT: unknown value of input ", i))
+			return
+		}
+		totin += out.Value
+	}
+	for _, out := range p.Outputs {
+		totout += out.Amount
+	}
+	if totout > totin {
+		e = errors.New("PSBT: outputs value exceeds inputs")
+		return
+	}
+	fee = totin - totout
+	return
+}
+
+
+func u32le(v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func vlen_bytes(v uint64) []byte {
+	buf := new(bytes.Buffer)
+	btc.WriteVlen(buf, v)
+	return buf.Bytes()
+}
+
+func kv(typ byte, keydata, value []byte) *KeyValue {
+	return &KeyValue{Key:append([]byte{typ}, keydata...), Value:value}
+}
+
+func bip32_value(d *Bip32Derivation) []byte {
+	res := u32le(d.Fingerprint)
+	for _, p := range d.Path {
+		res = append(res, u32le(p)...)
+	}
+	return res
+}
+
+func witness_bytes(w [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	btc.WriteVlen(buf, uint64(len(w)))
+	for _, d := range w {
+		btc.WriteVlen(buf, uint64(len(d)))
+		buf.Write(d)
+	}
+	return buf.Bytes()
+}
+
+func txout_bytes(out *btc.TxOut) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, out.Value)
+	btc.WriteVlen(buf, uint64(len(out.Pk_script)))
+	buf.Write(out.Pk_script)
+	return buf.Bytes()
+}
+
+// Writes the key/value pairs sorted by the keys, followed by the separator
+func write_map(buf *bytes.Buffer, kvs []*KeyValue) {
+	sort.Slice(kvs, func(a, b int) bool {
+		return bytes.Compare(kvs[a].Key, kvs[b].Key) < 0
+	})
+	for _, r := range kvs {
+		btc.WriteVlen(buf, uint64(len(r.Key)))
+		buf.Write(r.Key)
+		btc.WriteVlen(buf, uint64(len(r.Value)))
+		buf.Write(r.Value)
+	}
+	buf.WriteByte(0x00)
+}
+
+
+func (p *Psbt) Serialize() []byte {
+	var kvs []*KeyValue
+
+	buf := new(bytes.Buffer)
+	buf.Write(Magic)
+
+	if p.Version < 2 {
+		kvs = append(kvs, kv(PSBT_GLOBAL_UNSIGNED_TX, nil, p.UnsignedTx().Serialize()))
+	} else {
+		kvs = append(kvs, kv(PSBT_GLOBAL_TX_VERSION, nil, u32le(p.TxVersion)))
+		if p.FallbackLocktime != 0 {
+			kvs = append(kvs, kv(PSBT_GLOBAL_FALLBACK_LOCKTIME, nil, u32le(p.FallbackLocktime)))
+		}
+		kvs = append(kvs, kv(PSBT_GLOBAL_INPUT_COUNT, nil, vlen_bytes(uint64(len(p.Inputs)))))
+		kvs = append(kvs, kv(PSBT_GLOBAL_OUTPUT_COUNT, nil, vlen_bytes(uint64(len(p.Outputs)))))
+		if p.TxModifiable != 0 {
+			kvs = append(kvs, kv(PSBT_GLOBAL_TX_MODIFIABLE, nil, []byte{p.TxModifiable}))
+		}
+	}
+	for _, x := range p.Xpubs {
+		kvs = append(kvs, kv(PSBT_GLOBAL_XPUB, x.Pubkey, bip32_value(x)))
+	}
+	if p.Version > 0 {
+		kvs = append(kvs, kv(PSBT_GLOBAL_VERSION, nil, u32le(p.Version)))
+	}
+	write_map(buf, append(kvs, p.Unknown...))
+
+	for _, in := range p.Inputs {
+		kvs = nil
+		if in.NonWitnessUtxo != nil {
+			kvs = append(kvs, kv(PSBT_IN_NON_WITNESS_UTXO, nil, in.NonWitnessUtxo.SerializeNew()))
+		}
+		if in.WitnessUtxo != nil {
+			kvs = append(kvs, kv(PSBT_IN_WITNESS_UTXO, nil, txout_bytes(in.WitnessUtxo)))
+		}
+		for _, ps := range in.PartialSigs {
+			kvs = append(kvs, kv(PSBT_IN_PARTIAL_SIG, ps.Pubkey, ps.Sig))
+		}
+		if in.SighashType != 0 {
+			kvs = append(kvs, kv(PSBT_IN_SIGHASH_TYPE, nil, u32le(in.SighashType)))
+		}
+		if in.RedeemScript != nil {
+			kvs = append(kvs, kv(PSBT_IN_REDEEM_SCRIPT, nil, in.RedeemScript))
+		}
+		if in.WitnessScript != nil {
+			kvs = append(kvs, kv(PSBT_IN_WITNESS_SCRIPT, nil, in.WitnessScript))
+		}
+		for _, d := range in.Bip32Derivation {
+			kvs = append(kvs, kv(PSBT_IN_BIP32_DERIVATION, d.Pubkey, bip32_value(d)))
+		}
+		if in.FinalScriptSig != nil {
+			kvs = append(kvs, kv(PSBT_IN_FINAL_SCRIPTSIG, nil, in.FinalScriptSig))
+		}
+		if in.FinalScriptWitness != nil {
+			kvs = append(kvs, kv(PSBT_IN_FINAL_SCRIPTWITNESS, nil, witness_bytes(in.FinalScriptWitness)))
+		}
+		if p.Version >= 2 {
+			kvs = append(kvs, kv(PSBT_IN_PREVIOUS_TXID, nil, in.PrevOut.Hash[:]))
+			kvs = append(kvs, kv(PSBT_IN_OUTPUT_INDEX, nil, u32le(in.PrevOut.Vout)))
+			if in.Sequence != 0xffffffff {
+				kvs = append(kvs, kv(PSBT_IN_SEQUENCE, nil, u32le(in.Sequence)))
+			}
+			if in.RequiredTimeLocktime != 0 {
+				kvs = append(kvs, kv(PSBT_IN_REQUIRED_TIME_LOCKTIME, nil, u32le(in.RequiredTimeLocktime)))
+			}
+			if in.RequiredHeightLocktime != 0 {
+				kvs = append(kvs, kv(PSBT_IN_REQUIRED_HEIGHT_LOCKTIME, nil, u32le(in.RequiredHeightLocktime)))
+			}
+		}
+		if in.TapKeySig != nil {
+			kvs = append(kvs, kv(PSBT_IN_TAP_KEY_SIG, nil, in.TapKeySig))
+		}
+		if in.TapInternalKey != nil {
+			kvs = append(kvs, kv(PSBT_IN_TAP_INTERNAL_KEY, nil, in.TapInternalKey))
+		}
+		if in.TapMerkleRoot != nil {
+			kvs = append(kvs, kv(PSBT_IN_TAP_MERKLE_ROOT, nil, in.TapMerkleRoot))
+		}
+		write_map(buf, append(kvs, in.Unknown...))
+	}
+
+	for _, out := range p.Outputs {
+		kvs = nil
+		if out.RedeemScript != nil {
+			kvs = append(kvs, kv(PSBT_OUT_REDEEM_SCRIPT, nil, out.RedeemScript))
+		}
+		if out.WitnessScript != nil {
+			kvs = append(kvs, kv(PSBT_OUT_WITNESS_SCRIPT, nil, out.WitnessScript))
+		}
+		for _, d := range out.Bip32Derivation {
+			kvs = append(kvs, kv(PSBT_OUT_BIP32_DERIVATION, d.Pubkey, bip32_value(d)))
+		}
+		if p.Version >= 2 {
+			var a [8]byte
+			binary.LittleEndian.PutUint64(a[:], out.Amount)
+			kvs = append(kvs, kv(PSBT_OUT_AMOUNT, nil, a[:]))
+			kvs = append(kvs, kv(PSBT_OUT_SCRIPT, nil, out.Script))
+		}
+		if out.TapInternalKey != nil {
+			kvs = append(kvs, kv(PSBT_OUT_TAP_INTERNAL_KEY, nil, out.TapInternalKey))
+		}
+		write_map(buf, append(kvs, out.Unknown...))
+	}
+
+	return buf.Bytes()
+}
+
+
+// Base64 encoded PSBT
+func (p *Psbt) String() string {
+	return base64.StdEncoding.EncodeToString(p.Serialize())
+}
+
+
+// Converts the PSBT to the given version (0 or 2)
+func (p *Psbt) SetVersion(ver uint32) error {
+	if ver != 0 && ver != 2 {
+		return errors.New(fmt.Sprint("PSBT: unsupported version ", ver))
+	}
+	if ver < 2 && p.Version >= 2 {
+		p.FallbackLocktime = p.LockTime()
+		p.TxModifiable = 0
+		for _, in := range p.Inputs {
+			in.RequiredTimeLocktime = 0
+			in.RequiredHeightLocktime = 0
+		}
+	}
+	p.Version = ver
+	return nil
+}
@@ -0,0 +1,204 @@
+package psbt
+
+import (
+	"bytes"
+	"testing"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+type test_key struct {
+	priv, pub []byte
+	h160 [20]byte
+}
+
+func new_test_key(seed string) (k *test_key) {
+	k = new(test_key)
+	h := sha256.Sum256([]byte(seed))
+	k.priv = h[:]
+	k.pub = btc.PublicFromPrivate(k.priv, true)
+	k.h160 = btc.Rimp160AfterSha256(k.pub)
+	return
+}
+
+func p2sh_script(redeem []byte) []byte {
+	h := btc.Rimp160AfterSha256(redeem)
+	return append(append([]byte{0xa9, 20}, h[:]...), 0x87)
+}
+
+// Builds a transaction with inputs of all the supported types and a PSBT spending it
+func test_psbt(t *testing.T, keys []*test_key) (p *Psbt, prv *btc.Tx) {
+	ms2 := btc.NewMultiSig(2)
+	ms2.PublicKeys = [][]byte{keys[0].pub, keys[1].pub}
+	ws := ms2.P2SH()
+	wsh := sha256.Sum256(ws)
+
+	ms3 := btc.NewMultiSig(2)
+	ms3.PublicKeys = [][]byte{keys[0].pub, keys[1].pub, keys[2].pub}
+
+	p2wpkh := append([]byte{0, 20}, keys[2].h160[:]...)
+	tr := btc.NewAddrP2TR(keys[3].pub[1:], false)
+
+	prv = &btc.Tx{Version:2}
+	prv.TxIn = []*btc.TxIn{&btc.TxIn{Sequence:0xffffffff}}
+	prv.TxOut = []*btc.TxOut{
+		&btc.TxOut{Value:1000000, Pk_script:p2pkh_script(keys[0].h160[:])},
+		&btc.TxOut{Value:2000000, Pk_script:append([]byte{0, 20}, keys[1].h160[:]...)},
+		&btc.TxOut{Value:3000000, Pk_script:p2sh_script(p2wpkh)},
+		&btc.TxOut{Value:4000000, Pk_script:tr.OutScript()},
+		&btc.TxOut{Value:5000000, Pk_script:append([]byte{0, 32}, wsh[:]...)},
+		&btc.TxOut{Value:6000000, Pk_script:p2sh_script(ms3.P2SH())},
+	}
+	prv.SetHash(prv.Serialize())
+
+	tx := &btc.Tx{Version:2, Lock_time:123456}
+	for i := range prv.TxOut {
+		tx.TxIn = append(tx.TxIn, &btc.TxIn{Input:btc.TxPrevOut{Hash:prv.Hash.Hash, Vout:uint32(i)}, Sequence:0xfffffffd})
+	}
+	tx.TxOut = []*btc.TxOut{&btc.TxOut{Value:20000000, Pk_script:p2pkh_script(keys[3].h160[:])}}
+
+	var e error
+	if p, e = New(tx); e != nil {
+		t.Fatal(e)
+	}
+	for i, in := range p.Inputs {
+		if i == 0 || i == 5 {
+			in.NonWitnessUtxo = prv
+		} else {
+			in.WitnessUtxo = prv.TxOut[i]
+		}
+	}
+	p.Inputs[2].RedeemScript = p2wpkh
+	p.Inputs[4].WitnessScript = ws
+	p.Inputs[5].RedeemScript = ms3.P2SH()
+	return
+}
+
+func test_keys() (keys []*test_key) {
+	for _, s := range []string{"key1", "key2", "key3", "key4"} {
+		keys = append(keys, new_test_key(s))
+	}
+	return
+}
+
+func TestSignFinalize(t *testing.T) {
+	keys := test_keys()
+	p, prv := test_psbt(t, keys)
+
+	fee, e := p.Fee()
+	if e != nil || fee != 1000000 {
+		t.Fatal("Fee", fee, e)
+	}
+
+	raw := p.Serialize()
+	p2, e := Parse(raw)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(p2.Serialize(), raw) {
+		t.Error("Serialize/Parse roundtrip failed")
+	}
+
+	// first signer has only key1
+	if cnt, e := p.Sign(keys[0].priv, keys[0].pub); e != nil || cnt != 3 {
+		t.Fatal("Sign", cnt, e)
+	}
+	// second signer has the other keys
+	for _, k := range keys[1:] {
+		if _, e := p2.Sign(k.priv, k.pub); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if p.Finalize() == nil || p.IsComplete() {
+		t.Error("Finalize should fail with missing signatures")
+	}
+
+	// pass the partially signed one over serialization
+	if p, e = Decode([]byte(p.String())); e != nil {
+		t.Fatal(e)
+	}
+	if p2, e = Decode([]byte(hex.EncodeToString(p2.Serialize()))); e != nil {
+		t.Fatal(e)
+	}
+	if e = p.Combine(p2); e != nil {
+		t.Fatal(e)
+	}
+	if e = p.Finalize(); e != nil {
+		t.Fatal(e)
+	}
+	if p, e = Parse(p.Serialize()); e != nil {
+		t.Fatal(e)
+	}
+
+	tx, e := p.Extract()
+	if e != nil {
+		t.Fatal(e)
+	}
+	tx.Spent_outputs = prv.TxOut
+	for i := range tx.TxIn {
+		if !script.VerifyTxScript(prv.TxOut[i].Pk_script, prv.TxOut[i].Value, i, tx, script.STANDARD_VERIFY_FLAGS) {
+			t.Error("Input", i, "does not verify")
+		}
+	}
+}
+
+func TestVersion2(t *testing.T) {
+	p, _ := test_psbt(t, test_keys())
+	raw := p.Serialize()
+	txid := p.UnsignedTx().Hash.Hash
+
+	if e := p.SetVersion(2); e != nil {
+		t.Fatal(e)
+	}
+	p2, e := Parse(p.Serialize())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if p2.Version != 2 || p2.UnsignedTx().Hash.Hash != txid {
+		t.Error("Version 2 roundtrip failed")
+	}
+	if p2.LockTime() != 123456 {
+		t.Error("Bad lock time", p2.LockTime())
+	}
+	if e = p2.SetVersion(0); e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(p2.Serialize(), raw) {
+		t.Error("Conversion back to version 0 failed")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	p, _ := test_psbt(t, test_keys())
+	raw := p.Serialize()
+
+	if _, e := Decode([]byte("not a psbt")); e == nil {
+		t.Error("Garbage accepted")
+	}
+	if _, e := Parse(raw[:len(raw)-1]); e == nil {
+		t.Error("Truncated PSBT accepted")
+	}
+
+	// duplicate the unsigned transaction record
+	tx := p.UnsignedTx().Serialize()
+	dup := new(bytes.Buffer)
+	dup.Write(Magic)
+	for i := 0; i < 2; i++ {
+		dup.Write([]byte{1, PSBT_GLOBAL_UNSIGNED_TX})
+		btc.WriteVlen(dup, uint64(len(tx)))
+		dup.Write(tx)
+	}
+	dup.Write(raw[len(Magic) + 2 + len(vlen_bytes(uint64(len(tx)))) + len(tx):])
+	if _, e := Parse(dup.Bytes()); e == nil {
+		t.Error("Duplicate key accepted")
+	}
+
+	// a PSBT with a different transaction cannot be combined
+	p2, _ := test_psbt(t, test_keys())
+	p2.Inputs[0].Sequence = 0xffffffff
+	if p.Combine(p2) == nil {
+		t.Error("Combined different transactions")
+	}
+}
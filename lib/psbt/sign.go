@@ -0,0 +1,507 @@
+package psbt
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"crypto/sha256"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Returns true if the given script has a push of the data
+func script_has_push(scr, data []byte) bool {
+	var idx int
+	for idx < len(scr) {
+		_, pv, n, e := btc.GetOpcode(scr[idx:])
+		if e != nil {
+			return false
+		}
+		if bytes.Equal(pv, data) {
+			return true
+		}
+		idx += n
+	}
+	return false
+}
+
+func p2pkh_script(h160 []byte) []byte {
+	return append(append([]byte{0x76, 0xa9, 20}, h160...), 0x88, 0xac)
+}
+
+func push_data(d []byte) []byte {
+	buf := new(bytes.Buffer)
+	btc.WritePutLen(buf, uint32(len(d)))
+	buf.Write(d)
+	return buf.Bytes()
+}
+
+func (in *Input) IsFinalized() bool {
+	return in.FinalScriptSig != nil || in.FinalScriptWitness != nil
+}
+
+func (in *Input) partial_sig(pubkey []byte) []byte {
+	for _, ps := range in.PartialSigs {
+		if bytes.Equal(ps.Pubkey, pubkey) {
+			return ps.Sig
+		}
+	}
+	return nil
+}
+
+func (in *Input) add_partial_sig(pubkey, sig []byte) {
+	for _, ps := range in.PartialSigs {
+		if bytes.Equal(ps.Pubkey, pubkey) {
+			ps.Sig = sig
+			return
+		}
+	}
+	in.PartialSigs = append(in.PartialSigs, &PartialSig{Pubkey:pubkey, Sig:sig})
+}
+
+
+// Returns the script that the input is paying to (redeem script for P2SH)
+// and checks if redeem script matches the spent output.
+func (p *Psbt) spent_script(i int) (out *btc.TxOut, scr []byte, e error) {
+	in := p.Inputs[i]
+	if out = p.SpentOutput(i); out == nil {
+		e = errors.New(fmt.Sprint("PSBT: unknown output spent by input ", i))
+		return
+	}
+	scr = out.Pk_script
+	if btc.IsP2SH(scr) {
+		if in.RedeemScript == nil {
+			e = errors.New(fmt.Sprint("PSBT: missing redeem script for input ", i))
+			return
+		}
+		h := btc.Rimp160AfterSha256(in.RedeemScript)
+		if !bytes.Equal(h[:], scr[2:22]) {
+			e = errors.New(fmt.Sprint("PSBT: redeem script does not match input ", i))
+			return
+		}
+		scr = in.RedeemScript
+	}
+	return
+}
+
+
+// Sets Spent_outputs of the transaction (needed for taproot signature hash)
+func (p *Psbt) set_spent_outputs(tx *btc.Tx) error {
+	tx.Spent_outputs = make([]*btc.TxOut, len(p.Inputs))
+	for i := range p.Inputs {
+		if tx.Spent_outputs[i] = p.SpentOutput(i); tx.Spent_outputs[i] == nil {
+			tx.Spent_outputs = nil
+			return errors.New(fmt.Sprint("PSBT: unknown output spent by input ", i))
+		}
+	}
+	return nil
+}
+
+
+func ecdsa_sig(priv, hash []byte, hash_type uint32) ([]byte, error) {
+	r, s, er := btc.EcdsaSign(priv, hash)
+	if er != nil {
+		return nil, er
+	}
+	sig := &btc.Signature{HashType:byte(hash_type)}
+	sig.R.Set(r)
+	sig.S.Set(s)
+	return sig.Bytes(), nil
+}
+
+
+// Signs the given input with the private key, if the key can sign it.
+// pubkey must be the compressed public key of priv.
+// Supported are: P2PKH, P2PK, P2WPKH, P2TR (key path) and P2SH / P2WSH scripts (e.g. multisig).
+// Returns false if the input does not need signature from this key.
+func (p *Psbt) SignInput(i int, priv, pubkey []byte) (signed bool, e error) {
+	var out *btc.TxOut
+	var scr []byte
+
+	in := p.Inputs[i]
+	if in.IsFinalized() {
+		return
+	}
+	if out, scr, e = p.spent_script(i); e != nil {
+		return
+	}
+
+	tx := p.UnsignedTx()
+	hash_type := in.SighashType
+
+	ver, prog := btc.IsWitnessProgram(scr)
+	if prog == nil {
+		if in.NonWitnessUtxo == nil {
+			e = errors.New(fmt.Sprint("PSBT: input ", i, " needs non-witness utxo"))
+			return
+		}
+		h := btc.Rimp160AfterSha256(pubkey)
+		if len(scr)==25 && scr[0]==0x76 && scr[1]==0xa9 && scr[2]==20 && !bytes.Equal(scr[3:23], h[:]) ||
+			!script_has_push(scr, pubkey) && !script_has_push(scr, h[:]) {
+			return
+		}
+		if hash_type == 0 {
+			hash_type = btc.SIGHASH_ALL
+		}
+		var sig []byte
+		if sig, e = ecdsa_sig(priv, tx.SignatureHash(scr, i, int32(hash_type)), hash_type); e != nil {
+			return
+		}
+		in.add_partial_sig(pubkey, sig)
+		signed = true
+		return
+	}
+
+	if ver == 1 && len(prog) == 32 {
+		// taproot key path spending
+		q, _ := btc.TaprootOutputKey(pubkey[1:], in.TapMerkleRoot)
+		if !bytes.Equal(q, prog) {
+			return
+		}
+		if e = p.set_spent_outputs(tx); e != nil {
+			return
+		}
+		if hash_type > 0xff {
+			e = errors.New(fmt.Sprint("PSBT: invalid sighash type of input ", i))
+			return
+		}
+		h := tx.TaprootSigHash(&btc.TaprootExecData{CodeSepPos:0xffffffff}, i, byte(hash_type))
+		if h == nil {
+			e = errors.New(fmt.Sprint("PSBT: cannot calculate signature hash of input ", i))
+			return
+		}
+		sig := btc.SchnorrSign(btc.TaprootTweakPrivKey(priv, in.TapMerkleRoot), h)
+		if sig == nil {
+			e = errors.New("PSBT: SchnorrSign failed")
+			return
+		}
+		if hash_type != btc.SIGHASH_DEFAULT {
+			sig = append(sig, byte(hash_type))
+		}
+		in.TapKeySig = sig
+		if in.TapInternalKey == nil {
+			in.TapInternalKey = pubkey[1:]
+		}
+		signed = true
+		return
+	}
+
+	if ver != 0 {
+		e = errors.New(fmt.Sprint("PSBT: unsupported witness version of input ", i))
+		return
+	}
+
+	if hash_type == 0 {
+		hash_type = btc.SIGHASH_ALL
+	}
+	var script_code []byte
+	if len(prog) == 20 {
+		h := btc.Rimp160AfterSha256(pubkey)
+		if !bytes.Equal(h[:], prog) {
+			return
+		}
+		script_code = p2pkh_script(prog)
+	} else if len(prog) == 32 {
+		if in.WitnessScript == nil {
+			e = errors.New(fmt.Sprint("PSBT: missing witness script for input ", i))
+			return
+		}
+		if h := sha256.Sum256(in.WitnessScript); !bytes.Equal(h[:], prog) {
+			e = errors.New(fmt.Sprint("PSBT: witness script does not match input ", i))
+			return
+		}
+		if !script_has_push(in.WitnessScript, pubkey) {
+			return
+		}
+		script_code = in.WitnessScript
+	} else {
+		e = errors.New(fmt.Sprint("PSBT: unsupported witness program of input ", i))
+		return
+	}
+	var sig []byte
+	if sig, e = ecdsa_sig(priv, tx.WitnessSigHash(script_code, out.Value, i, int32(hash_type)), hash_type); e != nil {
+		return
+	}
+	in.add_partial_sig(pubkey, sig)
+	signed = true
+	return
+}
+
+
+// Signs all the inputs that can be signed with the given key.
+// Returns number of the signed inputs.
+func (p *Psbt) Sign(priv, pubkey []byte) (cnt int, e error) {
+	for i := range p.Inputs {
+		var ok bool
+		if ok, e = p.SignInput(i, priv, pubkey); e != nil {
+			return
+		}
+		if ok {
+			cnt++
+		}
+	}
+	return
+}
+
+
+// Builds the final scriptSig/witness for multisig or single key scripts.
+// Returns nil if there is not enough signatures.
+func (in *Input) script_sigs(scr []byte) (sigs [][]byte) {
+	if ms, er := btc.NewMultiSigFromP2SH(scr); er == nil {
+		sigs = [][]byte{nil} // the extra item for OP_CHECKMULTISIG bug
+		for _, pk := range ms.PublicKeys {
+			if sig := in.partial_sig(pk); sig != nil {
+				sigs = append(sigs, sig)
+				if len(sigs) == int(ms.SigsNeeded) + 1 {
+					return
+				}
+			}
+		}
+		return nil
+	}
+	if len(scr)==35 && scr[0]==33 && scr[34]==0xac/*OP_CHECKSIG*/ || len(scr)==67 && scr[0]==65 && scr[66]==0xac {
+		if sig := in.partial_sig(scr[1:len(scr)-1]); sig != nil {
+			return [][]byte{sig}
+		}
+	}
+	return nil
+}
+
+
+// Finalizes the input if it has all the needed signatures
+func (p *Psbt) FinalizeInput(i int) (e error) {
+	var scr []byte
+	var sigs [][]byte
+
+	in := p.Inputs[i]
+	if in.IsFinalized() {
+		return
+	}
+	if _, scr, e = p.spent_script(i); e != nil {
+		return
+	}
+
+	var final_sig []byte
+	if in.RedeemScript != nil {
+		final_sig = push_data(in.RedeemScript)
+	}
+
+	ver, prog := btc.IsWitnessProgram(scr)
+	switch {
+		case prog == nil:
+			if len(scr)==25 && scr[0]==0x76 && scr[1]==0xa9 && scr[2]==20 {
+				for _, ps := range in.PartialSigs {
+					if h := btc.Rimp160AfterSha256(ps.Pubkey); bytes.Equal(h[:], scr[3:23]) {
+						sigs = [][]byte{ps.Sig, ps.Pubkey}
+						break
+					}
+				}
+			} else {
+				sigs = in.script_sigs(scr)
+			}
+			if sigs == nil {
+				return errors.New(fmt.Sprint("PSBT: input ", i, " is not fully signed"))
+			}
+			buf := new(bytes.Buffer)
+			for _, d := range sigs {
+				if len(d) == 0 {
+					buf.WriteByte(btc.OP_0)
+				} else {
+					buf.Write(push_data(d))
+				}
+			}
+			in.FinalScriptSig = append(buf.Bytes(), final_sig...)
+
+		case ver == 0 && len(prog) == 20:
+			for _, ps := range in.PartialSigs {
+				if h := btc.Rimp160AfterSha256(ps.Pubkey); bytes.Equal(h[:], prog) {
+					in.FinalScriptWitness = [][]byte{ps.Sig, ps.Pubkey}
+					break
+				}
+			}
+			if in.FinalScriptWitness == nil {
+				return errors.New(fmt.Sprint("PSBT: input ", i, " is not fully signed"))
+			}
+			in.FinalScriptSig = final_sig
+
+		case ver == 0 && len(prog) == 32:
+			if in.WitnessScript == nil {
+				return errors.New(fmt.Sprint("PSBT: missing witness script for input ", i))
+			}
+			if sigs = in.script_sigs(in.WitnessScript); sigs == nil {
+				return errors.New(fmt.Sprint("PSBT: input ", i, " is not fully signed"))
+			}
+			if sigs[0] == nil {
+				sigs[0] = []byte{}
+			}
+			in.FinalScriptWitness = append(sigs, in.WitnessScript)
+			in.FinalScriptSig = final_sig
+
+		case ver == 1 && len(prog) == 32:
+			if in.TapKeySig == nil {
+				return errors.New(fmt.Sprint("PSBT: input ", i, " is not fully signed"))
+			}
+			in.FinalScriptWitness = [][]byte{in.TapKeySig}
+			in.FinalScriptSig = final_sig
+
+		default:
+			return errors.New(fmt.Sprint("PSBT: unsupported output type spent by input ", i))
+	}
+
+	if in.FinalScriptSig == nil && in.FinalScriptWitness != nil {
+		in.FinalScriptSig = []byte{}
+	}
+
+	// Clear all the fields that are not needed anymore (see BIP174)
+	in.PartialSigs = nil
+	in.SighashType = 0
+	in.RedeemScript = nil
+	in.WitnessScript = nil
+	in.Bip32Derivation = nil
+	in.TapKeySig = nil
+	in.TapInternalKey = nil
+	in.TapMerkleRoot = nil
+	return
+}
+
+
+// Finalizes all the inputs. Returns error if any of the inputs cannot be finalized.
+func (p *Psbt) Finalize() (e error) {
+	for i := range p.Inputs {
+		if er := p.FinalizeInput(i); er != nil && e == nil {
+			e = er
+		}
+	}
+	return
+}
+
+
+func (p *Psbt) IsComplete() bool {
+	for _, in := range p.Inputs {
+		if !in.IsFinalized() {
+			return false
+		}
+	}
+	return true
+}
+
+
+// Returns the final, signed transaction
+func (p *Psbt) Extract() (tx *btc.Tx, e error) {
+	if !p.IsComplete() {
+		e = errors.New("PSBT: not all the inputs are finalized")
+		return
+	}
+	tx = p.UnsignedTx()
+	for i, in := range p.Inputs {
+		tx.TxIn[i].ScriptSig = in.FinalScriptSig
+		if len(in.FinalScriptWitness) > 0 {
+			if tx.SegWit == nil {
+				tx.SegWit = make([][][]byte, len(tx.TxIn))
+			}
+			tx.SegWit[i] = in.FinalScriptWitness
+		}
+	}
+	if tx.SegWit != nil {
+		for i := range tx.SegWit {
+			if tx.SegWit[i] == nil {
+				tx.SegWit[i] = [][]byte{}
+			}
+		}
+		tx.SetHash(tx.SerializeNew())
+	} else {
+		tx.SetHash(tx.Serialize())
+	}
+	return
+}
+
+
+func merge_bip32(a, b []*Bip32Derivation) []*Bip32Derivation {
+	for _, d := range b {
+		var found bool
+		for _, x := range a {
+			if bytes.Equal(x.Pubkey, d.Pubkey) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, d)
+		}
+	}
+	return a
+}
+
+func merge_unknown(a, b []*KeyValue) []*KeyValue {
+	for _, d := range b {
+		var found bool
+		for _, x := range a {
+			if bytes.Equal(x.Key, d.Key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, d)
+		}
+	}
+	return a
+}
+
+func or_bytes(a, b []byte) []byte {
+	if a != nil {
+		return a
+	}
+	return b
+}
+
+
+// Merges the other PSBT (of the same transaction) into this one (BIP174 Combiner)
+func (p *Psbt) Combine(o *Psbt) error {
+	if p.UnsignedTx().Hash.Hash != o.UnsignedTx().Hash.Hash {
+		return errors.New("PSBT: cannot combine PSBTs of different transactions")
+	}
+	p.Xpubs = merge_bip32(p.Xpubs, o.Xpubs)
+	p.Unknown = merge_unknown(p.Unknown, o.Unknown)
+
+	for i, in := range p.Inputs {
+		oi := o.Inputs[i]
+		if in.IsFinalized() {
+			continue
+		}
+		if oi.IsFinalized() {
+			p.Inputs[i] = oi
+			continue
+		}
+		if in.NonWitnessUtxo == nil {
+			in.NonWitnessUtxo = oi.NonWitnessUtxo
+		}
+		if in.WitnessUtxo == nil {
+			in.WitnessUtxo = oi.WitnessUtxo
+		}
+		for _, ps := range oi.PartialSigs {
+			if in.partial_sig(ps.Pubkey) == nil {
+				in.PartialSigs = append(in.PartialSigs, ps)
+			}
+		}
+		if in.SighashType == 0 {
+			in.SighashType = oi.SighashType
+		}
+		in.RedeemScript = or_bytes(in.RedeemScript, oi.RedeemScript)
+		in.WitnessScript = or_bytes(in.WitnessScript, oi.WitnessScript)
+		in.Bip32Derivation = merge_bip32(in.Bip32Derivation, oi.Bip32Derivation)
+		in.TapKeySig = or_bytes(in.TapKeySig, oi.TapKeySig)
+		in.TapInternalKey = or_bytes(in.TapInternalKey, oi.TapInternalKey)
+		in.TapMerkleRoot = or_bytes(in.TapMerkleRoot, oi.TapMerkleRoot)
+		in.Unknown = merge_unknown(in.Unknown, oi.Unknown)
+	}
+
+	for i, out := range p.Outputs {
+		oo := o.Outputs[i]
+		out.RedeemScript = or_bytes(out.RedeemScript, oo.RedeemScript)
+		out.WitnessScript = or_bytes(out.WitnessScript, oo.WitnessScript)
+		out.Bip32Derivation = merge_bip32(out.Bip32Derivation, oo.Bip32Derivation)
+		out.TapInternalKey = or_bytes(out.TapInternalKey, oo.TapInternalKey)
+		out.Unknown = merge_unknown(out.Unknown, oo.Unknown)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package script
+
+import (
+	"fmt"
+	"sync"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+	Caches of successful verifications, shared by the memory pool and block validation:
+	 - signature cache: individual ECDSA and Schnorr signature checks
+	 - script cache: (wtxid, flags) of transactions with all the input scripts valid
+	The keys are salted with a random value, so nobody can predict them.
+	When a cache is full, random records get removed from it.
+*/
+
+const (
+	VER_CACHE_STORE = 1 << 31 // store successful signature checks in the cache (not a consensus flag)
+)
+
+var (
+	SigCacheMax = 200000 // max number of records in the signature cache (0 to disable it)
+	ScriptCacheMax = 100000 // max number of records in the script cache (0 to disable it)
+
+	sigCache = newVerifyCache()
+	scriptCache = newVerifyCache()
+)
+
+type verifyCache struct {
+	sync.Mutex
+	salt [32]byte
+	m map[[32]byte]bool
+	hits, misses uint64
+}
+
+func newVerifyCache() (c *verifyCache) {
+	c = new(verifyCache)
+	rand.Read(c.salt[:])
+	c.m = make(map[[32]byte]bool)
+	return
+}
+
+func (c *verifyCache) key(data ...[]byte) (k [32]byte) {
+	sha := sha256.New()
+	sha.Write(c.salt[:])
+	for _, d := range data {
+		sha.Write(d)
+	}
+	sha.Sum(k[:0])
+	return
+}
+
+func (c *verifyCache) get(k [32]byte, erase bool) (ok bool) {
+	c.Lock()
+	if _, ok = c.m[k]; ok {
+		if erase {
+			delete(c.m, k)
+		}
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.Unlock()
+	return
+}
+
+func (c *verifyCache) add(k [32]byte, max int) {
+	if max <= 0 {
+		return
+	}
+	c.Lock()
+	for kk := range c.m {
+		if len(c.m) < max {
+			break
+		}
+		delete(c.m, kk) // map iteration starts at a random point
+	}
+	c.m[k] = true
+	c.Unlock()
+}
+
+func (c *verifyCache) stats(name string, max int) string {
+	c.Lock()
+	defer c.Unlock()
+	return fmt.Sprintf("%s: %d/%d records,  %d hits,  %d misses\n", name, len(c.m), max, c.hits, c.misses)
+}
+
+
+func sigCacheKey(typ byte, pkey, sig, hash []byte) [32]byte {
+	return sigCache.key([]byte{typ, byte(len(pkey)), byte(len(sig))}, pkey, sig, hash)
+}
+
+// ecdsaVerify checks the signature in the cache, before doing the actual verification.
+// Valid signature is stored in the cache if VER_CACHE_STORE is set in flags.
+// Otherwise (block validation) its cache record gets removed - it is not going to be needed again.
+func ecdsaVerify(pkey, sig, hash []byte, flags uint32) bool {
+	if SigCacheMax <= 0 {
+		return btc.EcdsaVerify(pkey, sig, hash)
+	}
+	k := sigCacheKey('E', pkey, sig, hash)
+	if sigCache.get(k, (flags&VER_CACHE_STORE) == 0) {
+		return true
+	}
+	if !btc.EcdsaVerify(pkey, sig, hash) {
+		return false
+	}
+	if (flags&VER_CACHE_STORE) != 0 {
+		sigCache.add(k, SigCacheMax)
+	}
+	return true
+}
+
+// schnorrVerify is the same as ecdsaVerify, but for BIP340 signatures
+func schnorrVerify(pkey, sig, hash []byte, flags uint32) bool {
+	if SigCacheMax <= 0 {
+		return btc.SchnorrVerify(pkey, sig, hash)
+	}
+	k := sigCacheKey('S', pkey, sig, hash)
+	if sigCache.get(k, (flags&VER_CACHE_STORE) == 0) {
+		return true
+	}
+	if !btc.SchnorrVerify(pkey, sig, hash) {
+		return false
+	}
+	if (flags&VER_CACHE_STORE) != 0 {
+		sigCache.add(k, SigCacheMax)
+	}
+	return true
+}
+
+
+func scriptCacheKey(tx *btc.Tx, flags uint32) [32]byte {
+	var fl [4]byte
+	binary.LittleEndian.PutUint32(fl[:], flags&^VER_CACHE_STORE)
+	return scriptCache.key(tx.WTxID().Hash[:], fl[:])
+}
+
+// ScriptCacheGet returns true if all the input scripts of the tx have been verified with these flags.
+// Unless VER_CACHE_STORE is set in flags (block validation), the record gets removed on a hit,
+// as the tx is confirmed by the block and it is not going to be needed again.
+func ScriptCacheGet(tx *btc.Tx, flags uint32) bool {
+	if ScriptCacheMax <= 0 {
+		return false
+	}
+	return scriptCache.get(scriptCacheKey(tx, flags), (flags&VER_CACHE_STORE) == 0)
+}
+
+// ScriptCacheAdd records that all the input scripts of the tx are valid with these flags.
+// Call it only after each of the inputs has been verified with the same flags, or with a superset of them
+// (each verification flag only makes the script rules stricter).
+func ScriptCacheAdd(tx *btc.Tx, flags uint32) {
+	scriptCache.add(scriptCacheKey(tx, flags), ScriptCacheMax)
+}
+
+// VerifyCacheStats returns statistics of the signature and the script caches.
+func VerifyCacheStats() string {
+	return sigCache.stats("SigCache", SigCacheMax) + scriptCache.stats("ScriptCache", ScriptCacheMax)
+}
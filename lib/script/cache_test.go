@@ -0,0 +1,95 @@
+package script
+
+import (
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestSigCache(t *testing.T) {
+	DBG_ERR = false
+	key := new_tap_key()
+	q, _ := btc.TaprootOutputKey(key.pub, nil)
+	tx := tap_spending_tx(append([]byte{0x51, 32}, q...))
+	if er := tx.SignTaprootKeyPath(0, btc.SIGHASH_ALL, key.priv, nil); er != nil {
+		t.Fatal(er.Error())
+	}
+
+	cnt := btc.SchnorrVerifyCnt()
+	if !tap_verify(tx, tap_flags|VER_CACHE_STORE) {
+		t.Fatal("Key path spending failed")
+	}
+	if btc.SchnorrVerifyCnt() != cnt+1 {
+		t.Error("Signature not verified")
+	}
+
+	// now it should come from the cache
+	if !tap_verify(tx, tap_flags|VER_CACHE_STORE) || !tap_verify(tx, tap_flags) {
+		t.Error("Cached signature failed")
+	}
+	if btc.SchnorrVerifyCnt() != cnt+1 {
+		t.Error("Signature verified again, instead of taken from the cache")
+	}
+
+	// without VER_CACHE_STORE (block validation) the record was removed after use
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Key path spending failed")
+	}
+	if btc.SchnorrVerifyCnt() != cnt+2 {
+		t.Error("Signature should have been removed from the cache")
+	}
+
+	// modified tx gives another sighash, so it must not hit the cache
+	tap_verify(tx, tap_flags|VER_CACHE_STORE)
+	spent := tx.Spent_outputs
+	tx, _ = btc.NewTx(tx.SerializeNew())
+	tx.Spent_outputs = spent
+	tx.TxOut[0].Value--
+	if tap_verify(tx, tap_flags) {
+		t.Error("Modified transaction should fail")
+	}
+}
+
+
+func TestScriptCache(t *testing.T) {
+	tx := tap_spending_tx([]byte{0x51})
+	tx.SegWit = [][][]byte{[][]byte{[]byte{1}}}
+	tx.SetHash(tx.SerializeNew())
+
+	if ScriptCacheGet(tx, tap_flags) {
+		t.Error("Unexpected script cache hit")
+	}
+	ScriptCacheAdd(tx, tap_flags|VER_CACHE_STORE)
+	if !ScriptCacheGet(tx, tap_flags) {
+		t.Error("Script cache miss")
+	}
+	if ScriptCacheGet(tx, tap_flags&^uint32(VER_TAPROOT)) {
+		t.Error("Script cache hit with different flags")
+	}
+	if ScriptCacheGet(tx, tap_flags) {
+		t.Error("Script cache record not removed by block validation")
+	}
+	ScriptCacheAdd(tx, tap_flags)
+	if !ScriptCacheGet(tx, tap_flags|VER_CACHE_STORE) || !ScriptCacheGet(tx, tap_flags|VER_CACHE_STORE) {
+		t.Error("Script cache record removed by memory pool lookup")
+	}
+
+	// different witness data means different wtxid
+	tx2, _ := btc.NewTx(tx.SerializeNew())
+	tx2.SegWit[0][0][0] = 2
+	tx2.SetHash(tx2.SerializeNew())
+	if !tx2.Hash.Equal(&tx.Hash) || ScriptCacheGet(tx2, tap_flags) {
+		t.Error("Script cache hit for different witness")
+	}
+
+	prv := ScriptCacheMax
+	ScriptCacheMax = 10
+	for i := 0; i < 50; i++ {
+		tx.TxOut[0].Value++
+		tx.SetHash(tx.SerializeNew())
+		ScriptCacheAdd(tx, tap_flags)
+	}
+	if len(scriptCache.m) > ScriptCacheMax || !ScriptCacheGet(tx, tap_flags) {
+		t.Error("Script cache not bounded properly", len(scriptCache.m))
+	}
+	ScriptCacheMax = prv
+}
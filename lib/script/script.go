@@ -41,11 +41,16 @@ const (
 	VER_NULLFAIL = 1<<14
 	VER_WITNESS_PUBKEY = 1 << 15 // WITNESS_PUBKEYTYPE
 	VER_CONST_SCRIPTCODE = 1 << 16
+	VER_TAPROOT = 1 << 17 // BIP341 & BIP342
+	VER_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION = 1 << 18
+	VER_DISCOURAGE_OP_SUCCESS = 1 << 19
+	VER_DISCOURAGE_UPGRADABLE_PUBKEYTYPE = 1 << 20
 
 	STANDARD_VERIFY_FLAGS = VER_P2SH | VER_STRICTENC | VER_DERSIG | VER_LOW_S |
 		VER_NULLDUMMY | VER_MINDATA | VER_BLOCK_OPS | VER_CLEANSTACK | VER_CLTV | VER_CSV |
 		VER_WITNESS | VER_WITNESS_PROG | VER_MINIMALIF | VER_NULLFAIL | VER_WITNESS_PUBKEY |
-		VER_CONST_SCRIPTCODE
+		VER_CONST_SCRIPTCODE | VER_TAPROOT | VER_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION |
+		VER_DISCOURAGE_OP_SUCCESS | VER_DISCOURAGE_UPGRADABLE_PUBKEYTYPE
 
 	LOCKTIME_THRESHOLD = 500000000
 	SEQUENCE_LOCKTIME_DISABLE_FLAG = 1<<31
@@ -55,6 +60,8 @@ const (
 
 	SIGVERSION_BASE = 0
 	SIGVERSION_WITNESS_V0 = 1
+	SIGVERSION_TAPROOT = 2 // key path spending (used only for the signature hash)
+	SIGVERSION_TAPSCRIPT = 3
 )
 
 
@@ -62,7 +69,7 @@ func VerifyTxScript(pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags ui
 	if VerifyConsensus!=nil {
 		defer func() {
 			// We call CompareToConsensus inside another function to wait for final "result"
-			VerifyConsensus(pkScr, amount, i, tx, ver_flags, result)
+			VerifyConsensus(pkScr, amount, i, tx, ver_flags&^VER_CACHE_STORE, result)
 		}()
 	}
 
@@ -83,7 +90,7 @@ func VerifyTxScript(pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags ui
 	}
 
 	var stack, stackCopy scrStack
-	if !evalScript(sigScr, amount, &stack, tx, i, ver_flags, SIGVERSION_BASE) {
+	if !evalScript(sigScr, amount, &stack, tx, i, ver_flags, SIGVERSION_BASE, nil) {
 		if DBG_ERR {
 			if tx != nil {
 				fmt.Println("VerifyTxScript", tx.Hash.String(), i+1, "/", len(tx.TxIn))
@@ -104,7 +111,7 @@ func VerifyTxScript(pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags ui
 		stackCopy.copy_from(&stack)
 	}
 
-	if !evalScript(pkScr, amount, &stack, tx, i, ver_flags, SIGVERSION_BASE) {
+	if !evalScript(pkScr, amount, &stack, tx, i, ver_flags, SIGVERSION_BASE, nil) {
 		if DBG_SCR {
 			fmt.Println("* pkScript failed :", hex.EncodeToString(pkScr[:]))
 			fmt.Println("* VerifyTxScript", tx.Hash.String(), i+1, "/", len(tx.TxIn))
@@ -152,7 +159,7 @@ func VerifyTxScript(pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags ui
 				}
 				return
 			}
-			if !VerifyWitnessProgram(&witness, amount, tx, i, witnessversion, witnessprogram, ver_flags) {
+			if !VerifyWitnessProgram(&witness, amount, tx, i, witnessversion, witnessprogram, ver_flags, false) {
 				if DBG_ERR {
 					fmt.Println("VerifyWitnessProgram failed A")
 				}
@@ -199,7 +206,7 @@ func VerifyTxScript(pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags ui
 			fmt.Println("pubKey2:", hex.EncodeToString(pubKey2))
 		}
 
-		if !evalScript(pubKey2, amount, &stack, tx, i, ver_flags, SIGVERSION_BASE) {
+		if !evalScript(pubKey2, amount, &stack, tx, i, ver_flags, SIGVERSION_BASE, nil) {
 			if DBG_ERR {
 				fmt.Println("P2SH extra verification failed")
 			}
@@ -238,7 +245,7 @@ func VerifyTxScript(pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags ui
 					}
 					return
 				}
-				if !VerifyWitnessProgram(&witness, amount, tx, i, witnessversion, witnessprogram, ver_flags) {
+				if !VerifyWitnessProgram(&witness, amount, tx, i, witnessversion, witnessprogram, ver_flags, true) {
 					if DBG_ERR {
 						fmt.Println("VerifyWitnessProgram failed B")
 					}
@@ -293,14 +300,16 @@ func b2i(b bool) int64 {
 	}
 }
 
-func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32, sigversion int) bool {
+// execdata is only needed for SIGVERSION_TAPSCRIPT (can be nil otherwise)
+func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32, sigversion int, execdata *tapscript_ctx) bool {
 	if DBG_SCR {
 		fmt.Println("evalScript len", len(p), "amount", amount, "inp", inp, "flagz", ver_flags, "sigver", sigversion)
 		stack.print()
 	}
 
 
-	if len(p) > MAX_SCRIPT_SIZE {
+	// Tapscript has no script size limit
+	if (sigversion == SIGVERSION_BASE || sigversion == SIGVERSION_WITNESS_V0) && len(p) > MAX_SCRIPT_SIZE {
 		if DBG_ERR {
 			fmt.Println("script too long", len(p))
 		}
@@ -323,6 +332,7 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 	var exestack scrStack
 	var altstack scrStack
 	sta, idx, opcnt := 0, 0, 0
+	var opcode_pos uint32
 	checkMinVals := (ver_flags&VER_MINDATA)!=0
 	for idx < len(p) {
 		inexec := exestack.nofalse()
@@ -349,7 +359,7 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 			return false
 		}
 
-		if opcode > 0x60 {
+		if opcode > 0x60 && sigversion != SIGVERSION_TAPSCRIPT {
 			opcnt++
 			if opcnt > 201 {
 				if DBG_ERR {
@@ -424,7 +434,8 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 							return false
 						}
 						vch := stack.pop()
-						if sigversion==SIGVERSION_WITNESS_V0 && (ver_flags&VER_MINIMALIF)!=0 {
+						// MINIMALIF is a policy for witness v0, but it is consensus for tapscript
+						if sigversion==SIGVERSION_TAPSCRIPT || sigversion==SIGVERSION_WITNESS_V0 && (ver_flags&VER_MINIMALIF)!=0 {
 							if len(vch)>1 {
 								if DBG_ERR {
 									fmt.Println("SCRIPT_ERR_MINIMALIF-1")
@@ -924,6 +935,9 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 
 				case opcode==0xab: // OP_CODESEPARATOR
 					sta = idx
+					if execdata != nil {
+						execdata.CodeSepPos = opcode_pos
+					}
 
 				case opcode==0xac || opcode==0xad: // OP_CHECKSIG || OP_CHECKSIGVERIFY
 
@@ -937,6 +951,23 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 					vchSig := stack.top(-2)
 					vchPubKey := stack.top(-1)
 
+					if sigversion == SIGVERSION_TAPSCRIPT {
+						var ok bool
+						if fSuccess, ok = evalChecksigTapscript(vchSig, vchPubKey, tx, inp, ver_flags, execdata); !ok {
+							return false
+						}
+						stack.pop()
+						stack.pop()
+						if opcode==0xad {
+							if !fSuccess { // OP_CHECKSIGVERIFY
+								return false
+							}
+						} else { // OP_CHECKSIG
+							stack.pushBool(fSuccess)
+						}
+						break
+					}
+
 					scriptCode := p[sta:]
 
 					// Drop the signature in pre-segwit scripts but not segwit scripts
@@ -974,7 +1005,7 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 							fmt.Println(" key:", hex.EncodeToString(vchPubKey))
 							fmt.Println(" sig:", hex.EncodeToString(vchSig))
 						}
-						fSuccess = btc.EcdsaVerify(vchPubKey, vchSig, sh)
+						fSuccess = ecdsaVerify(vchPubKey, vchSig, sh, ver_flags)
 						if DBG_SCR {
 							fmt.Println(" ->", fSuccess)
 						}
@@ -1005,6 +1036,12 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 					}
 
 				case opcode==0xae || opcode==0xaf: //OP_CHECKMULTISIG || OP_CHECKMULTISIGVERIFY
+					if sigversion == SIGVERSION_TAPSCRIPT {
+						if DBG_ERR {
+							fmt.Println("SCRIPT_ERR_TAPSCRIPT_CHECKMULTISIG")
+						}
+						return false
+					}
 					//fmt.Println("OP_CHECKMULTISIG ...")
 					//stack.print()
 					if stack.size()<1 {
@@ -1093,7 +1130,7 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 							} else {
 								sh = tx.SignatureHash(xxx, inp, int32(vchSig[len(vchSig)-1]))
 							}
-							if btc.EcdsaVerify(vchPubKey, vchSig, sh) {
+							if ecdsaVerify(vchPubKey, vchSig, sh, ver_flags) {
 								isig++
 								sigscnt--
 							}
@@ -1268,6 +1305,25 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 						return false
 					}
 
+				case opcode==0xba && sigversion==SIGVERSION_TAPSCRIPT: // OP_CHECKSIGADD
+					if stack.size()<3 {
+						if DBG_ERR {
+							fmt.Println("Stack too short for opcode", opcode)
+						}
+						return false
+					}
+					sig := stack.top(-3)
+					num := stack.topInt(-2, checkMinVals)
+					pubkey := stack.top(-1)
+					success, ok := evalChecksigTapscript(sig, pubkey, tx, inp, ver_flags, execdata)
+					if !ok {
+						return false
+					}
+					stack.pop()
+					stack.pop()
+					stack.pop()
+					stack.pushInt(num + b2i(success))
+
 				case opcode==0xb0 || opcode>=0xb3 && opcode<=0xb9: //OP_NOP1 || OP_NOP4..OP_NOP10
 					if (ver_flags&VER_BLOCK_OPS)!=0 {
 						return false
@@ -1288,12 +1344,13 @@ func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, v
 			fmt.Printf("Finished Executing opcode 0x%02x\n", opcode)
 			stack.print()
 		}
-		if (stack.size() + altstack.size() > 1000) {
+		if (stack.size() + altstack.size() > MAX_STACK_SIZE) {
 			if DBG_ERR {
 				fmt.Println("Stack too big")
 			}
 			return false
 		}
+		opcode_pos++
 	}
 
 	if DBG_SCR {
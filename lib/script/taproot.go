@@ -0,0 +1,239 @@
+package script
+
+import (
+	"fmt"
+	"crypto/sha256"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+const (
+	VALIDATION_WEIGHT_PER_SIGOP_PASSED = 50
+	VALIDATION_WEIGHT_OFFSET = 50
+	MAX_STACK_SIZE = 1000
+)
+
+// Execution context of a taproot spend (BIP341/BIP342)
+type tapscript_ctx struct {
+	btc.TaprootExecData
+	weight_left int64 // validation weight budget (tapscript only)
+}
+
+
+// Returns true for opcodes that make a tapscript succeed unconditionally (BIP342)
+func IsOpSuccess(opcode int) bool {
+	return opcode == 0x50 || opcode == 0x62 || (opcode >= 0x7e && opcode <= 0x81) ||
+		(opcode >= 0x83 && opcode <= 0x86) || (opcode >= 0x89 && opcode <= 0x8a) ||
+		(opcode >= 0x8d && opcode <= 0x8e) || (opcode >= 0x95 && opcode <= 0x99) ||
+		(opcode >= 0xbb && opcode <= 0xfe)
+}
+
+
+// Verifies BIP340 signature (with the optional hash type byte) for taproot key path or tapscript
+func checkSchnorrSignature(sig, pubkey []byte, tx *btc.Tx, inp int, flags uint32, execdata *tapscript_ctx) bool {
+	hash_type := byte(btc.SIGHASH_DEFAULT)
+	if len(sig) == 65 {
+		hash_type = sig[64]
+		if hash_type == btc.SIGHASH_DEFAULT {
+			if DBG_ERR {
+				fmt.Println("SCRIPT_ERR_SCHNORR_SIG_HASHTYPE")
+			}
+			return false
+		}
+		sig = sig[:64]
+	} else if len(sig) != 64 {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_SCHNORR_SIG_SIZE", len(sig))
+		}
+		return false
+	}
+	h := tx.TaprootSigHash(&execdata.TaprootExecData, inp, hash_type)
+	if h == nil {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_SCHNORR_SIG_HASHTYPE - cannot calculate sighash")
+		}
+		return false
+	}
+	if !schnorrVerify(pubkey, sig, h, flags) {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_SCHNORR_SIG")
+		}
+		return false
+	}
+	return true
+}
+
+
+// Signature check of OP_CHECKSIG, OP_CHECKSIGVERIFY and OP_CHECKSIGADD inside tapscript.
+// Returns ok=false if the script must fail.
+func evalChecksigTapscript(sig, pubkey []byte, tx *btc.Tx, inp int, flags uint32, execdata *tapscript_ctx) (success, ok bool) {
+	success = len(sig) > 0
+	if success {
+		execdata.weight_left -= VALIDATION_WEIGHT_PER_SIGOP_PASSED
+		if execdata.weight_left < 0 {
+			if DBG_ERR {
+				fmt.Println("SCRIPT_ERR_TAPSCRIPT_VALIDATION_WEIGHT")
+			}
+			return
+		}
+	}
+	if len(pubkey) == 0 {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_PUBKEYTYPE")
+		}
+		return
+	} else if len(pubkey) == 32 {
+		if success && !checkSchnorrSignature(sig, pubkey, tx, inp, flags, execdata) {
+			return
+		}
+	} else {
+		// New public key version softforks should be defined before this `else` block.
+		if (flags & VER_DISCOURAGE_UPGRADABLE_PUBKEYTYPE) != 0 {
+			if DBG_ERR {
+				fmt.Println("SCRIPT_ERR_DISCOURAGE_UPGRADABLE_PUBKEYTYPE")
+			}
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+
+// Returns the serialized size of the witness stack (as it is in the transaction)
+func witnessSize(stack *scrStack) (res int64) {
+	res = int64(btc.VLenSize(uint64(stack.size())))
+	for i := 0; i < stack.size(); i++ {
+		res += int64(btc.VLenSize(uint64(len(stack.at(i))))) + int64(len(stack.at(i)))
+	}
+	return
+}
+
+
+// Verifies spending of the segwit version 1 (taproot) output
+func verifyTaproot(witness *witness_ctx, amount uint64, tx *btc.Tx, inp int, program []byte, flags uint32) bool {
+	var stack scrStack
+	var execdata tapscript_ctx
+
+	execdata.CodeSepPos = 0xffffffff
+	stack.copy_from(&witness.stack)
+
+	if stack.size() == 0 {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_WITNESS_PROGRAM_WITNESS_EMPTY")
+		}
+		return false
+	}
+
+	if stack.size() >= 2 {
+		if annex := stack.top(-1); len(annex) > 0 && annex[0] == btc.ANNEX_TAG {
+			// Drop annex (this is non-standard; see IsWitnessStandard)
+			sha := sha256.New()
+			btc.WriteVlen(sha, uint64(len(annex)))
+			sha.Write(annex)
+			execdata.AnnexHash = sha.Sum(nil)
+			stack.pop()
+		}
+	}
+
+	if stack.size() == 1 {
+		// Key path spending (stack size is 1 after removing optional annex)
+		if !checkSchnorrSignature(stack.top(-1), program, tx, inp, flags, &execdata) {
+			return false
+		}
+		return true
+	}
+
+	// Script path spending (stack size is >1 after removing optional annex)
+	control := stack.pop()
+	script := stack.pop()
+	if len(control) < btc.TAPROOT_CONTROL_BASE_SIZE || len(control) > btc.TAPROOT_CONTROL_MAX_SIZE ||
+		(len(control) - btc.TAPROOT_CONTROL_BASE_SIZE) % btc.TAPROOT_CONTROL_NODE_SIZE != 0 {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_TAPROOT_WRONG_CONTROL_SIZE", len(control))
+		}
+		return false
+	}
+	leaf_ver := control[0] & btc.TAPROOT_LEAF_MASK
+	execdata.TapLeafHash = btc.TapLeafHash(leaf_ver, script)
+	internal_key := control[1:btc.TAPROOT_CONTROL_BASE_SIZE]
+	tweak := btc.TapTweak(internal_key, btc.TaprootMerkleRoot(control, execdata.TapLeafHash))
+	if !secp256k1.CheckPayToContract(program, (control[0] & 1) != 0, internal_key, tweak) {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_WITNESS_PROGRAM_MISMATCH - taproot commitment")
+		}
+		return false
+	}
+
+	if leaf_ver != btc.TAPROOT_LEAF_TAPSCRIPT {
+		if (flags & VER_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION) != 0 {
+			if DBG_ERR {
+				fmt.Println("SCRIPT_ERR_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION")
+			}
+			return false
+		}
+		// Future softforks may introduce new leaf versions - for now they are anyone-can-spend
+		return true
+	}
+
+	// Tapscript (leaf version 0xc0)
+	execdata.weight_left = witnessSize(&witness.stack) + VALIDATION_WEIGHT_OFFSET
+
+	// OP_SUCCESSx processing overrides everything, including stack element size limits
+	var idx int
+	for idx < len(script) {
+		opcode, _, n, e := btc.GetOpcode(script[idx:])
+		if e != nil {
+			if DBG_ERR {
+				fmt.Println("SCRIPT_ERR_BAD_OPCODE in tapscript")
+			}
+			return false
+		}
+		idx += n
+		if IsOpSuccess(opcode) {
+			if (flags & VER_DISCOURAGE_OP_SUCCESS) != 0 {
+				if DBG_ERR {
+					fmt.Println("SCRIPT_ERR_DISCOURAGE_OP_SUCCESS")
+				}
+				return false
+			}
+			return true
+		}
+	}
+
+	// Tapscript enforces initial stack size limits (altstack is empty here)
+	if stack.size() > MAX_STACK_SIZE {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_STACK_SIZE")
+		}
+		return false
+	}
+	for i := 0; i < stack.size(); i++ {
+		if len(stack.at(i)) > btc.MAX_SCRIPT_ELEMENT_SIZE {
+			if DBG_ERR {
+				fmt.Println("SCRIPT_ERR_PUSH_SIZE")
+			}
+			return false
+		}
+	}
+
+	if !evalScript(script, amount, &stack, tx, inp, flags, SIGVERSION_TAPSCRIPT, &execdata) {
+		return false
+	}
+
+	// Scripts inside witness implicitly require cleanstack behaviour
+	if stack.size() != 1 {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_CLEANSTACK - tapscript")
+		}
+		return false
+	}
+	if !stack.topBool(-1) {
+		if DBG_ERR {
+			fmt.Println("SCRIPT_ERR_EVAL_FALSE")
+		}
+		return false
+	}
+	return true
+}
+
@@ -0,0 +1,286 @@
+package script
+
+import (
+	"bytes"
+	"testing"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+const tap_flags = STANDARD_VERIFY_FLAGS
+
+type tap_key struct {
+	priv, pub []byte // pub is x-only
+}
+
+func new_tap_key() (k *tap_key) {
+	var pub [33]byte
+	k = new(tap_key)
+	k.priv = make([]byte, 32)
+	rand.Read(k.priv)
+	secp256k1.BaseMultiply(k.priv, pub[:])
+	k.pub = pub[1:]
+	return
+}
+
+// Returns a transaction spending the given taproot output
+func tap_spending_tx(pk_script []byte) (tx *btc.Tx) {
+	tx = new(btc.Tx)
+	tx.Version = 2
+	tx.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Vout:1}, Sequence:0xffffffff}}
+	rand.Read(tx.TxIn[0].Input.Hash[:])
+	tx.TxOut = []*btc.TxOut{&btc.TxOut{Value:99000, Pk_script:[]byte{0x6a}}}
+	tx.Spent_outputs = []*btc.TxOut{&btc.TxOut{Value:100000, Pk_script:pk_script}}
+	return
+}
+
+// Returns the output script and the control block for a tree with a single tapscript leaf
+func tap_single_leaf(internal *tap_key, script []byte) (pk_script, control []byte) {
+	q, odd := btc.TaprootOutputKey(internal.pub, btc.TapLeafHash(btc.TAPROOT_LEAF_TAPSCRIPT, script))
+	pk_script = append([]byte{0x51, 32}, q...)
+	control = append([]byte{btc.TAPROOT_LEAF_TAPSCRIPT}, internal.pub...)
+	if odd {
+		control[0] |= 1
+	}
+	return
+}
+
+func tap_verify(tx *btc.Tx, flags uint32) bool {
+	tx.SetHash(tx.SerializeNew())
+	return VerifyTxScript(tx.Spent_outputs[0].Pk_script, tx.Spent_outputs[0].Value, 0, tx, flags)
+}
+
+func tap_script_sig(tx *btc.Tx, key *tap_key, script []byte, hash_type byte) []byte {
+	ed := &btc.TaprootExecData{TapLeafHash:btc.TapLeafHash(btc.TAPROOT_LEAF_TAPSCRIPT, script), CodeSepPos:0xffffffff}
+	sig := btc.SchnorrSign(key.priv, tx.TaprootSigHash(ed, 0, hash_type))
+	if hash_type != btc.SIGHASH_DEFAULT {
+		sig = append(sig, hash_type)
+	}
+	return sig
+}
+
+
+func TestTaprootKeyPath(t *testing.T) {
+	DBG_ERR = false
+	key := new_tap_key()
+	q, _ := btc.TaprootOutputKey(key.pub, nil)
+	tx := tap_spending_tx(append([]byte{0x51, 32}, q...))
+
+	for _, ht := range []byte{btc.SIGHASH_DEFAULT, btc.SIGHASH_ALL, btc.SIGHASH_NONE|btc.SIGHASH_ANYONECANPAY} {
+		if er := tx.SignTaprootKeyPath(0, ht, key.priv, nil); er != nil {
+			t.Fatal(er.Error())
+		}
+		if !tap_verify(tx, tap_flags) {
+			t.Error("Key path spending failed for hash type", ht)
+		}
+	}
+
+	// Explicit SIGHASH_DEFAULT byte is not allowed
+	tx.SignTaprootKeyPath(0, btc.SIGHASH_DEFAULT, key.priv, nil)
+	tx.SegWit[0][0] = append(tx.SegWit[0][0], 0)
+	if tap_verify(tx, tap_flags) {
+		t.Error("65 bytes signature with SIGHASH_DEFAULT should fail")
+	}
+
+	// Changing the output after signing must invalidate the signature
+	tx.SignTaprootKeyPath(0, btc.SIGHASH_ALL, key.priv, nil)
+	tx, _ = btc.NewTx(tx.SerializeNew())
+	tx.Spent_outputs = tap_spending_tx(append([]byte{0x51, 32}, q...)).Spent_outputs
+	tx.TxOut[0].Value--
+	if tap_verify(tx, tap_flags) {
+		t.Error("Modified transaction should fail")
+	}
+	// ... unless taproot is not enforced
+	if !tap_verify(tx, tap_flags & ^uint32(VER_TAPROOT|VER_WITNESS_PROG)) {
+		t.Error("Without VER_TAPROOT the output should be anyone-can-spend")
+	}
+
+	// Spent_outputs are needed for the signature hash
+	out := tx.Spent_outputs[0]
+	tx.Spent_outputs = nil
+	if VerifyTxScript(out.Pk_script, out.Value, 0, tx, tap_flags) {
+		t.Error("Verification without Spent_outputs should fail")
+	}
+}
+
+
+func TestTaprootScriptPath(t *testing.T) {
+	DBG_ERR = false
+	internal, k1, k2 := new_tap_key(), new_tap_key(), new_tap_key()
+
+	// 2-of-2 using OP_CHECKSIGADD: <k1> OP_CHECKSIG <k2> OP_CHECKSIGADD OP_2 OP_EQUAL
+	script := append(append([]byte{32}, k1.pub...), 0xac, 32)
+	script = append(append(script, k2.pub...), 0xba, 0x52, 0x87)
+	pk_script, control := tap_single_leaf(internal, script)
+	tx := tap_spending_tx(pk_script)
+
+	sig1 := tap_script_sig(tx, k1, script, btc.SIGHASH_DEFAULT)
+	sig2 := tap_script_sig(tx, k2, script, btc.SIGHASH_SINGLE)
+	tx.SegWit = [][][]byte{[][]byte{sig2, sig1, script, control}}
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Script path 2-of-2 spending failed")
+	}
+
+	// One empty signature gives only 1 (fails the script, but not with an error)
+	tx.SegWit = [][][]byte{[][]byte{[]byte{}, sig1, script, control}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("1-of-2 should not pass")
+	}
+
+	// Bad signature (non-empty) must fail
+	bad := append([]byte{}, sig2...)
+	bad[0] ^= 1
+	tx.SegWit = [][][]byte{[][]byte{bad, sig1, script, control}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Invalid signature should fail")
+	}
+
+	// Wrong parity bit in the control block
+	ctrl := append([]byte{}, control...)
+	ctrl[0] ^= 1
+	tx.SegWit = [][][]byte{[][]byte{sig2, sig1, script, ctrl}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Wrong control block should fail")
+	}
+
+	// Control block of a wrong size
+	tx.SegWit = [][][]byte{[][]byte{sig2, sig1, script, append(control, 0)}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Wrong control block size should fail")
+	}
+
+	// Annex changes the signature hash
+	tx.SegWit = [][][]byte{[][]byte{sig2, sig1, script, control, []byte{btc.ANNEX_TAG}}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Annex not committed to by the signatures should fail")
+	}
+}
+
+
+func TestTaprootMerkleProof(t *testing.T) {
+	DBG_ERR = false
+	internal := new_tap_key()
+
+	// Tree with two leaves: OP_TRUE and OP_2 OP_EQUAL
+	s1, s2 := []byte{0x51}, []byte{0x52, 0x87}
+	h1 := btc.TapLeafHash(btc.TAPROOT_LEAF_TAPSCRIPT, s1)
+	h2 := btc.TapLeafHash(btc.TAPROOT_LEAF_TAPSCRIPT, s2)
+	q, odd := btc.TaprootOutputKey(internal.pub, btc.TapBranchHash(h1, h2))
+	tx := tap_spending_tx(append([]byte{0x51, 32}, q...))
+
+	control := append([]byte{btc.TAPROOT_LEAF_TAPSCRIPT}, internal.pub...)
+	if odd {
+		control[0] |= 1
+	}
+	tx.SegWit = [][][]byte{[][]byte{s1, append(control, h2...)}}
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Spending the first leaf failed")
+	}
+	tx.SegWit = [][][]byte{[][]byte{[]byte{2}, s2, append(control, h1...)}}
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Spending the second leaf failed")
+	}
+	tx.SegWit = [][][]byte{[][]byte{[]byte{2}, s2, append(control, h2...)}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Wrong merkle proof should fail")
+	}
+}
+
+
+func TestTapscriptRules(t *testing.T) {
+	DBG_ERR = false
+	internal, key := new_tap_key(), new_tap_key()
+
+	// OP_SUCCESSx makes the script valid, unless discouraged
+	script := []byte{0x00, 0x50}
+	pk_script, control := tap_single_leaf(internal, script)
+	tx := tap_spending_tx(pk_script)
+	tx.SegWit = [][][]byte{[][]byte{script, control}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("OP_SUCCESS should be discouraged")
+	}
+	if !tap_verify(tx, tap_flags & ^uint32(VER_DISCOURAGE_OP_SUCCESS)) {
+		t.Error("OP_SUCCESS should succeed")
+	}
+
+	// CHECKMULTISIG is disabled
+	script = []byte{0x00, 0x00, 0x00, 0xae}
+	pk_script, control = tap_single_leaf(internal, script)
+	tx = tap_spending_tx(pk_script)
+	tx.SegWit = [][][]byte{[][]byte{script, control}}
+	if tap_verify(tx, tap_flags & ^uint32(VER_CLEANSTACK)) {
+		t.Error("OP_CHECKMULTISIG should fail in tapscript")
+	}
+
+	// MINIMALIF is a consensus rule
+	script = []byte{0x63, 0x51, 0x67, 0x51, 0x68}
+	pk_script, control = tap_single_leaf(internal, script)
+	tx = tap_spending_tx(pk_script)
+	tx.SegWit = [][][]byte{[][]byte{[]byte{2}, script, control}}
+	if tap_verify(tx, tap_flags & ^uint32(VER_MINIMALIF)) {
+		t.Error("Non-minimal OP_IF argument should fail")
+	}
+	tx.SegWit = [][][]byte{[][]byte{[]byte{1}, script, control}}
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Minimal OP_IF argument failed")
+	}
+
+	// Unknown public key type is discouraged
+	script = []byte{0x02, 0x01, 0x01, 0xac}
+	pk_script, control = tap_single_leaf(internal, script)
+	tx = tap_spending_tx(pk_script)
+	tx.SegWit = [][][]byte{[][]byte{[]byte{1}, script, control}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Unknown public key type should be discouraged")
+	}
+	if !tap_verify(tx, tap_flags & ^uint32(VER_DISCOURAGE_UPGRADABLE_PUBKEYTYPE)) {
+		t.Error("Unknown public key type should succeed")
+	}
+
+	// Validation weight: the same signature checked too many times
+	script = append([]byte{32}, key.pub...)
+	for i := 0; i < 10; i++ {
+		script = append(script, 0x6e, 0xad) // OP_2DUP OP_CHECKSIGVERIFY
+	}
+	script = append(script, 0xac)
+	pk_script, control = tap_single_leaf(internal, script)
+	tx = tap_spending_tx(pk_script)
+	tx.SegWit = [][][]byte{[][]byte{tap_script_sig(tx, key, script, btc.SIGHASH_DEFAULT), script, control}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Validation weight budget exceeded, but the script passed")
+	}
+	// ... but it passes with enough witness data (annex)
+	tx.SegWit[0] = append(tx.SegWit[0], append([]byte{btc.ANNEX_TAG}, bytes.Repeat([]byte{0}, 500)...))
+	ed := &btc.TaprootExecData{TapLeafHash:btc.TapLeafHash(btc.TAPROOT_LEAF_TAPSCRIPT, script), CodeSepPos:0xffffffff}
+	ed.AnnexHash = annex_hash(tx.SegWit[0][3])
+	tx.SegWit[0][0] = btc.SchnorrSign(key.priv, tx.TaprootSigHash(ed, 0, btc.SIGHASH_DEFAULT))
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Validation weight budget should be enough")
+	}
+
+	// OP_CODESEPARATOR position is committed to
+	script = append([]byte{0xab, 32}, key.pub...) // OP_CODESEPARATOR <key> OP_CHECKSIG
+	script = append(script, 0xac)
+	pk_script, control = tap_single_leaf(internal, script)
+	tx = tap_spending_tx(pk_script)
+	ed = &btc.TaprootExecData{TapLeafHash:btc.TapLeafHash(btc.TAPROOT_LEAF_TAPSCRIPT, script), CodeSepPos:0xffffffff}
+	tx.SegWit = [][][]byte{[][]byte{btc.SchnorrSign(key.priv, tx.TaprootSigHash(ed, 0, btc.SIGHASH_DEFAULT)), script, control}}
+	if tap_verify(tx, tap_flags) {
+		t.Error("Signature without OP_CODESEPARATOR position should fail")
+	}
+	ed.CodeSepPos = 0
+	tx.SegWit[0][0] = btc.SchnorrSign(key.priv, tx.TaprootSigHash(ed, 0, btc.SIGHASH_DEFAULT))
+	if !tap_verify(tx, tap_flags) {
+		t.Error("Signature with OP_CODESEPARATOR position failed")
+	}
+}
+
+
+func annex_hash(annex []byte) []byte {
+	sha := sha256.New()
+	btc.WriteVlen(sha, uint64(len(annex)))
+	sha.Write(annex)
+	return sha.Sum(nil)
+}
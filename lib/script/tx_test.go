@@ -137,6 +137,7 @@ func execute_test_tx(t *testing.T, tv *testvector) bool {
 	}
 
 	oks := 0
+	tx.Spent_outputs = make([]*btc.TxOut, len(tx.TxIn))
 	for i := range tx.TxIn {
 		var j int
 		for j = range tv.inps {
@@ -155,8 +156,12 @@ func execute_test_tx(t *testing.T, tv *testvector) bool {
 			t.Error(er.Error())
 			continue
 		}
+		tx.Spent_outputs[i] = &btc.TxOut{Pk_script:pk, Value:tv.inps[j].value}
+	}
 
-		if VerifyTxScript(pk, tv.inps[j].value, i, tx, tv.ver_flags) {
+	// All the spent outputs must be known before verifying the scripts (for taproot)
+	for i, out := range tx.Spent_outputs {
+		if out != nil && VerifyTxScript(out.Pk_script, out.Value, i, tx, tv.ver_flags) {
 			oks++
 		}
 	}
@@ -16,7 +16,7 @@ func (w *witness_ctx) IsNull() bool {
 	return w.stack.size()==0
 }
 
-func VerifyWitnessProgram(witness *witness_ctx, amount uint64, tx *btc.Tx, inp int, witversion int, program []byte, flags uint32) bool {
+func VerifyWitnessProgram(witness *witness_ctx, amount uint64, tx *btc.Tx, inp int, witversion int, program []byte, flags uint32, is_p2sh bool) bool {
 	var stack scrStack
 	var scriptPubKey []byte
 
@@ -71,6 +71,12 @@ func VerifyWitnessProgram(witness *witness_ctx, amount uint64, tx *btc.Tx, inp i
 			}
 			return false
 		}
+	} else if witversion == 1 && len(program) == 32 && !is_p2sh {
+		// BIP341 Taproot: 32-byte non-P2SH witness v1 program (which encodes a P2C-tweaked pubkey)
+		if (flags&VER_TAPROOT) == 0 {
+			return true
+		}
+		return verifyTaproot(witness, amount, tx, inp, program, flags)
 	} else if (flags&VER_WITNESS_PROG) != 0 {
 		if DBG_ERR {
 			fmt.Println("SCRIPT_ERR_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM")
@@ -94,7 +100,7 @@ func VerifyWitnessProgram(witness *witness_ctx, amount uint64, tx *btc.Tx, inp i
 		}
 	}
 
-	if !evalScript(scriptPubKey, amount, &stack, tx, inp, flags, SIGVERSION_WITNESS_V0) {
+	if !evalScript(scriptPubKey, amount, &stack, tx, inp, flags, SIGVERSION_WITNESS_V0, nil) {
 		return false
 	}
 
@@ -0,0 +1,182 @@
+package secp256k1
+
+import (
+	"math/big"
+	"crypto/rand"
+)
+
+// ElligatorSwift encoding of public keys, as used by BIP324.
+// A point's x coordinate is represented by a pair of field elements (u, t) - 64 bytes
+// that are indistinguishable from random data.
+// Only used during the handshakes, so the field arithmetic is done with big.Int,
+// for the sake of simplicity.
+
+var (
+	ell_c1 *big.Int // sqrt(-3)
+	ell_c2 *big.Int // (sqrt(-3)-1)/2
+	ell_sqrt_exp *big.Int // (p+1)/4
+)
+
+
+func ell_init() {
+	p := &TheCurve.p.Int
+	ell_sqrt_exp = new(big.Int).Add(p, BigInt1)
+	ell_sqrt_exp.Rsh(ell_sqrt_exp, 2)
+	ell_c1, _ = fe_sqrt(new(big.Int).Sub(p, big.NewInt(3)))
+	ell_c2 = fe_div(fe_sub(ell_c1, BigInt1), big.NewInt(2))
+}
+
+func fe_add(a, b *big.Int) *big.Int {
+	r := new(big.Int).Add(a, b)
+	return r.Mod(r, &TheCurve.p.Int)
+}
+
+func fe_sub(a, b *big.Int) *big.Int {
+	r := new(big.Int).Sub(a, b)
+	return r.Mod(r, &TheCurve.p.Int)
+}
+
+func fe_mul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, &TheCurve.p.Int)
+}
+
+func fe_div(a, b *big.Int) *big.Int {
+	r := new(big.Int).ModInverse(b, &TheCurve.p.Int)
+	return fe_mul(a, r)
+}
+
+func fe_neg(a *big.Int) *big.Int {
+	return fe_sub(new(big.Int), a)
+}
+
+// Returns the square root of a, if there is one
+func fe_sqrt(a *big.Int) (r *big.Int, ok bool) {
+	r = new(big.Int).Exp(a, ell_sqrt_exp, &TheCurve.p.Int)
+	ok = fe_mul(r, r).Cmp(new(big.Int).Mod(a, &TheCurve.p.Int)) == 0
+	return
+}
+
+// Returns u^3+7
+func fe_curve(u *big.Int) *big.Int {
+	return fe_add(fe_mul(fe_mul(u, u), u), big.NewInt(7))
+}
+
+// Returns true if x is a valid X coordinate of a point on the curve
+func fe_valid_x(x *big.Int) bool {
+	return big.Jacobi(fe_curve(x), &TheCurve.p.Int) >= 0
+}
+
+
+// Returns X coordinate of the point that the given (u, t) pair maps to
+func xswiftec(u, t *big.Int) *big.Int {
+	u = new(big.Int).Mod(u, &TheCurve.p.Int)
+	t = new(big.Int).Mod(t, &TheCurve.p.Int)
+	if u.Sign() == 0 {
+		u.SetInt64(1)
+	}
+	if t.Sign() == 0 {
+		t.SetInt64(1)
+	}
+	u3_7 := fe_curve(u)
+	if fe_add(u3_7, fe_mul(t, t)).Sign() == 0 {
+		t = fe_add(t, t)
+	}
+	x := fe_div(fe_sub(u3_7, fe_mul(t, t)), fe_add(t, t))
+	y := fe_div(fe_add(x, t), fe_mul(ell_c1, u))
+	if res := fe_add(u, fe_mul(big.NewInt(4), fe_mul(y, y))); fe_valid_x(res) {
+		return res
+	}
+	two := big.NewInt(2)
+	if res := fe_div(fe_sub(fe_neg(fe_div(x, y)), u), two); fe_valid_x(res) {
+		return res
+	}
+	return fe_div(fe_sub(fe_div(x, y), u), two)
+}
+
+// Returns t such that xswiftec(u, t) == x (or nil if there is none for this u and c)
+// c (0-7) selects one of the possible solutions.
+func xswiftec_inv(x, u *big.Int, c int) *big.Int {
+	var s, v *big.Int
+	if c&2 == 0 {
+		if fe_valid_x(fe_sub(fe_neg(x), u)) {
+			return nil
+		}
+		v = x
+		s = fe_neg(fe_div(fe_curve(u), fe_add(fe_mul(u, u), fe_mul(v, fe_add(u, v)))))
+	} else {
+		s = fe_sub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		r, ok := fe_sqrt(fe_neg(fe_mul(s, fe_add(fe_mul(big.NewInt(4), fe_curve(u)), fe_mul(big.NewInt(3), fe_mul(s, fe_mul(u, u)))))))
+		if !ok || c&1 != 0 && r.Sign() == 0 {
+			return nil
+		}
+		v = fe_div(fe_sub(fe_div(r, s), u), big.NewInt(2))
+	}
+	w, ok := fe_sqrt(s)
+	if !ok {
+		return nil
+	}
+	a := fe_sub(v, fe_mul(u, ell_c2)) // u*(1-sqrt(-3))/2 + v
+	b := fe_add(fe_mul(u, fe_add(ell_c2, BigInt1)), v) // u*(1+sqrt(-3))/2 + v
+	switch c&5 {
+		case 0: return fe_neg(fe_mul(w, a))
+		case 1: return fe_mul(w, b)
+		case 4: return fe_mul(w, a)
+	}
+	return fe_neg(fe_mul(w, b))
+}
+
+
+// Decodes the 64 bytes of ElligatorSwift encoding into 32 bytes of the X coordinate
+func EllSwiftDecode(ell []byte) (x []byte) {
+	var u, t big.Int
+	u.SetBytes(ell[:32])
+	t.SetBytes(ell[32:64])
+	x = make([]byte, 32)
+	xswiftec(&u, &t).FillBytes(x)
+	return
+}
+
+// Returns random ElligatorSwift encoding of the given X coordinate (which must be valid)
+func EllSwiftEncode(xb []byte) (ell []byte) {
+	var x big.Int
+	var rnd [33]byte
+	x.SetBytes(xb)
+	ell = make([]byte, 64)
+	for {
+		rand.Read(rnd[:])
+		u := new(big.Int).SetBytes(rnd[:32])
+		if u.Sign() == 0 || u.Cmp(&TheCurve.p.Int) >= 0 {
+			continue
+		}
+		t := xswiftec_inv(&x, u, int(rnd[32]&7))
+		if t == nil || xswiftec(u, t).Cmp(&x) != 0 {
+			continue
+		}
+		u.FillBytes(ell[:32])
+		t.FillBytes(ell[32:])
+		return
+	}
+}
+
+// Returns ElligatorSwift encoding of the public key for the given private key
+func EllSwiftCreate(seckey []byte) []byte {
+	var pub [33]byte
+	BaseMultiply(seckey, pub[:])
+	return EllSwiftEncode(pub[1:])
+}
+
+// X-only ECDH: returns X coordinate of seckey * P, where P is given in ElligatorSwift encoding
+func EllSwiftXDH(ell, seckey []byte) (x []byte) {
+	var pub [33]byte
+	pub[0] = 0x02
+	copy(pub[1:], EllSwiftDecode(ell))
+	var res [33]byte
+	if !Multiply(pub[:], seckey, res[:]) {
+		return nil
+	}
+	return res[1:]
+}
@@ -0,0 +1,72 @@
+package secp256k1
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+	"crypto/rand"
+)
+
+// From BIP324 ellswift_decode_test_vectors.csv
+var ellSwiftDecodeVectors = [][2]string{
+	{"00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000", "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca9743be5aa0c"},
+	{"000000000000000000000000000000000000000000000000000000000000000001d3475bf7655b0fb2d852921035b2ef607f49069b97454e6795251062741771", "b5da00b73cd6560520e7c364086e7cd23a34bf60d0e707be9fc34d4cd5fdfa2c"},
+	{"000000000000000000000000000000000000000000000000000000000000000082277c4a71f9d22e66ece523f8fa08741a7c0912c66a69ce68514bfd3515b49f", "f482f2e241753ad0fb89150d8491dc1e34ff0b8acfbb442cfe999e2e5e6fd1d2"},
+	{"00000000000000000000000000000000000000000000000000000000000000008421cc930e77c9f514b6915c3dbe2a94c6d8f690b5b739864ba6789fb8a55dd0", "9f59c40275f5085a006f05dae77eb98c6fd0db1ab4a72ac47eae90a4fc9e57e0"},
+	{"0000000000000000000000000000000000000000000000000000000000000000bde70df51939b94c9c24979fa7dd04ebd9b3572da7802290438af2a681895441", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa9fffffd6b"},
+	{"0000000000000000000000000000000000000000000000000000000000000000d19c182d2759cd99824228d94799f8c6557c38a1c0d6779b9d4b729c6f1ccc42", "70720db7e238d04121f5b1afd8cc5ad9d18944c6bdc94881f502b7a3af3aecff"},
+	{"0000000000000000000000000000000000000000000000000000000000000000fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca9743be5aa0c"},
+	{"0000000000000000000000000000000000000000000000000000000000000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff2664bbd5", "50873db31badcc71890e4f67753a65757f97aaa7dd5f1e82b753ace32219064b"},
+	{"0000000000000000000000000000000000000000000000000000000000000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff7028de7d", "1eea9cc59cfcf2fa151ac6c274eea4110feb4f7b68c5965732e9992e976ef68e"},
+	{"0000000000000000000000000000000000000000000000000000000000000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffffcbcfb7e7", "12303941aedc208880735b1f1795c8e55be520ea93e103357b5d2adb7ed59b8e"},
+	{"0000000000000000000000000000000000000000000000000000000000000000fffffffffffffffffffffffffffffffffffffffffffffffffffffffff3113ad9", "7eed6b70e7b0767c7d7feac04e57aa2a12fef5e0f48f878fcbb88b3b6b5e0783"},
+	{"0a2d2ba93507f1df233770c2a797962cc61f6d15da14ecd47d8d27ae1cd5f8530000000000000000000000000000000000000000000000000000000000000000", "532167c11200b08c0e84a354e74dcc40f8b25f4fe686e30869526366278a0688"},
+	{"0a2d2ba93507f1df233770c2a797962cc61f6d15da14ecd47d8d27ae1cd5f853fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", "532167c11200b08c0e84a354e74dcc40f8b25f4fe686e30869526366278a0688"},
+	{"0ffde9ca81d751e9cdaffc1a50779245320b28996dbaf32f822f20117c22fbd6c74d99efceaa550f1ad1c0f43f46e7ff1ee3bd0162b7bf55f2965da9c3450646", "74e880b3ffd18fe3cddf7902522551ddf97fa4a35a3cfda8197f947081a57b8f"},
+	{"0ffde9ca81d751e9cdaffc1a50779245320b28996dbaf32f822f20117c22fbd6ffffffffffffffffffffffffffffffffffffffffffffffffffffffff156ca896", "377b643fce2271f64e5c8101566107c1be4980745091783804f654781ac9217c"},
+	{"123658444f32be8f02ea2034afa7ef4bbe8adc918ceb49b12773b625f490b368ffffffffffffffffffffffffffffffffffffffffffffffffffffffff8dc5fe11", "ed16d65cf3a9538fcb2c139f1ecbc143ee14827120cbc2659e667256800b8142"},
+}
+
+func TestEllSwiftDecode(t *testing.T) {
+	for _, v := range ellSwiftDecodeVectors {
+		ell, _ := hex.DecodeString(v[0])
+		if s := hex.EncodeToString(EllSwiftDecode(ell)); s != v[1] {
+			t.Error("Bad decoding of", v[0], s)
+		}
+	}
+	// any 64 bytes must decode into a valid X coordinate
+	var pub XY
+	for i := 0; i < 100; i++ {
+		ell := make([]byte, 64)
+		rand.Read(ell)
+		if !pub.ParseXOnlyPubkey(EllSwiftDecode(ell)) {
+			t.Fatal("Invalid point from", hex.EncodeToString(ell))
+		}
+	}
+}
+
+func TestEllSwiftEncode(t *testing.T) {
+	var seckey [32]byte
+	var pub [33]byte
+	for i := 0; i < 100; i++ {
+		rand.Read(seckey[:])
+		BaseMultiply(seckey[:], pub[:])
+		ell := EllSwiftCreate(seckey[:])
+		if !bytes.Equal(EllSwiftDecode(ell), pub[1:]) {
+			t.Fatal("Roundtrip failed for", hex.EncodeToString(seckey[:]))
+		}
+	}
+}
+
+func TestEllSwiftXDH(t *testing.T) {
+	var ka, kb [32]byte
+	rand.Read(ka[:])
+	rand.Read(kb[:])
+	ella := EllSwiftCreate(ka[:])
+	ellb := EllSwiftCreate(kb[:])
+	xa := EllSwiftXDH(ellb, ka[:])
+	xb := EllSwiftXDH(ella, kb[:])
+	if len(xa) != 32 || !bytes.Equal(xa, xb) {
+		t.Error("Shared secrets differ")
+	}
+}
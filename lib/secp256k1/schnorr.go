@@ -0,0 +1,318 @@
+package secp256k1
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// BIP340 tagged hash: sha256(sha256(tag) || sha256(tag) || data...)
+func TaggedHash(tag string, data ...[]byte) (res []byte) {
+	th := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(th[:])
+	h.Write(th[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+
+// Sets the point from a 32 bytes long x-only public key (the one with even Y).
+// Returns false if the key is not a valid point on the curve.
+func (elem *XY) ParseXOnlyPubkey(pub []byte) bool {
+	var x Number
+	if len(pub) != 32 {
+		return false
+	}
+	x.SetBytes(pub)
+	if x.Cmp(&TheCurve.p.Int) >= 0 {
+		return false
+	}
+	elem.X.SetB32(pub)
+	elem.SetXO(&elem.X, false)
+	return elem.IsValid()
+}
+
+
+// Returns e = H_challenge(R.x || P.x || m) mod n
+func schnorr_challenge(e *Number, r, pk, msg []byte) {
+	e.SetBytes(TaggedHash("BIP0340/challenge", r, pk, msg))
+	e.mod(&TheCurve.Order)
+}
+
+
+// Verifies a BIP340 schnorr signature.
+// pkey - 32 bytes x-only public key, sig - 64 bytes, msg - 32 bytes
+func SchnorrVerify(pkey, sig, msg []byte) bool {
+	var P, R XY
+	var r, s, e Number
+	var pj, rj XYZ
+
+	if len(sig) != 64 || len(msg) != 32 {
+		return false
+	}
+	if !P.ParseXOnlyPubkey(pkey) {
+		return false
+	}
+	r.SetBytes(sig[:32])
+	if r.Cmp(&TheCurve.p.Int) >= 0 {
+		return false
+	}
+	s.SetBytes(sig[32:])
+	if s.Cmp(&TheCurve.Order.Int) >= 0 {
+		return false
+	}
+	schnorr_challenge(&e, sig[:32], pkey, msg)
+	if e.Sign() != 0 {
+		e.Sub(&TheCurve.Order.Int, &e.Int)
+	}
+
+	// R = s*G - e*P
+	pj.SetXY(&P)
+	pj.ECmult(&rj, &e, &s)
+	if rj.IsInfinity() {
+		return false
+	}
+	R.SetXYZ(&rj)
+	R.X.Normalize()
+	R.Y.Normalize()
+	if R.Y.IsOdd() {
+		return false
+	}
+	var rx [32]byte
+	R.X.GetB32(rx[:])
+	return r.Cmp(new(Number).SetBytes(rx[:])) == 0
+}
+
+
+// Creates a BIP340 schnorr signature (64 bytes).
+// aux is 32 bytes of auxiliary random data. Returns nil if the key is invalid.
+func SchnorrSign(seckey, msg, aux []byte) (sig []byte) {
+	var d, k, e Number
+	var P, R XY
+	var pj, rj XYZ
+	var px, rx, t [32]byte
+
+	if len(seckey) != 32 || len(msg) != 32 || len(aux) != 32 {
+		return
+	}
+	d.SetBytes(seckey)
+	if d.Sign() == 0 || d.Cmp(&TheCurve.Order.Int) >= 0 {
+		return
+	}
+	ECmultGen(&pj, &d)
+	P.SetXYZ(&pj)
+	P.X.Normalize()
+	P.Y.Normalize()
+	if P.Y.IsOdd() {
+		d.Sub(&TheCurve.Order.Int, &d.Int)
+	}
+	P.X.GetB32(px[:])
+
+	copy(t[:], d.get_bin(32))
+	ah := TaggedHash("BIP0340/aux", aux)
+	for i := range t {
+		t[i] ^= ah[i]
+	}
+	k.SetBytes(TaggedHash("BIP0340/nonce", t[:], px[:], msg))
+	k.mod(&TheCurve.Order)
+	if k.Sign() == 0 {
+		return
+	}
+	ECmultGen(&rj, &k)
+	R.SetXYZ(&rj)
+	R.X.Normalize()
+	R.Y.Normalize()
+	if R.Y.IsOdd() {
+		k.Sub(&TheCurve.Order.Int, &k.Int)
+	}
+	R.X.GetB32(rx[:])
+
+	schnorr_challenge(&e, rx[:], px[:], msg)
+	e.mod_mul(&e, &d, &TheCurve.Order)
+	e.Add(&e.Int, &k.Int)
+	e.mod(&TheCurve.Order)
+
+	sig = make([]byte, 64)
+	copy(sig[:32], rx[:])
+	copy(sig[32:], e.get_bin(32))
+	return
+}
+
+
+// r = sum(scalars[i]*points[i]) + ng*G
+// Uses one shared chain of doublings for all the points (Strauss' algorithm).
+func ecmult_multi(r *XYZ, points []XYZ, scalars []Number, ng *Number) {
+	var tmpj XYZ
+	var n int
+	var bits int
+
+	wnafs := make([][257]int, len(points))
+	lens := make([]int, len(points))
+	pres := make([][]XYZ, len(points))
+	for i := range points {
+		lens[i] = ecmult_wnaf(wnafs[i][:], &scalars[i], WINDOW_A)
+		if lens[i] > bits {
+			bits = lens[i]
+		}
+		pres[i] = points[i].precomp(WINDOW_A)
+	}
+
+	r.Infinity = true
+	for i := bits-1; i >= 0; i-- {
+		r.Double(r)
+		for j := range points {
+			if i >= lens[j] {
+				continue
+			}
+			n = wnafs[j][i]
+			if n > 0 {
+				r.Add(r, &pres[j][(n-1)/2])
+			} else if n != 0 {
+				pres[j][(-n-1)/2].Neg(&tmpj)
+				r.Add(r, &tmpj)
+			}
+		}
+	}
+
+	if ng.Sign() != 0 {
+		ECmultGen(&tmpj, ng)
+		r.Add(r, &tmpj)
+	}
+}
+
+
+// Verifies a number of BIP340 signatures at once.
+// Returns true only if all of them are valid. If it returns false, use SchnorrVerify
+// on each of the signatures to find out which one(s) failed.
+func SchnorrBatchVerify(pkeys, sigs, msgs [][]byte) bool {
+	if len(pkeys) != len(sigs) || len(pkeys) != len(msgs) {
+		return false
+	}
+	if len(sigs) == 0 {
+		return true
+	}
+	if len(sigs) == 1 {
+		return SchnorrVerify(pkeys[0], sigs[0], msgs[0])
+	}
+
+	var P, R XY
+	var a, e, s, ssum Number
+	var rnd [32]byte
+	points := make([]XYZ, 2*len(sigs))
+	scalars := make([]Number, 2*len(sigs))
+
+	for i := range sigs {
+		if len(sigs[i]) != 64 || len(msgs[i]) != 32 {
+			return false
+		}
+		if !P.ParseXOnlyPubkey(pkeys[i]) || !R.ParseXOnlyPubkey(sigs[i][:32]) {
+			return false
+		}
+		s.SetBytes(sigs[i][32:])
+		if s.Cmp(&TheCurve.Order.Int) >= 0 {
+			return false
+		}
+		schnorr_challenge(&e, sigs[i][:32], pkeys[i], msgs[i])
+
+		// a_0 = 1, a_i = random numbers from [1, n-1]
+		if i == 0 {
+			a.SetInt64(1)
+		} else {
+			for {
+				if _, er := rand.Read(rnd[:]); er != nil {
+					return false
+				}
+				a.SetBytes(rnd[:])
+				if a.Sign() != 0 && a.Cmp(&TheCurve.Order.Int) < 0 {
+					break
+				}
+			}
+		}
+
+		// sum(a_i*R_i) + sum(a_i*e_i*P_i) - sum(a_i*s_i)*G must be infinity
+		points[2*i].SetXY(&R)
+		scalars[2*i].Set(&a.Int)
+		points[2*i+1].SetXY(&P)
+		scalars[2*i+1].mod_mul(&a, &e, &TheCurve.Order)
+		s.mod_mul(&s, &a, &TheCurve.Order)
+		ssum.Add(&ssum.Int, &s.Int)
+	}
+	ssum.mod(&TheCurve.Order)
+	if ssum.Sign() != 0 {
+		ssum.Sub(&TheCurve.Order.Int, &ssum.Int)
+	}
+
+	var res XYZ
+	ecmult_multi(&res, points, scalars, &ssum)
+	return res.IsInfinity()
+}
+
+
+// Checks if the x-only key q is the tweaked key of the x-only key p, so if q = p + t*G,
+// where q's Y coordinate is odd when q_odd is set (used by BIP341 script path spending).
+func CheckPayToContract(q []byte, q_odd bool, p, t []byte) bool {
+	res, odd := XOnlyPubkeyTweakAdd(p, t)
+	return res != nil && odd == q_odd && string(res) == string(q)
+}
+
+
+// Returns the x-only key of p + t*G and the parity of its Y coordinate (BIP341 key tweaking).
+// Returns nil if p is not a valid x-only key, or if t is out of range.
+func XOnlyPubkeyTweakAdd(p, t []byte) (q []byte, odd bool) {
+	var P, Q XY
+	var tn, one Number
+	var pj, qj XYZ
+
+	if !P.ParseXOnlyPubkey(p) || len(t) != 32 {
+		return
+	}
+	tn.SetBytes(t)
+	if tn.Cmp(&TheCurve.Order.Int) >= 0 {
+		return
+	}
+	one.SetInt64(1)
+	pj.SetXY(&P)
+	pj.ECmult(&qj, &one, &tn)
+	if qj.IsInfinity() {
+		return
+	}
+	Q.SetXYZ(&qj)
+	Q.X.Normalize()
+	Q.Y.Normalize()
+	q = make([]byte, 32)
+	Q.X.GetB32(q)
+	odd = Q.Y.IsOdd()
+	return
+}
+
+
+// Returns the private key matching XOnlyPubkeyTweakAdd(pubkey(seckey), t) - used for signing with
+// the tweaked key. Returns nil if the keys are out of range.
+func XOnlySeckeyTweakAdd(seckey, t []byte) (res []byte) {
+	var d, tn Number
+	var pj XYZ
+	var P XY
+
+	d.SetBytes(seckey)
+	if d.Sign() == 0 || d.Cmp(&TheCurve.Order.Int) >= 0 {
+		return
+	}
+	tn.SetBytes(t)
+	if tn.Cmp(&TheCurve.Order.Int) >= 0 {
+		return
+	}
+	ECmultGen(&pj, &d)
+	P.SetXYZ(&pj)
+	P.Y.Normalize()
+	if P.Y.IsOdd() {
+		d.Sub(&TheCurve.Order.Int, &d.Int)
+	}
+	d.Add(&d.Int, &tn.Int)
+	d.mod(&TheCurve.Order)
+	if d.Sign() == 0 {
+		return
+	}
+	return d.get_bin(32)
+}
@@ -55,4 +55,5 @@ func init_contants() {
 
 func init() {
 	init_contants()
+	ell_init()
 }
@@ -0,0 +1,153 @@
+package utxo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+UTXO snapshot format (all records sorted by the key, so the same UTXO set always gives the same bytes):
+ [4] - LastBlockHeight (LE)
+ [32] - LastBlockHash
+ [8] - number of records (LE)
+ then for each record:
+ var_len - length of the record
+ [UtxoIdxLen] - key
+ [...] - value, as kept in HashMap
+
+The snapshot's hash is double SHA256 of all the bytes above.
+*/
+
+const (
+	SNAPSHOT_MAX_RECORD_SIZE = 4e6
+)
+
+// WriteSnapshot stores the current UTXO set in the canonical snapshot format.
+// Returns the snapshot's hash and the number of records written.
+func (db *UnspentDB) WriteSnapshot(w io.Writer) (hash *btc.Uint256, cnt uint64, e error) {
+	sha := sha256.New()
+	wr := bufio.NewWriterSize(io.MultiWriter(w, sha), 0x100000)
+
+	db.RWMutex.RLock()
+	keys := make([]UtxoKeyType, 0, len(db.HashMap))
+	for k := range db.HashMap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	binary.Write(wr, binary.LittleEndian, db.LastBlockHeight)
+	var blhash [32]byte
+	copy(blhash[:], db.LastBlockHash)
+	wr.Write(blhash[:])
+	binary.Write(wr, binary.LittleEndian, uint64(len(keys)))
+	for _, k := range keys {
+		v := db.HashMap[k]
+		btc.WriteVlen(wr, uint64(UtxoIdxLen+len(v)))
+		wr.Write(k[:])
+		if _, e = wr.Write(v); e != nil {
+			break
+		}
+	}
+	db.RWMutex.RUnlock()
+
+	if e == nil {
+		e = wr.Flush()
+	}
+	if e != nil {
+		return
+	}
+	hash = new(btc.Uint256)
+	hash.Hash = sha256.Sum256(sha.Sum(nil))
+	cnt = uint64(len(keys))
+	return
+}
+
+// LoadSnapshot replaces the content of the database with the given UTXO snapshot.
+// If expected is not nil, the snapshot is only applied if its hash matches it.
+// Returns the snapshot's hash.
+func (db *UnspentDB) LoadSnapshot(r io.Reader, expected *btc.Uint256) (hash *btc.Uint256, e error) {
+	var height uint32
+	var blhash [32]byte
+	var cnt, le uint64
+	var k, prv UtxoKeyType
+
+	sha := sha256.New()
+	buf := bufio.NewReaderSize(r, 0x100000)
+	rd := io.TeeReader(buf, sha)
+
+	if e = binary.Read(rd, binary.LittleEndian, &height); e != nil {
+		return
+	}
+	if e = btc.ReadAll(rd, blhash[:]); e != nil {
+		return
+	}
+	if e = binary.Read(rd, binary.LittleEndian, &cnt); e != nil {
+		return
+	}
+
+	hm := make(map[UtxoKeyType][]byte)
+	defer func() {
+		if e != nil {
+			for _, v := range hm {
+				free(v)
+			}
+		}
+	}()
+	for i := uint64(0); i < cnt; i++ {
+		if le, e = btc.ReadVLen(rd); e != nil {
+			return
+		}
+		if le <= UtxoIdxLen || le > SNAPSHOT_MAX_RECORD_SIZE {
+			e = errors.New("UTXO snapshot: bad record length")
+			return
+		}
+		if e = btc.ReadAll(rd, k[:]); e != nil {
+			return
+		}
+		if i > 0 && bytes.Compare(prv[:], k[:]) >= 0 {
+			e = errors.New("UTXO snapshot: records not sorted")
+			return
+		}
+		prv = k
+		v := malloc(uint32(int(le) - UtxoIdxLen))
+		if e = btc.ReadAll(rd, v); e != nil {
+			free(v)
+			return
+		}
+		hm[k] = v
+	}
+	if _, er := buf.ReadByte(); er != io.EOF {
+		e = errors.New("UTXO snapshot: extra data at the end")
+		return
+	}
+
+	hash = new(btc.Uint256)
+	hash.Hash = sha256.Sum256(sha.Sum(nil))
+	if expected != nil && !hash.Equal(expected) {
+		e = errors.New("UTXO snapshot: hash mismatch - " + hash.String())
+		return
+	}
+
+	db.Mutex.Lock()
+	db.abortWriting()
+	db.RWMutex.Lock()
+	for _, v := range db.HashMap {
+		free(v)
+	}
+	db.HashMap = hm
+	db.LastBlockHeight = height
+	db.LastBlockHash = blhash[:]
+	db.RWMutex.Unlock()
+	db.DirtyDB.Set()
+	db.Mutex.Unlock()
+	return
+}
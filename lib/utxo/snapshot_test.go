@@ -0,0 +1,80 @@
+package utxo
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func snapshotTestDB() (db *UnspentDB) {
+	db = new(UnspentDB)
+	db.HashMap = make(map[UtxoKeyType][]byte)
+	db.LastBlockHeight = 1234
+	db.LastBlockHash = make([]byte, 32)
+	db.LastBlockHash[0] = 0x77
+	for i := 0; i < 100; i++ {
+		rec := new(UtxoRec)
+		rec.TxID = btc.Sha2Sum([]byte{byte(i)})
+		rec.InBlock = uint32(i)
+		rec.Coinbase = i == 0
+		rec.Outs = make([]*UtxoTxOut, 1+i%3)
+		rec.Outs[len(rec.Outs)-1] = &UtxoTxOut{Value: uint64(i) * 1000, PKScr: []byte{0x51, byte(i)}}
+		var k UtxoKeyType
+		copy(k[:], rec.TxID[:])
+		db.HashMap[k] = rec.Bytes()
+	}
+	return
+}
+
+func TestSnapshot(t *testing.T) {
+	db := snapshotTestDB()
+	buf := new(bytes.Buffer)
+	hash, cnt, e := db.WriteSnapshot(buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if cnt != 100 {
+		t.Error("Bad number of records", cnt)
+	}
+
+	// the same set must always give the same snapshot
+	buf2 := new(bytes.Buffer)
+	hash2, _, _ := snapshotTestDB().WriteSnapshot(buf2)
+	if !hash.Equal(hash2) || !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Error("Snapshot not deterministic")
+	}
+
+	db2 := new(UnspentDB)
+	db2.HashMap = make(map[UtxoKeyType][]byte)
+	lhash, e := db2.LoadSnapshot(bytes.NewReader(buf.Bytes()), hash)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !lhash.Equal(hash) || db2.LastBlockHeight != 1234 || !bytes.Equal(db2.LastBlockHash, db.LastBlockHash) {
+		t.Error("Bad state after LoadSnapshot")
+	}
+	if len(db2.HashMap) != len(db.HashMap) || !db2.DirtyDB.Get() {
+		t.Error("Bad UTXO set after LoadSnapshot")
+	}
+	for k, v := range db.HashMap {
+		if !bytes.Equal(db2.HashMap[k], v) {
+			t.Error("Record mismatch", k)
+		}
+	}
+
+	db3 := new(UnspentDB)
+	db3.HashMap = make(map[UtxoKeyType][]byte)
+	if _, e = db3.LoadSnapshot(bytes.NewReader(buf.Bytes()), btc.NewUint256(make([]byte, 32))); e == nil {
+		t.Error("Snapshot with wrong hash accepted")
+	}
+	if len(db3.HashMap) != 0 || db3.LastBlockHeight != 0 {
+		t.Error("UTXO set modified by rejected snapshot")
+	}
+	if _, e = db3.LoadSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), nil); e == nil {
+		t.Error("Truncated snapshot accepted")
+	}
+	if _, e = db3.LoadSnapshot(bytes.NewReader(append(buf.Bytes(), 0)), nil); e == nil {
+		t.Error("Snapshot with extra data accepted")
+	}
+}
@@ -0,0 +1,292 @@
+package utxo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+Undo records of the blocks - everything needed to take a block off the UTXO set.
+They are kept (as long as the blocks' data) in the "undo" folder, next to BlockDB's files:
+ NNNNN.dat - records of UNDO_BLOCKS_PER_FILE consecutive heights (NNNNN is height/UNDO_BLOCKS_PER_FILE)
+ undo.idx - UNDO_IDX_REC_SIZE bytes for each height:
+  [0:32] - block hash
+  [32:40] - position of the record in the .dat file (LE)
+  [40:44] - length of the record (LE) - zero if there is no record for this height
+
+Record format:
+ [0:32] - block hash
+ [32:36] - block height (LE)
+ var_int - number of the block's transactions that added outputs to UTXO, then for each of them:
+  [32] - TXID
+  var_int - number of outputs
+ var_int - number of transactions with outputs spent by the block, then for each of them:
+  var_int - length of the record
+  [...] - the spent outputs, with the height and coinbase flag (as in UtxoRec.Serialize(true))
+ [4] - checksum: first 4 bytes of double SHA256 of all the bytes above
+*/
+
+const (
+	UNDO_BLOCKS_PER_FILE = 1000
+	UNDO_IDX_REC_SIZE    = 44
+)
+
+var ErrNoUndoRecord = errors.New("Undo: no record for this block")
+
+type UndoAddedTx struct {
+	TxID   [32]byte
+	OutCnt uint32
+}
+
+// BlockUndo is the undo record of one block
+type BlockUndo struct {
+	Hash   [32]byte
+	Height uint32
+	Added  []UndoAddedTx
+	Spent  []*UtxoRec // sorted by TxID
+}
+
+// NewBlockUndo makes the undo record from the changes the block has made to UTXO.
+func NewBlockUndo(changes *BlockChanges, blhash []byte) (u *BlockUndo) {
+	u = &BlockUndo{Height: changes.Height}
+	copy(u.Hash[:], blhash)
+	u.Added = make([]UndoAddedTx, len(changes.AddList))
+	for i, rec := range changes.AddList {
+		u.Added[i] = UndoAddedTx{TxID: rec.TxID, OutCnt: uint32(len(rec.Outs))}
+	}
+	u.Spent = make([]*UtxoRec, 0, len(changes.UndoData))
+	for _, rec := range changes.UndoData {
+		u.Spent = append(u.Spent, rec)
+	}
+	sort.Slice(u.Spent, func(i, j int) bool {
+		return bytes.Compare(u.Spent[i].TxID[:], u.Spent[j].TxID[:]) < 0
+	})
+	return
+}
+
+// Bytes returns the serialized record, with the checksum at the end.
+func (u *BlockUndo) Bytes() []byte {
+	bu := new(bytes.Buffer)
+	bu.Write(u.Hash[:])
+	binary.Write(bu, binary.LittleEndian, u.Height)
+	btc.WriteVlen(bu, uint64(len(u.Added)))
+	for i := range u.Added {
+		bu.Write(u.Added[i].TxID[:])
+		btc.WriteVlen(bu, uint64(u.Added[i].OutCnt))
+	}
+	btc.WriteVlen(bu, uint64(len(u.Spent)))
+	for _, rec := range u.Spent {
+		bin := rec.Serialize(true)
+		btc.WriteVlen(bu, uint64(len(bin)))
+		bu.Write(bin)
+	}
+	sum := btc.Sha2Sum(bu.Bytes())
+	bu.Write(sum[:4])
+	return bu.Bytes()
+}
+
+// SpentCount returns the number of outputs spent by the block.
+func (u *BlockUndo) SpentCount() (cnt int) {
+	for _, rec := range u.Spent {
+		for _, o := range rec.Outs {
+			if o != nil {
+				cnt++
+			}
+		}
+	}
+	return
+}
+
+// ParseBlockUndo verifies the checksum and decodes the record.
+func ParseBlockUndo(dat []byte) (u *BlockUndo, e error) {
+	if len(dat) < 32+4+1+1+4 {
+		return nil, errors.New("Undo: record too short")
+	}
+	sum := btc.Sha2Sum(dat[:len(dat)-4])
+	if !bytes.Equal(sum[:4], dat[len(dat)-4:]) {
+		return nil, errors.New("Undo: checksum mismatch")
+	}
+	dat = dat[:len(dat)-4]
+
+	defer func() {
+		if r := recover(); r != nil {
+			u, e = nil, errors.New(fmt.Sprint("Undo: corrupt record - ", r))
+		}
+	}()
+
+	u = new(BlockUndo)
+	copy(u.Hash[:], dat[:32])
+	u.Height = binary.LittleEndian.Uint32(dat[32:36])
+	off := 36
+
+	cnt, n := btc.VLen(dat[off:])
+	off += n
+	if n == 0 || cnt < 0 || cnt > (len(dat)-off)/33 {
+		return nil, errors.New("Undo: bad number of added transactions")
+	}
+	u.Added = make([]UndoAddedTx, cnt)
+	for i := range u.Added {
+		copy(u.Added[i].TxID[:], dat[off:off+32])
+		off += 32
+		le, n := btc.VLen(dat[off:])
+		if n == 0 || le <= 0 {
+			return nil, errors.New("Undo: bad output count")
+		}
+		off += n
+		u.Added[i].OutCnt = uint32(le)
+	}
+
+	cnt, n = btc.VLen(dat[off:])
+	off += n
+	if n == 0 || cnt < 0 || cnt > len(dat)-off {
+		return nil, errors.New("Undo: bad number of spent records")
+	}
+	u.Spent = make([]*UtxoRec, cnt)
+	for i := range u.Spent {
+		le, n := btc.VLen(dat[off:])
+		off += n
+		if n == 0 || le < 32 || off+le > len(dat) {
+			return nil, errors.New("Undo: bad length of spent record")
+		}
+		u.Spent[i] = FullUtxoRec(dat[off : off+le])
+		off += le
+	}
+	if off != len(dat) {
+		return nil, errors.New("Undo: extra data at the end of the record")
+	}
+	return
+}
+
+// UndoStore keeps undo records of the blocks, indexed by height.
+type UndoStore struct {
+	dir    string
+	idx    *os.File
+	dat    *os.File
+	datno  uint32 // number of the .dat file that is open
+	pruned uint32 // .dat files below this one have been removed
+}
+
+// OpenUndoStore opens (or creates) the undo records in the given folder.
+func OpenUndoStore(dir string) (s *UndoStore, e error) {
+	if dir != "" && dir[len(dir)-1] != '/' && dir[len(dir)-1] != '\\' {
+		dir += string(os.PathSeparator)
+	}
+	os.MkdirAll(dir, 0770)
+	s = &UndoStore{dir: dir}
+	if s.idx, e = os.OpenFile(dir+"undo.idx", os.O_RDWR|os.O_CREATE, 0660); e != nil {
+		s = nil
+	}
+	return
+}
+
+func (s *UndoStore) datName(no uint32) string {
+	return fmt.Sprintf("%s%05d.dat", s.dir, no)
+}
+
+// Put stores the undo record, replacing the one previously stored at the same height.
+func (s *UndoStore) Put(u *BlockUndo) (e error) {
+	no := u.Height / UNDO_BLOCKS_PER_FILE
+	if s.dat == nil || s.datno != no {
+		if s.dat != nil {
+			s.dat.Close()
+		}
+		if s.dat, e = os.OpenFile(s.datName(no), os.O_RDWR|os.O_CREATE, 0660); e != nil {
+			return
+		}
+		s.datno = no
+	}
+	pos, e := s.dat.Seek(0, io.SeekEnd)
+	if e != nil {
+		return
+	}
+	raw := u.Bytes()
+	if _, e = s.dat.Write(raw); e != nil {
+		return
+	}
+	var rec [UNDO_IDX_REC_SIZE]byte
+	copy(rec[0:32], u.Hash[:])
+	binary.LittleEndian.PutUint64(rec[32:40], uint64(pos))
+	binary.LittleEndian.PutUint32(rec[40:44], uint32(len(raw)))
+	_, e = s.idx.WriteAt(rec[:], int64(u.Height)*UNDO_IDX_REC_SIZE)
+	return
+}
+
+// Get reads the undo record of the block at the given height.
+// If hash is not nil, the record must belong to the block with this hash.
+func (s *UndoStore) Get(height uint32, hash []byte) (u *BlockUndo, e error) {
+	var rec [UNDO_IDX_REC_SIZE]byte
+	if _, e = s.idx.ReadAt(rec[:], int64(height)*UNDO_IDX_REC_SIZE); e != nil {
+		return nil, ErrNoUndoRecord
+	}
+	le := binary.LittleEndian.Uint32(rec[40:44])
+	if le == 0 {
+		return nil, ErrNoUndoRecord
+	}
+	if hash != nil && !bytes.Equal(hash, rec[0:32]) {
+		return nil, ErrNoUndoRecord // the record is of another block at this height
+	}
+
+	no := height / UNDO_BLOCKS_PER_FILE
+	f := s.dat
+	if f == nil || s.datno != no {
+		if f, e = os.Open(s.datName(no)); e != nil {
+			return
+		}
+		defer f.Close()
+	}
+	dat := make([]byte, le)
+	if _, e = f.ReadAt(dat, int64(binary.LittleEndian.Uint64(rec[32:40]))); e != nil {
+		return
+	}
+	if u, e = ParseBlockUndo(dat); e != nil {
+		return
+	}
+	if u.Height != height || !bytes.Equal(u.Hash[:], rec[0:32]) {
+		return nil, errors.New(fmt.Sprint("Undo: record of block ", u.Height, " found at height ", height))
+	}
+	return
+}
+
+// Del removes the record stored at the given height.
+func (s *UndoStore) Del(height uint32) (e error) {
+	if height > s.MaxHeight() {
+		return
+	}
+	var rec [UNDO_IDX_REC_SIZE]byte
+	_, e = s.idx.WriteAt(rec[:], int64(height)*UNDO_IDX_REC_SIZE)
+	return
+}
+
+// MaxHeight returns the highest height that can have a record.
+func (s *UndoStore) MaxHeight() uint32 {
+	if fi, e := s.idx.Stat(); e == nil && fi.Size() >= UNDO_IDX_REC_SIZE {
+		return uint32(fi.Size()/UNDO_IDX_REC_SIZE) - 1
+	}
+	return 0
+}
+
+// Prune removes the .dat files with all the records below the given height.
+func (s *UndoStore) Prune(height uint32) {
+	for ; (s.pruned+1)*UNDO_BLOCKS_PER_FILE <= height; s.pruned++ {
+		if s.dat != nil && s.datno == s.pruned {
+			s.dat.Close()
+			s.dat = nil
+		}
+		os.Remove(s.datName(s.pruned))
+	}
+}
+
+func (s *UndoStore) Close() {
+	if s.dat != nil {
+		s.dat.Close()
+		s.dat = nil
+	}
+	s.idx.Close()
+}
@@ -0,0 +1,195 @@
+package utxo
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func undoTestRec(i int, outs ...uint64) (rec *UtxoRec) {
+	rec = new(UtxoRec)
+	rec.TxID = btc.Sha2Sum([]byte{0xee, byte(i)})
+	rec.InBlock = uint32(i)
+	rec.Coinbase = i == 0
+	rec.Outs = make([]*UtxoTxOut, len(outs))
+	for o, val := range outs {
+		if val != 0 {
+			rec.Outs[o] = &UtxoTxOut{Value: val, PKScr: []byte{0x51, byte(i), byte(o)}}
+		}
+	}
+	return
+}
+
+func undoTestBlock(height uint32) (u *BlockUndo) {
+	ch := &BlockChanges{Height: height, UndoData: make(map[[32]byte]*UtxoRec)}
+	ch.AddList = []*UtxoRec{undoTestRec(100, 5000), undoTestRec(101, 1, 2, 3)}
+	for i := 0; i < 5; i++ {
+		rec := undoTestRec(i, uint64(i+1)*100, 0, 7)
+		ch.UndoData[rec.TxID] = rec
+	}
+	return NewBlockUndo(ch, bytes.Repeat([]byte{byte(height)}, 32))
+}
+
+func TestBlockUndo(t *testing.T) {
+	u := undoTestBlock(77)
+	for i := 1; i < len(u.Spent); i++ {
+		if bytes.Compare(u.Spent[i-1].TxID[:], u.Spent[i].TxID[:]) >= 0 {
+			t.Fatal("Spent records not sorted")
+		}
+	}
+	if u.SpentCount() != 10 {
+		t.Error("Bad SpentCount", u.SpentCount())
+	}
+
+	raw := u.Bytes()
+	u2, e := ParseBlockUndo(raw)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if u2.Height != 77 || u2.Hash != u.Hash || len(u2.Added) != 2 || len(u2.Spent) != 5 {
+		t.Fatal("Parsed record does not match")
+	}
+	if u2.Added[1].OutCnt != 3 || u2.Spent[0].Outs[1] != nil || u2.Spent[0].InBlock != u.Spent[0].InBlock {
+		t.Error("Parsed record has bad content")
+	}
+	if !bytes.Equal(u2.Bytes(), raw) {
+		t.Error("Serialized again differs")
+	}
+
+	for _, i := range []int{0, 33, len(raw) / 2, len(raw) - 1} {
+		bad := append([]byte{}, raw...)
+		bad[i] ^= 0x01
+		if _, e := ParseBlockUndo(bad); e == nil {
+			t.Error("Corruption at", i, "not detected")
+		}
+	}
+	if _, e := ParseBlockUndo(raw[:len(raw)-1]); e == nil {
+		t.Error("Truncated record not detected")
+	}
+}
+
+func TestUndoStore(t *testing.T) {
+	dir := t.TempDir()
+	s, e := OpenUndoStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, h := range []uint32{1, 2, UNDO_BLOCKS_PER_FILE + 1} {
+		if e = s.Put(undoTestBlock(h)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if s.MaxHeight() != UNDO_BLOCKS_PER_FILE+1 {
+		t.Error("Bad MaxHeight", s.MaxHeight())
+	}
+	u := undoTestBlock(2)
+	if u2, e := s.Get(2, u.Hash[:]); e != nil || !bytes.Equal(u2.Bytes(), u.Bytes()) {
+		t.Error("Get 2 failed", e)
+	}
+	if _, e = s.Get(3, nil); e != ErrNoUndoRecord {
+		t.Error("Get 3 should have no record", e)
+	}
+	if _, e = s.Get(1, u.Hash[:]); e != ErrNoUndoRecord {
+		t.Error("Get 1 with hash of another block should have no record", e)
+	}
+
+	// another block at the same height
+	u = undoTestBlock(2)
+	u.Hash[0] = 0xff
+	s.Put(u)
+	if u2, e := s.Get(2, nil); e != nil || u2.Hash != u.Hash {
+		t.Error("Replaced record not returned", e)
+	}
+	s.Close()
+
+	s, e = OpenUndoStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	s.Prune(UNDO_BLOCKS_PER_FILE)
+	if _, e = s.Get(1, nil); e == nil {
+		t.Error("Record of a pruned block still there")
+	}
+	if _, e = s.Get(UNDO_BLOCKS_PER_FILE+1, nil); e != nil {
+		t.Error("Record above prune height gone", e)
+	}
+}
+
+func TestUndoBlock(t *testing.T) {
+	db := NewUnspentDb(&NewUnspentOpts{Dir: t.TempDir() + "/", Rescan: true})
+	defer db.Close()
+
+	hash1 := bytes.Repeat([]byte{1}, 32)
+	hash2 := bytes.Repeat([]byte{2}, 32)
+	a, b := undoTestRec(0, 100, 200), undoTestRec(1, 300)
+	db.CommitBlockTxs(&BlockChanges{Height: 1, AddList: []*UtxoRec{a, b},
+		UndoData: make(map[[32]byte]*UtxoRec)}, hash1)
+
+	state := make(map[UtxoKeyType][]byte)
+	for k, v := range db.HashMap {
+		state[k] = append([]byte{}, v...)
+	}
+
+	// block 2 spends a:0 and b:0 and adds c
+	ch := &BlockChanges{Height: 2, AddList: []*UtxoRec{undoTestRec(2, 400)},
+		DeledTxs: map[[32]byte][]bool{a.TxID: {true, false}, b.TxID: {true}},
+		UndoData: map[[32]byte]*UtxoRec{a.TxID: undoTestRec(0, 100, 0), b.TxID: undoTestRec(1, 300)}}
+	db.CommitBlockTxs(ch, hash2)
+	if len(db.HashMap) != 2 {
+		t.Fatal("Bad number of records after block 2", len(db.HashMap))
+	}
+
+	if e := db.UndoBlock(hash1, hash1); e != ErrNoUndoRecord {
+		t.Error("Undo with a bad hash should fail", e)
+	}
+	if e := db.UndoBlock(hash2, hash1); e != nil {
+		t.Fatal(e)
+	}
+	if db.LastBlockHeight != 1 || !bytes.Equal(db.LastBlockHash, hash1) {
+		t.Error("Bad last block after undo", db.LastBlockHeight)
+	}
+	if _, e := db.undo.Get(2, hash2); e != ErrNoUndoRecord {
+		t.Error("Record of the undone block still there", e)
+	}
+	if len(db.HashMap) != len(state) {
+		t.Fatal("Bad number of records after undo", len(db.HashMap))
+	}
+	for k, v := range state {
+		if !bytes.Equal(db.HashMap[k], v) {
+			t.Errorf("Record %x not restored", k[:])
+		}
+	}
+}
+
+func TestUndoPrune(t *testing.T) {
+	db := NewUnspentDb(&NewUnspentOpts{Dir: t.TempDir() + "/", Rescan: true})
+	defer db.Close()
+	db.UnwindBufLen = 2
+
+	const last = 3*UNDO_BLOCKS_PER_FILE + 5
+	for h := uint32(1); h <= last; h++ {
+		db.CommitBlockTxs(&BlockChanges{Height: h, AddList: []*UtxoRec{undoTestRec(int(h), 100)},
+			UndoData: make(map[[32]byte]*UtxoRec)}, bytes.Repeat([]byte{byte(h)}, 32))
+	}
+	// the records do not depend on UnwindBufLen
+	for _, h := range []uint32{1, UNDO_BLOCKS_PER_FILE, last - 2, last} {
+		if _, e := db.undo.Get(h, nil); e != nil {
+			t.Error("Record", h, "missing", e)
+		}
+	}
+
+	// only the files with all the records up to the pruned height get removed
+	db.PruneUndo(2*UNDO_BLOCKS_PER_FILE - 2)
+	for _, h := range []uint32{1, UNDO_BLOCKS_PER_FILE - 1} {
+		if _, e := db.undo.Get(h, nil); e == nil {
+			t.Error("Record", h, "should have been pruned")
+		}
+	}
+	for _, h := range []uint32{UNDO_BLOCKS_PER_FILE, 2*UNDO_BLOCKS_PER_FILE - 1, last} {
+		if _, e := db.undo.Get(h, nil); e != nil {
+			t.Error("Record", h, "missing after pruning", e)
+		}
+	}
+}
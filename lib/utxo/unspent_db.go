@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/others/sys"
@@ -61,6 +62,7 @@ type UnspentDB struct {
 	CurrentHeightOnDisk uint32
 	hurryup             chan bool
 	DoNotWriteUndoFiles bool
+	undo                *UndoStore
 	CB                  CallbackFunctions
 }
 
@@ -89,6 +91,12 @@ func NewUnspentDb(opts *NewUnspentOpts) (db *UnspentDB) {
 	os.Remove(db.dir_undo + "tmp")
 	os.Remove(db.dir_utxo + "UTXO.db.tmp")
 
+	if us, er := OpenUndoStore(db.dir_undo); er == nil {
+		db.undo = us
+	} else {
+		println("UTXO: cannot open undo records:", er.Error())
+	}
+
 	if opts.Rescan {
 		db.HashMap = make(map[UtxoKeyType][]byte, UTXO_RECORDS_PREALLOC)
 		return
@@ -322,24 +330,14 @@ finito:
 
 // Commit the given add/del transactions to UTXO and Unwind DBs
 func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e error) {
-	undo_fn := fmt.Sprint(db.dir_undo, changes.Height)
-
 	db.Mutex.Lock()
 	defer db.Mutex.Unlock()
 	db.abortWriting()
 
-	if changes.UndoData != nil {
-		bu := new(bytes.Buffer)
-		bu.Write(blhash)
-		if changes.UndoData != nil {
-			for _, xx := range changes.UndoData {
-				bin := xx.Serialize(true)
-				btc.WriteVlen(bu, uint64(len(bin)))
-				bu.Write(bin)
-			}
+	if changes.UndoData != nil && db.undo != nil && !db.DoNotWriteUndoFiles {
+		if er := db.undo.Put(NewBlockUndo(changes, blhash)); er != nil {
+			println("UTXO: cannot write undo record:", er.Error())
 		}
-		ioutil.WriteFile(db.dir_undo+"tmp", bu.Bytes(), 0666)
-		os.Rename(db.dir_undo+"tmp", undo_fn)
 	}
 
 	db.commit(changes)
@@ -350,6 +348,7 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 	copy(db.LastBlockHash, blhash)
 	db.LastBlockHeight = changes.Height
 
+	// the undo records are kept as long as the blocks' data (see PruneUndo), only the old format files get removed
 	if changes.Height > db.UnwindBufLen {
 		os.Remove(fmt.Sprint(db.dir_undo, changes.Height-db.UnwindBufLen))
 	}
@@ -358,18 +357,62 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 	return
 }
 
-func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
+// UndoBlock takes the last block off UTXO, using its undo record.
+// Returns ErrNoUndoRecord if there is no record for the block.
+func (db *UnspentDB) UndoBlock(blhash, newhash []byte) (e error) {
 	db.Mutex.Lock()
 	defer db.Mutex.Unlock()
+
+	if db.undo == nil {
+		return ErrNoUndoRecord
+	}
+	var u *BlockUndo
+	if u, e = db.undo.Get(db.LastBlockHeight, blhash); e != nil {
+		return
+	}
 	db.abortWriting()
 
-	for _, tx := range bl.Txs {
-		lst := make([]bool, len(tx.TxOut))
-		for i := range lst {
-			lst[i] = true
+	for i := range u.Added {
+		lst := make([]bool, u.Added[i].OutCnt)
+		for j := range lst {
+			lst[j] = true
 		}
-		db.del(tx.Hash.Hash[:], lst)
+		db.del(u.Added[i].TxID[:], lst)
+	}
+	db.addBack(u.Spent)
+	db.undo.Del(db.LastBlockHeight)
+
+	db.LastBlockHeight--
+	copy(db.LastBlockHash, newhash)
+	db.DirtyDB.Set()
+	return
+}
+
+// GetUndo returns the undo record of the given block (ErrNoUndoRecord if there is none).
+func (db *UnspentDB) GetUndo(height uint32, blhash []byte) (u *BlockUndo, e error) {
+	db.Mutex.Lock()
+	if db.undo == nil {
+		e = ErrNoUndoRecord
+	} else {
+		u, e = db.undo.Get(height, blhash)
+	}
+	db.Mutex.Unlock()
+	return
+}
+
+// PruneUndo removes the undo records of the blocks up to the given height (whose data has been pruned).
+func (db *UnspentDB) PruneUndo(height uint32) {
+	db.Mutex.Lock()
+	if db.undo != nil {
+		db.undo.Prune(height + 1)
 	}
+	db.Mutex.Unlock()
+}
+
+// UndoBlockTxs takes the last block off UTXO, using the block and the undo file of the old format.
+func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) (e error) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
 
 	fn := fmt.Sprint(db.dir_undo, db.LastBlockHeight)
 	var addback []*UtxoRec
@@ -380,7 +423,19 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 
 	dat, er := ioutil.ReadFile(fn)
 	if er != nil {
-		panic(er.Error())
+		return errors.New(fmt.Sprint("UndoBlockTxs: no undo data for block ", db.LastBlockHeight))
+	}
+	if len(dat) < 32 || !bytes.Equal(dat[:32], bl.Hash.Hash[:]) {
+		return errors.New("UndoBlockTxs: " + fn + " is not for block " + bl.Hash.String())
+	}
+	db.abortWriting()
+
+	for _, tx := range bl.Txs {
+		lst := make([]bool, len(tx.TxOut))
+		for i := range lst {
+			lst[i] = true
+		}
+		db.del(tx.Hash.Hash[:], lst)
 	}
 
 	off := 32 // ship the block hash
@@ -391,7 +446,17 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 		off += le
 		addback = append(addback, qr)
 	}
+	db.addBack(addback)
+
+	os.Remove(fn)
+	db.LastBlockHeight--
+	copy(db.LastBlockHash, newhash)
+	db.DirtyDB.Set()
+	return
+}
 
+// addBack puts the spent outputs back into UTXO.
+func (db *UnspentDB) addBack(addback []*UtxoRec) {
 	for _, tx := range addback {
 		if db.CB.NotifyTxAdd != nil {
 			db.CB.NotifyTxAdd(tx)
@@ -414,11 +479,6 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 		db.HashMap[ind] = malloc_and_copy(tx.Bytes())
 		db.RWMutex.Unlock()
 	}
-
-	os.Remove(fn)
-	db.LastBlockHeight--
-	copy(db.LastBlockHash, newhash)
-	db.DirtyDB.Set()
 }
 
 // Call it when the main thread is idle
@@ -463,6 +523,10 @@ func (db *UnspentDB) Close() {
 	}
 	db.writingDone.Wait()
 	db.lastFileClosed.Wait()
+	if db.undo != nil {
+		db.undo.Close()
+		db.undo = nil
+	}
 }
 
 // Get given unspent output
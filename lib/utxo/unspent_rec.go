@@ -283,3 +283,7 @@ func (r *UtxoTxOut) IsP2WPKH() bool {
 func (r *UtxoTxOut) IsP2WSH() bool {
 	return len(r.PKScr)==34 && r.PKScr[0]==0 && r.PKScr[1]==32
 }
+
+func (r *UtxoTxOut) IsP2TR() bool {
+	return len(r.PKScr)==34 && r.PKScr[0]==btc.OP_1 && r.PKScr[1]==32
+}
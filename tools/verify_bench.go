@@ -0,0 +1,156 @@
+// This tool measures how fast the client verifies scripts of the recent blocks, using different number of threads.
+// It replays the blocks from BlockDB that have their undo records (the spent outputs) in UTXO's "undo" folder.
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"time"
+	"strconv"
+	"strings"
+	"runtime"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+const VerifyFlags = script.VER_P2SH | script.VER_DERSIG | script.VER_NULLDUMMY |
+	script.VER_CLTV | script.VER_CSV | script.VER_WITNESS | script.VER_TAPROOT
+
+var (
+	dir = flag.String("d", "", "Gocoin's data folder of the network (the one with blockchain.dat and UTXO.db)")
+	threads = flag.String("t", "", "Comma separated list of thread counts to test (default: 1 and then doubled up to the number of CPUs)")
+	maxblocks = flag.Int("n", 1000, "Replay at most this many of the most recent blocks")
+)
+
+
+// load_block returns the block with Spent_outputs of all its transactions set
+func load_block(bdb *chain.BlockDB, u *utxo.BlockUndo) (bl *btc.Block, inputs int, e error) {
+	undo := make(map[[32]byte] *utxo.UtxoRec, len(u.Spent))
+	for _, rec := range u.Spent {
+		undo[rec.TxID] = rec
+	}
+
+	raw, _, e := bdb.BlockGet(btc.NewUint256(u.Hash[:]))
+	if e != nil {
+		return
+	}
+	if bl, e = btc.NewBlock(raw); e != nil {
+		return
+	}
+	if e = bl.BuildTxList(); e != nil {
+		return
+	}
+	bl.VerifyFlags = VerifyFlags
+
+	blunsp := make(map[[32]byte] []*btc.TxOut, len(bl.Txs))
+	for _, tx := range bl.Txs {
+		if !tx.IsCoinBase() {
+			tx.Spent_outputs = make([]*btc.TxOut, len(tx.TxIn))
+			for i := range tx.TxIn {
+				inp := &tx.TxIn[i].Input
+				if rec, ok := undo[inp.Hash]; ok && int(inp.Vout) < len(rec.Outs) && rec.Outs[inp.Vout] != nil {
+					tx.Spent_outputs[i] = &btc.TxOut{Value:rec.Outs[inp.Vout].Value, Pk_script:rec.Outs[inp.Vout].PKScr}
+				} else if outs, ok := blunsp[inp.Hash]; ok && int(inp.Vout) < len(outs) {
+					tx.Spent_outputs[i] = outs[inp.Vout]
+				} else {
+					e = fmt.Errorf("spent output %s of block %s not found", inp.String(), bl.Hash.String())
+					return
+				}
+			}
+			inputs += len(tx.TxIn)
+		}
+		blunsp[tx.Hash.Hash] = tx.TxOut
+	}
+	return
+}
+
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		fmt.Println("Specify the data folder with -d (e.g. ~/.bitcoin/gocoin/btcnet)")
+		fmt.Println("Do not run this tool while the client is using the same folder.")
+		flag.PrintDefaults()
+		return
+	}
+	if !strings.HasSuffix(*dir, string(os.PathSeparator)) {
+		*dir += string(os.PathSeparator)
+	}
+
+	var cnts []int
+	if *threads != "" {
+		for _, s := range strings.Split(*threads, ",") {
+			n, e := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+			if e != nil || n == 0 {
+				println("Bad thread count:", s)
+				return
+			}
+			cnts = append(cnts, int(n))
+		}
+	} else {
+		for n := 1; n < runtime.NumCPU(); n *= 2 {
+			cnts = append(cnts, n)
+		}
+		cnts = append(cnts, runtime.NumCPU())
+	}
+
+	us, e := utxo.OpenUndoStore(*dir + "undo")
+	if e != nil {
+		println(e.Error())
+		return
+	}
+	var undos []*utxo.BlockUndo
+	for h := us.MaxHeight(); h > 0 && len(undos) < *maxblocks; h-- {
+		if u, e := us.Get(h, nil); e == nil {
+			undos = append([]*utxo.BlockUndo{u}, undos...)
+		} else if e != utxo.ErrNoUndoRecord {
+			println("Block", h, "skipped:", e.Error())
+		}
+	}
+	us.Close()
+	if len(undos) == 0 {
+		println("No undo records found")
+		return
+	}
+
+	bdb := chain.NewBlockDB(*dir)
+	bdb.LoadBlockIndex(nil, func(ch *chain.Chain, hash, hdr []byte, height, blen, txs uint32) {})
+
+	fmt.Println("Loading blocks", undos[0].Height, "...", undos[len(undos)-1].Height)
+	var blocks []*btc.Block
+	var inputs int
+	for _, u := range undos {
+		bl, n, e := load_block(bdb, u)
+		if e != nil {
+			println("Block", u.Height, "skipped:", e.Error())
+			continue
+		}
+		blocks = append(blocks, bl)
+		inputs += n
+	}
+	bdb.Close()
+	fmt.Println(len(blocks), "blocks with", inputs, "inputs loaded")
+	if inputs == 0 {
+		return
+	}
+
+	var first time.Duration
+	for _, n := range cnts {
+		chain.SetScriptVerifyThreads(n)
+		sta := time.Now()
+		for _, bl := range blocks {
+			if e := chain.VerifyBlockScripts(bl); e != nil {
+				println("Block", bl.Hash.String(), e.Error())
+			}
+		}
+		tim := time.Now().Sub(sta)
+		if first == 0 {
+			first = tim
+		}
+		fmt.Printf("%3d thread(s): %s  -  %.1f us/input  -  speedup x%.2f\n", n, tim.String(),
+			float64(tim.Nanoseconds())/1e3/float64(inputs), float64(first)/float64(tim))
+	}
+}
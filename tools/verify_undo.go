@@ -0,0 +1,152 @@
+// This tool verifies the undo records of the blocks, kept in UTXO's "undo" folder.
+// It checks the checksum of each record and (with -b) whether it matches the block stored in BlockDB.
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"strings"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+var (
+	dir = flag.String("d", "", "Gocoin's data folder of the network (the one with blockchain.dat and UTXO.db)")
+	from = flag.Uint("f", 1, "Start from this block height")
+	blocks = flag.Bool("b", false, "Check the records against the blocks from BlockDB")
+	verbose = flag.Bool("v", false, "Print each record that has been checked")
+)
+
+
+// check_block returns an error if the undo record does not exactly match what the block spends and adds
+func check_block(bl *btc.Block, u *utxo.BlockUndo) error {
+	txs := make(map[[32]byte] *btc.Tx, len(bl.Txs))
+	for _, tx := range bl.Txs {
+		txs[tx.Hash.Hash] = tx
+	}
+
+	for _, a := range u.Added {
+		tx, ok := txs[a.TxID]
+		if !ok {
+			return fmt.Errorf("added tx %s is not in the block", btc.NewUint256(a.TxID[:]).String())
+		}
+		if int(a.OutCnt) != len(tx.TxOut) {
+			return fmt.Errorf("added tx %s has %d outputs, not %d", tx.Hash.String(), len(tx.TxOut), a.OutCnt)
+		}
+	}
+
+	// outputs of the previous blocks, spent by this one
+	spent := make(map[btc.TxPrevOut] bool)
+	inblock := make(map[[32]byte] bool, len(bl.Txs))
+	for _, tx := range bl.Txs {
+		if !tx.IsCoinBase() {
+			for i := range tx.TxIn {
+				if inp := tx.TxIn[i].Input; !inblock[inp.Hash] {
+					spent[inp] = true
+				}
+			}
+		}
+		inblock[tx.Hash.Hash] = true
+	}
+
+	var cnt int
+	for _, rec := range u.Spent {
+		if rec.InBlock >= u.Height {
+			return fmt.Errorf("spent tx %s comes from block %d", btc.NewUint256(rec.TxID[:]).String(), rec.InBlock)
+		}
+		for vout, o := range rec.Outs {
+			if o == nil {
+				continue
+			}
+			if !spent[btc.TxPrevOut{Hash:rec.TxID, Vout:uint32(vout)}] {
+				return fmt.Errorf("output %s-%03d is not spent by the block", btc.NewUint256(rec.TxID[:]).String(), vout)
+			}
+			cnt++
+		}
+	}
+	if cnt != len(spent) {
+		return fmt.Errorf("block spends %d outputs, but the record has %d", len(spent), cnt)
+	}
+	return nil
+}
+
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		fmt.Println("Specify the data folder with -d (e.g. ~/.bitcoin/gocoin/btcnet)")
+		fmt.Println("Do not run this tool while the client is using the same folder.")
+		flag.PrintDefaults()
+		return
+	}
+	if !strings.HasSuffix(*dir, string(os.PathSeparator)) {
+		*dir += string(os.PathSeparator)
+	}
+
+	us, e := utxo.OpenUndoStore(*dir + "undo")
+	if e != nil {
+		println(e.Error())
+		os.Exit(1)
+	}
+	defer us.Close()
+
+	var bdb *chain.BlockDB
+	if *blocks {
+		bdb = chain.NewBlockDB(*dir)
+		bdb.LoadBlockIndex(nil, func(ch *chain.Chain, hash, hdr []byte, height, blen, txs uint32) {})
+		defer bdb.Close()
+	}
+
+	var ok, missing, bad, noblock, spent int
+	max := us.MaxHeight()
+	for h := uint32(*from); h <= max; h++ {
+		u, e := us.Get(h, nil)
+		if e == utxo.ErrNoUndoRecord {
+			missing++
+			continue
+		}
+		if e != nil {
+			fmt.Println("Block", h, "-", e.Error())
+			bad++
+			continue
+		}
+
+		if bdb != nil {
+			raw, _, e := bdb.BlockGet(btc.NewUint256(u.Hash[:]))
+			if e != nil {
+				noblock++
+			} else {
+				bl, e := btc.NewBlock(raw)
+				if e == nil {
+					e = bl.BuildTxList()
+				}
+				if e == nil {
+					e = check_block(bl, u)
+				}
+				if e != nil {
+					fmt.Println("Block", h, btc.NewUint256(u.Hash[:]).String(), "-", e.Error())
+					bad++
+					continue
+				}
+			}
+		}
+
+		if *verbose {
+			fmt.Println("Block", h, btc.NewUint256(u.Hash[:]).String(), "-", len(u.Added), "txs added,",
+				u.SpentCount(), "outputs spent")
+		}
+		spent += u.SpentCount()
+		ok++
+	}
+
+	fmt.Println("Heights", *from, "...", max, "-", ok, "records OK with", spent, "spent outputs,",
+		missing, "missing,", bad, "bad")
+	if bdb != nil && noblock > 0 {
+		fmt.Println(noblock, "records could not be checked against the blocks (not in BlockDB)")
+	}
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
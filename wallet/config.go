@@ -12,6 +12,7 @@ import (
 var (
 	keycnt uint = 250
 	testnet bool = false
+	regtest bool = false
 	waltype uint = 3
 	type2sec string
 	uncompressed bool = false
@@ -21,6 +22,8 @@ var (
 	litecoin bool = false
 	txfilename string
 	stdin bool
+	hdpath string
+	bip39pass string
 )
 
 func parse_config() {
@@ -60,7 +63,7 @@ func parse_config() {
 				case "type":
 					v, e := strconv.ParseUint(ll[1], 10, 32)
 					if e == nil {
-						if v>=1 && v<=4 {
+						if v>=1 && v<=5 {
 							waltype = uint(v)
 						} else {
 							println(i, "wallet.cfg: incorrect wallet type", v)
@@ -74,6 +77,12 @@ func parse_config() {
 				case "type2sec":
 					type2sec = ll[1]
 
+				case "hdpath":
+					hdpath = ll[1]
+
+				case "bip39pass":
+					bip39pass = ll[1]
+
 				case "keycnt":
 					v, e := strconv.ParseUint(ll[1], 10, 32)
 					if e == nil {
@@ -137,10 +146,12 @@ func parse_config() {
 
 	flag.UintVar(&keycnt, "n", keycnt, "Set the number of determinstic keys to be calculated by the wallet")
 	flag.BoolVar(&testnet, "t", testnet, "Testnet mode")
-	flag.UintVar(&waltype, "type", waltype, "Type of a deterministic wallet to be used (1 to 4)")
+	flag.BoolVar(&regtest, "regtest", regtest, "Regtest mode (implies testnet)")
+	flag.UintVar(&waltype, "type", waltype, "Type of a deterministic wallet to be used (1 to 5)")
 	flag.StringVar(&type2sec, "t2sec", type2sec, "Enforce using this secret for Type-2 wallet (hex encoded)")
+	flag.StringVar(&hdpath, "path", hdpath, "Account derivation path for Type-5 wallet (e.g. m/84'/0'/0')")
 	flag.BoolVar(&uncompressed, "u", uncompressed, "Deprecated in this version")
-	flag.StringVar(&fee, "fee", fee, "Specify transaction fee to be used")
+	flag.StringVar(&fee, "fee", fee, "Specify transaction fee to be used (or auto[:N] to confirm within N blocks)")
 	flag.BoolVar(&apply2bal, "a", apply2bal, "Apply changes to the balance folder (does not work with -raw)")
 	flag.BoolVar(&litecoin, "ltc", litecoin, "Litecoin mode")
 	flag.StringVar(&txfilename, "txfn", "", "Use this filename for output transaction (otherwise use a random name)")
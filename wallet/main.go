@@ -4,6 +4,8 @@ import (
 	"os"
 	"fmt"
 	"flag"
+	"strconv"
+	"strings"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin"
 	"github.com/piotrnar/gocoin/lib/others/sys"
@@ -45,6 +47,9 @@ var (
 	// Decode raw tx
 	dumptxfn *string  = flag.String("d", "", "Decode a raw transaction (specify filename as the parameter)")
 
+	// Partially Signed Bitcoin Transaction (BIP174)
+	psbtcmd *string  = flag.String("psbt", "", "PSBT command: sign, finalize, decode or combine (specify the PSBT file(s) after all the switches)")
+
 	// Sign raw message
 	signhash *string  = flag.String("hash", "", "Sign a raw hash value (use together with -sign parameter)")
 
@@ -61,6 +66,13 @@ var (
 
 	segwit_mode *bool = flag.Bool("segwit", false, "List SegWit deposit addresses (instead of P2KH)")
 	bech32_mode *bool = flag.Bool("bech32", false, "use with -segwit to see P2WPKH deposit addresses (instead of P2SH-WPKH)")
+	taproot_mode *bool = flag.Bool("taproot", false, "List P2TR (taproot) deposit addresses (instead of P2KH)")
+
+	// Export output descriptors
+	descriptors *bool = flag.Bool("desc", false, "Print output descriptors of the wallet's addresses (to track them as watch-only)")
+
+	// Generate BIP39 mnemonic
+	bip39words *int = flag.Int("bip39", 0, "Generate a new BIP39 mnemonic of the given number of words (12, 15, 18, 21 or 24)")
 )
 
 
@@ -91,31 +103,64 @@ func main() {
 
 	flag.Parse() // this one will print defaults and exit in case of any unknown switches (like -h)
 
+	if regtest {
+		testnet = true
+		btc.TestnetHRP = btc.RegtestHRP
+	}
+
 	if uncompressed {
 		println("For SegWit address safety, uncompressed keys are disabled in this version")
 		os.Exit(1)
 	}
 
 	// convert string fee to uint64
-	if val, e := btc.StringToSatoshis(fee); e != nil {
+	if fee=="auto" {
+		autoFee = 6
+	} else if strings.HasPrefix(fee, "auto:") {
+		if n, e := strconv.ParseUint(fee[5:], 10, 32); e != nil || n < 1 {
+			println("Incorrect fee value", fee)
+			os.Exit(1)
+		} else {
+			autoFee = uint(n)
+		}
+	} else if val, e := btc.StringToSatoshis(fee); e != nil {
 		println("Incorrect fee value", fee)
 		os.Exit(1)
 	} else {
 		curFee = val
 	}
 
+	// new mnemonic for Type-5 wallet?
+	if *bip39words!=0 {
+		new_mnemonic()
+		return
+	}
+
 	// decode raw transaction?
 	if *dumptxfn!="" {
 		dump_raw_tx()
 		return
 	}
 
+	// PSBT file?
+	if *psbtcmd!="" {
+		process_psbt()
+		cleanExit(0)
+	}
+
 	// dump public key or secret scan key?
 	if *pubkey!="" {
 		make_wallet()
 		cleanExit(0)
 	}
 
+	// export descriptors?
+	if *descriptors {
+		make_wallet()
+		dump_descriptors()
+		cleanExit(0)
+	}
+
 	// list public addresses?
 	if *list {
 		make_wallet()
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"io/ioutil"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/psbt"
+)
+
+
+func psbt_from_file(fn string) *psbt.Psbt {
+	d, er := ioutil.ReadFile(fn)
+	if er != nil {
+		fmt.Println("ERROR:", er.Error())
+		cleanExit(1)
+	}
+	p, er := psbt.Decode(d)
+	if er != nil {
+		fmt.Println("ERROR: Cannot decode", fn, "-", er.Error())
+		cleanExit(1)
+	}
+	return p
+}
+
+
+func write_psbt_file(p *psbt.Psbt) {
+	var fn string
+	if txfilename == "" {
+		fn = p.UnsignedTx().Hash.String()[:8]+".psbt"
+	} else {
+		fn = txfilename
+	}
+	if er := ioutil.WriteFile(fn, p.Serialize(), 0666); er != nil {
+		fmt.Println("ERROR:", er.Error())
+		cleanExit(1)
+	}
+	fmt.Println("PSBT stored in", fn)
+}
+
+
+// fill in the spent outputs and redeem scripts that we can find in the balance folder and the wallet
+func psbt_fill_inputs(p *psbt.Psbt) {
+	for i, in := range p.Inputs {
+		if in.NonWitnessUtxo == nil {
+			if ptx := tx_from_balance(btc.NewUint256(in.PrevOut.Hash[:]), false); ptx != nil {
+				if int(in.PrevOut.Vout) < len(ptx.TxOut) {
+					ptx.SetHash(ptx.Serialize())
+					in.NonWitnessUtxo = ptx
+				}
+			}
+		}
+		out := p.SpentOutput(i)
+		if out == nil {
+			continue
+		}
+		if in.WitnessUtxo == nil {
+			if ver, prog := btc.IsWitnessProgram(out.Pk_script); prog != nil && ver <= 16 {
+				in.WitnessUtxo = out
+			}
+		}
+		if in.RedeemScript == nil && btc.IsP2SH(out.Pk_script) {
+			// P2SH-P2WPKH of our segwit keys
+			if k_idx := hash_to_key_idx(out.Pk_script[2:22]); k_idx >= 0 && segwit[k_idx] != nil &&
+				segwit[k_idx].Hash160 == btc.Rimp160AfterSha256(append([]byte{0,20}, keys[k_idx].BtcAddr.Hash160[:]...)) {
+				in.RedeemScript = append([]byte{0,20}, keys[k_idx].BtcAddr.Hash160[:]...)
+				if in.WitnessUtxo == nil {
+					in.WitnessUtxo = out
+				}
+			}
+		}
+	}
+}
+
+
+func psbt_sign(p *psbt.Psbt) {
+	psbt_fill_inputs(p)
+	var cnt int
+	for _, k := range keys {
+		n, er := p.Sign(k.Key, k.BtcAddr.Pubkey)
+		if er != nil {
+			fmt.Println("ERROR:", er.Error())
+			cleanExit(1)
+		}
+		cnt += n
+	}
+	fmt.Println(cnt, "signature(s) added")
+	write_psbt_file(p)
+}
+
+
+func psbt_finalize(p *psbt.Psbt) {
+	if er := p.Finalize(); er != nil {
+		fmt.Println("ERROR:", er.Error())
+		cleanExit(1)
+	}
+	tx, er := p.Extract()
+	if er != nil {
+		fmt.Println("ERROR:", er.Error())
+		cleanExit(1)
+	}
+	write_tx_file(tx)
+}
+
+
+func psbt_decode(p *psbt.Psbt) {
+	tx := p.UnsignedTx()
+	fmt.Println("PSBT Version:", p.Version)
+	fmt.Println("ID:", tx.Hash.String())
+	fmt.Println("Tx Version:", tx.Version, "  Lock Time:", tx.Lock_time)
+	fmt.Println("TX IN cnt:", len(p.Inputs))
+	var unsigned int
+	for i, in := range p.Inputs {
+		fmt.Printf("%4d) %s seq=%08x\n", i, in.PrevOut.String(), in.Sequence)
+		if out := p.SpentOutput(i); out != nil {
+			if a := addr_from_pkscr(out.Pk_script); a != nil {
+				fmt.Printf("%15s BTC from %s\n", btc.UintToBtc(out.Value), a.String())
+			} else {
+				fmt.Printf("%15s BTC from %s\n", btc.UintToBtc(out.Value), hex.EncodeToString(out.Pk_script))
+			}
+		} else {
+			fmt.Println("       - unknown spent output")
+		}
+		if in.IsFinalized() {
+			fmt.Println("       - finalized")
+			continue
+		}
+		unsigned++
+		for _, ps := range in.PartialSigs {
+			fmt.Println("       - signed by", hex.EncodeToString(ps.Pubkey))
+		}
+		if in.TapKeySig != nil {
+			fmt.Println("       - taproot key path signature")
+		}
+		if in.RedeemScript != nil {
+			fmt.Println("       - redeem script", hex.EncodeToString(in.RedeemScript))
+		}
+		if in.WitnessScript != nil {
+			fmt.Println("       - witness script", hex.EncodeToString(in.WitnessScript))
+		}
+	}
+	fmt.Println("TX OUT cnt:", len(p.Outputs))
+	for i, out := range p.Outputs {
+		if a := addr_from_pkscr(out.Script); a != nil {
+			fmt.Printf("%4d) %15s BTC to %s\n", i, btc.UintToBtc(out.Amount), a.String())
+		} else {
+			fmt.Printf("%4d) %15s BTC to %s\n", i, btc.UintToBtc(out.Amount), hex.EncodeToString(out.Script))
+		}
+	}
+	if fee, er := p.Fee(); er == nil {
+		fmt.Println("Fee:", btc.UintToBtc(fee), "BTC")
+	}
+	if unsigned > 0 {
+		fmt.Println(unsigned, "input(s) not finalized yet")
+	} else {
+		fmt.Println("All the inputs finalized")
+	}
+}
+
+
+// process -psbt command with the file name(s) given as the remaining arguments
+func process_psbt() {
+	files := flag.Args()
+	if len(files) == 0 {
+		fmt.Println("ERROR: Specify PSBT file name (after all the switches)")
+		os.Exit(1)
+	}
+	p := psbt_from_file(files[0])
+
+	switch *psbtcmd {
+		case "decode":
+			psbt_decode(p)
+
+		case "sign":
+			make_wallet()
+			psbt_sign(p)
+
+		case "finalize":
+			psbt_finalize(p)
+
+		case "combine":
+			if len(files) < 2 {
+				fmt.Println("ERROR: Specify at least two PSBT files to combine")
+				os.Exit(1)
+			}
+			for _, fn := range files[1:] {
+				if er := p.Combine(psbt_from_file(fn)); er != nil {
+					fmt.Println("ERROR:", fn, "-", er.Error())
+					os.Exit(1)
+				}
+			}
+			write_psbt_file(p)
+
+		default:
+			fmt.Println("ERROR: Unknown PSBT command", *psbtcmd, "- use sign, finalize, decode or combine")
+			os.Exit(1)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"fmt"
 	"bufio"
 	"strings"
 	"github.com/piotrnar/gocoin/lib/btc"
@@ -17,6 +18,9 @@ var (
 	// set in parse_spend():
 	spendBtc, feeBtc, changeBtc uint64
 	sendTo []oneSendTo
+
+	// set in load_fee_estimate():
+	feeSpkb uint64 // satoshis per 1000 vbytes (when "-fee auto" is used)
 )
 
 // parse the "-send ..." parameter
@@ -95,9 +99,50 @@ func parse_batch() {
 	}
 }
 
+// read the feerate for autoFee blocks from balance/fees.txt
+func load_fee_estimate() {
+	f, e := os.Open("balance/fees.txt")
+	if e != nil {
+		println("Cannot use auto fee:", e.Error())
+		cleanExit(1)
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	for {
+		l, _, e := rd.ReadLine()
+		if len(l)==0 && e!=nil {
+			break
+		}
+		var blocks uint
+		var spb float64
+		if _, er := fmt.Sscanf(string(l), "%d %f", &blocks, &spb); er != nil {
+			println("ERROR in fees.txt: ", string(l))
+			continue
+		}
+		if blocks > autoFee && feeSpkb != 0 {
+			break // the file is sorted - we have the closest lower target
+		}
+		feeSpkb = uint64(spb * 1000)
+	}
+	if feeSpkb == 0 {
+		println("No fee estimate found in balance/fees.txt")
+		cleanExit(1)
+	}
+	if *verbose {
+		fmt.Printf("Using %.3f SPB to confirm within %d blocks\n", float64(feeSpkb)/1000, autoFee)
+	}
+}
+
 // returns true if spend operation has been requested
 func send_request() bool {
 	feeBtc = curFee
+	if autoFee != 0 && (*send!="" || *batch!="") {
+		if *subfee {
+			println("Auto fee cannot be used with -f switch")
+			cleanExit(1)
+		}
+		load_fee_estimate()
+	}
 	if *send!="" {
 		parse_spend()
 	}
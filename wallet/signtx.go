@@ -9,6 +9,49 @@ import (
 )
 
 
+// taproot signatures commit to all the outputs spent by the transaction
+func set_spent_outputs(tx *btc.Tx) bool {
+	tx.Spent_outputs = make([]*btc.TxOut, len(tx.TxIn))
+	for i := range tx.TxIn {
+		ptx := tx_from_balance(btc.NewUint256(tx.TxIn[i].Input.Hash[:]), false)
+		if ptx == nil || int(tx.TxIn[i].Input.Vout) >= len(ptx.TxOut) {
+			tx.Spent_outputs = nil
+			return false
+		}
+		tx.Spent_outputs[i] = ptx.TxOut[tx.TxIn[i].Input.Vout]
+	}
+	return true
+}
+
+
+// estimated virtual size of a signed input spending the given output
+func input_vsize(pkscr []byte) uint64 {
+	if btc.IsP2TR(pkscr) {
+		return 58 // 41 + (1 + 65) / 4
+	}
+	if ver, prog := btc.IsWitnessProgram(pkscr); prog != nil && ver == 0 {
+		return 68 // 41 + (1 + 1 + 72 + 1 + 33) / 4
+	}
+	if btc.IsP2SH(pkscr) {
+		return 91 // P2SH-P2WPKH: 41 + 23 + 108 / 4
+	}
+	return 41 + 1 + 72 + 1 + 33 // P2PKH
+}
+
+// estimated virtual size of the transaction we are making, without its inputs
+func tx_vsize_no_inputs() (vsize uint64) {
+	vsize = 4 + 1 + 1 + 4 + 1 // version, in/out counts, lock_time, segwit marker
+	for o := range sendTo {
+		vsize += 9 + uint64(len(sendTo[o].addr.OutScript()))
+	}
+	vsize += 9 + uint64(len(get_change_addr().OutScript()))
+	if *message!="" {
+		vsize += 9 + 2 + uint64(len(*message))
+	}
+	return
+}
+
+
 // prepare a signed transaction
 func sign_tx(tx *btc.Tx) (all_signed bool) {
 	var multisig_done bool
@@ -43,6 +86,26 @@ func sign_tx(tx *btc.Tx) (all_signed bool) {
 				all_signed = false
 				continue
 			}
+
+			if btc.IsP2TR(uo.Pk_script) {
+				k_idx := taproot_key_idx(uo.Pk_script[2:])
+				if k_idx < 0 {
+					fmt.Println("WARNING: You do not have key for P2TR output at input", in)
+					all_signed = false
+					continue
+				}
+				if tx.Spent_outputs == nil && !set_spent_outputs(tx) {
+					fmt.Println("ERROR: Cannot sign taproot input", in, "- not all the inputs are in balance folder")
+					all_signed = false
+					continue
+				}
+				if er := tx.SignTaprootKeyPath(in, btc.SIGHASH_DEFAULT, keys[k_idx].Key, nil); er != nil {
+					fmt.Println("ERROR: Sign failed for input number", in, er.Error())
+					all_signed = false
+				}
+				continue
+			}
+
 			adr := addr_from_pkscr(uo.Pk_script)
 			if adr == nil {
 				fmt.Println("WARNING: Don't know how to sign input number", in)
@@ -127,6 +190,11 @@ func make_signed_tx() {
 	tx.Version = 1
 	tx.Lock_time = 0
 
+	var vsize uint64
+	if feeSpkb != 0 {
+		vsize = tx_vsize_no_inputs()
+	}
+
 	// Select as many inputs as we need to pay the full amount (with the fee)
 	var btcsofar uint64
 	for i := range unspentOuts {
@@ -142,6 +210,10 @@ func make_signed_tx() {
 
 		btcsofar += uo.Value
 		unspentOuts[i].spent = true
+		if feeSpkb != 0 {
+			vsize += input_vsize(uo.Pk_script)
+			feeBtc = vsize * feeSpkb / 1000
+		}
 		if !*useallinputs && ( btcsofar >= spendBtc + feeBtc ) {
 			break
 		}
@@ -152,6 +224,9 @@ func make_signed_tx() {
 		cleanExit(1)
 	}
 	changeBtc = btcsofar - (spendBtc + feeBtc)
+	if feeSpkb != 0 {
+		fmt.Println("Transaction fee", btc.UintToBtc(feeBtc), "BTC for estimated", vsize, "vbytes")
+	}
 	if *verbose {
 		fmt.Printf("Spending %d out of %d outputs...\n", len(tx.TxIn), len(unspentOuts))
 	}
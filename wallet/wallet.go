@@ -6,8 +6,10 @@ import (
 	"bufio"
 	"bytes"
 	"strings"
+	"crypto/rand"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/descriptor"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 )
 
@@ -18,7 +20,12 @@ var (
 	// set in make_wallet():
 	keys []*btc.PrivateAddr
 	segwit []*btc.BtcAddr
+	taproot []*btc.BtcAddr
 	curFee uint64
+	autoFee uint // confirmation target (in blocks) if "-fee auto" is used
+	hd_account *btc.HDWallet // account's public key of Type-5 wallet
+	hd_account_path string
+	hd_master_fpr uint32 // fingerprint of the master key (for HD wallets)
 )
 
 
@@ -79,6 +86,7 @@ func make_wallet() {
 
 	var seed_key []byte
 	var hdwal *btc.HDWallet
+	var hd_chains [2]*btc.HDWallet
 
 	defer func() {
 		sys.ClearBuffer(seed_key)
@@ -86,6 +94,12 @@ func make_wallet() {
 			sys.ClearBuffer(hdwal.Key)
 			sys.ClearBuffer(hdwal.ChCode)
 		}
+		for _, w := range hd_chains {
+			if w!=nil {
+				sys.ClearBuffer(w.Key)
+				sys.ClearBuffer(w.ChCode)
+			}
+		}
 	}()
 
 	pass := getpass()
@@ -117,6 +131,31 @@ func make_wallet() {
 		lab = "TypHD"
 		hdwal = btc.MasterKey(pass, testnet)
 		sys.ClearBuffer(pass)
+		hd_master_fpr = hdwal.Fingerprint()
+	} else if waltype==5 {
+		// BIP39 mnemonic with BIP44/49/84/86 account structure
+		if _, e := btc.MnemonicToEntropy(string(pass)); e != nil {
+			sys.ClearBuffer(pass)
+			println("ERROR: Type-5 wallet requires a valid BIP39 mnemonic as the seed password:", e.Error())
+			cleanExit(1)
+		}
+		seed := btc.MnemonicToSeed(string(pass), bip39pass)
+		sys.ClearBuffer(pass)
+		hdwal = btc.MasterKey(seed, testnet)
+		sys.ClearBuffer(seed)
+		hd_master_fpr = hdwal.Fingerprint()
+
+		hd_account_path = get_hd_account_path()
+		acc, e := hdwal.DerivePath(hd_account_path)
+		if e != nil {
+			println("ERROR: Account derivation path", hd_account_path, "-", e.Error())
+			cleanExit(1)
+		}
+		hd_account = acc.Pub()
+		hd_account.ChCode = append([]byte{}, acc.ChCode...) // acc's buffers get cleared below
+		hd_chains[0], hd_chains[1] = acc.Child(0), acc.Child(1) // receiving and change addresses
+		sys.ClearBuffer(acc.Key)
+		sys.ClearBuffer(acc.ChCode)
 	} else {
 		sys.ClearBuffer(pass)
 		println("ERROR: Unsupported wallet type", waltype)
@@ -127,8 +166,12 @@ func make_wallet() {
 		fmt.Println("Generating", keycnt, "keys, version", ver_pubkey(),"...")
 	}
 
+	n := keycnt
+	if waltype==5 {
+		n *= 2 // change addresses follow the receiving ones
+	}
 	first_determ_idx = len(keys)
-	for i:=uint(0); i < keycnt; {
+	for i:=uint(0); i < n; {
 		prv_key := make([]byte, 32)
 		if waltype==3 {
 			btc.ShaHash(seed_key, prv_key)
@@ -139,12 +182,17 @@ func make_wallet() {
 		} else if waltype==1 {
 			btc.ShaHash(seed_key, prv_key)
 			copy(seed_key, prv_key)
-		} else /*if waltype==4*/ {
+		} else if waltype==4 {
 			// HD wallet
 			_hd := hdwal.Child(uint32(0x80000000|i))
 			copy(prv_key, _hd.Key[1:])
 			sys.ClearBuffer(_hd.Key)
 			sys.ClearBuffer(_hd.ChCode)
+		} else /*if waltype==5*/ {
+			_hd := hd_chains[i/keycnt].Child(uint32(i%keycnt))
+			copy(prv_key, _hd.Key[1:])
+			sys.ClearBuffer(_hd.Key)
+			sys.ClearBuffer(_hd.ChCode)
 		}
 
 		rec := btc.NewPrivateAddr(prv_key, ver_secret(), !uncompressed)
@@ -155,7 +203,11 @@ func make_wallet() {
 			return
 		}
 
-		rec.BtcAddr.Extra.Label = fmt.Sprint(lab, " ", i+1)
+		if waltype==5 {
+			rec.BtcAddr.Extra.Label = fmt.Sprint(hd_account_path, "/", i/keycnt, "/", i%keycnt)
+		} else {
+			rec.BtcAddr.Extra.Label = fmt.Sprint(lab, " ", i+1)
+		}
 		keys = append(keys, rec)
 		i++
 	}
@@ -163,12 +215,14 @@ func make_wallet() {
 		fmt.Println("Private keys re-generated")
 	}
 
-	// Calculate SegWit addresses
+	// Calculate SegWit and Taproot addresses
 	segwit = make([]*btc.BtcAddr, len(keys))
+	taproot = make([]*btc.BtcAddr, len(keys))
 	for i, pk := range keys {
 		if len(pk.Pubkey)!=33 {
 			continue
 		}
+		taproot[i] = btc.NewAddrP2TR(pk.Pubkey, testnet)
 		if *bech32_mode {
 			segwit[i] = btc.NewAddrFromPkScript(append([]byte{0,20}, pk.Hash160[:]...), testnet)
 		} else {
@@ -179,6 +233,52 @@ func make_wallet() {
 }
 
 
+// Print a new random BIP39 mnemonic, to be used as the seed of Type-5 wallet
+func new_mnemonic() {
+	if *bip39words<12 || *bip39words>24 || (*bip39words%3)!=0 {
+		println("ERROR: Number of words must be 12, 15, 18, 21 or 24")
+		os.Exit(1)
+	}
+	entropy := make([]byte, *bip39words*4/3)
+	if _, e := rand.Read(entropy); e != nil {
+		println("ERROR:", e.Error())
+		os.Exit(1)
+	}
+	m, e := btc.NewMnemonic(entropy)
+	sys.ClearBuffer(entropy)
+	if e != nil {
+		println("ERROR:", e.Error())
+		os.Exit(1)
+	}
+	fmt.Println(m)
+	println("Write down the words above and use them as the seed password of Type-5 wallet")
+}
+
+
+// Returns the account's derivation path for Type-5 wallet
+func get_hd_account_path() string {
+	if hdpath!="" {
+		return hdpath
+	}
+	var purpose, coin int
+	if *taproot_mode {
+		purpose = 86
+	} else if *segwit_mode && *bech32_mode {
+		purpose = 84
+	} else if *segwit_mode {
+		purpose = 49
+	} else {
+		purpose = 44
+	}
+	if testnet {
+		coin = 1
+	} else if litecoin {
+		coin = 2
+	}
+	return fmt.Sprintf("m/%d'/%d'/0'", purpose, coin)
+}
+
+
 // Print all the public addresses
 func dump_addrs() {
 	f, _ := os.Create("wallet.txt")
@@ -188,6 +288,9 @@ func dump_addrs() {
 		fmt.Fprintln(f, "#", hex.EncodeToString(keys[first_determ_idx].BtcAddr.Pubkey))
 		fmt.Fprintln(f, "#", hex.EncodeToString(type2_secret))
 	}
+	if hd_account!=nil {
+		fmt.Fprintln(f, "#", hd_account_path, hd_account.String())
+	}
 	for i := range keys {
 		if !*noverify {
 			if er := btc.VerifyKeyPair(keys[i].Key, keys[i].BtcAddr.Pubkey); er!=nil {
@@ -196,7 +299,13 @@ func dump_addrs() {
 			}
 		}
 		var pubaddr string
-		if *segwit_mode {
+		if *taproot_mode {
+			if taproot[i]==nil {
+				pubaddr = "-=CompressedKey=-"
+			} else {
+				pubaddr = taproot[i].String()
+			}
+		} else if *segwit_mode {
 			if segwit[i]==nil {
 				pubaddr = "-=CompressedKey=-"
 			} else {
@@ -217,6 +326,38 @@ func dump_addrs() {
 }
 
 
+// Returns descriptor of the given key expression, for the current address mode
+func key_descriptor(key string) string {
+	if *taproot_mode {
+		return "tr(" + key + ")"
+	} else if *segwit_mode && *bech32_mode {
+		return "wpkh(" + key + ")"
+	} else if *segwit_mode {
+		return "sh(wpkh(" + key + "))"
+	}
+	return "pkh(" + key + ")"
+}
+
+
+// Print output descriptors of the wallet (to be imported into a watch-only wallet)
+func dump_descriptors() {
+	if hd_account!=nil {
+		org := fmt.Sprintf("[%08x%s]", hd_master_fpr, hd_account_path[1:])
+		for chain := 0; chain < 2; chain++ {
+			fmt.Println(descriptor.AddChecksum(key_descriptor(fmt.Sprint(org, hd_account.String(), "/", chain, "/*"))))
+		}
+		return
+	}
+	for i := range keys {
+		key := hex.EncodeToString(keys[i].BtcAddr.Pubkey)
+		if waltype==4 {
+			key = fmt.Sprintf("[%08x/%d']%s", hd_master_fpr, i-first_determ_idx, key)
+		}
+		fmt.Println(descriptor.AddChecksum(key_descriptor(key)), keys[i].BtcAddr.Extra.Label)
+	}
+}
+
+
 func public_to_key(pubkey []byte) *btc.PrivateAddr {
 	for i := range keys {
 		if bytes.Equal(pubkey, keys[i].BtcAddr.Pubkey) {
@@ -240,6 +381,17 @@ func hash_to_key_idx(h160 []byte) (res int) {
 }
 
 
+// returns index of the key for the given P2TR witness program
+func taproot_key_idx(prog []byte) (res int) {
+	for i := range taproot {
+		if taproot[i]!=nil && bytes.Equal(taproot[i].SegwitProg.Program, prog) {
+			return i
+		}
+	}
+	return -1
+}
+
+
 func hash_to_key(h160 []byte) *btc.PrivateAddr {
 	if i:=hash_to_key_idx(h160); i>=0 {
 		return keys[i]
@@ -272,6 +424,12 @@ func pkscr_to_key(scr []byte) *btc.PrivateAddr {
 	if len(scr)==22 && scr[0]==0x00 && scr[1]==0x14 {
 		return hash_to_key(scr[2:])
 	}
+	// P2TR
+	if btc.IsP2TR(scr) {
+		if i:=taproot_key_idx(scr[2:]); i>=0 {
+			return keys[i]
+		}
+	}
 	return nil
 }
 
@@ -26,6 +26,7 @@ func start() error {
 func reset_wallet() {
 	keys = nil
 	type2_secret = nil
+	hd_account = nil
 }
 
 func stop() {
@@ -141,3 +142,40 @@ func TestImportPriv(t *testing.T) {
 		t.Error("Should be uncompressed")
 	}
 }
+
+
+func TestMakeWalletBIP39(t *testing.T) {
+	defer stop()
+	if start() != nil {
+		t.Error("start failed")
+	}
+	ioutil.WriteFile(SECRET, []byte("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about\n"), 0600)
+
+	waltype = 5
+	uncompressed = false
+	testnet = false
+	keycnt = 2
+	*segwit_mode, *bech32_mode = true, true
+	defer func() {
+		*segwit_mode, *bech32_mode = false, false
+	}()
+
+	reset_wallet()
+	make_wallet()
+	if len(keys) != 2*int(keycnt) {
+		t.Fatal("keys - wrong number", len(keys))
+	}
+	// BIP84 test vectors
+	for i, exp := range []string{"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g",
+		"bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"} {
+		if segwit[i].String() != exp {
+			t.Error("Expected address mismatch", i, segwit[i].String(), exp)
+		}
+	}
+	if keys[2].BtcAddr.Extra.Label != "m/84'/0'/0'/1/0" {
+		t.Error("Bad label", keys[2].BtcAddr.Extra.Label)
+	}
+	if hd_master_fpr != 0x73c5da0a || hd_account.String() != "xpub6CatWdiZiodmUeTDp8LT5or8nmbKNcuyvz7WyksVFkKB4RHwCD3XyuvPEbvqAQY3rAPshWcMLoP2fMFMKHPJ4ZeZXYVUhLv1VMrjPC7PW6V" {
+		t.Errorf("Bad account key %08x %s", hd_master_fpr, hd_account.String())
+	}
+}